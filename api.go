@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"smart-git/database/schema"
+	"smart-git/gitc"
 
 	wanfcodec "github.com/WJQSERVER/wanf"
 	"github.com/infinite-iroha/touka"
@@ -19,6 +20,7 @@ type APIRepoRecord struct {
 	CreatedAt   string `wanf:"created_at" json:"created_at"`
 	UpdatedAt   string `wanf:"updated_at" json:"updated_at"`
 	ExpiresAt   string `wanf:"expires_at" json:"expires_at"`
+	OrphanedAt  string `wanf:"orphaned_at,omitempty" json:"orphaned_at,omitempty"`
 }
 
 type APIRepoStats struct {
@@ -54,6 +56,165 @@ type APISyncResponse struct {
 	Refreshed   bool   `wanf:"refreshed" json:"refreshed"`
 }
 
+type APIJob struct {
+	ID         string `wanf:"id" json:"id"`
+	Kind       string `wanf:"kind" json:"kind"`
+	Repo       string `wanf:"repo" json:"repo"`
+	Host       string `wanf:"host" json:"host"`
+	Priority   int    `wanf:"priority" json:"priority"`
+	State      string `wanf:"state" json:"state"`
+	EnqueuedAt string `wanf:"enqueued_at" json:"enqueued_at"`
+	StartedAt  string `wanf:"started_at,omitempty" json:"started_at,omitempty"`
+}
+
+type APIJobList struct {
+	Running int      `wanf:"running" json:"running"`
+	Queued  int      `wanf:"queued" json:"queued"`
+	Items   []APIJob `wanf:"items" json:"items"`
+}
+
+type APISnapshot struct {
+	Owner     string `wanf:"owner" json:"owner"`
+	Repo      string `wanf:"repo" json:"repo"`
+	Name      string `wanf:"name" json:"name"`
+	HeadOID   string `wanf:"head_oid,omitempty" json:"head_oid,omitempty"`
+	Refs      int    `wanf:"refs" json:"refs"`
+	CreatedAt string `wanf:"created_at,omitempty" json:"created_at,omitempty"`
+}
+
+type APISnapshotList struct {
+	Items []APISnapshot `wanf:"items" json:"items"`
+}
+
+type APIRefUpdate struct {
+	Owner       string `wanf:"owner" json:"owner"`
+	Repo        string `wanf:"repo" json:"repo"`
+	Ref         string `wanf:"ref" json:"ref"`
+	OldOID      string `wanf:"old_oid,omitempty" json:"old_oid,omitempty"`
+	NewOID      string `wanf:"new_oid,omitempty" json:"new_oid,omitempty"`
+	Kind        string `wanf:"kind" json:"kind"`
+	FastForward bool   `wanf:"fast_forward" json:"fast_forward"`
+	Rewrite     bool   `wanf:"rewrite" json:"rewrite"`
+	Time        string `wanf:"time" json:"time"`
+}
+
+type APIRefUpdateList struct {
+	Items []APIRefUpdate `wanf:"items" json:"items"`
+}
+
+type APIRef struct {
+	Name string `wanf:"name" json:"name"`
+	OID  string `wanf:"oid" json:"oid"`
+}
+
+type APIRefState struct {
+	Owner string   `wanf:"owner" json:"owner"`
+	Repo  string   `wanf:"repo" json:"repo"`
+	Time  string   `wanf:"time" json:"time"`
+	Refs  []APIRef `wanf:"refs" json:"refs"`
+}
+
+type APIRepoLockMode struct {
+	Acquired   int64 `wanf:"acquired" json:"acquired"`
+	Waited     int64 `wanf:"waited" json:"waited"`
+	WaitTimeMS int64 `wanf:"wait_time_ms" json:"wait_time_ms"`
+	Timeouts   int64 `wanf:"timeouts" json:"timeouts"`
+}
+
+type APIRepoLock struct {
+	Repo           string `wanf:"repo" json:"repo"`
+	Readers        int    `wanf:"readers" json:"readers"`
+	Writer         bool   `wanf:"writer" json:"writer"`
+	WaitingReaders int    `wanf:"waiting_readers" json:"waiting_readers"`
+	WaitingWriters int    `wanf:"waiting_writers" json:"waiting_writers"`
+}
+
+type APIRepoLockStats struct {
+	Shared    APIRepoLockMode `wanf:"shared" json:"shared"`
+	Exclusive APIRepoLockMode `wanf:"exclusive" json:"exclusive"`
+	Items     []APIRepoLock   `wanf:"items" json:"items"`
+}
+
+type APIMaintenance struct {
+	Owner       string `wanf:"owner" json:"owner"`
+	Repo        string `wanf:"repo" json:"repo"`
+	Time        string `wanf:"time" json:"time"`
+	DurationMS  int64  `wanf:"duration_ms" json:"duration_ms"`
+	PacksBefore int    `wanf:"packs_before" json:"packs_before"`
+	PacksAfter  int    `wanf:"packs_after" json:"packs_after"`
+	LooseBefore int    `wanf:"loose_before" json:"loose_before"`
+	LooseAfter  int    `wanf:"loose_after" json:"loose_after"`
+	SizeBefore  int64  `wanf:"size_before" json:"size_before"`
+	SizeAfter   int64  `wanf:"size_after" json:"size_after"`
+	StaleFiles  int    `wanf:"stale_files" json:"stale_files"`
+	Repacked    bool   `wanf:"repacked" json:"repacked"`
+	Error       string `wanf:"error,omitempty" json:"error,omitempty"`
+}
+
+type APIMaintenanceList struct {
+	Items []APIMaintenance `wanf:"items" json:"items"`
+}
+
+type APIObjectPool struct {
+	Network string   `wanf:"network" json:"network"`
+	Members []string `wanf:"members" json:"members"`
+	Packs   int      `wanf:"packs" json:"packs"`
+	Loose   int      `wanf:"loose" json:"loose"`
+	Size    int64    `wanf:"size" json:"size"`
+}
+
+type APIObjectPoolList struct {
+	Items []APIObjectPool `wanf:"items" json:"items"`
+}
+
+type APIVerifyReport struct {
+	Owner        string   `wanf:"owner" json:"owner"`
+	Repo         string   `wanf:"repo" json:"repo"`
+	OK           bool     `wanf:"ok" json:"ok"`
+	Packs        int      `wanf:"packs" json:"packs"`
+	Loose        int      `wanf:"loose" json:"loose"`
+	Refs         int      `wanf:"refs" json:"refs"`
+	Connectivity bool     `wanf:"connectivity" json:"connectivity"`
+	DurationMS   int64    `wanf:"duration_ms" json:"duration_ms"`
+	Problems     []string `wanf:"problems,omitempty" json:"problems,omitempty"`
+	Quarantine   string   `wanf:"quarantine,omitempty" json:"quarantine,omitempty"`
+	Recloning    bool     `wanf:"recloning" json:"recloning"`
+}
+
+type APIFsckIssue struct {
+	Kind     string `wanf:"kind" json:"kind"`
+	Repo     string `wanf:"repo" json:"repo"`
+	Path     string `wanf:"path,omitempty" json:"path,omitempty"`
+	Detail   string `wanf:"detail,omitempty" json:"detail,omitempty"`
+	Fixed    bool   `wanf:"fixed" json:"fixed"`
+	FixError string `wanf:"fix_error,omitempty" json:"fix_error,omitempty"`
+}
+
+type APIFsckReport struct {
+	Records int            `wanf:"records" json:"records"`
+	Dirs    int            `wanf:"dirs" json:"dirs"`
+	Sums    int            `wanf:"sums" json:"sums"`
+	Pools   int            `wanf:"pools" json:"pools"`
+	Unfixed int            `wanf:"unfixed" json:"unfixed"`
+	Items   []APIFsckIssue `wanf:"items" json:"items"`
+}
+
+type APILayoutMove struct {
+	Repo  string `wanf:"repo" json:"repo"`
+	From  string `wanf:"from" json:"from"`
+	To    string `wanf:"to" json:"to"`
+	Error string `wanf:"error,omitempty" json:"error,omitempty"`
+}
+
+type APILayoutMigration struct {
+	Layout    string          `wanf:"layout" json:"layout"`
+	DryRun    bool            `wanf:"dry_run" json:"dry_run"`
+	Repos     int             `wanf:"repos" json:"repos"`
+	Moved     []APILayoutMove `wanf:"moved" json:"moved"`
+	Conflicts []APILayoutMove `wanf:"conflicts" json:"conflicts"`
+	Failed    []APILayoutMove `wanf:"failed" json:"failed"`
+}
+
 type APIErrorResponse struct {
 	Error string `wanf:"error" json:"error"`
 }
@@ -87,6 +248,7 @@ func NewAPIRepoRecord(record schema.RepoData) APIRepoRecord {
 		CreatedAt:   formatTime(record.DownloadedTime),
 		UpdatedAt:   formatTime(record.UpdatedTime),
 		ExpiresAt:   formatTime(record.ExpireTime),
+		OrphanedAt:  formatTime(record.OrphanedTime),
 	}
 }
 
@@ -99,6 +261,142 @@ func NewAPIRepoStats(record schema.RepoSumData) APIRepoStats {
 	}
 }
 
+func NewAPIJob(job gitc.Job) APIJob {
+	return APIJob{
+		ID:         job.ID,
+		Kind:       job.Kind,
+		Repo:       job.Repo,
+		Host:       job.Host,
+		Priority:   job.Priority,
+		State:      job.State,
+		EnqueuedAt: formatTime(job.EnqueuedAt),
+		StartedAt:  formatTime(job.StartedAt),
+	}
+}
+
+func NewAPIRepoLockStats(stats gitc.RepoLockStats) APIRepoLockStats {
+	mode := func(m gitc.RepoLockModeStats) APIRepoLockMode {
+		return APIRepoLockMode{Acquired: m.Acquired, Waited: m.Waited, WaitTimeMS: m.WaitTime.Milliseconds(), Timeouts: m.Timeouts}
+	}
+	items := make([]APIRepoLock, 0, len(stats.Repos))
+	for _, repo := range stats.Repos {
+		items = append(items, APIRepoLock{
+			Repo:           repo.Repo,
+			Readers:        repo.Readers,
+			Writer:         repo.Writer,
+			WaitingReaders: repo.WaitingReaders,
+			WaitingWriters: repo.WaitingWriters,
+		})
+	}
+	return APIRepoLockStats{Shared: mode(stats.Shared), Exclusive: mode(stats.Exclusive), Items: items}
+}
+
+func NewAPIMaintenance(record schema.MaintenanceRecord) APIMaintenance {
+	return APIMaintenance{
+		Owner:       record.RepoUser,
+		Repo:        record.RepoName,
+		Time:        formatTime(record.Time),
+		DurationMS:  record.Duration.Milliseconds(),
+		PacksBefore: record.PacksBefore,
+		PacksAfter:  record.PacksAfter,
+		LooseBefore: record.LooseBefore,
+		LooseAfter:  record.LooseAfter,
+		SizeBefore:  record.SizeBefore,
+		SizeAfter:   record.SizeAfter,
+		StaleFiles:  record.StaleFiles,
+		Repacked:    record.Repacked,
+		Error:       record.Error,
+	}
+}
+
+func NewAPIObjectPool(pool gitc.ObjectPoolInfo) APIObjectPool {
+	members := pool.Members
+	if members == nil {
+		members = []string{}
+	}
+	return APIObjectPool{
+		Network: pool.Network,
+		Members: members,
+		Packs:   pool.Stats.Packs,
+		Loose:   pool.Stats.Loose,
+		Size:    pool.Stats.Size,
+	}
+}
+
+func NewAPIVerifyReport(owner string, repo string, report gitc.VerifyReport) APIVerifyReport {
+	return APIVerifyReport{
+		Owner:        owner,
+		Repo:         repo,
+		OK:           len(report.Problems) == 0,
+		Packs:        report.Packs,
+		Loose:        report.Loose,
+		Refs:         report.Refs,
+		Connectivity: report.Connectivity,
+		DurationMS:   report.Duration.Milliseconds(),
+		Problems:     report.Problems,
+		Quarantine:   report.Quarantine,
+		Recloning:    report.Recloning,
+	}
+}
+
+func NewAPIFsckReport(report gitc.FsckReport) APIFsckReport {
+	items := make([]APIFsckIssue, 0, len(report.Issues))
+	for _, issue := range report.Issues {
+		items = append(items, APIFsckIssue{
+			Kind:     issue.Kind,
+			Repo:     issue.Repo,
+			Path:     issue.Path,
+			Detail:   issue.Detail,
+			Fixed:    issue.Fixed,
+			FixError: issue.FixError,
+		})
+	}
+	return APIFsckReport{Records: report.Records, Dirs: report.Dirs, Sums: report.Sums, Pools: report.Pools, Unfixed: report.Unfixed(), Items: items}
+}
+
+func NewAPILayoutMigration(report gitc.LayoutMigration) APILayoutMigration {
+	moves := func(items []gitc.LayoutMove) []APILayoutMove {
+		resp := make([]APILayoutMove, 0, len(items))
+		for _, move := range items {
+			resp = append(resp, APILayoutMove{Repo: move.Repo, From: move.From, To: move.To, Error: move.Error})
+		}
+		return resp
+	}
+	return APILayoutMigration{
+		Layout:    report.Layout,
+		DryRun:    report.DryRun,
+		Repos:     report.Repos,
+		Moved:     moves(report.Moved),
+		Conflicts: moves(report.Conflicts),
+		Failed:    moves(report.Failed),
+	}
+}
+
+func NewAPISnapshot(owner string, repo string, snapshot gitc.Snapshot) APISnapshot {
+	return APISnapshot{
+		Owner:     owner,
+		Repo:      repo,
+		Name:      snapshot.Name,
+		HeadOID:   snapshot.Head,
+		Refs:      snapshot.Refs,
+		CreatedAt: formatTime(snapshot.CreatedAt),
+	}
+}
+
+func NewAPIRefUpdate(update schema.RefUpdate) APIRefUpdate {
+	return APIRefUpdate{
+		Owner:       update.RepoUser,
+		Repo:        update.RepoName,
+		Ref:         update.Ref,
+		OldOID:      update.OldHash,
+		NewOID:      update.NewHash,
+		Kind:        update.Kind,
+		FastForward: update.FastForward,
+		Rewrite:     gitc.IsRewrite(update.Kind),
+		Time:        formatTime(update.Time),
+	}
+}
+
 func formatTime(t time.Time) string {
 	if t.IsZero() {
 		return ""
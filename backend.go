@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"smart-git/gitc"
+
+	"github.com/go-git/go-billy/v6/osfs"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/format/pktline"
+	"github.com/go-git/go-git/v6/plumbing/protocol"
+	"github.com/go-git/go-git/v6/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v6/plumbing/transport"
+	"github.com/go-git/go-git/v6/storage"
+)
+
+// uploadPackBackend 为 smart HTTP 生成引用广告并处理 upload-pack 请求,
+// view 决定客户端可见的引用(快照命名空间与 hideRefs)
+type uploadPackBackend interface {
+	AdvertiseRefs(ctx context.Context, repoPath string, version string, view gitc.RefView, w io.Writer) error
+	UploadPack(ctx context.Context, repoPath string, version string, view gitc.RefView, r io.ReadCloser, w io.WriteCloser) error
+}
+
+// currentUploadPackBackend 根据 gitc 当前的执行后端选择 upload-pack 实现
+func currentUploadPackBackend() uploadPackBackend {
+	if sys := gitc.SystemGitBackend(); sys != nil {
+		return systemUploadPack{git: sys}
+	}
+	return goGitUploadPack{}
+}
+
+// loadRepoStorer 加载 repoPath 处的裸仓库, 不存在时返回 transport.ErrRepositoryNotFound
+func loadRepoStorer(repoPath string) (storage.Storer, error) {
+	ep, err := transport.NewEndpoint("/")
+	if err != nil {
+		return nil, err
+	}
+	st, err := transport.NewFilesystemLoader(osfs.New(repoPath), true).Load(ep)
+	if err != nil {
+		return nil, err
+	}
+	// 对象池成员通过 alternates 借用对象池中的对象
+	if dirs, err := gitc.AlternateObjectDirs(repoPath); err == nil && len(dirs) > 0 {
+		return gitc.AlternatesStorage(repoPath), nil
+	}
+	return st, nil
+}
+
+// goGitUploadPack 使用 go-git 的纯 Go 实现
+type goGitUploadPack struct{}
+
+func (goGitUploadPack) AdvertiseRefs(ctx context.Context, repoPath string, version string, view gitc.RefView, w io.Writer) error {
+	st, err := loadRepoStorer(repoPath)
+	if err != nil {
+		return err
+	}
+	return writeAdvertisedRefs(ctx, st, transport.UploadPackService, version, view, w)
+}
+
+// UploadPack 只支持 v0/v1, stateless 请求不重新广告引用, 因此不需要 view
+func (goGitUploadPack) UploadPack(ctx context.Context, repoPath string, version string, _ gitc.RefView, r io.ReadCloser, w io.WriteCloser) error {
+	st, err := loadRepoStorer(repoPath)
+	if err != nil {
+		return err
+	}
+
+	// partial clone 与 shallow 请求由 serveUploadPack 处理
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if req, err := parseUploadPackRequest(body, version); err == nil {
+		// 与 git upload-pack 一致, 以 ERR 包拒绝本地不存在的 want
+		for _, want := range req.Wants {
+			if h, ok := plumbing.FromHex(want); ok && st.HasEncodedObject(h) != nil {
+				_, err := pktline.WriteError(w, fmt.Errorf("upload-pack: not our ref %s", want))
+				return err
+			}
+		}
+		if needsCustomUploadPack(req) {
+			return serveUploadPack(st, req, w)
+		}
+	}
+
+	return transport.UploadPack(ctx, st, io.NopCloser(bytes.NewReader(body)), w,
+		&transport.UploadPackOptions{
+			GitProtocol:   version,
+			AdvertiseRefs: false,
+			StatelessRPC:  true,
+		})
+}
+
+// systemUploadPack 调用系统 git upload-pack, 支持 protocol v2、bitmap 与 partial clone
+type systemUploadPack struct {
+	git *gitc.SystemGit
+}
+
+func (b systemUploadPack) AdvertiseRefs(ctx context.Context, repoPath string, version string, view gitc.RefView, w io.Writer) error {
+	if _, err := loadRepoStorer(repoPath); err != nil {
+		return err
+	}
+	// 与 git http-backend 一致, protocol v2 不输出 service 头
+	if transport.ProtocolVersion(version) != protocol.V2 {
+		if err := (&packp.SmartReply{Service: transport.UploadPackService.String()}).Encode(w); err != nil {
+			return err
+		}
+	}
+	return b.git.UploadPack(ctx, repoPath, version, true, view, nil, w)
+}
+
+func (b systemUploadPack) UploadPack(ctx context.Context, repoPath string, version string, view gitc.RefView, r io.ReadCloser, w io.WriteCloser) error {
+	return b.git.UploadPack(ctx, repoPath, version, false, view, r, w)
+}
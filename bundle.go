@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"smart-git/gitc"
+	"strings"
+
+	"github.com/go-git/go-git/v6/plumbing/format/pktline"
+	"github.com/infinite-iroha/touka"
+)
+
+// bundle-uri 列表中 bundle 的标识
+const bundleID = "smart-git"
+
+// handleCloneBundle 以静态文件形式提供仓库预生成的 bundle, 支持 Range 续传
+func handleCloneBundle() touka.HandlerFunc {
+	return func(c *touka.Context) {
+		store := gitc.CurrentBundles()
+		if store == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		serveArtifact(c, store.Path(c.Param("user")+"/"+c.Param("repo")), "application/x-git-bundle")
+	}
+}
+
+// serveArtifact 提供预生成的文件, 不存在时返回 404
+func serveArtifact(c *touka.Context, path string, contentType string) {
+	f, err := os.Open(path)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	defer f.Close() //nolint:errcheck
+
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Writer.Header().Set("Content-Type", contentType)
+	http.ServeContent(c.Writer, c.Request, filepath.Base(path), stat.ModTime(), f)
+}
+
+// bundleAvailable 判断仓库是否有可通过 bundle-uri 广告的 bundle
+func bundleAvailable(userName string, repoName string) bool {
+	store := gitc.CurrentBundles()
+	if store == nil {
+		return false
+	}
+	_, err := store.Stat(userName + "/" + repoName)
+	return err == nil
+}
+
+// bundleURL 返回仓库 bundle 的绝对地址, 未配置 baseURL 时按请求推断
+func bundleURL(r *http.Request, userName string, repoName string) string {
+	base := strings.TrimSuffix(cfg.Bundle.BaseURL, "/")
+	if base == "" {
+		base = requestOrigin(r)
+	}
+	return base + "/" + userName + "/" + repoName + "/clone.bundle"
+}
+
+// forwardedProxies 为可以信任其 X-Forwarded-Proto 的反向代理, 与限流共用 rateLimit.trustedProxies
+var forwardedProxies []netip.Prefix
+
+// requestOrigin 按请求的 Host 与 X-Forwarded-Proto 推断 smart-git 的外部地址;
+// 只有直连地址属于受信代理时才解析 X-Forwarded-Proto. Host 由客户端决定, 推断的地址只能返回给发出该请求的客户端
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if remote, ok := parseRemoteAddr(r.RemoteAddr); ok && containsAddr(forwardedProxies, remote) &&
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// writeBundleURIList 响应 protocol v2 的 bundle-uri 命令; 没有可用 bundle 时返回空列表
+func writeBundleURIList(w io.Writer, r *http.Request, userName string, repoName string) error {
+	var lines []string
+	if store := gitc.CurrentBundles(); store != nil {
+		if stat, err := store.Stat(userName + "/" + repoName); err == nil {
+			lines = []string{
+				"bundle.version=1",
+				"bundle.mode=all",
+				"bundle.heuristic=creationToken",
+				fmt.Sprintf("bundle.%s.uri=%s", bundleID, bundleURL(r, userName, repoName)),
+				fmt.Sprintf("bundle.%s.creationToken=%d", bundleID, stat.ModTime().Unix()),
+			}
+		}
+	}
+	for _, line := range lines {
+		if _, err := pktline.Writeln(w, line); err != nil {
+			return err
+		}
+	}
+	return pktline.WriteFlush(w)
+}
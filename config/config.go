@@ -3,7 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -11,10 +13,23 @@ import (
 )
 
 type Config struct {
-	Server   ServerConfig
-	Log      LogConfig
-	Database DatabaseConfig
-	Cache    CacheConfig
+	Server       ServerConfig
+	Log          LogConfig
+	Database     DatabaseConfig
+	Cache        CacheConfig
+	RateLimit    RateLimitConfig
+	Upstream     UpstreamConfig
+	Pack         PackConfig
+	Git          GitConfig
+	PackCache    PackCacheConfig
+	Bundle       BundleConfig
+	PackfileURIs PackfileURIConfig
+	Mirror       MirrorConfig
+	RefJournal   RefJournalConfig
+	RepoLock     RepoLockConfig
+	Maintenance  MaintenanceConfig
+	Verify       VerifyConfig
+	ObjectPool   ObjectPoolConfig
 }
 
 type ServerConfig struct {
@@ -22,6 +37,7 @@ type ServerConfig struct {
 	Port     int    `toml:"port" wanf:"port"`
 	BaseDir  string `toml:"baseDir" wanf:"baseDir"`
 	MemLimit int64  `toml:"memLimit" wanf:"memLimit"`
+	Layout   string `toml:"layout" wanf:"layout"` // 镜像目录布局: flat(默认, baseDir/owner/repo), sharded(baseDir/ab/cd/owner/repo, 大写字母转义)
 }
 
 type LogConfig struct {
@@ -44,6 +60,241 @@ type CacheConfig struct {
 	ExpireEx time.Duration `toml:"expireEx" wanf:"expireEx"`
 }
 
+/*
+[rateLimit]
+enabled = true
+ratePerSecond = 5.0
+burst = 20
+maxInflight = 4
+trustedProxies = ["127.0.0.1/32"]
+identityHeader = "X-Auth-User"
+
+[[rateLimit.rules]]
+pattern = "torvalds/*"
+ratePerSecond = 1.0
+burst = 5
+maxInflight = 1
+*/
+type RateLimitConfig struct {
+	Enabled        bool            `toml:"enabled" wanf:"enabled"`
+	RatePerSecond  float64         `toml:"ratePerSecond" wanf:"ratePerSecond"` // 每个客户端每秒补充的令牌数
+	Burst          int             `toml:"burst" wanf:"burst"`                 // 令牌桶容量
+	MaxInflight    int             `toml:"maxInflight" wanf:"maxInflight"`     // 每个客户端同时进行的 upload-pack 上限, 0 表示不限制
+	TrustedProxies []string        `toml:"trustedProxies" wanf:"trustedProxies"`
+	IdentityHeader string          `toml:"identityHeader" wanf:"identityHeader"` // 受信代理校验客户端身份后设置的请求头, 为空时只按客户端 IP 限流
+	Rules          []RateLimitRule `toml:"rules" wanf:"rules"`
+}
+
+// RateLimitRule 针对匹配 owner/repo 的仓库覆盖全局限流参数
+type RateLimitRule struct {
+	Pattern       string  `toml:"pattern" wanf:"pattern"`
+	RatePerSecond float64 `toml:"ratePerSecond" wanf:"ratePerSecond"`
+	Burst         int     `toml:"burst" wanf:"burst"`
+	MaxInflight   int     `toml:"maxInflight" wanf:"maxInflight"`
+}
+
+/*
+[upstream]
+maxConcurrent = 8
+perHostConcurrent = 4
+maxQueued = 256
+
+[[upstream.hosts]]
+host = "github.com"
+maxConcurrent = 6
+*/
+type UpstreamConfig struct {
+	MaxConcurrent     int                 `toml:"maxConcurrent" wanf:"maxConcurrent"`         // 同时进行的上游 clone/fetch 上限, 0 表示不限制
+	PerHostConcurrent int                 `toml:"perHostConcurrent" wanf:"perHostConcurrent"` // 单个上游 host 的默认并发上限, 0 表示不限制
+	MaxQueued         int                 `toml:"maxQueued" wanf:"maxQueued"`                 // 排队任务上限, 0 表示不限制
+	Hosts             []UpstreamHostLimit `toml:"hosts" wanf:"hosts"`
+}
+
+// UpstreamHostLimit 覆盖指定上游 host 的并发上限
+type UpstreamHostLimit struct {
+	Host          string `toml:"host" wanf:"host"`
+	MaxConcurrent int    `toml:"maxConcurrent" wanf:"maxConcurrent"`
+}
+
+/*
+[pack]
+memBudget = 2048 # MB
+queueTimeout = "30s"
+*/
+type PackConfig struct {
+	MemBudget    int64         `toml:"memBudget" wanf:"memBudget"`       // pack 生成的内存预算(MB), 为 0 时不限制
+	QueueTimeout time.Duration `toml:"queueTimeout" wanf:"queueTimeout"` // 等待预算的最长时间, 0 表示一直等待到客户端断开
+}
+
+/*
+[git]
+backend = "system" # go-git, system
+binPath = "/usr/bin/git"
+*/
+type GitConfig struct {
+	Backend string `toml:"backend" wanf:"backend"` // go-git(默认, 纯 Go) 或 system(调用系统 git)
+	BinPath string `toml:"binPath" wanf:"binPath"` // system 后端使用的 git 可执行文件, 为空时从 PATH 查找
+}
+
+/*
+[packCache]
+enabled = true
+dir = "/data/smart-git/packcache"
+maxSize = 10240 # MB
+*/
+type PackCacheConfig struct {
+	Enabled bool   `toml:"enabled" wanf:"enabled"`
+	Dir     string `toml:"dir" wanf:"dir"`
+	MaxSize int64  `toml:"maxSize" wanf:"maxSize"` // 缓存总大小上限(MB), 0 表示不限制
+}
+
+/*
+[bundle]
+enabled = true
+dir = "/data/smart-git/bundles"
+baseURL = "https://git.example.com"
+interval = "6h"
+repos = ["torvalds/*", "golang/go"]
+*/
+type BundleConfig struct {
+	Enabled  bool          `toml:"enabled" wanf:"enabled"`
+	Dir      string        `toml:"dir" wanf:"dir"`
+	BaseURL  string        `toml:"baseURL" wanf:"baseURL"`   // 客户端访问 smart-git 的外部地址, 为空时按请求推断
+	Interval time.Duration `toml:"interval" wanf:"interval"` // 同一仓库两次生成 bundle 的最小间隔
+	Repos    []string      `toml:"repos" wanf:"repos"`       // 生成 bundle 的仓库模式, 为空时对全部仓库生成
+}
+
+/*
+[packfileURIs]
+enabled = true
+dir = "/data/smart-git/packfiles"
+baseURL = "https://cdn.example.com/packfiles"
+minSize = 256 # MB
+interval = "24h"
+repos = ["torvalds/*"]
+*/
+type PackfileURIConfig struct {
+	Enabled  bool          `toml:"enabled" wanf:"enabled"`
+	Dir      string        `toml:"dir" wanf:"dir"`
+	BaseURL  string        `toml:"baseURL" wanf:"baseURL"`   // 提供 dir 内容的静态服务地址, 为空时由 smart-git 自身提供
+	MinSize  int64         `toml:"minSize" wanf:"minSize"`   // 仓库对象小于该大小(MB)时不拆分
+	Interval time.Duration `toml:"interval" wanf:"interval"` // 重新生成历史 pack 的最小间隔
+	Repos    []string      `toml:"repos" wanf:"repos"`       // 启用拆分的仓库模式, 为空时对全部仓库启用
+}
+
+/*
+[[mirror.rules]]
+pattern = "torvalds/linux"
+mode = "branches" # full, branches, refs
+depth = 1
+deepenOnDemand = true
+
+[[mirror.rules]]
+pattern = "chromium/*"
+mode = "refs"
+refs = ["refs/heads/main", "refs/tags/v*"]
+blobless = true
+
+[[mirror.rules]]
+pattern = "*"
+refspecs = ["+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"]
+hideRefs = ["refs/pull", "refs/changes"]
+*/
+type MirrorConfig struct {
+	Rules []MirrorRule `toml:"rules" wanf:"rules"`
+}
+
+// MirrorRule 指定匹配 owner/repo 的仓库在本地的镜像方式, 按顺序取第一条匹配的规则
+type MirrorRule struct {
+	Pattern        string   `toml:"pattern" wanf:"pattern"`
+	Mode           string   `toml:"mode" wanf:"mode"`                     // full(默认, 全部引用), branches(仅 refs/heads), refs(仅 Refs 列出的引用)
+	Refs           []string `toml:"refs" wanf:"refs"`                     // mode = "refs" 时镜像的引用, 支持 refs/heads/release/* 形式的通配
+	Refspecs       []string `toml:"refspecs" wanf:"refspecs"`             // 自定义同步使用的 refspec, 设置后取代 mode, 不能与 branches/refs 同时使用
+	HideRefs       []string `toml:"hideRefs" wanf:"hideRefs"`             // 与 git 的 uploadpack.hideRefs 相同: 按前缀从引用广告中隐藏引用, "!" 开头表示取消隐藏, 对象仍可获取
+	Depth          int      `toml:"depth" wanf:"depth"`                   // 大于 0 时为浅镜像, 只保留每个引用最近的 Depth 个提交
+	Blobless       bool     `toml:"blobless" wanf:"blobless"`             // 以 blob:none 镜像, blob 在需要时由系统 git 向上游按需获取
+	DeepenOnDemand bool     `toml:"deepenOnDemand" wanf:"deepenOnDemand"` // 客户端请求的历史超出浅镜像深度时自动加深, 否则返回错误
+}
+
+/*
+[refJournal]
+maxEntries = 10000
+*/
+type RefJournalConfig struct {
+	MaxEntries int `toml:"maxEntries" wanf:"maxEntries"` // 每个仓库保留的引用日志条目上限, 0 表示不限制
+}
+
+/*
+[repoLock]
+timeout = "10m"
+provider = "lease" # none, flock, lease
+leaseTTL = "1m"
+*/
+type RepoLockConfig struct {
+	Timeout  time.Duration `toml:"timeout" wanf:"timeout"`   // 等待仓库读写锁的最长时间, 0 表示一直等待到请求结束
+	Provider string        `toml:"provider" wanf:"provider"` // 跨进程锁: none(默认, 单进程), flock(锁文件), lease(租约文件), 多个进程共享 BaseDir 时需要配置
+	LeaseTTL time.Duration `toml:"leaseTTL" wanf:"leaseTTL"` // lease 的有效期, 持有者每 1/3 有效期续期一次, 崩溃后过期由其它进程接管
+}
+
+/*
+[maintenance]
+enabled = true
+interval = "1h"
+packThreshold = 20
+looseThreshold = 1000
+pruneGrace = "1h"
+replacedPackGrace = "1h"
+*/
+type MaintenanceConfig struct {
+	Enabled           bool          `toml:"enabled" wanf:"enabled"`                     // 定时检查并维护仓库, 关闭时仍可通过 API 手动维护
+	Interval          time.Duration `toml:"interval" wanf:"interval"`                   // 检查全部仓库的间隔
+	PackThreshold     int           `toml:"packThreshold" wanf:"packThreshold"`         // pack 数量达到该值时维护, 0 表示不按 pack 数量触发
+	LooseThreshold    int           `toml:"looseThreshold" wanf:"looseThreshold"`       // 松散对象数量达到该值时维护, 0 表示不按松散对象数量触发
+	PruneGrace        time.Duration `toml:"pruneGrace" wanf:"pruneGrace"`               // 不可达对象、旧 pack 与临时文件早于该时间才删除
+	ReplacedPackGrace time.Duration `toml:"replacedPackGrace" wanf:"replacedPackGrace"` // 共享存储时被替换的旧 pack 保留该时间后才删除, 其它进程可能仍在读取
+}
+
+/*
+[verify]
+afterSync = true
+connectivity = false
+*/
+type VerifyConfig struct {
+	AfterSync    bool `toml:"afterSync" wanf:"afterSync"`       // 克隆与 fetch 完成后、发布到镜像前校验 pack、松散对象与引用
+	Connectivity bool `toml:"connectivity" wanf:"connectivity"` // 同步后还检查从全部引用可达的对象是否都存在, 大仓库较慢
+}
+
+/*
+[objectPool]
+enabled = true
+detectRootCommit = true
+
+[[objectPool.networks]]
+name = "linux"
+repos = ["torvalds/linux", "gregkh/linux"]
+*/
+type ObjectPoolConfig struct {
+	Enabled          bool                `toml:"enabled" wanf:"enabled"`                   // 同一 fork 网络的镜像共享对象池, 对象只保存一份
+	DetectRootCommit bool                `toml:"detectRootCommit" wanf:"detectRootCommit"` // 未匹配 networks 的镜像按 HEAD 的根提交归入网络
+	Networks         []ObjectPoolNetwork `toml:"networks" wanf:"networks"`
+}
+
+// ObjectPoolNetwork 显式指定 fork 网络, 匹配 Repos 中任一模式的镜像共享名为 Name 的对象池, 按顺序取第一个匹配的网络
+type ObjectPoolNetwork struct {
+	Name  string   `toml:"name" wanf:"name"`   // 对象池名称, 由字母、数字、"."、"_"、"-" 组成, 不能以 "." 开头
+	Repos []string `toml:"repos" wanf:"repos"` // owner/repo 模式, 例如 "*/linux"
+}
+
+// MatchRepo 判断 owner/repo 是否匹配 path.Match 风格的模式, 例如 "owner/*"
+func MatchRepo(pattern string, owner string, repo string) bool {
+	if pattern == "" {
+		return false
+	}
+	// GitHub 的名称不区分大小写, 请求中的名称已转为小写
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(owner+"/"+repo))
+	return err == nil && matched
+}
+
 // LoadConfig 从 WANF/TOML 配置文件加载配置，WANF 优先
 func LoadConfig(filePath string) (*Config, error) {
 	resolvedPath, err := resolveConfigPath(filePath)
@@ -118,6 +369,7 @@ host = "0.0.0.0"
 port = 8080
 baseDir = "/data/smart-git/repos"
 memLimit = 0 #MB
+layout = "flat" # flat, sharded
 
 [log]
 logfilepath = "/data/smart-git/log/smart-git.log"
@@ -130,6 +382,69 @@ path = "/data/smart-git/db/smart-git.db"
 [cache]
 expire = "1h"
 expireEx = "10m"
+
+[rateLimit]
+enabled = false
+ratePerSecond = 5.0
+burst = 20
+maxInflight = 4
+
+[upstream]
+maxConcurrent = 8
+perHostConcurrent = 4
+maxQueued = 256
+
+[pack]
+memBudget = 0
+queueTimeout = "30s"
+
+[git]
+backend = "go-git"
+binPath = ""
+
+[packCache]
+enabled = false
+dir = "/data/smart-git/packcache"
+maxSize = 10240
+
+[bundle]
+enabled = false
+dir = "/data/smart-git/bundles"
+baseURL = ""
+interval = "6h"
+repos = []
+
+[packfileURIs]
+enabled = false
+dir = "/data/smart-git/packfiles"
+baseURL = ""
+minSize = 256
+interval = "24h"
+repos = []
+
+[refJournal]
+maxEntries = 10000
+
+[repoLock]
+timeout = "10m"
+provider = "none"
+leaseTTL = "1m"
+
+[maintenance]
+enabled = false
+interval = "1h"
+packThreshold = 20
+looseThreshold = 1000
+pruneGrace = "1h"
+replacedPackGrace = "1h"
+
+[verify]
+afterSync = true
+connectivity = false
+
+[objectPool]
+enabled = false
+detectRootCommit = true
 */
 func DefaultConfig() *Config {
 	return &Config{
@@ -138,6 +453,7 @@ func DefaultConfig() *Config {
 			Port:     8080,
 			BaseDir:  "/data/smart-git/repos",
 			MemLimit: 0,
+			Layout:   "flat",
 		},
 		Log: LogConfig{
 			LogFilePath: "/data/smart-git/log/smart-git.log",
@@ -151,5 +467,63 @@ func DefaultConfig() *Config {
 			Expire:   time.Hour,
 			ExpireEx: 10 * time.Minute,
 		},
+		RateLimit: RateLimitConfig{
+			Enabled:       false,
+			RatePerSecond: 5,
+			Burst:         20,
+			MaxInflight:   4,
+		},
+		Upstream: UpstreamConfig{
+			MaxConcurrent:     8,
+			PerHostConcurrent: 4,
+			MaxQueued:         256,
+		},
+		Pack: PackConfig{
+			MemBudget:    0,
+			QueueTimeout: 30 * time.Second,
+		},
+		Git: GitConfig{
+			Backend: "go-git",
+		},
+		PackCache: PackCacheConfig{
+			Enabled: false,
+			Dir:     "/data/smart-git/packcache",
+			MaxSize: 10240,
+		},
+		Bundle: BundleConfig{
+			Enabled:  false,
+			Dir:      "/data/smart-git/bundles",
+			Interval: 6 * time.Hour,
+		},
+		PackfileURIs: PackfileURIConfig{
+			Enabled:  false,
+			Dir:      "/data/smart-git/packfiles",
+			MinSize:  256,
+			Interval: 24 * time.Hour,
+		},
+		RefJournal: RefJournalConfig{
+			MaxEntries: 10000,
+		},
+		RepoLock: RepoLockConfig{
+			Timeout:  10 * time.Minute,
+			Provider: "none",
+			LeaseTTL: time.Minute,
+		},
+		Maintenance: MaintenanceConfig{
+			Enabled:           false,
+			Interval:          time.Hour,
+			PackThreshold:     20,
+			LooseThreshold:    1000,
+			PruneGrace:        time.Hour,
+			ReplacedPackGrace: time.Hour,
+		},
+		Verify: VerifyConfig{
+			AfterSync:    true,
+			Connectivity: false,
+		},
+		ObjectPool: ObjectPoolConfig{
+			Enabled:          false,
+			DetectRootCommit: true,
+		},
 	}
 }
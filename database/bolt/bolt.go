@@ -1,13 +1,19 @@
 package bolt
 
 import (
+	"time"
+
 	"go.etcd.io/bbolt"
 )
 
 const (
 	// 数据存储的桶名称
-	dataBucketName = `smart-git`
-	sumBucketName  = `smart-git-sum`
+	dataBucketName    = `smart-git`
+	sumBucketName     = `smart-git-sum`
+	refStateBucket    = `smart-git-refs`
+	refJournalBucket  = `smart-git-ref-journal`
+	refBaselineBucket = `smart-git-ref-baseline`
+	maintenanceBucket = `smart-git-maintenance`
 )
 
 type Storage struct {
@@ -16,12 +22,23 @@ type Storage struct {
 
 // OpenDatabase 打开一个 BoltDB 数据库
 func OpenDatabase(dbFilePath string) *Storage {
-	db, err := bbolt.Open(dbFilePath, 0666, nil)
+	storage, err := Open(dbFilePath, 0)
 	if err != nil {
 		logError("Failed to open BoltDB file: %s", err)
 		panic(err) // 直接终止程序，确保问题被及时发现
 	}
-	return &Storage{db: db}
+	return storage
+}
+
+// Open 打开 BoltDB 数据库, timeout 大于 0 时等待其它进程释放文件锁最多 timeout
+func Open(dbFilePath string, timeout time.Duration) (*Storage, error) {
+	options := *bbolt.DefaultOptions
+	options.Timeout = timeout
+	db, err := bbolt.Open(dbFilePath, 0666, &options)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{db: db}, nil
 }
 
 // Close 关闭 BoltDB
@@ -9,6 +9,9 @@ import (
 func init() {
 	gob.Register(&schema.RepoData{})
 	gob.Register(&schema.RepoSumData{})
+	gob.Register(&schema.RefUpdate{})
+	gob.Register(&schema.RefBaseline{})
+	gob.Register(&schema.MaintenanceRecord{})
 }
 
 func encodeRepoData(w io.Writer, data *schema.RepoData) error {
@@ -26,3 +29,35 @@ func encodeRepoSumData(w io.Writer, data *schema.RepoSumData) error {
 func decodeRepoSumData(r io.Reader, data *schema.RepoSumData) error {
 	return gob.NewDecoder(r).Decode(data)
 }
+
+func encodeRefUpdate(w io.Writer, data *schema.RefUpdate) error {
+	return gob.NewEncoder(w).Encode(data)
+}
+
+func decodeRefUpdate(r io.Reader, data *schema.RefUpdate) error {
+	return gob.NewDecoder(r).Decode(data)
+}
+
+func encodeRefState(w io.Writer, refs map[string]string) error {
+	return gob.NewEncoder(w).Encode(refs)
+}
+
+func decodeRefState(r io.Reader, refs *map[string]string) error {
+	return gob.NewDecoder(r).Decode(refs)
+}
+
+func encodeRefBaseline(w io.Writer, data *schema.RefBaseline) error {
+	return gob.NewEncoder(w).Encode(data)
+}
+
+func decodeRefBaseline(r io.Reader, data *schema.RefBaseline) error {
+	return gob.NewDecoder(r).Decode(data)
+}
+
+func encodeMaintenanceRecord(w io.Writer, data *schema.MaintenanceRecord) error {
+	return gob.NewEncoder(w).Encode(data)
+}
+
+func decodeMaintenanceRecord(r io.Reader, data *schema.MaintenanceRecord) error {
+	return gob.NewDecoder(r).Decode(data)
+}
@@ -0,0 +1,69 @@
+package bolt
+
+import (
+	"bytes"
+	"fmt"
+	"smart-git/database/schema"
+
+	"go.etcd.io/bbolt"
+)
+
+// SaveMaintenanceRecord 按 owner/repo 保存最近一次维护的结果
+func (s *Storage) SaveMaintenanceRecord(data *schema.MaintenanceRecord) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		var buf bytes.Buffer
+		if err := encodeMaintenanceRecord(&buf, data); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucketIfNotExists([]byte(maintenanceBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(data.RepoUser+"/"+data.RepoName), buf.Bytes())
+	})
+}
+
+// GetMaintenanceRecord 获取仓库最近一次维护的结果
+func (s *Storage) GetMaintenanceRecord(repoUser string, repoName string) (*schema.MaintenanceRecord, bool, error) {
+	var record schema.MaintenanceRecord
+	found := false
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(maintenanceBucket))
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get([]byte(repoUser + "/" + repoName))
+		if value == nil {
+			return nil
+		}
+		if err := decodeMaintenanceRecord(bytes.NewReader(value), &record); err != nil {
+			return fmt.Errorf("MaintenanceRecord gob 反序列化失败: %w", err)
+		}
+		found = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("GetMaintenanceRecord 失败: %w", err)
+	}
+	return &record, found, nil
+}
+
+// GetAllMaintenanceRecords 按仓库顺序返回全部维护记录
+func (s *Storage) GetAllMaintenanceRecords() ([]schema.MaintenanceRecord, error) {
+	var records []schema.MaintenanceRecord
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(maintenanceBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, value []byte) error {
+			var record schema.MaintenanceRecord
+			if err := decodeMaintenanceRecord(bytes.NewReader(value), &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
@@ -0,0 +1,204 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"smart-git/database/schema"
+
+	"go.etcd.io/bbolt"
+)
+
+// 引用日志按仓库分为子桶, 键为递增序号, 按记录顺序遍历
+
+// GetRefState 获取仓库最近一次同步记录的引用状态
+func (s *Storage) GetRefState(repoUser string, repoName string) (map[string]string, bool, error) {
+	var refs map[string]string
+	found := false
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(refStateBucket))
+		if bucket == nil {
+			return nil
+		}
+		dataBytes := bucket.Get([]byte(repoUser + "/" + repoName))
+		if dataBytes == nil {
+			return nil
+		}
+		if err := decodeRefState(bytes.NewReader(dataBytes), &refs); err != nil {
+			return fmt.Errorf("RefState gob 反序列化失败: %w", err)
+		}
+		found = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("GetRefState 失败: %w", err)
+	}
+	return refs, found, nil
+}
+
+// SaveRefUpdates 保存引用状态并追加引用日志
+func (s *Storage) SaveRefUpdates(repoUser string, repoName string, refs map[string]string, updates []schema.RefUpdate, maxEntries int) error {
+	key := []byte(repoUser + "/" + repoName)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		var buf bytes.Buffer
+		if err := encodeRefState(&buf, refs); err != nil {
+			return err
+		}
+		state, err := tx.CreateBucketIfNotExists([]byte(refStateBucket))
+		if err != nil {
+			return err
+		}
+		if err := state.Put(key, buf.Bytes()); err != nil {
+			return err
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+
+		journal, err := tx.CreateBucketIfNotExists([]byte(refJournalBucket))
+		if err != nil {
+			return err
+		}
+		bucket, err := journal.CreateBucketIfNotExists(key)
+		if err != nil {
+			return err
+		}
+		for i := range updates {
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			// bbolt 在事务提交前引用写入的值, 每条记录使用独立的缓冲区
+			var value bytes.Buffer
+			if err := encodeRefUpdate(&value, &updates[i]); err != nil {
+				return err
+			}
+			if err := bucket.Put(binary.BigEndian.AppendUint64(nil, seq), value.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		// 超出上限时删除最早的条目, 并折叠到基线状态中, 使按时间查询在基线之后仍然准确
+		if maxEntries <= 0 {
+			return nil
+		}
+		// 只从头部删除, 序号连续, 条目数可由首尾序号得出
+		first, _ := bucket.Cursor().First()
+		excess := int(bucket.Sequence()-binary.BigEndian.Uint64(first)+1) - maxEntries
+		if excess <= 0 {
+			return nil
+		}
+		baselines, err := tx.CreateBucketIfNotExists([]byte(refBaselineBucket))
+		if err != nil {
+			return err
+		}
+		baseline := schema.RefBaseline{Refs: map[string]string{}}
+		if dataBytes := baselines.Get(key); dataBytes != nil {
+			if err := decodeRefBaseline(bytes.NewReader(dataBytes), &baseline); err != nil {
+				return fmt.Errorf("RefBaseline gob 反序列化失败: %w", err)
+			}
+		}
+		if baseline.Refs == nil {
+			baseline.Refs = map[string]string{}
+		}
+		var stale [][]byte
+		cursor := bucket.Cursor()
+		for k, value := cursor.First(); k != nil && len(stale) < excess; k, value = cursor.Next() {
+			var record schema.RefUpdate
+			if err := decodeRefUpdate(bytes.NewReader(value), &record); err != nil {
+				return err
+			}
+			if record.NewHash == "" {
+				delete(baseline.Refs, record.Ref)
+			} else {
+				baseline.Refs[record.Ref] = record.NewHash
+			}
+			baseline.Time = record.Time
+			stale = append(stale, bytes.Clone(k))
+		}
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		var value bytes.Buffer
+		if err := encodeRefBaseline(&value, &baseline); err != nil {
+			return err
+		}
+		return baselines.Put(key, value.Bytes())
+	})
+}
+
+// GetRefBaseline 获取引用日志被删除部分折叠后的引用状态
+func (s *Storage) GetRefBaseline(repoUser string, repoName string) (*schema.RefBaseline, bool, error) {
+	var baseline schema.RefBaseline
+	found := false
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(refBaselineBucket))
+		if bucket == nil {
+			return nil
+		}
+		dataBytes := bucket.Get([]byte(repoUser + "/" + repoName))
+		if dataBytes == nil {
+			return nil
+		}
+		if err := decodeRefBaseline(bytes.NewReader(dataBytes), &baseline); err != nil {
+			return fmt.Errorf("RefBaseline gob 反序列化失败: %w", err)
+		}
+		found = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("GetRefBaseline 失败: %w", err)
+	}
+	return &baseline, found, nil
+}
+
+// GetRefUpdates 获取仓库的引用日志
+func (s *Storage) GetRefUpdates(repoUser string, repoName string) ([]schema.RefUpdate, error) {
+	var records []schema.RefUpdate
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		journal := tx.Bucket([]byte(refJournalBucket))
+		if journal == nil {
+			return nil
+		}
+		bucket := journal.Bucket([]byte(repoUser + "/" + repoName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, value []byte) error {
+			var record schema.RefUpdate
+			if err := decodeRefUpdate(bytes.NewReader(value), &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// GetAllRefUpdates 获取全部仓库的引用日志
+func (s *Storage) GetAllRefUpdates(kinds ...string) ([]schema.RefUpdate, error) {
+	var records []schema.RefUpdate
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		journal := tx.Bucket([]byte(refJournalBucket))
+		if journal == nil {
+			return nil
+		}
+		return journal.ForEachBucket(func(key []byte) error {
+			return journal.Bucket(key).ForEach(func(_, value []byte) error {
+				var record schema.RefUpdate
+				if err := decodeRefUpdate(bytes.NewReader(value), &record); err != nil {
+					return err
+				}
+				if len(kinds) == 0 || slices.Contains(kinds, record.Kind) {
+					records = append(records, record)
+				}
+				return nil
+			})
+		})
+	})
+	return records, err
+}
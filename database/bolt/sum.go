@@ -109,3 +109,15 @@ func (s *Storage) GetAllSumData() ([]schema.RepoSumData, error) {
 
 	return records, err
 }
+
+// DeleteSumData 删除仓库的拉取统计
+func (s *Storage) DeleteSumData(repoUser string, repoName string) error {
+	key := repoUser + "/" + repoName
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(sumBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
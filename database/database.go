@@ -1,6 +1,8 @@
 package database
 
 import (
+	"time"
+
 	"smart-git/config"
 	"smart-git/database/bolt"
 	"smart-git/database/schema"
@@ -19,9 +21,36 @@ type DataAccess interface {
 	SaveSumData(*schema.RepoSumData) error
 	GetSumData(string, string) (*schema.RepoSumData, bool, error)
 	GetAllSumData() ([]schema.RepoSumData, error)
+	DeleteSumData(string, string) error
+
+	// GetRefState 返回仓库最近一次同步记录的引用状态
+	GetRefState(string, string) (map[string]string, bool, error)
+	// SaveRefUpdates 在同一事务中保存新的引用状态并追加引用日志, maxEntries 大于 0 时只保留最新的条目,
+	// 删除的条目折叠到 GetRefBaseline 返回的引用状态中
+	SaveRefUpdates(string, string, map[string]string, []schema.RefUpdate, int) error
+	GetRefBaseline(string, string) (*schema.RefBaseline, bool, error)
+	// GetRefUpdates 按记录顺序返回仓库的引用日志
+	GetRefUpdates(string, string) ([]schema.RefUpdate, error)
+	// GetAllRefUpdates 按仓库与记录顺序返回全部引用日志, kinds 非空时只返回这些类型
+	GetAllRefUpdates(...string) ([]schema.RefUpdate, error)
+
+	// SaveMaintenanceRecord 保存仓库最近一次维护的结果, 覆盖之前的记录
+	SaveMaintenanceRecord(*schema.MaintenanceRecord) error
+	GetMaintenanceRecord(string, string) (*schema.MaintenanceRecord, bool, error)
+	GetAllMaintenanceRecords() ([]schema.MaintenanceRecord, error)
 	Close()
 }
 
 func SetDBInfo(cfg *config.Config) {
 	DB = bolt.OpenDatabase(cfg.Database.Path)
 }
+
+// OpenDB 打开数据库, 数据库被其它进程(例如运行中的服务)占用超过 timeout 时返回错误
+func OpenDB(cfg *config.Config, timeout time.Duration) error {
+	storage, err := bolt.Open(cfg.Database.Path, timeout)
+	if err != nil {
+		return err
+	}
+	DB = storage
+	return nil
+}
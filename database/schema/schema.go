@@ -21,8 +21,10 @@ type RepoData struct {
 	RepoName string
 	// clone的Commit hash
 	RepoCommitHash string
-	// 生命周期状态: pending/synced
+	// 生命周期状态: pending/synced/orphaned
 	Status string
+	// 上游不可访问、被标记为 orphaned 的时间
+	OrphanedTime time.Time
 }
 
 type RepoSumData struct {
@@ -35,3 +37,58 @@ type RepoSumData struct {
 	// 请求计数
 	RequestCount int
 }
+
+// RefUpdate 为一次同步中单个引用的变化
+type RefUpdate struct {
+	// 仓库所有者
+	RepoUser string
+	// 仓库名称
+	RepoName string
+	// 引用名称
+	Ref string
+	// 同步前的对象 ID, 新建的引用为空
+	OldHash string
+	// 同步后的对象 ID, 删除的引用为空
+	NewHash string
+	// 是否为快进更新
+	FastForward bool
+	// 变化类型: create/fast-forward/forced/tag-rewrite/delete/update
+	Kind string
+	// 记录时间
+	Time time.Time
+}
+
+// RefBaseline 为引用日志因条目上限删除的记录折叠后的引用状态
+type RefBaseline struct {
+	// 被删除的最后一条记录的时间
+	Time time.Time
+	// 该时间的引用状态
+	Refs map[string]string
+}
+
+// MaintenanceRecord 为仓库最近一次维护(repack/prune/临时文件清理)的结果
+type MaintenanceRecord struct {
+	// 仓库所有者
+	RepoUser string
+	// 仓库名称
+	RepoName string
+	// 开始时间
+	Time time.Time
+	// 耗时
+	Duration time.Duration
+	// 维护前后的 pack 数量
+	PacksBefore int
+	PacksAfter  int
+	// 维护前后的松散对象数量
+	LooseBefore int
+	LooseAfter  int
+	// 维护前后 objects 目录的字节数
+	SizeBefore int64
+	SizeAfter  int64
+	// 删除的过期临时文件数量
+	StaleFiles int
+	// 是否执行了 repack 与 prune, 浅镜像在 go-git 后端下只清理临时文件
+	Repacked bool
+	// 失败时的错误信息
+	Error string
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/filemode"
+	"github.com/go-git/go-git/v6/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v6/plumbing/object"
+	"github.com/go-git/go-git/v6/storage"
+)
+
+// packFilter 是 partial clone 对象过滤规则, 多个规则组合时取最严格的结果
+type packFilter struct {
+	noBlobs bool
+	// blobLimit 为 blob 大小上限(字节), 大小不小于该值的 blob 被省略, -1 表示不限制
+	blobLimit int64
+	// treeDepth 省略距根 tree 深度不小于该值的 tree 与 blob, -1 表示不限制
+	treeDepth int
+	// sparse 为 sparse:oid 指定的 sparse-checkout 模式, 只保留匹配路径的 blob
+	sparse []gitignore.Pattern
+}
+
+// parsePackFilter 解析 filter 参数, 支持 blob:none、blob:limit、tree、sparse:oid 与 combine
+func parsePackFilter(st storage.Storer, spec string) (*packFilter, error) {
+	f := &packFilter{blobLimit: -1, treeDepth: -1}
+	if err := f.add(st, spec); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *packFilter) add(st storage.Storer, spec string) error {
+	switch {
+	case spec == "blob:none":
+		f.noBlobs = true
+	case strings.HasPrefix(spec, "blob:limit="):
+		limit, err := parseFilterSize(strings.TrimPrefix(spec, "blob:limit="))
+		if err != nil {
+			return err
+		}
+		if f.blobLimit < 0 || limit < f.blobLimit {
+			f.blobLimit = limit
+		}
+	case strings.HasPrefix(spec, "tree:"):
+		depth, err := strconv.Atoi(strings.TrimPrefix(spec, "tree:"))
+		if err != nil || depth < 0 {
+			return fmt.Errorf("invalid filter: %s", spec)
+		}
+		if f.treeDepth < 0 || depth < f.treeDepth {
+			f.treeDepth = depth
+		}
+	case strings.HasPrefix(spec, "sparse:oid="):
+		if f.sparse != nil {
+			return errors.New("only one sparse filter is allowed")
+		}
+		patterns, err := loadSparsePatterns(st, strings.TrimPrefix(spec, "sparse:oid="))
+		if err != nil {
+			return err
+		}
+		f.sparse = patterns
+	case strings.HasPrefix(spec, "combine:"):
+		for _, sub := range strings.Split(strings.TrimPrefix(spec, "combine:"), "+") {
+			sub, err := url.PathUnescape(sub)
+			if err != nil {
+				return err
+			}
+			if err := f.add(st, sub); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("filter '%s' not supported", spec)
+	}
+	return nil
+}
+
+// parseFilterSize 解析带 k/m/g 单位的大小
+func parseFilterSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult, s = 1<<10, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		mult, s = 1<<20, strings.TrimSuffix(s, "m")
+	case strings.HasSuffix(s, "g"):
+		mult, s = 1<<30, strings.TrimSuffix(s, "g")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid blob limit: %s", s)
+	}
+	return n * mult, nil
+}
+
+// loadSparsePatterns 读取 sparse:oid 指向的 blob, 值可以是对象 ID 或 <rev>:<path>
+func loadSparsePatterns(st storage.Storer, value string) ([]gitignore.Pattern, error) {
+	var hash plumbing.Hash
+	if h, ok := plumbing.FromHex(value); ok {
+		hash = h
+	} else {
+		rev, path, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid sparse oid: %s", value)
+		}
+		repo, err := git.Open(st, nil)
+		if err != nil {
+			return nil, err
+		}
+		commitHash, err := repo.ResolveRevision(plumbing.Revision(rev))
+		if err != nil {
+			return nil, err
+		}
+		commit, err := repo.CommitObject(*commitHash)
+		if err != nil {
+			return nil, err
+		}
+		file, err := commit.File(path)
+		if err != nil {
+			return nil, err
+		}
+		hash = file.Hash
+	}
+
+	blob, err := object.GetBlob(st, hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close() //nolint:errcheck
+
+	var patterns []gitignore.Pattern
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, gitignore.ParsePattern(line, nil))
+	}
+	return patterns, scanner.Err()
+}
+
+// sparseMatch 按 sparse-checkout 规则判断路径是否保留: 从路径本身向上查找最后匹配的模式
+func (f *packFilter) sparseMatch(path []string) bool {
+	for i := len(path); i > 0; i-- {
+		isDir := i < len(path)
+		for j := len(f.sparse) - 1; j >= 0; j-- {
+			switch f.sparse[j].Match(path[:i], isDir) {
+			case gitignore.Exclude:
+				return true
+			case gitignore.Include:
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// filterWalker 按 packFilter 收集需要发送的对象
+type filterWalker struct {
+	st     storage.Storer
+	filter *packFilter
+	ignore map[plumbing.Hash]bool
+	// boundary 为浅边界提交, 只发送提交本身与其 tree, 不再遍历父提交
+	boundary map[plumbing.Hash]bool
+
+	seen      map[plumbing.Hash]bool
+	treeDepth map[string]int
+	objects   []plumbing.Hash
+}
+
+// filteredObjects 返回从 wants 可达、不在 ignore 中且通过过滤的对象, 遍历在 boundary 提交处停止;
+// 显式请求的对象总是发送
+func filteredObjects(st storage.Storer, wants []plumbing.Hash, ignore map[plumbing.Hash]bool, boundary map[plumbing.Hash]bool, filter *packFilter) ([]plumbing.Hash, error) {
+	w := &filterWalker{
+		st:        st,
+		filter:    filter,
+		ignore:    ignore,
+		boundary:  boundary,
+		seen:      map[plumbing.Hash]bool{},
+		treeDepth: map[string]int{},
+	}
+	for _, want := range wants {
+		if err := w.walkWant(want); err != nil {
+			return nil, err
+		}
+	}
+	return w.objects, nil
+}
+
+func (w *filterWalker) add(h plumbing.Hash) bool {
+	if w.seen[h] || w.ignore[h] {
+		return false
+	}
+	w.seen[h] = true
+	w.objects = append(w.objects, h)
+	return true
+}
+
+func (w *filterWalker) walkWant(h plumbing.Hash) error {
+	obj, err := w.st.EncodedObject(plumbing.AnyObject, h)
+	if err != nil {
+		return err
+	}
+	switch obj.Type() {
+	case plumbing.TagObject:
+		tag, err := object.DecodeTag(w.st, obj)
+		if err != nil {
+			return err
+		}
+		w.add(h)
+		return w.walkWant(tag.Target)
+	case plumbing.CommitObject:
+		return w.walkCommits(h)
+	case plumbing.TreeObject:
+		w.add(h)
+		return w.walkTreeEntries(h, 0, nil)
+	default:
+		w.add(h)
+		return nil
+	}
+}
+
+func (w *filterWalker) walkCommits(start plumbing.Hash) error {
+	stack := []plumbing.Hash{start}
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !w.add(h) {
+			continue
+		}
+		commit, err := object.GetCommit(w.st, h)
+		if err != nil {
+			return err
+		}
+		if err := w.walkTree(commit.TreeHash, 0, nil); err != nil {
+			return err
+		}
+		if !w.boundary[h] {
+			stack = append(stack, commit.ParentHashes...)
+		}
+	}
+	return nil
+}
+
+// walkTree 处理深度为 depth 的 tree; 同一 tree 在更浅处出现过时不再重复遍历
+func (w *filterWalker) walkTree(h plumbing.Hash, depth int, path []string) error {
+	if w.ignore[h] || (w.filter.treeDepth >= 0 && depth >= w.filter.treeDepth) {
+		return nil
+	}
+	// sparse 过滤的结果取决于路径, 需要按路径区分
+	key := h.String()
+	if w.filter.sparse != nil {
+		key += ":" + strings.Join(path, "/")
+	}
+	if d, ok := w.treeDepth[key]; ok && d <= depth {
+		return nil
+	}
+	w.treeDepth[key] = depth
+	if !w.seen[h] {
+		w.seen[h] = true
+		w.objects = append(w.objects, h)
+	}
+	return w.walkTreeEntries(h, depth, path)
+}
+
+func (w *filterWalker) walkTreeEntries(h plumbing.Hash, depth int, path []string) error {
+	tree, err := object.GetTree(w.st, h)
+	if err != nil {
+		return err
+	}
+	for _, entry := range tree.Entries {
+		entryPath := append(append([]string(nil), path...), entry.Name)
+		switch entry.Mode {
+		case filemode.Submodule:
+			continue
+		case filemode.Dir:
+			if err := w.walkTree(entry.Hash, depth+1, entryPath); err != nil {
+				return err
+			}
+		default:
+			include, err := w.includeBlob(entry.Hash, depth+1, entryPath)
+			if err != nil {
+				return err
+			}
+			if include {
+				w.add(entry.Hash)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *filterWalker) includeBlob(h plumbing.Hash, depth int, path []string) (bool, error) {
+	f := w.filter
+	if w.seen[h] || w.ignore[h] || f.noBlobs || (f.treeDepth >= 0 && depth >= f.treeDepth) {
+		return false, nil
+	}
+	if f.sparse != nil && !f.sparseMatch(path) {
+		return false, nil
+	}
+	if f.blobLimit >= 0 {
+		obj, err := w.st.EncodedObject(plumbing.BlobObject, h)
+		if err != nil {
+			return false, err
+		}
+		if obj.Size() >= f.blobLimit {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,111 @@
+//go:build behavior
+// +build behavior
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"smart-git/gitc"
+)
+
+// countMissing 返回 dir 中全部引用可达、但本地缺失的对象数
+func countMissing(t *testing.T, gitPath string, dir string) int {
+	output := gitOutput(t, gitPath, dir, nil, "rev-list", "--objects", "--all", "--missing=print")
+	n := 0
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "?") {
+			n++
+		}
+	}
+	return n
+}
+
+// startFilterServer 创建单个提交的上游仓库并启动服务, 树结构为:
+//
+//	small.txt        小 blob
+//	big.bin          4 KiB 的 blob
+//	sparse           sparse:oid 使用的模式, 只保留 dir/
+//	dir/top.txt
+//	dir/sub/deep.txt
+func startFilterServer(t *testing.T, gitPath string, backend string) (string, string) {
+	return startMirrorServer(t, gitPath, backend, func(src string) {
+		files := map[string]string{
+			"small.txt":        "small\n",
+			"big.bin":          strings.Repeat("0123456789abcdef", 256),
+			"sparse":           "/dir/\n",
+			"dir/top.txt":      "top\n",
+			"dir/sub/deep.txt": "deep\n",
+		}
+		for name, content := range files {
+			path := filepath.Join(src, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runGit(t, gitPath, src, "add", ".")
+		runGit(t, gitPath, src, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", "files")
+	})
+}
+
+// TestGitBehaviorFilter 测试 --filter 的 blob:none、blob:limit、tree:<depth> 与 sparse:oid,
+// 克隆后缺失的对象数符合过滤规则, checkout 时按需从服务端取回缺失的对象
+func TestGitBehaviorFilter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping behavior test in short mode")
+	}
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found, skipping behavior test")
+	}
+
+	filters := []struct {
+		spec    string
+		missing int
+	}{
+		// 全部 5 个 blob
+		{"blob:none", 5},
+		{"blob:limit=1k", 1},
+		// 深度为 2 的 dir/top.txt 与 dir/sub, dir/sub 缺失时不再遍历其中的对象
+		{"tree:2", 2},
+		// 不在 dir/ 下的 small.txt、big.bin 与 sparse
+		{"sparse:oid=main:sparse", 3},
+	}
+
+	for _, backend := range []string{gitc.BackendGoGit, gitc.BackendSystem} {
+		for _, proto := range []string{"0", "2"} {
+			t.Run(backend+"/v"+proto, func(t *testing.T) {
+				url, tmpDir := startFilterServer(t, gitPath, backend)
+				protoArgs := []string{"-c", "protocol.version=" + proto}
+
+				for i, filter := range filters {
+					// --no-checkout 避免克隆后立即按需取回缺失的 blob
+					path := filepath.Join(tmpDir, "clone"+string(rune('a'+i)))
+					runGit(t, gitPath, tmpDir, append(protoArgs, "clone", "--no-checkout", "--filter="+filter.spec, url, path)...)
+					if n := countMissing(t, gitPath, path); n != filter.missing {
+						t.Fatalf("--filter=%s: expected %d missing objects, got %d", filter.spec, filter.missing, n)
+					}
+
+					// checkout 从 promisor 远程取回缺失的 blob 与 tree
+					runGit(t, gitPath, path, append(protoArgs, "checkout", "main")...)
+					content, err := os.ReadFile(filepath.Join(path, "dir", "sub", "deep.txt"))
+					if err != nil || string(content) != "deep\n" {
+						t.Fatalf("--filter=%s: checkout did not fetch dir/sub/deep.txt: %q, %v", filter.spec, content, err)
+					}
+					if n := countMissing(t, gitPath, path); n != 0 {
+						t.Fatalf("--filter=%s: expected no missing objects after checkout, got %d", filter.spec, n)
+					}
+					runGit(t, gitPath, path, "fsck")
+				}
+			})
+		}
+	}
+}
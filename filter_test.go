@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+// TestParsePackFilter 测试 filter 参数解析与 combine 取最严格规则
+func TestParsePackFilter(t *testing.T) {
+	f, err := parsePackFilter(nil, "blob:none")
+	if err != nil || !f.noBlobs || f.blobLimit != -1 || f.treeDepth != -1 {
+		t.Fatalf("unexpected blob:none filter: %+v, %v", f, err)
+	}
+
+	f, err = parsePackFilter(nil, "blob:limit=2k")
+	if err != nil || f.blobLimit != 2048 {
+		t.Fatalf("unexpected blob:limit filter: %+v, %v", f, err)
+	}
+
+	f, err = parsePackFilter(nil, "combine:tree%3A3+blob:limit=1m+tree:1+blob:limit=10")
+	if err != nil || f.treeDepth != 1 || f.blobLimit != 10 {
+		t.Fatalf("unexpected combine filter: %+v, %v", f, err)
+	}
+
+	for _, spec := range []string{"blob:limit=abc", "tree:-1", "object:type=blob", ""} {
+		if _, err := parsePackFilter(nil, spec); err == nil {
+			t.Fatalf("expected error for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"smart-git/config"
+	"smart-git/database"
+	"smart-git/gitc"
+	"time"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// fsckDBTimeout 为 fsck 子命令等待数据库文件锁的时间, 服务运行时数据库被占用, 应改用 /api/fsck
+const fsckDBTimeout = 5 * time.Second
+
+// runFsck 执行 `smart-git fsck [-c config] [-fix]`, 没有未修复的不一致时返回 0
+func runFsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	cfgPath := flags.String("c", "./config/config", "config file path")
+	cfgCompat := flags.String("cfg", "", "config file path (compat alias)")
+	fix := flags.Bool("fix", false, "fix the inconsistencies found")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *cfgCompat != "" {
+		*cfgPath = *cfgCompat
+	}
+
+	var err error
+	cfg, err = config.LoadConfig(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to load config: %v\n", err)
+		return 2
+	}
+	if err := database.OpenDB(cfg, fsckDBTimeout); err != nil {
+		fmt.Fprintf(os.Stderr, "fail to open database %s: %v\n", cfg.Database.Path, err)
+		fmt.Fprintln(os.Stderr, "the database is locked while smart-git is running, use GET/POST /api/fsck instead")
+		return 2
+	}
+	defer database.DB.Close()
+	if err := gitc.SetupRepoLocks(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "fail to setup repo locks: %v\n", err)
+		return 2
+	}
+	if err := gitc.SetupLayout(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "fail to setup repo layout: %v\n", err)
+		return 2
+	}
+
+	report, err := gitc.Fsck(context.Background(), cfg, *fix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck failed: %v\n", err)
+		return 2
+	}
+	for _, issue := range report.Issues {
+		status := ""
+		switch {
+		case issue.Fixed:
+			status = " [fixed]"
+		case issue.FixError != "":
+			status = " [fix failed: " + issue.FixError + "]"
+		}
+		fmt.Printf("%-20s %s: %s%s\n", issue.Kind, issue.Repo, issue.Detail, status)
+	}
+	fmt.Printf("checked %d records, %d directories, %d sum records, %d object pools: %d issues, %d unfixed\n",
+		report.Records, report.Dirs, report.Sums, report.Pools, len(report.Issues), report.Unfixed())
+	if report.Unfixed() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// handleFsck 核对 BaseDir 与数据库, fix 为 true 时修复发现的不一致
+func handleFsck(fix bool) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		report, err := gitc.Fsck(c.Request.Context(), cfg, fix)
+		if err != nil {
+			logError("fsck request failed: %v\n", err)
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp := NewAPIFsckReport(*report)
+		RenderWANF(c, http.StatusOK, &resp)
+	}
+}
@@ -8,10 +8,14 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"path/filepath"
 	"regexp"
+	"smart-git/gitc"
 	"strings"
 	"time"
 
+	"github.com/go-git/go-billy/v6"
+	"github.com/go-git/go-billy/v6/osfs"
 	"github.com/go-git/go-git/v6/plumbing"
 	"github.com/go-git/go-git/v6/plumbing/object"
 	"github.com/go-git/go-git/v6/plumbing/protocol/packp"
@@ -84,7 +88,7 @@ type service struct {
 var services = []service{
 	{regexp.MustCompile("(.*?)/HEAD$"), http.MethodGet, getTextFile, ""},
 	{regexp.MustCompile("(.*?)/info/refs$"), http.MethodGet, getInfoRefs, ""},
-	{regexp.MustCompile("(.*?)/objects/info/alternates$"), http.MethodGet, getTextFile, ""},
+	{regexp.MustCompile("(.*?)/objects/info/alternates$"), http.MethodGet, getAlternates, ""},
 	{regexp.MustCompile("(.*?)/objects/info/http-alternates$"), http.MethodGet, getTextFile, ""},
 	{regexp.MustCompile("(.*?)/objects/info/packs$"), http.MethodGet, getInfoPacks, ""},
 	{regexp.MustCompile("(.*?)/objects/[0-9a-f]{2}/[0-9a-f]{38}$"), http.MethodGet, getLooseObject, ""},
@@ -257,6 +261,15 @@ func sendFile(w http.ResponseWriter, r *http.Request, contentType string) {
 	}
 	fs := fss.Filesystem()
 	f, err := fs.Open(file)
+	if err != nil && isObjectFile(file) {
+		// 借用的对象(对象池)通过本仓库的对象路由提供
+		for _, afs := range alternateFilesystems(fs) {
+			if f, err = afs.Open(file); err == nil {
+				fs = afs
+				break
+			}
+		}
+	}
 	if err != nil {
 		renderStatusError(w, http.StatusNotFound)
 		return
@@ -286,6 +299,74 @@ func getTextFile(w http.ResponseWriter, r *http.Request) {
 	sendFile(w, r, "text/plain; charset=utf-8")
 }
 
+// getAlternates 只返回相对路径的条目. 绝对路径的对象目录(对象池)位于服务器本地, 其中的对象已通过本仓库的对象路由提供,
+// 不向客户端暴露; 没有剩余条目时与没有 alternates 一样返回 404
+func getAlternates(w http.ResponseWriter, r *http.Request) {
+	fs, ok := requestFilesystem(r)
+	if !ok {
+		renderStatusError(w, http.StatusNotFound)
+		return
+	}
+	f, err := fs.Open("objects/info/alternates")
+	if err != nil {
+		renderStatusError(w, http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		renderStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	var buf strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || filepath.IsAbs(line) {
+			continue
+		}
+		buf.WriteString(line + "\n")
+	}
+	if buf.Len() == 0 {
+		renderStatusError(w, http.StatusNotFound)
+		return
+	}
+	hdrNocache(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, buf.String())
+}
+
+// requestFilesystem 返回请求仓库的文件系统
+func requestFilesystem(r *http.Request) (billy.Filesystem, bool) {
+	st, ok := r.Context().Value(contextKey("storer")).(storage.Storer)
+	if !ok {
+		return nil, false
+	}
+	fss, ok := st.(storer.FilesystemStorer)
+	if !ok {
+		return nil, false
+	}
+	return fss.Filesystem(), true
+}
+
+// alternateFilesystems 返回仓库 objects/info/alternates 中对象目录所属仓库的文件系统
+func alternateFilesystems(fs billy.Filesystem) []billy.Filesystem {
+	dirs, err := gitc.AlternateObjectDirs(fs.Root())
+	if err != nil {
+		return nil
+	}
+	filesystems := make([]billy.Filesystem, 0, len(dirs))
+	for _, dir := range dirs {
+		filesystems = append(filesystems, osfs.New(filepath.Dir(dir)))
+	}
+	return filesystems
+}
+
+// isObjectFile 判断请求的文件是否为松散对象或 pack
+func isObjectFile(file string) bool {
+	file = strings.TrimPrefix(file, "/")
+	return strings.HasPrefix(file, "objects/") && !strings.HasPrefix(file, "objects/info/")
+}
+
 func getInfoRefs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	st, ok := ctx.Value(contextKey("storer")).(storage.Storer)
@@ -309,7 +390,7 @@ func getInfoRefs(w http.ResponseWriter, r *http.Request) {
 		var err error
 		switch service {
 		case transport.UploadPackService:
-			err = writeAdvertisedRefs(ctx, st, service, version, w)
+			err = writeAdvertisedRefs(ctx, st, service, version, gitc.RefView{}, w)
 		case transport.ReceivePackService:
 			err = transport.ReceivePack(ctx, st, nil, ioutil.WriteNopCloser(w),
 				&transport.ReceivePackOptions{
@@ -331,8 +412,40 @@ func getInfoRefs(w http.ResponseWriter, r *http.Request) {
 }
 
 func getInfoPacks(w http.ResponseWriter, r *http.Request) {
-	hdrCacheForever(w)
-	sendFile(w, r, "text/plain; charset=utf-8")
+	fs, ok := requestFilesystem(r)
+	if !ok {
+		hdrCacheForever(w)
+		sendFile(w, r, "text/plain; charset=utf-8")
+		return
+	}
+	alternates := alternateFilesystems(fs)
+	if len(alternates) == 0 {
+		hdrCacheForever(w)
+		sendFile(w, r, "text/plain; charset=utf-8")
+		return
+	}
+
+	// 借用对象池对象的仓库同时列出对象池的 pack, 这些 pack 通过本仓库的 pack 路由提供
+	var buf strings.Builder
+	seen := map[string]bool{}
+	for _, pfs := range append([]billy.Filesystem{fs}, alternates...) {
+		entries, err := pfs.ReadDir("objects/pack")
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || filepath.Ext(name) != ".pack" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			buf.WriteString("P " + name + "\n")
+		}
+	}
+	buf.WriteString("\n")
+	hdrNocache(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, buf.String())
 }
 
 func getLooseObject(w http.ResponseWriter, r *http.Request) {
@@ -373,6 +486,7 @@ func writeAdvertisedRefs(
 	st storage.Storer,
 	service transport.Service,
 	version string,
+	view gitc.RefView,
 	w io.Writer,
 ) error {
 	_ = ctx
@@ -422,9 +536,31 @@ func writeAdvertisedRefs(
 		if err := ar.Capabilities.Set(capability.Shallow); err != nil {
 			return err
 		}
+		if err := ar.Capabilities.Set(capability.DeepenSince); err != nil {
+			return err
+		}
+		if err := ar.Capabilities.Set(capability.DeepenNot); err != nil {
+			return err
+		}
+		if err := ar.Capabilities.Set(capability.DeepenRelative); err != nil {
+			return err
+		}
+		if err := ar.Capabilities.Set(capability.IncludeTag); err != nil {
+			return err
+		}
+		// partial clone 需要 filter, 之后的按需补取以及锁文件固定的提交需要请求未广告的对象
+		if err := ar.Capabilities.Set(capability.Filter); err != nil {
+			return err
+		}
+		if err := ar.Capabilities.Set(capability.AllowTipSHA1InWant); err != nil {
+			return err
+		}
+		if err := ar.Capabilities.Set(capability.AllowReachableSHA1InWant); err != nil {
+			return err
+		}
 	}
 
-	if err := addAdvertisedReferences(st, ar, service == transport.UploadPackService); err != nil {
+	if err := addAdvertisedReferences(st, ar, service == transport.UploadPackService, view); err != nil {
 		return err
 	}
 
@@ -435,14 +571,21 @@ func writeAdvertisedRefs(
 	return ar.Encode(w)
 }
 
-func addAdvertisedReferences(st storage.Storer, ar *packp.AdvRefs, addHead bool) error {
+// addAdvertisedReferences 将 view 中可见的引用加入广告, 命名空间内的引用以去掉前缀后的名称广告;
+// 隐藏引用的对象仍可按 ID 获取
+func addAdvertisedReferences(st storage.Storer, ar *packp.AdvRefs, addHead bool, view gitc.RefView) error {
 	iter, err := st.IterReferences()
 	if err != nil {
 		return err
 	}
 
 	return iter.ForEach(func(r *plumbing.Reference) error {
-		hash, name := r.Hash(), r.Name()
+		hash := r.Hash()
+		visible, ok := view.VisibleName(r.Name().String())
+		if !ok {
+			return nil
+		}
+		name := plumbing.ReferenceName(visible)
 		switch r.Type() {
 		case plumbing.SymbolicReference:
 			ref, err := storer.ResolveReference(st, r.Target())
@@ -460,15 +603,17 @@ func addAdvertisedReferences(st storage.Storer, ar *packp.AdvRefs, addHead bool)
 				return nil
 			}
 			if r.Type() == plumbing.SymbolicReference {
-				if err := ar.Capabilities.Add(capability.SymRef, fmt.Sprintf("%s:%s", name, r.Target())); err != nil {
-					return err
+				if target, ok := view.VisibleName(r.Target().String()); ok {
+					if err := ar.Capabilities.Add(capability.SymRef, fmt.Sprintf("%s:%s", name, target)); err != nil {
+						return err
+					}
 				}
 			}
 			ar.Head = &hash
 		}
 
 		ar.References[name.String()] = hash
-		if r.Name().IsTag() {
+		if name.IsTag() {
 			if tag, err := object.GetTag(st, hash); err == nil {
 				ar.Peeled[name.String()] = tag.Target
 			}
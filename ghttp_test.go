@@ -2,13 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"smart-git/gitc"
 	"strings"
 	"testing"
+
+	"github.com/go-git/go-billy/v6/osfs"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/transport"
+	"github.com/go-git/go-git/v6/storage/memory"
 )
 
 // mockLogger 创建一个日志记录器用于测试
@@ -201,3 +210,93 @@ func TestResponseAlreadyStartedRemoved(t *testing.T) {
 
 	_ = rec
 }
+
+// TestWriteAdvertisedRefsHideRefs 测试 hideRefs 隐藏的引用不出现在广告中
+func TestWriteAdvertisedRefsHideRefs(t *testing.T) {
+	st := memory.NewStorage()
+	hash := plumbing.NewHash("17b24e835317f14df978a91d3e8fa0c4cddfdddc")
+	for _, ref := range []*plumbing.Reference{
+		plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/main"),
+		plumbing.NewHashReference("refs/heads/main", hash),
+		plumbing.NewHashReference("refs/pull/1/head", hash),
+		plumbing.NewHashReference("refs/pull/1/merge", hash),
+		plumbing.NewHashReference("refs/pullx", hash),
+	} {
+		if err := st.SetReference(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeAdvertisedRefs(context.Background(), st, transport.UploadPackService, "", gitc.RefView{HideRefs: []string{"refs/pull", "!refs/pull/1/head"}}, &buf); err != nil {
+		t.Fatalf("advertise failed: %v", err)
+	}
+	adv := buf.String()
+	for _, name := range []string{"HEAD", "refs/heads/main", "refs/pull/1/head", "refs/pullx"} {
+		if !strings.Contains(adv, " "+name+"\n") && !strings.Contains(adv, " "+name+"\x00") {
+			t.Errorf("expected %s in advertisement: %q", name, adv)
+		}
+	}
+	if strings.Contains(adv, "refs/pull/1/merge") {
+		t.Errorf("hidden ref advertised: %q", adv)
+	}
+}
+
+// TestDumbHTTPAlternates 测试对象池成员的 dumb HTTP 路由: 不暴露绝对路径的 alternates,
+// 对象池中的 pack 与松散对象通过成员自身的路由提供
+func TestDumbHTTPAlternates(t *testing.T) {
+	tmpDir := t.TempDir()
+	poolPack := "pack-" + strings.Repeat("a", 40) + ".pack"
+	memberPack := "pack-" + strings.Repeat("b", 40) + ".pack"
+	loose := filepath.Join("objects", "ab", strings.Repeat("c", 38))
+	files := map[string]string{
+		filepath.Join("pool", "objects", "pack", poolPack):       "pool pack",
+		filepath.Join("pool", loose):                             "pool object",
+		filepath.Join("member", "config"):                        "",
+		filepath.Join("member", "HEAD"):                          "ref: refs/heads/main\n",
+		filepath.Join("member", "objects", "pack", memberPack):   "member pack",
+		filepath.Join("member", "objects", "info", "alternates"): filepath.Join(tmpDir, "pool", "objects") + "\n../../other/objects\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend := NewBackend(transport.NewFilesystemLoader(osfs.New(tmpDir), false))
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		backend.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, body := get("/member/objects/info/alternates"); code != http.StatusOK || body != "../../other/objects\n" {
+		t.Fatalf("unexpected alternates: %d %q", code, body)
+	}
+	code, body := get("/member/objects/info/packs")
+	if code != http.StatusOK || !strings.Contains(body, "P "+poolPack+"\n") || !strings.Contains(body, "P "+memberPack+"\n") {
+		t.Fatalf("unexpected info/packs: %d %q", code, body)
+	}
+	if code, body := get("/member/objects/pack/" + poolPack); code != http.StatusOK || body != "pool pack" {
+		t.Fatalf("pool pack not served: %d %q", code, body)
+	}
+	if code, body := get("/member/" + filepath.ToSlash(loose)); code != http.StatusOK || body != "pool object" {
+		t.Fatalf("pool object not served: %d %q", code, body)
+	}
+	if code, _ := get("/member/objects/pack/pack-" + strings.Repeat("d", 40) + ".pack"); code != http.StatusNotFound {
+		t.Fatalf("missing pack: %d", code)
+	}
+
+	// 只有对象池一个绝对路径时与没有 alternates 一样
+	alternates := filepath.Join(tmpDir, "member", "objects", "info", "alternates")
+	if err := os.WriteFile(alternates, []byte(filepath.Join(tmpDir, "pool", "objects")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := get("/member/objects/info/alternates"); code != http.StatusNotFound {
+		t.Fatalf("absolute alternates exposed: %d", code)
+	}
+}
@@ -0,0 +1,442 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"smart-git/config"
+	"smart-git/database"
+	"smart-git/database/schema"
+
+	gconfig "github.com/go-git/go-git/v6/config"
+	"github.com/go-git/go-git/v6/plumbing"
+)
+
+// CanonicalRepoName 返回仓库的规范名称: GitHub 的 owner 与仓库名称不区分大小写, 且可以带 .git 后缀,
+// /Foo/Bar、/foo/bar 与 /foo/bar.git 为同一个仓库, 规范名称为小写且不带 .git 后缀
+func CanonicalRepoName(userName string, repoName string) (string, string) {
+	return strings.ToLower(userName), strings.TrimSuffix(strings.ToLower(repoName), ".git")
+}
+
+// IsCanonicalRepoName 判断名称是否已是规范名称
+func IsCanonicalRepoName(userName string, repoName string) bool {
+	canonicalUser, canonicalRepo := CanonicalRepoName(userName, repoName)
+	return canonicalUser == userName && canonicalRepo == repoName
+}
+
+// repoAliases 返回记录、镜像目录与拉取统计中不是规范名称的 owner/repo, 按名称排序
+func repoAliases(basedir string) ([]string, error) {
+	keys := map[string]bool{}
+	records, err := GetAllRepoData()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		keys[record.RepoUser+"/"+record.RepoName] = true
+	}
+	dirs, err := repoDirs(basedir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		keys[dir] = true
+	}
+	sums, err := database.DB.GetAllSumData()
+	if err != nil {
+		return nil, err
+	}
+	for _, sum := range sums {
+		keys[sum.RepoUser+"/"+sum.RepoName] = true
+	}
+	var aliases []string
+	for key := range keys {
+		userName, repoName, _ := strings.Cut(key, "/")
+		if !IsCanonicalRepoName(userName, repoName) {
+			aliases = append(aliases, key)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases, nil
+}
+
+var (
+	// ErrAliasNeedsFix 表示别名与规范名称各有镜像, 合并需要删除别名的镜像, 只在 fsck -fix 时执行
+	ErrAliasNeedsFix = errors.New("duplicate mirror kept, run fsck -fix to merge")
+	// ErrAliasSkipped 表示别名的镜像不能自动合并, 需要人工处理
+	ErrAliasSkipped = errors.New("alias mirror skipped")
+)
+
+// MergeRepoAliases 将以非规范名称保存的镜像、记录与拉取统计合并到规范名称下, 启动时执行, 返回合并的数量.
+// 启动时不删除任何镜像与记录: 规范名称已有镜像的别名记录警告并保留, 由 fsck -fix 合并;
+// 单个仓库合并失败时同样记录警告并继续, 留给 fsck 报告
+func MergeRepoAliases(ctx context.Context, cfg *config.Config) (int, error) {
+	aliases, err := repoAliases(cfg.Server.BaseDir)
+	if err != nil {
+		return 0, err
+	}
+	merged := 0
+	for _, alias := range aliases {
+		if err := ctx.Err(); err != nil {
+			return merged, err
+		}
+		userName, repoName, _ := strings.Cut(alias, "/")
+		if _, err := mergeRepoAlias(ctx, cfg.Server.BaseDir, userName, repoName, false); err != nil {
+			logWarning("merge repo alias failed: %v, repo: %s\n", err, alias)
+			continue
+		}
+		merged++
+	}
+	return merged, nil
+}
+
+// mergeRepoAlias 在两个名称的独占锁下将别名合并到规范名称, 返回处理说明:
+//   - 规范名称还没有可用的镜像时, 别名的镜像移动到规范名称的目录, 别名的记录(含孤立状态)改为规范名称;
+//     大小写不敏感的文件系统上两个名称为同一目录时同样移动, 只改变目录名的大小写
+//   - 否则 fix 为 false 时返回 ErrAliasNeedsFix, 不做任何修改; fix 为 true 时先将别名镜像中的内部引用(快照等)
+//     与对象复制到规范名称的镜像, 再删除别名的镜像与记录. 孤立的别名与无法复制内部引用的别名返回 ErrAliasSkipped
+//   - 别名的拉取统计累加到规范名称
+func mergeRepoAlias(ctx context.Context, basedir string, userName string, repoName string, fix bool) (string, error) {
+	canonicalUser, canonicalRepo := CanonicalRepoName(userName, repoName)
+	if err := ValidateRepoName(canonicalUser, canonicalRepo); err != nil {
+		return "", err
+	}
+	unlock, err := lockRepo(ctx, canonicalUser, canonicalRepo)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	unlockAlias, err := lockRepo(ctx, userName, repoName)
+	if err != nil {
+		return "", err
+	}
+	defer unlockAlias()
+
+	alias := userName + "/" + repoName
+	canonical := canonicalUser + "/" + canonicalRepo
+	record, exists, err := GetRepoData(userName, repoName)
+	if err != nil {
+		return "", err
+	}
+	canonicalRecord, canonicalExists, err := GetRepoData(canonicalUser, canonicalRepo)
+	if err != nil {
+		return "", err
+	}
+
+	var detail string
+	aliasPath := RepoPath(basedir, userName, repoName)
+	targetPath := RepoPath(basedir, canonicalUser, canonicalRepo)
+	switch {
+	case dirExists(aliasPath) && (sameDir(aliasPath, targetPath) || (!dirExists(targetPath) && repoIsUsable(aliasPath))):
+		target := layoutPath(CurrentLayout(), basedir, canonicalUser, canonicalRepo)
+		if err := moveAliasDir(basedir, aliasPath, target); err != nil {
+			return "", err
+		}
+		if pool := repoPoolDir(target); pool != "" {
+			if err := renamePoolMember(pool, alias, canonical, target); err != nil {
+				logWarning("rename object pool member failed: %v, repo: %s\n", err, canonical)
+			}
+		}
+		// 记录描述的是移动的镜像, 以别名的记录为准, 保留孤立状态与时间
+		switch {
+		case exists:
+			moved := *record
+			moved.RepoUser, moved.RepoName, moved.LocalPath = canonicalUser, canonicalRepo, target
+			err = SaveRepoData(&moved)
+		case canonicalExists:
+			canonicalRecord.LocalPath = target
+			err = SaveRepoData(canonicalRecord)
+		}
+		if err != nil {
+			return "", err
+		}
+		detail = "mirror moved to " + target
+	case !fix && (dirExists(aliasPath) || exists):
+		return "", ErrAliasNeedsFix
+	case dirExists(aliasPath):
+		if exists && record.Status == RepoStatusOrphaned {
+			return "", fmt.Errorf("%w: alias mirror is orphaned", ErrAliasSkipped)
+		}
+		if !repoIsUsable(aliasPath) {
+			return "", fmt.Errorf("%w: alias mirror is not usable", ErrAliasSkipped)
+		}
+		copied, err := copyInternalRefs(aliasPath, targetPath)
+		if err != nil {
+			return "", err
+		}
+		if err := removeMirrorDir(aliasPath, userName, repoName); err != nil {
+			return "", err
+		}
+		removeEmptyParents(basedir, aliasPath)
+		InvalidatePackCache(canonical)
+		detail = "duplicate mirror removed"
+		if copied > 0 {
+			detail += fmt.Sprintf(", %d internal refs copied", copied)
+		}
+	}
+	if exists {
+		if detail == "" {
+			detail = "record without mirror removed"
+		}
+		if err := DeleteRepoData(userName, repoName); err != nil {
+			return "", err
+		}
+	}
+	InvalidatePackCache(alias)
+
+	sum, sumExists, err := GetSumData(userName, repoName)
+	if err != nil {
+		return "", err
+	}
+	if sumExists {
+		merged, ok, err := GetSumData(canonicalUser, canonicalRepo)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			merged = &schema.RepoSumData{RepoUser: canonicalUser, RepoName: canonicalRepo}
+		}
+		merged.CloneCount += sum.CloneCount
+		merged.RequestCount += sum.RequestCount
+		if err := SaveSumData(merged, canonicalUser, canonicalRepo); err != nil {
+			return "", err
+		}
+		if err := database.DB.DeleteSumData(userName, repoName); err != nil {
+			return "", err
+		}
+		if detail == "" {
+			detail = "sum record merged"
+		}
+	}
+	logInfo("仓库 '%s' 合并到 '%s': %s。\n", alias, canonical, detail)
+	return detail, nil
+}
+
+// copyInternalRefs 将别名镜像中的内部引用(InternalRefPrefix, 含快照)及其对象复制到规范名称的镜像, 返回复制的引用数.
+// 对象以硬链接(失败时复制)的方式加入规范镜像, 引用写入前检查两边的同名引用是否一致, 符号引用(快照的 HEAD)最后写入;
+// 别名为浅镜像或 blobless 镜像、使用规范镜像没有的对象池, 或同名引用不一致时返回 ErrAliasSkipped
+func copyInternalRefs(aliasPath string, targetPath string) (int, error) {
+	aliasRepo, err := openRepo(aliasPath)
+	if err != nil {
+		return 0, err
+	}
+	iter, err := aliasRepo.Storer.IterReferences()
+	if err != nil {
+		return 0, err
+	}
+	var internal []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), InternalRefPrefix) {
+			internal = append(internal, ref)
+		}
+		return nil
+	})
+	if err != nil || len(internal) == 0 {
+		return 0, err
+	}
+	if IsPartialRepo(aliasPath) {
+		return 0, fmt.Errorf("%w: partial alias mirror holds internal refs", ErrAliasSkipped)
+	}
+	aliasAlternates, err := AlternateObjectDirs(aliasPath)
+	if err != nil {
+		return 0, err
+	}
+	targetAlternates, err := AlternateObjectDirs(targetPath)
+	if err != nil {
+		return 0, err
+	}
+	for _, dir := range aliasAlternates {
+		if !slices.Contains(targetAlternates, dir) {
+			return 0, fmt.Errorf("%w: alias mirror uses object directory %s not shared by the canonical mirror", ErrAliasSkipped, dir)
+		}
+	}
+	repo, err := openRepo(targetPath)
+	if err != nil {
+		return 0, err
+	}
+	var copied []*plumbing.Reference
+	for _, ref := range internal {
+		existing, err := repo.Storer.Reference(ref.Name())
+		if err == nil {
+			if existing.String() != ref.String() {
+				return 0, fmt.Errorf("%w: ref %s differs from the canonical mirror", ErrAliasSkipped, ref.Name())
+			}
+			continue
+		}
+		copied = append(copied, ref)
+	}
+	if len(copied) == 0 {
+		return 0, nil
+	}
+	sort.SliceStable(copied, func(i, j int) bool {
+		return copied[i].Type() == plumbing.HashReference && copied[j].Type() != plumbing.HashReference
+	})
+
+	if err := linkObjects(filepath.Join(aliasPath, "objects"), filepath.Join(targetPath, "objects")); err != nil {
+		return 0, err
+	}
+	repo, err = openRepo(targetPath)
+	if err != nil {
+		return 0, err
+	}
+	for _, ref := range copied {
+		if ref.Type() != plumbing.HashReference {
+			continue
+		}
+		if _, err := repo.Storer.EncodedObject(plumbing.AnyObject, ref.Hash()); err != nil {
+			return 0, fmt.Errorf("object %s of ref %s not copied: %w", ref.Hash(), ref.Name(), err)
+		}
+	}
+	for _, ref := range copied {
+		if err := repo.Storer.SetReference(ref); err != nil {
+			return 0, err
+		}
+	}
+
+	// 快照的创建时间保存在配置中
+	aliasCfg, err := aliasRepo.Config()
+	if err == nil {
+		var cfg *gconfig.Config
+		cfg, err = repo.Config()
+		if err == nil {
+			section := cfg.Raw.Section(InternalNamespace)
+			for _, sub := range aliasCfg.Raw.Section(InternalNamespace).Subsections {
+				if !section.HasSubsection(sub.Name) {
+					for _, option := range sub.Options {
+						section.Subsection(sub.Name).AddOption(option.Key, option.Value)
+					}
+				}
+			}
+			err = repo.SetConfig(cfg)
+		}
+	}
+	if err != nil {
+		logWarning("copy snapshot time failed: %v, repo: %s\n", err, targetPath)
+	}
+	return len(copied), nil
+}
+
+// linkObjects 将 from 中的 pack 与松散对象硬链接到 to, 已存在的文件跳过; 硬链接失败时复制文件.
+// .idx 最后链接, 读取方只会看到完整的 pack
+func linkObjects(from string, to string) error {
+	packs, err := os.ReadDir(filepath.Join(from, "pack"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	sort.SliceStable(packs, func(i, j int) bool {
+		return filepath.Ext(packs[i].Name()) != ".idx" && filepath.Ext(packs[j].Name()) == ".idx"
+	})
+	for _, entry := range packs {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), "tmp_") {
+			continue
+		}
+		if err := linkObjectFile(filepath.Join(from, "pack", entry.Name()), filepath.Join(to, "pack", entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || len(entry.Name()) != 2 {
+			continue
+		}
+		objects, err := os.ReadDir(filepath.Join(from, entry.Name()))
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			if err := linkObjectFile(filepath.Join(from, entry.Name(), object.Name()), filepath.Join(to, entry.Name(), object.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// linkObjectFile 将对象文件硬链接到 to, 目标已存在时跳过, 跨文件系统等无法硬链接时经临时文件复制
+func linkObjectFile(from string, to string) error {
+	if fileExists(to) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(from, to); err == nil || errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(to), "tmp_obj_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), to)
+}
+
+// moveAliasDir 经暂存目录移动镜像, 大小写不敏感的文件系统上只改变大小写的 rename 可能不生效
+func moveAliasDir(basedir string, from string, to string) error {
+	if err := os.MkdirAll(stagingDir(basedir), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(stagingDir(basedir), "alias-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	moving := filepath.Join(tmp, "repo")
+	if err := os.Rename(from, moving); err != nil {
+		return err
+	}
+	removeEmptyParents(basedir, from)
+	err = os.MkdirAll(filepath.Dir(to), 0755)
+	if err == nil {
+		err = os.Rename(moving, to)
+	}
+	if err != nil {
+		// 放回原处, 避免随暂存目录删除
+		_ = os.MkdirAll(filepath.Dir(from), 0755)
+		return errors.Join(err, os.Rename(moving, from))
+	}
+	// 对象池的相对路径随目录层级改变
+	if err := relinkPoolAlternates(basedir, to); err != nil {
+		logWarning("relink object pool alternates failed: %v, path: %s\n", err, to)
+	}
+	return nil
+}
+
+// sameDir 判断两个路径是否为同一个目录
+func sameDir(a string, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
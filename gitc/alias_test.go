@@ -0,0 +1,134 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCanonicalRepoName(t *testing.T) {
+	for _, name := range [][4]string{
+		{"Foo", "Bar", "foo", "bar"},
+		{"foo", "bar.git", "foo", "bar"},
+		{"FOO", "Bar.GIT", "foo", "bar"},
+		{"foo", "bar.git.git", "foo", "bar.git"},
+		{"foo", ".github", "foo", ".github"},
+	} {
+		userName, repoName := CanonicalRepoName(name[0], name[1])
+		if userName != name[2] || repoName != name[3] {
+			t.Fatalf("canonical name of %s/%s: got %s/%s", name[0], name[1], userName, repoName)
+		}
+	}
+}
+
+// TestMergeRepoAliases 测试启动时只移动规范名称没有镜像的别名, 重复镜像由 fsck -fix 在复制快照后合并,
+// 孤立的别名跳过并报告, 拉取统计累加
+func TestMergeRepoAliases(t *testing.T) {
+	basedir, src, cfg := newTestMirror(t, "")
+	src.commit("first")
+
+	ctx := context.Background()
+	aliases := [][2]string{{"Owner", "Repo"}, {"owner", "repo.git"}}
+	for _, alias := range aliases {
+		if err := EnsureRepoReady(ctx, basedir, alias[0], alias[1], src.path, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := AddCloneCount(alias[0], alias[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 只有拉取统计的别名
+	if err := AddCloneCount("OWNER", "repo"); err != nil {
+		t.Fatal(err)
+	}
+	// 重复镜像中的快照在合并时保留
+	if _, err := CreateSnapshot(basedir, "owner", "repo.git", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	// 孤立的重复镜像
+	for _, name := range [][2]string{{"other", "repo"}, {"Other", "repo"}} {
+		if err := EnsureRepoReady(ctx, basedir, name[0], name[1], src.path, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orphaned, _, err := GetRepoData("Other", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphaned.Status = RepoStatusOrphaned
+	orphaned.OrphanedTime = time.Now()
+	if err := SaveRepoData(orphaned); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Fsck(ctx, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, issue := range report.Issues {
+		if issue.Kind == FsckRepoAlias {
+			found = append(found, issue.Repo)
+		}
+	}
+	if !slices.Equal(found, []string{"Other/repo", "Owner/Repo", "owner/repo.git", "OWNER/repo"}) {
+		t.Fatalf("unexpected alias issues: %v", found)
+	}
+
+	// 启动时的合并不删除镜像与记录
+	merged, err := MergeRepoAliases(ctx, cfg)
+	if err != nil || merged != 2 {
+		t.Fatalf("unexpected merge: %d, %v", merged, err)
+	}
+	dirs, err := repoDirs(basedir)
+	if err != nil || !slices.Equal(dirs, []string{"Other/repo", "other/repo", "owner/repo", "owner/repo.git"}) {
+		t.Fatalf("unexpected mirrors after boot merge: %v, %v", dirs, err)
+	}
+	if _, err := mergeRepoAlias(ctx, basedir, "owner", "repo.git", false); !errors.Is(err, ErrAliasNeedsFix) {
+		t.Fatalf("duplicate mirror merged without fix: %v", err)
+	}
+
+	report, err = Fsck(ctx, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixed, skipped []string
+	for _, issue := range report.Issues {
+		if issue.Fixed {
+			fixed = append(fixed, issue.Repo)
+		} else if issue.FixError != "" {
+			skipped = append(skipped, issue.Repo)
+		}
+	}
+	if !slices.Equal(fixed, []string{"owner/repo.git"}) || !slices.Equal(skipped, []string{"Other/repo"}) {
+		t.Fatalf("unexpected fsck fix: fixed %v, skipped %v", fixed, skipped)
+	}
+
+	localPath := filepath.Join(basedir, "owner", "repo")
+	record, ok, err := GetRepoData("owner", "repo")
+	if err != nil || !ok || record.LocalPath != localPath || !repoIsUsable(localPath) {
+		t.Fatalf("merged mirror not usable: %+v, %v", record, err)
+	}
+	if !SnapshotExists(localPath, "v1") {
+		t.Fatal("snapshot of the duplicate mirror lost")
+	}
+	if _, ok, _ := GetRepoData("owner", "repo.git"); ok {
+		t.Fatal("alias record left")
+	}
+	orphaned, ok, err = GetRepoData("Other", "repo")
+	if err != nil || !ok || orphaned.Status != RepoStatusOrphaned {
+		t.Fatalf("orphaned alias not kept: %+v, %v", orphaned, err)
+	}
+	dirs, err = repoDirs(basedir)
+	if err != nil || !slices.Equal(dirs, []string{"Other/repo", "other/repo", "owner/repo"}) {
+		t.Fatalf("unexpected mirrors after fix: %v, %v", dirs, err)
+	}
+	// 两个镜像克隆时各计数一次
+	sum, ok, err := GetSumData("owner", "repo")
+	if err != nil || !ok || sum.CloneCount != 5 {
+		t.Fatalf("sum records not merged: %+v, %v", sum, err)
+	}
+}
@@ -0,0 +1,82 @@
+package gitc
+
+import (
+	"context"
+	"sync"
+
+	"smart-git/config"
+)
+
+// ScheduleArtifacts 在仓库同步后按需于后台重新生成 bundle 与历史 pack;
+// 浅镜像与 blobless 镜像缺少对象, 不生成
+func ScheduleArtifacts(basedir string, userName string, repoName string, localPath string) {
+	if IsPartialRepo(localPath) {
+		return
+	}
+	ScheduleBundle(basedir, userName, repoName)
+	ScheduleHistoryPack(basedir, userName, repoName)
+}
+
+// generateLocked 在仓库共享锁下按镜像当前的路径执行 generate, 生成期间同步、维护与布局迁移等待其结束;
+// 等待期间镜像被删除或变为不完整的镜像时不生成
+func generateLocked(ctx context.Context, basedir string, userName string, repoName string, generate func(ctx context.Context, repo string, localPath string) error) error {
+	unlock, err := RLockRepo(ctx, userName, repoName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	localPath := RepoPath(basedir, userName, repoName)
+	if !repoIsUsable(localPath) {
+		return ErrRepoNotMirrored
+	}
+	if IsPartialRepo(localPath) {
+		return nil
+	}
+	return generate(ctx, userName+"/"+repoName, localPath)
+}
+
+// matchRepos 判断 owner/repo 是否匹配任一模式, 模式为空时全部匹配
+func matchRepos(patterns []string, userName string, repoName string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if config.MatchRepo(pattern, userName, repoName) {
+			return true
+		}
+	}
+	return false
+}
+
+// repoTasks 保证同一仓库同时只有一个后台生成任务
+type repoTasks struct {
+	mu      sync.Mutex
+	running map[string]struct{}
+}
+
+// start 在后台经上游任务队列以后台优先级执行 fn, 与 clone/fetch 共用并发名额, 交互式请求优先;
+// 该仓库已有任务在排队或运行时直接返回
+func (t *repoTasks) start(kind string, repo string, fn func(ctx context.Context) error) {
+	t.mu.Lock()
+	if _, ok := t.running[repo]; ok {
+		t.mu.Unlock()
+		return
+	}
+	if t.running == nil {
+		t.running = map[string]struct{}{}
+	}
+	t.running[repo] = struct{}{}
+	t.mu.Unlock()
+
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			delete(t.running, repo)
+			t.mu.Unlock()
+		}()
+		ctx := WithPriority(context.Background(), PriorityBackground)
+		if err := Jobs().Run(ctx, kind, repo, "", fn); err != nil {
+			logWarning("generate %s failed: %v, repo: %s\n", kind, err, repo)
+		}
+	}()
+}
@@ -0,0 +1,380 @@
+package gitc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"smart-git/config"
+
+	"github.com/go-git/go-git/v6"
+	gconfig "github.com/go-git/go-git/v6/config"
+	"github.com/go-git/go-git/v6/plumbing"
+)
+
+const (
+	BackendGoGit  = "go-git"
+	BackendSystem = "system"
+)
+
+// Backend 执行与上游同步相关的 clone/fetch 操作
+type Backend interface {
+	Name() string
+	// Clone 按 spec 将 repoURL 以 mirror 形式克隆到 localPath
+	Clone(ctx context.Context, localPath string, repoURL string, spec MirrorSpec) error
+	// Fetch 按 spec 从 origin 拉取引用并清理上游已删除的引用, 内部引用(InternalRefPrefix)保持不变,
+	// 已是最新时可以返回 git.NoErrAlreadyUpToDate
+	Fetch(ctx context.Context, localPath string, spec MirrorSpec) error
+	// FetchObjects 按对象 ID 从 origin 获取对象, 以 WantRefPrefix 下的内部引用保存, 浅镜像与 blobless 镜像沿用 spec 的深度与过滤规则
+	FetchObjects(ctx context.Context, localPath string, hashes []string, spec MirrorSpec) error
+}
+
+var (
+	backendMu     sync.RWMutex
+	activeBackend Backend = goGitBackend{}
+)
+
+// SetupBackend 根据配置选择 git 执行后端, 配置了 git 可执行文件时使用系统 git
+func SetupBackend(cfg *config.Config) error {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+
+	switch cfg.Git.Backend {
+	case "", BackendGoGit:
+		activeBackend = goGitBackend{}
+	case BackendSystem:
+		sys, err := NewSystemGit(cfg.Git.BinPath)
+		if err != nil {
+			return err
+		}
+		activeBackend = sys
+	default:
+		return fmt.Errorf("unknown git backend: %s", cfg.Git.Backend)
+	}
+	logInfo("git backend: %s\n", activeBackend.Name())
+	return nil
+}
+
+// CurrentBackend 返回当前使用的 git 执行后端
+func CurrentBackend() Backend {
+	backendMu.RLock()
+	defer backendMu.RUnlock()
+	return activeBackend
+}
+
+// SystemGitBackend 在使用系统 git 后端时返回它, 否则返回 nil
+func SystemGitBackend() *SystemGit {
+	sys, _ := CurrentBackend().(*SystemGit)
+	return sys
+}
+
+// goGitBackend 是纯 Go 的默认实现
+type goGitBackend struct{}
+
+func (goGitBackend) Name() string { return BackendGoGit }
+
+func (goGitBackend) Clone(ctx context.Context, localPath string, repoURL string, spec MirrorSpec) error {
+	if spec.IsFull() {
+		_, err := git.PlainCloneContext(ctx, localPath, &git.CloneOptions{
+			URL:      repoURL,
+			Progress: os.Stdout,
+			Mirror:   true,
+			Bare:     true,
+		})
+		return err
+	}
+
+	repo, err := git.PlainInit(localPath, true)
+	if err != nil {
+		return err
+	}
+	refSpecs := make([]gconfig.RefSpec, 0, len(spec.RefSpecs()))
+	for _, refSpec := range spec.RefSpecs() {
+		refSpecs = append(refSpecs, gconfig.RefSpec(refSpec))
+	}
+	remote, err := repo.CreateRemote(&gconfig.RemoteConfig{
+		Name:  "origin",
+		URLs:  []string{repoURL},
+		Fetch: refSpecs,
+	})
+	if err != nil {
+		return err
+	}
+
+	var remoteHead plumbing.ReferenceName
+	refs, err := remote.ListContext(ctx, &git.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			remoteHead = ref.Target()
+		}
+	}
+
+	if err := fetchGoGit(ctx, remote, spec); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+	return pointMirrorHead(localPath, remoteHead)
+}
+
+func (goGitBackend) Fetch(ctx context.Context, localPath string, spec MirrorSpec) error {
+	repo, err := git.PlainOpen(localPath)
+	if err != nil {
+		return err
+	}
+
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return err
+	}
+
+	return keepInternalRefs(localPath, func() error {
+		return fetchGoGit(ctx, remote, spec)
+	})
+}
+
+func (goGitBackend) FetchObjects(ctx context.Context, localPath string, hashes []string, spec MirrorSpec) error {
+	repo, err := git.PlainOpen(localPath)
+	if err != nil {
+		return err
+	}
+
+	refSpecs := make([]gconfig.RefSpec, 0, len(hashes))
+	for _, h := range hashes {
+		refSpecs = append(refSpecs, gconfig.RefSpec(h+":"+WantRefPrefix+h))
+	}
+
+	return repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   refSpecs,
+		Depth:      spec.Depth,
+		Progress:   os.Stdout,
+		Tags:       plumbing.NoTags,
+		Force:      true,
+	})
+}
+
+func fetchGoGit(ctx context.Context, remote *git.Remote, spec MirrorSpec) error {
+	refSpecs := make([]gconfig.RefSpec, 0, len(spec.RefSpecs()))
+	for _, refSpec := range spec.RefSpecs() {
+		refSpecs = append(refSpecs, gconfig.RefSpec(refSpec))
+	}
+	// 只镜像部分引用时不额外拉取 tag
+	tags := plumbing.AllTags
+	if !spec.AllRefs() {
+		tags = plumbing.NoTags
+	}
+
+	return remote.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   refSpecs,
+		Depth:      spec.Depth,
+		Prune:      true,
+		Progress:   os.Stdout,
+		Tags:       tags,
+		Force:      true,
+	})
+}
+
+// SystemGit 通过调用系统 git 可执行文件完成同步与 upload-pack
+type SystemGit struct {
+	Path string
+}
+
+// NewSystemGit 查找并校验 git 可执行文件, binPath 为空时从 PATH 中查找
+func NewSystemGit(binPath string) (*SystemGit, error) {
+	if binPath == "" {
+		binPath = "git"
+	}
+	resolved, err := exec.LookPath(binPath)
+	if err != nil {
+		return nil, fmt.Errorf("git binary not found: %w", err)
+	}
+	return &SystemGit{Path: resolved}, nil
+}
+
+func (g *SystemGit) Name() string { return BackendSystem }
+
+// Command 构造一个在 dir 中执行的 git 命令, 并禁用交互式凭据提示
+func (g *SystemGit) Command(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, g.Path, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	return cmd
+}
+
+// Run 执行 git 命令, 失败时在错误中附带 stderr
+func (g *SystemGit) Run(ctx context.Context, dir string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := g.Command(ctx, dir, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Output 执行 git 命令并返回 stdout, stdin 为 nil 时不提供输入
+func (g *SystemGit) Output(ctx context.Context, dir string, stdin io.Reader, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := g.Command(ctx, dir, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (g *SystemGit) Clone(ctx context.Context, localPath string, repoURL string, spec MirrorSpec) error {
+	if spec.IsFull() {
+		return g.Run(ctx, "", "clone", "--mirror", "--", repoURL, localPath)
+	}
+
+	if err := g.Run(ctx, "", "init", "--quiet", "--bare", "--", localPath); err != nil {
+		return err
+	}
+	if err := g.Run(ctx, localPath, "config", "remote.origin.url", repoURL); err != nil {
+		return err
+	}
+	for _, refSpec := range spec.RefSpecs() {
+		if err := g.Run(ctx, localPath, "config", "--add", "remote.origin.fetch", refSpec); err != nil {
+			return err
+		}
+	}
+
+	// 输出形如 "ref: refs/heads/main\tHEAD"
+	var remoteHead plumbing.ReferenceName
+	out, err := g.Output(ctx, localPath, nil, "ls-remote", "--symref", "origin", "HEAD")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if target, ok := strings.CutPrefix(line, "ref: "); ok {
+			remoteHead = plumbing.ReferenceName(strings.TrimSuffix(target, "\tHEAD"))
+		}
+	}
+
+	if err := g.Fetch(ctx, localPath, spec); err != nil {
+		return err
+	}
+	return pointMirrorHead(localPath, remoteHead)
+}
+
+func (g *SystemGit) Fetch(ctx context.Context, localPath string, spec MirrorSpec) error {
+	args := []string{"fetch", "--prune", "--force"}
+	if !spec.AllRefs() {
+		args = append(args, "--no-tags")
+	}
+	if spec.Depth > 0 {
+		args = append(args, "--depth="+strconv.Itoa(spec.Depth))
+	}
+	if spec.Blobless {
+		args = append(args, "--filter=blob:none")
+	}
+	args = append(args, "origin")
+	args = append(args, spec.RefSpecs()...)
+	return keepInternalRefs(localPath, func() error {
+		return g.Run(ctx, localPath, args...)
+	})
+}
+
+func (g *SystemGit) FetchObjects(ctx context.Context, localPath string, hashes []string, spec MirrorSpec) error {
+	args := []string{"fetch", "--no-tags", "--no-write-fetch-head", "--recurse-submodules=no"}
+	if spec.Depth > 0 {
+		args = append(args, "--depth="+strconv.Itoa(spec.Depth))
+	}
+	if spec.Blobless {
+		args = append(args, "--filter=blob:none")
+	}
+	args = append(args, "origin")
+	for _, h := range hashes {
+		args = append(args, h+":"+WantRefPrefix+h)
+	}
+	return g.Run(ctx, localPath, args...)
+}
+
+// missingObjects 返回 oids 中本地不存在的对象; 关闭 promisor 以免 cat-file 逐个按需获取
+func (g *SystemGit) missingObjects(ctx context.Context, localPath string, oids []string) ([]string, error) {
+	out, err := g.Output(ctx, localPath, strings.NewReader(strings.Join(oids, "\n")+"\n"),
+		"-c", "remote.origin.promisor=false", "cat-file", "--batch-check=%(objectname)")
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if oid, ok := strings.CutSuffix(line, " missing"); ok {
+			missing = append(missing, oid)
+		}
+	}
+	return missing, nil
+}
+
+// UploadPack 以 stateless-rpc 模式运行 git upload-pack,
+// advertise 为 true 时仅输出引用广告, 广告与 ls-refs 结果只包含 view 中可见的引用
+func (g *SystemGit) UploadPack(ctx context.Context, repoPath string, version string, advertise bool, view RefView, r io.Reader, w io.Writer) error {
+	// 允许 partial clone 的 filter 以及之后按对象 ID 补取缺失对象
+	args := []string{
+		"-c", "uploadpack.allowFilter=true",
+		"-c", "uploadpack.allowAnySHA1InWant=true",
+		"-c", "uploadpack.hideRefs=" + strings.TrimSuffix(InternalRefPrefix, "/"),
+	}
+	for _, hideRef := range view.HideRefs {
+		args = append(args, "-c", "uploadpack.hideRefs="+hideRef)
+	}
+	args = append(args, "upload-pack", "--stateless-rpc")
+	if advertise {
+		args = append(args, "--advertise-refs")
+	}
+	args = append(args, repoPath)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := g.Command(ctx, "", args...)
+	if version != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+version)
+	}
+	if view.Namespace != "" {
+		cmd.Env = append(cmd.Env, "GIT_NAMESPACE="+view.Namespace)
+	}
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// 优先使用 w 的 ReadFrom, 以便 flushResponseWriter 逐块 flush 输出
+	var copyErr error
+	if rf, ok := w.(io.ReaderFrom); ok {
+		_, copyErr = rf.ReadFrom(stdout)
+	} else {
+		_, copyErr = io.Copy(w, stdout)
+	}
+	if copyErr != nil {
+		cancel()
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if copyErr != nil {
+			return fmt.Errorf("git upload-pack: %w", copyErr)
+		}
+		return fmt.Errorf("git upload-pack: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return copyErr
+}
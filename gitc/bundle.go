@@ -0,0 +1,122 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"smart-git/config"
+)
+
+const bundleExt = ".bundle"
+
+// BundleStore 在仓库同步后于后台生成 git bundle, 供客户端通过 bundle-uri 预先下载
+type BundleStore struct {
+	dir      string
+	interval time.Duration
+	patterns []string
+	git      *SystemGit
+	tasks    repoTasks
+}
+
+var (
+	bundleMu     sync.RWMutex
+	activeBundle *BundleStore
+)
+
+// SetupBundles 根据配置初始化全局 bundle 存储, 未启用时清空; 生成 bundle 依赖系统 git 后端
+func SetupBundles(cfg *config.Config) error {
+	bundleMu.Lock()
+	defer bundleMu.Unlock()
+
+	if !cfg.Bundle.Enabled {
+		activeBundle = nil
+		return nil
+	}
+	if cfg.Bundle.Dir == "" {
+		return errors.New("bundle.dir is required when bundle is enabled")
+	}
+	sys := SystemGitBackend()
+	if sys == nil {
+		return errors.New("bundle requires git.backend = \"system\"")
+	}
+	if err := os.MkdirAll(cfg.Bundle.Dir, 0755); err != nil {
+		return err
+	}
+	activeBundle = &BundleStore{
+		dir:      cfg.Bundle.Dir,
+		interval: cfg.Bundle.Interval,
+		patterns: cfg.Bundle.Repos,
+		git:      sys,
+	}
+	return nil
+}
+
+// CurrentBundles 返回全局 bundle 存储, 未启用时返回 nil
+func CurrentBundles() *BundleStore {
+	bundleMu.RLock()
+	defer bundleMu.RUnlock()
+	return activeBundle
+}
+
+// ScheduleBundle 在需要时于后台为 repo(owner/name)重新生成 bundle
+func ScheduleBundle(basedir string, userName string, repoName string) {
+	store := CurrentBundles()
+	if store == nil || !store.Enabled(userName, repoName) {
+		return
+	}
+	store.schedule(basedir, userName, repoName)
+}
+
+// Enabled 判断 owner/repo 是否需要生成 bundle
+func (s *BundleStore) Enabled(userName string, repoName string) bool {
+	return matchRepos(s.patterns, userName, repoName)
+}
+
+// Path 返回 repo(owner/name)的 bundle 文件路径
+func (s *BundleStore) Path(repo string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(repo)+bundleExt)
+}
+
+// Stat 返回已生成 bundle 的文件信息, 不存在时返回错误
+func (s *BundleStore) Stat(repo string) (os.FileInfo, error) {
+	return os.Stat(s.Path(repo))
+}
+
+func (s *BundleStore) schedule(basedir string, userName string, repoName string) {
+	repo := userName + "/" + repoName
+	if info, err := s.Stat(repo); err == nil && time.Since(info.ModTime()) < s.interval {
+		return
+	}
+	s.tasks.start(JobKindBundle, repo, func(ctx context.Context) error {
+		return generateLocked(ctx, basedir, userName, repoName, s.Generate)
+	})
+}
+
+// Generate 用 git bundle create 生成包含全部引用(不含内部引用)的 bundle, 完成后原子替换旧文件; 调用方需持有仓库锁
+func (s *BundleStore) Generate(ctx context.Context, repo string, localPath string) error {
+	path := s.Path(repo)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*"+bundleExt)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+
+	if err := s.git.Run(ctx, localPath, "bundle", "create", "--quiet", tmpPath, "--exclude="+InternalRefPrefix+"*", "--all"); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	logInfo("bundle generated for %s\n", repo)
+	return nil
+}
@@ -3,9 +3,9 @@ package gitc
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
-	"sync"
 	"time"
 
 	"smart-git/config"
@@ -13,8 +13,6 @@ import (
 
 	"github.com/WJQSERVER-STUDIO/logger"
 	"github.com/go-git/go-git/v6"
-	gconfig "github.com/go-git/go-git/v6/config"
-	"github.com/go-git/go-git/v6/plumbing"
 )
 
 var (
@@ -24,25 +22,23 @@ var (
 	logInfo    = logger.LogInfo
 	logWarning = logger.LogWarning
 	logError   = logger.LogError
-
-	repoLocksMu sync.Mutex
-	repoLocks   = map[string]*repoLockEntry{}
 )
 
-type repoLockEntry struct {
-	mu   sync.Mutex
-	refs int
-}
-
 func EnsureRepoReady(ctx context.Context, basedir string, userName string, repoName string, repoURL string, cfg *config.Config) error {
-	lockKey := userName + "/" + repoName
-	lock := acquireRepoLock(lockKey)
-	defer releaseRepoLock(lockKey, lock)
+	unlock, err := lockRepo(ctx, userName, repoName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	return syncRepoLocked(ctx, basedir, userName, repoName, repoURL, cfg)
 }
 
 func RecoverPendingRepos(cfg *config.Config) error {
+	if err := cleanStagingDir(cfg.Server.BaseDir); err != nil {
+		return err
+	}
+
 	records, err := GetAllRepoData()
 	if err != nil {
 		return err
@@ -54,6 +50,13 @@ func RecoverPendingRepos(cfg *config.Config) error {
 		}
 
 		if repoIsUsable(record.LocalPath) {
+			usable, err := verifyInterruptedRepo(cfg.Server.BaseDir, record)
+			if err != nil {
+				return err
+			}
+			if !usable {
+				continue
+			}
 			headHash, err := LocalHeadHash(record.LocalPath)
 			if err != nil {
 				logError("recover pending repo head failed: %v, repo: %s/%s\n", err, record.RepoUser, record.RepoName)
@@ -78,7 +81,7 @@ func RecoverPendingRepos(cfg *config.Config) error {
 }
 
 func syncRepoLocked(ctx context.Context, basedir string, userName string, repoName string, repoURL string, cfg *config.Config) error {
-	localPath := filepath.Join(basedir, userName, repoName)
+	localPath := RepoPath(basedir, userName, repoName)
 	repoData, exists, err := GetRepoData(userName, repoName)
 	if err != nil {
 		return err
@@ -90,34 +93,50 @@ func syncRepoLocked(ctx context.Context, basedir string, userName string, repoNa
 
 	if exists && repoData.Status == RepoStatusPending {
 		if repoIsUsable(localPath) {
-			return finalizeSyncedRepo(localPath, repoURL, userName, repoName, cfg.Cache.ExpireEx)
-		}
-		if err := removeRepoArtifacts(*repoData); err != nil {
+			usable, err := verifyInterruptedRepo(basedir, *repoData)
+			if err != nil {
+				return err
+			}
+			if usable {
+				return finalizeSyncedRepo(basedir, localPath, repoURL, userName, repoName, cfg.Cache.ExpireEx)
+			}
+		} else if err := removeRepoArtifacts(*repoData); err != nil {
 			return err
 		}
 		repoData = nil
 		exists = false
 	}
 
+	// orphaned 镜像是上游唯一留存的副本, 不删除也不重建
+	if exists && repoData.Status == RepoStatusOrphaned {
+		if !repoIsUsable(localPath) {
+			return fmt.Errorf("orphaned mirror %s is not usable", localPath)
+		}
+		if repoData.ExpireTime.After(time.Now()) {
+			return nil
+		}
+		return refreshExistingRepo(ctx, basedir, localPath, repoURL, userName, repoName, cfg, repoData)
+	}
+
 	if exists && repoIsUsable(localPath) {
 		if repoData.Status != RepoStatusSynced {
-			return finalizeSyncedRepo(localPath, repoURL, userName, repoName, cfg.Cache.ExpireEx)
+			return finalizeSyncedRepo(basedir, localPath, repoURL, userName, repoName, cfg.Cache.ExpireEx)
 		}
 		if repoData.ExpireTime.After(time.Now()) {
 			logInfo("仓库 '%s' 已经存在且在有效期内。\n", localPath)
 			return nil
 		}
-		return refreshExistingRepo(ctx, localPath, repoURL, userName, repoName, cfg, repoData)
+		return refreshExistingRepo(ctx, basedir, localPath, repoURL, userName, repoName, cfg, repoData)
 	}
 
 	if !exists && repoIsUsable(localPath) {
 		logWarning("仓库 '%s' 存在但缺少元数据，自动修复记录。\n", localPath)
-		return finalizeSyncedRepo(localPath, repoURL, userName, repoName, cfg.Cache.ExpireEx)
+		return finalizeSyncedRepo(basedir, localPath, repoURL, userName, repoName, cfg.Cache.ExpireEx)
 	}
 
 	if stat, statErr := os.Stat(localPath); statErr == nil && stat.IsDir() {
 		logWarning("仓库目录 '%s' 存在但不可用，准备重建。\n", localPath)
-		if err := os.RemoveAll(localPath); err != nil {
+		if err := removeMirrorDir(localPath, userName, repoName); err != nil {
 			return err
 		}
 	}
@@ -136,11 +155,9 @@ func syncRepoLocked(ctx context.Context, basedir string, userName string, repoNa
 		return err
 	}
 
-	_, err = git.PlainCloneContext(ctx, localPath, &git.CloneOptions{
-		URL:      repoURL,
-		Progress: os.Stdout,
-		Mirror:   true,
-		Bare:     true,
+	spec := MirrorFor(userName, repoName)
+	err = Jobs().Run(ctx, JobKindClone, userName+"/"+repoName, repoURL, func(ctx context.Context) error {
+		return cloneStaged(ctx, basedir, localPath, repoURL, spec)
 	})
 	if err != nil {
 		cleanupErr := cleanupFailedClone(userName, repoName, localPath)
@@ -151,47 +168,40 @@ func syncRepoLocked(ctx context.Context, basedir string, userName string, repoNa
 		return err
 	}
 
+	joinPoolLogged(ctx, basedir, userName, repoName, localPath)
 	if err := AddCloneCount(userName, repoName); err != nil {
 		return err
 	}
 
-	return finalizeSyncedRepo(localPath, repoURL, userName, repoName, cfg.Cache.Expire)
+	return finalizeSyncedRepo(basedir, localPath, repoURL, userName, repoName, cfg.Cache.Expire)
 }
 
-func refreshExistingRepo(ctx context.Context, localPath string, repoURL string, userName string, repoName string, cfg *config.Config, repoData *schema.RepoData) error {
-	if err := SavePendingRepoData(repoURL, userName, repoName, localPath); err != nil {
-		return err
+func refreshExistingRepo(ctx context.Context, basedir string, localPath string, repoURL string, userName string, repoName string, cfg *config.Config, repoData *schema.RepoData) error {
+	// orphaned 镜像同步期间保持原状态, 中断后不会被当作未完成的克隆清理
+	orphaned := repoData.Status == RepoStatusOrphaned
+	if !orphaned {
+		if err := SavePendingRepoData(repoURL, userName, repoName, localPath); err != nil {
+			return err
+		}
 	}
 
-	repo, err := git.PlainOpen(localPath)
+	repo, err := openRepo(localPath)
 	if err != nil {
-		cleanupErr := DeleteRepoData(repoData.RepoUser, repoData.RepoName)
-		if cleanupErr != nil {
-			return errors.Join(err, cleanupErr)
-		}
-		return err
+		return discardRepoData(repoData, err)
 	}
 
-	remote, err := repo.Remote("origin")
-	if err != nil {
-		cleanupErr := DeleteRepoData(repoData.RepoUser, repoData.RepoName)
-		if cleanupErr != nil {
-			return errors.Join(err, cleanupErr)
-		}
-		return err
+	if _, err := repo.Remote("origin"); err != nil {
+		return discardRepoData(repoData, err)
 	}
 
-	fetchErr := remote.FetchContext(ctx, &git.FetchOptions{
-		RemoteName: "origin",
-		RefSpecs: []gconfig.RefSpec{
-			gconfig.RefSpec("+refs/*:refs/*"),
-		},
-		Prune:    true,
-		Progress: os.Stdout,
-		Tags:     plumbing.AllTags,
-		Force:    true,
+	fetchErr := Jobs().Run(ctx, JobKindFetch, userName+"/"+repoName, repoURL, func(ctx context.Context) error {
+		return fetchStaged(ctx, basedir, localPath, syncSpec(localPath, MirrorFor(userName, repoName)))
 	})
 	if fetchErr != nil && !errors.Is(fetchErr, git.NoErrAlreadyUpToDate) {
+		// 上游被删除或转为私有时保留镜像, orphaned 镜像遇到临时错误时也继续提供已有内容
+		if orphaned || isUpstreamGone(fetchErr) {
+			return markRepoOrphaned(repoData, cfg.Cache.Expire, fetchErr)
+		}
 		restoreErr := restoreSyncedRepoData(repoData, cfg.Cache.ExpireEx)
 		if restoreErr != nil {
 			return errors.Join(fetchErr, restoreErr)
@@ -199,6 +209,11 @@ func refreshExistingRepo(ctx context.Context, localPath string, repoURL string,
 		logError("fetch 仓库 '%s' 失败: %v\n", repoURL, fetchErr)
 		return fetchErr
 	}
+	if orphaned {
+		logInfo("仓库 '%s/%s' 的上游已恢复访问。\n", userName, repoName)
+		repoData.OrphanedTime = time.Time{}
+	}
+	joinPoolLogged(ctx, basedir, userName, repoName, localPath)
 
 	localHeadHash, err := LocalHeadHash(localPath)
 	if err != nil {
@@ -211,22 +226,48 @@ func refreshExistingRepo(ctx context.Context, localPath string, repoURL string,
 
 	if errors.Is(fetchErr, git.NoErrAlreadyUpToDate) || localHeadHash == repoData.RepoCommitHash {
 		logInfo("仓库 '%s' 经过 fetch 检查后仍是最新。\n", localPath)
+		// HEAD 未变时其它分支与 tag 仍可能被更新或改写
+		if fetchErr == nil {
+			if err := recordRefJournal(localPath, userName, repoName); err != nil {
+				logWarning("record ref journal failed: %v, repo: %s/%s\n", err, userName, repoName)
+			}
+		}
+		ScheduleArtifacts(basedir, userName, repoName, localPath)
 		return ExtendRepoExpire(repoData, cfg.Cache.ExpireEx)
 	}
 
-	return finalizeSyncedRepo(localPath, repoURL, userName, repoName, cfg.Cache.Expire)
+	return finalizeSyncedRepo(basedir, localPath, repoURL, userName, repoName, cfg.Cache.Expire)
 }
 
-func finalizeSyncedRepo(localPath string, repoURL string, userName string, repoName string, expire time.Duration) error {
+func finalizeSyncedRepo(basedir string, localPath string, repoURL string, userName string, repoName string, expire time.Duration) error {
 	headHash, err := LocalHeadHash(localPath)
 	if err != nil {
 		return err
 	}
-	return SaveSyncedRepoData(repoURL, userName, repoName, localPath, headHash, expire)
+	if err := SaveSyncedRepoData(repoURL, userName, repoName, localPath, headHash, expire); err != nil {
+		return err
+	}
+	if err := recordRefJournal(localPath, userName, repoName); err != nil {
+		logWarning("record ref journal failed: %v, repo: %s/%s\n", err, userName, repoName)
+	}
+	InvalidatePackCache(userName + "/" + repoName)
+	ScheduleArtifacts(basedir, userName, repoName, localPath)
+	return nil
+}
+
+// discardRepoData 在镜像无法打开时删除仓库记录以便下次重建; orphaned 镜像只返回错误
+func discardRepoData(repoData *schema.RepoData, err error) error {
+	if repoData.Status == RepoStatusOrphaned {
+		return err
+	}
+	if cleanupErr := DeleteRepoData(repoData.RepoUser, repoData.RepoName); cleanupErr != nil {
+		return errors.Join(err, cleanupErr)
+	}
+	return err
 }
 
 func LocalHeadHash(repoPath string) (string, error) {
-	repo, err := git.PlainOpen(repoPath)
+	repo, err := openRepo(repoPath)
 	if err != nil {
 		return "", err
 	}
@@ -244,7 +285,7 @@ func repoIsUsable(repoPath string) bool {
 	if _, err := os.Stat(repoPath); err != nil {
 		return false
 	}
-	repo, err := git.PlainOpen(repoPath)
+	repo, err := openRepo(repoPath)
 	if err != nil {
 		return false
 	}
@@ -253,7 +294,7 @@ func repoIsUsable(repoPath string) bool {
 
 func removeRepoArtifacts(repoData schema.RepoData) error {
 	if repoData.LocalPath != "" {
-		if err := os.RemoveAll(repoData.LocalPath); err != nil {
+		if err := removeMirrorDir(repoData.LocalPath, repoData.RepoUser, repoData.RepoName); err != nil {
 			return err
 		}
 	}
@@ -277,28 +318,3 @@ func cleanupFailedClone(repoUser, repoName, localPath string) error {
 	}
 	return cleanupErr
 }
-
-func acquireRepoLock(key string) *repoLockEntry {
-	repoLocksMu.Lock()
-	entry, ok := repoLocks[key]
-	if !ok {
-		entry = &repoLockEntry{}
-		repoLocks[key] = entry
-	}
-	entry.refs++
-	repoLocksMu.Unlock()
-
-	entry.mu.Lock()
-	return entry
-}
-
-func releaseRepoLock(key string, entry *repoLockEntry) {
-	entry.mu.Unlock()
-
-	repoLocksMu.Lock()
-	entry.refs--
-	if entry.refs == 0 {
-		delete(repoLocks, key)
-	}
-	repoLocksMu.Unlock()
-}
@@ -9,6 +9,8 @@ import (
 const (
 	RepoStatusPending = "pending"
 	RepoStatusSynced  = "synced"
+	// RepoStatusOrphaned 表示上游已被删除或转为私有, 镜像保留并以只读方式继续提供
+	RepoStatusOrphaned = "orphaned"
 )
 
 func SaveRepoData(data *schema.RepoData) error {
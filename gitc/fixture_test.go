@@ -0,0 +1,110 @@
+package gitc
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"smart-git/config"
+	"smart-git/database"
+	"smart-git/database/bolt"
+
+	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/object"
+)
+
+// forEachBackend 分别以 go-git 与系统 git(已安装时)运行 fn
+func forEachBackend(t *testing.T, fn func(t *testing.T, backend string)) {
+	backends := []string{BackendGoGit}
+	if _, err := exec.LookPath("git"); err == nil {
+		backends = append(backends, BackendSystem)
+	}
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			fn(t, backend)
+		})
+	}
+}
+
+// requireGit 在没有安装 git 时跳过测试
+func requireGit(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+}
+
+// testUpstream 为测试用的上游仓库
+type testUpstream struct {
+	t    *testing.T
+	path string
+	repo *git.Repository
+	wt   *git.Worktree
+}
+
+// newTestUpstream 在 path 初始化上游仓库
+func newTestUpstream(t *testing.T, path string) *testUpstream {
+	t.Helper()
+	repo, err := git.PlainInit(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testUpstreamOf(t, path, repo)
+}
+
+// testUpstreamOf 包装已有的非裸仓库
+func testUpstreamOf(t *testing.T, path string, repo *git.Repository) *testUpstream {
+	t.Helper()
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testUpstream{t: t, path: path, repo: repo, wt: wt}
+}
+
+// commit 创建空提交
+func (u *testUpstream) commit(msg string) plumbing.Hash {
+	u.t.Helper()
+	h, err := u.wt.Commit(msg, &git.CommitOptions{
+		AllowEmptyCommits: true,
+		Author:            &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	return h
+}
+
+// commitFile 以 content 覆盖 file 后提交
+func (u *testUpstream) commitFile(content string) plumbing.Hash {
+	u.t.Helper()
+	if err := os.WriteFile(filepath.Join(u.path, "file"), []byte(content), 0644); err != nil {
+		u.t.Fatal(err)
+	}
+	if _, err := u.wt.Add("file"); err != nil {
+		u.t.Fatal(err)
+	}
+	return u.commit(content)
+}
+
+// newTestMirror 在临时目录中打开数据库并初始化上游仓库 src, 返回 BaseDir、上游仓库与使用 backend 的配置;
+// backend 为空时不设置后端. 测试结束时关闭数据库并恢复默认后端
+func newTestMirror(t *testing.T, backend string) (string, *testUpstream, *config.Config) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	database.DB = bolt.OpenDatabase(filepath.Join(tmpDir, "db"))
+	t.Cleanup(func() { database.DB.Close() })
+	cfg := config.DefaultConfig()
+	cfg.Server.BaseDir = filepath.Join(tmpDir, "repos")
+	if backend != "" {
+		cfg.Git.Backend = backend
+		if err := SetupBackend(cfg); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = SetupBackend(config.DefaultConfig()) })
+	}
+	return cfg.Server.BaseDir, newTestUpstream(t, filepath.Join(tmpDir, "src")), cfg
+}
@@ -0,0 +1,332 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"smart-git/config"
+	"smart-git/database"
+)
+
+// fsck 发现的不一致类型
+const (
+	FsckOrphanedDir       = "orphaned-dir"        // BaseDir 中的仓库目录没有记录
+	FsckMissingPath       = "missing-path"        // 记录指向的镜像不存在或不可用
+	FsckLocalPathMismatch = "local-path-mismatch" // 记录的 LocalPath 不在当前 BaseDir 下
+	FsckStaleCommit       = "stale-commit"        // 记录的 RepoCommitHash 与镜像的 HEAD 不一致
+	FsckOrphanedSum       = "orphaned-sum"        // 拉取统计没有对应的仓库
+	FsckOrphanedPool      = "orphaned-pool"       // 对象池已没有成员
+	FsckPoolAlternates    = "pool-alternates"     // 对象池成员的 alternates 没有指向当前 BaseDir 下的对象池
+	FsckRepoAlias         = "repo-alias"          // 以非规范名称(大小写不同或带 .git 后缀)保存的仓库
+)
+
+// FsckIssue 为一项不一致, Fixed 表示已修复
+type FsckIssue struct {
+	Kind     string
+	Repo     string
+	Path     string
+	Detail   string
+	Fixed    bool
+	FixError string
+}
+
+// FsckReport 为一次 fsck 的结果
+type FsckReport struct {
+	Records int
+	Dirs    int
+	Sums    int
+	Pools   int
+	Issues  []FsckIssue
+}
+
+// Unfixed 返回未修复的不一致数量
+func (r *FsckReport) Unfixed() int {
+	n := 0
+	for _, issue := range r.Issues {
+		if !issue.Fixed {
+			n++
+		}
+	}
+	return n
+}
+
+// Fsck 核对 BaseDir 中的镜像目录与数据库中的仓库记录、拉取统计, fix 为 true 时修复:
+//   - 没有记录的可用镜像按 origin 地址补写记录, 不可用的目录移入隔离目录
+//   - 记录指向的镜像不存在或不可用时删除记录, 下次请求时重新克隆
+//   - LocalPath 与当前 BaseDir 不一致且镜像在当前位置可用时更新 LocalPath
+//   - RepoCommitHash 与镜像 HEAD 不一致时更新为 HEAD
+//   - 删除既没有记录也没有镜像的拉取统计
+//   - 对象池成员的 alternates 指向 BaseDir 移动前的位置时改写为当前对象池的相对路径
+//   - 删除已没有成员的对象池; alternates 仍指向该网络(不论位于哪个根目录)的镜像都是成员
+//   - 将非规范名称的镜像、记录与拉取统计合并到规范名称
+//
+// 每个仓库在检查期间持有仓库锁(修复时为独占锁), 可以在服务运行时执行
+func Fsck(ctx context.Context, cfg *config.Config, fix bool) (*FsckReport, error) {
+	basedir := cfg.Server.BaseDir
+	report := &FsckReport{}
+
+	records, err := GetAllRepoData()
+	if err != nil {
+		return nil, err
+	}
+	report.Records = len(records)
+	dirs, err := repoDirs(basedir)
+	if err != nil {
+		return nil, err
+	}
+	report.Dirs = len(dirs)
+
+	keys := map[string]bool{}
+	for _, record := range records {
+		keys[record.RepoUser+"/"+record.RepoName] = true
+	}
+	for _, dir := range dirs {
+		keys[dir] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		userName, repoName, _ := strings.Cut(key, "/")
+		if !IsCanonicalRepoName(userName, repoName) {
+			report.Issues = append(report.Issues, fsckAlias(ctx, basedir, userName, repoName, fix))
+			continue
+		}
+		issues, err := fsckRepo(ctx, cfg, userName, repoName, fix)
+		if err != nil {
+			return nil, fmt.Errorf("fsck %s: %w", key, err)
+		}
+		report.Issues = append(report.Issues, issues...)
+	}
+
+	sums, err := database.DB.GetAllSumData()
+	if err != nil {
+		return nil, err
+	}
+	report.Sums = len(sums)
+	for _, sum := range sums {
+		if !IsCanonicalRepoName(sum.RepoUser, sum.RepoName) {
+			if !keys[sum.RepoUser+"/"+sum.RepoName] {
+				report.Issues = append(report.Issues, fsckAlias(ctx, basedir, sum.RepoUser, sum.RepoName, fix))
+			}
+			continue
+		}
+		_, exists, err := GetRepoData(sum.RepoUser, sum.RepoName)
+		if err != nil {
+			return nil, err
+		}
+		localPath := RepoPath(basedir, sum.RepoUser, sum.RepoName)
+		if exists || dirExists(localPath) {
+			continue
+		}
+		issue := FsckIssue{
+			Kind:   FsckOrphanedSum,
+			Repo:   sum.RepoUser + "/" + sum.RepoName,
+			Detail: fmt.Sprintf("clone count %d, request count %d", sum.CloneCount, sum.RequestCount),
+		}
+		if fix {
+			issue.fix(database.DB.DeleteSumData(sum.RepoUser, sum.RepoName))
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	networks, err := ObjectPoolNetworks(basedir)
+	if err != nil {
+		return nil, err
+	}
+	report.Pools = len(networks)
+	for _, network := range networks {
+		members, err := poolMembers(basedir, network)
+		if err != nil {
+			return nil, err
+		}
+		if len(members) > 0 {
+			continue
+		}
+		issue := FsckIssue{Kind: FsckOrphanedPool, Repo: poolDirName + "/" + network, Path: poolPath(basedir, network), Detail: "object pool has no members"}
+		if fix {
+			issue.fix(removeEmptyPool(ctx, basedir, network))
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	for _, issue := range report.Issues {
+		if issue.Fixed {
+			logInfo("fsck fixed %s: %s, %s\n", issue.Kind, issue.Repo, issue.Detail)
+		} else {
+			logWarning("fsck found %s: %s, %s %s\n", issue.Kind, issue.Repo, issue.Detail, issue.FixError)
+		}
+	}
+	return report, nil
+}
+
+func (i *FsckIssue) fix(err error) {
+	if err != nil {
+		i.FixError = err.Error()
+		return
+	}
+	i.Fixed = true
+}
+
+// fsckAlias 报告以非规范名称保存的仓库, fix 为 true 时合并到规范名称
+func fsckAlias(ctx context.Context, basedir string, userName string, repoName string, fix bool) FsckIssue {
+	canonicalUser, canonicalRepo := CanonicalRepoName(userName, repoName)
+	issue := FsckIssue{
+		Kind:   FsckRepoAlias,
+		Repo:   userName + "/" + repoName,
+		Path:   RepoPath(basedir, userName, repoName),
+		Detail: "alias of " + canonicalUser + "/" + canonicalRepo,
+	}
+	if fix {
+		detail, err := mergeRepoAlias(ctx, basedir, userName, repoName, true)
+		if err == nil {
+			issue.Detail += ", " + detail
+		}
+		issue.fix(err)
+	}
+	return issue
+}
+
+// fsckRepo 在仓库锁下核对一个仓库的记录与镜像目录
+func fsckRepo(ctx context.Context, cfg *config.Config, userName string, repoName string, fix bool) ([]FsckIssue, error) {
+	var unlock func()
+	var err error
+	if fix {
+		unlock, err = lockRepo(ctx, userName, repoName)
+	} else {
+		unlock, err = RLockRepo(ctx, userName, repoName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	basedir := cfg.Server.BaseDir
+	key := userName + "/" + repoName
+	localPath := RepoPath(basedir, userName, repoName)
+	record, exists, err := GetRepoData(userName, repoName)
+	if err != nil {
+		return nil, err
+	}
+	// pending 记录由启动时的 RecoverPendingRepos 或下次请求处理, 其间的目录可能正在同步
+	if exists && record.Status == RepoStatusPending {
+		return nil, nil
+	}
+	// 先改写失效的 alternates, 之后的检查读取对象池中的对象
+	var issues []FsckIssue
+	if network := stalePoolAlternates(basedir, localPath); network != "" {
+		issue := FsckIssue{Kind: FsckPoolAlternates, Repo: key, Path: localPath, Detail: "alternates of object pool " + network + " point to " + repoPoolDir(localPath)}
+		if fix {
+			issue.fix(relinkPoolAlternates(basedir, localPath))
+		}
+		issues = append(issues, issue)
+	}
+	usable := repoIsUsable(localPath)
+
+	if !exists {
+		if !dirExists(localPath) {
+			return issues, nil
+		}
+		issue := FsckIssue{Kind: FsckOrphanedDir, Repo: key, Path: localPath}
+		if !usable {
+			issue.Detail = "directory is not a usable git repository"
+			if fix {
+				target, err := quarantineRepoLocked(basedir, userName, repoName, localPath, errors.New(issue.Detail))
+				if err == nil {
+					issue.Detail += ", moved to " + target
+				}
+				issue.fix(err)
+			}
+			return append(issues, issue), nil
+		}
+		repoURL, headHash, err := mirrorOrigin(localPath)
+		if err != nil {
+			issue.Detail = err.Error()
+			return append(issues, issue), nil
+		}
+		issue.Detail = "mirror of " + repoURL + " has no record"
+		if fix {
+			issue.fix(SaveSyncedRepoData(repoURL, userName, repoName, localPath, headHash, cfg.Cache.ExpireEx))
+		}
+		return append(issues, issue), nil
+	}
+
+	if record.LocalPath != localPath {
+		issue := FsckIssue{Kind: FsckLocalPathMismatch, Repo: key, Path: localPath, Detail: "recorded path " + record.LocalPath}
+		if usable {
+			if fix {
+				record.LocalPath = localPath
+				issue.fix(SaveRepoData(record))
+			}
+			issues = append(issues, issue)
+		} else if record.LocalPath != "" {
+			issues = append(issues, issue)
+		}
+	}
+	if !usable {
+		issue := FsckIssue{Kind: FsckMissingPath, Repo: key, Path: localPath, Detail: "mirror is missing or not usable"}
+		if record.Status == RepoStatusOrphaned {
+			issue.Detail += ", upstream is gone"
+		}
+		if fix {
+			err := DeleteRepoData(userName, repoName)
+			for i := range issues {
+				issues[i].fix(err)
+			}
+			issue.fix(err)
+		}
+		return append(issues, issue), nil
+	}
+
+	headHash, err := LocalHeadHash(localPath)
+	if err != nil {
+		// 镜像可以打开但 HEAD 无法解析, 交由 verify 判断是否损坏
+		issues = append(issues, FsckIssue{Kind: FsckStaleCommit, Repo: key, Path: localPath, Detail: "resolve HEAD: " + err.Error()})
+		return issues, nil
+	}
+	if record.RepoCommitHash != headHash {
+		issue := FsckIssue{Kind: FsckStaleCommit, Repo: key, Path: localPath, Detail: fmt.Sprintf("recorded %s, HEAD is %s", record.RepoCommitHash, headHash)}
+		if fix {
+			record.RepoCommitHash = headHash
+			issue.fix(SaveRepoData(record))
+		}
+		issues = append(issues, issue)
+	}
+	return issues, nil
+}
+
+// mirrorOrigin 返回镜像的 origin 地址与 HEAD
+func mirrorOrigin(localPath string) (string, string, error) {
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return "", "", err
+	}
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return "", "", fmt.Errorf("no origin remote: %w", err)
+	}
+	urls := remote.Config().URLs
+	if len(urls) == 0 {
+		return "", "", errors.New("origin remote has no url")
+	}
+	headHash, err := LocalHeadHash(localPath)
+	if err != nil {
+		return "", "", err
+	}
+	return urls[0], headHash, nil
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
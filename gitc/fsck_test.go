@@ -0,0 +1,187 @@
+package gitc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"smart-git/config"
+
+	"github.com/go-git/go-git/v6"
+)
+
+// TestFsck 测试 fsck 报告并修复目录与记录之间的各类不一致, 修复后再次检查没有问题
+func TestFsck(t *testing.T) {
+	basedir, src, cfg := newTestMirror(t, "")
+	src.commit("first")
+
+	ctx := context.Background()
+	for _, name := range []string{"moved", "unrecorded"} {
+		if err := EnsureRepoReady(ctx, basedir, "owner", name, src.path, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// BaseDir 迁移后的旧路径与过期的提交
+	moved, _, err := GetRepoData("owner", "moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved.LocalPath = filepath.Join("/old/base", "owner", "moved")
+	moved.RepoCommitHash = strings.Repeat("0", 40)
+	if err := SaveRepoData(moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteRepoData("owner", "unrecorded"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(basedir, "owner", "junk"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveSyncedRepoData(src.path, "owner", "deleted", filepath.Join(basedir, "owner", "deleted"), strings.Repeat("1", 40), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddCloneCount("owner", "ghost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddCloneCount("owner", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(stagingDir(basedir), "owner", "staged"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.PlainInit(poolPath(basedir, "empty"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		FsckLocalPathMismatch + " owner/moved",
+		FsckMissingPath + " owner/deleted",
+		FsckOrphanedDir + " owner/junk",
+		FsckOrphanedDir + " owner/unrecorded",
+		FsckOrphanedPool + " .pools/empty",
+		FsckOrphanedSum + " owner/ghost",
+		FsckStaleCommit + " owner/moved",
+	}
+	issues := func(report *FsckReport) []string {
+		var got []string
+		for _, issue := range report.Issues {
+			got = append(got, issue.Kind+" "+issue.Repo)
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	report, err := Fsck(ctx, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := issues(report); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected issues:\n%s", strings.Join(got, "\n"))
+	}
+	if report.Unfixed() != len(want) {
+		t.Fatalf("report without fix should not fix anything: %+v", report.Issues)
+	}
+
+	report, err = Fsck(ctx, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := issues(report); len(got) != len(want) || report.Unfixed() != 0 {
+		t.Fatalf("issues not fixed: %+v", report.Issues)
+	}
+
+	data, ok, err := GetRepoData("owner", "unrecorded")
+	if err != nil || !ok || data.RepoURL != src.path || data.Status != RepoStatusSynced {
+		t.Fatalf("unrecorded mirror not registered: %+v, %v, %v", data, ok, err)
+	}
+	data, _, err = GetRepoData("owner", "moved")
+	if err != nil || data.LocalPath != filepath.Join(basedir, "owner", "moved") || data.RepoCommitHash == strings.Repeat("0", 40) {
+		t.Fatalf("moved record not fixed: %+v, %v", data, err)
+	}
+	if _, ok, _ := GetRepoData("owner", "deleted"); ok {
+		t.Fatal("record of missing mirror not deleted")
+	}
+	if _, ok, _ := GetSumData("owner", "ghost"); ok {
+		t.Fatal("orphaned sum record not deleted")
+	}
+	if _, ok, _ := GetSumData("owner", "moved"); !ok {
+		t.Fatal("sum record of existing repo deleted")
+	}
+	if dirExists(filepath.Join(basedir, "owner", "junk")) {
+		t.Fatal("unusable directory not quarantined")
+	}
+	if dirExists(poolPath(basedir, "empty")) {
+		t.Fatal("object pool without members not removed")
+	}
+
+	report, err = Fsck(ctx, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("issues left after fix: %+v", report.Issues)
+	}
+}
+
+// TestFsckPoolAlternates 测试 BaseDir 移动后, 成员 alternates 残留旧绝对路径的对象池不被当作没有成员删除,
+// 失效的 alternates 单独报告并改写为当前对象池的相对路径
+func TestFsckPoolAlternates(t *testing.T) {
+	oldBase, src, cfg := newTestMirror(t, "")
+	cfg.ObjectPool.Enabled = true
+	if err := SetupObjectPools(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetupObjectPools(config.DefaultConfig()) })
+	network := "root-" + src.commitFile("first").String()
+
+	ctx := context.Background()
+	if err := EnsureRepoReady(ctx, oldBase, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	// 旧版本写入的绝对路径
+	oldPath := filepath.Join(oldBase, "owner", "repo")
+	stale := filepath.Join(oldBase, poolDirName, network, "objects")
+	if err := os.WriteFile(filepath.Join(oldPath, "objects", "info", "alternates"), []byte(stale+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	basedir := oldBase + "-moved"
+	if err := os.Rename(oldBase, basedir); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Server.BaseDir = basedir
+	localPath := filepath.Join(basedir, "owner", "repo")
+
+	kinds := func(report *FsckReport) []string {
+		var kinds []string
+		for _, issue := range report.Issues {
+			kinds = append(kinds, issue.Kind)
+		}
+		sort.Strings(kinds)
+		return kinds
+	}
+	report, err := Fsck(ctx, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(kinds(report), " "); got != FsckLocalPathMismatch+" "+FsckPoolAlternates || report.Unfixed() != 0 {
+		t.Fatalf("unexpected fsck fix: %+v", report.Issues)
+	}
+	if !dirExists(poolPath(basedir, network)) {
+		t.Fatal("object pool of a moved member removed")
+	}
+	if got := stalePoolAlternates(basedir, localPath); got != "" {
+		t.Fatalf("alternates not relinked: %q", got)
+	}
+	verify, err := verifyRepo(ctx, localPath, true)
+	if err != nil || len(verify.Problems) != 0 {
+		t.Fatalf("member not readable after fix: %+v, %v", verify, err)
+	}
+	report, err = Fsck(ctx, cfg, false)
+	if err != nil || len(report.Issues) != 0 {
+		t.Fatalf("issues left after fix: %+v, %v", report, err)
+	}
+}
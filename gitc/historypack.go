@@ -0,0 +1,213 @@
+package gitc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"smart-git/config"
+)
+
+const historyManifestName = "manifest.json"
+
+// HistoryPack 描述一个预生成的历史 pack: 包含 Tips 可达的全部对象,
+// 客户端通过 packfile-uris 直接下载, upload-pack 只需发送 Tips 之后的增量
+type HistoryPack struct {
+	// Hash 为 pack 校验和, 即 pack-<hash>.pack 中的 hash, 客户端以此校验下载内容
+	Hash    string    `json:"hash"`
+	Tips    []string  `json:"tips"`
+	Created time.Time `json:"created"`
+}
+
+// HistoryPackStore 管理按仓库拆分出的历史 pack
+type HistoryPackStore struct {
+	dir      string
+	minSize  int64
+	interval time.Duration
+	patterns []string
+	git      *SystemGit
+	tasks    repoTasks
+}
+
+var (
+	historyPackMu     sync.RWMutex
+	activeHistoryPack *HistoryPackStore
+)
+
+// SetupHistoryPacks 根据配置初始化全局历史 pack 存储, 未启用时清空; 依赖系统 git 后端
+func SetupHistoryPacks(cfg *config.Config) error {
+	historyPackMu.Lock()
+	defer historyPackMu.Unlock()
+
+	if !cfg.PackfileURIs.Enabled {
+		activeHistoryPack = nil
+		return nil
+	}
+	if cfg.PackfileURIs.Dir == "" {
+		return errors.New("packfileURIs.dir is required when packfile-uris is enabled")
+	}
+	sys := SystemGitBackend()
+	if sys == nil {
+		return errors.New("packfile-uris requires git.backend = \"system\"")
+	}
+	if err := os.MkdirAll(cfg.PackfileURIs.Dir, 0755); err != nil {
+		return err
+	}
+	activeHistoryPack = &HistoryPackStore{
+		dir:      cfg.PackfileURIs.Dir,
+		minSize:  cfg.PackfileURIs.MinSize * 1024 * 1024,
+		interval: cfg.PackfileURIs.Interval,
+		patterns: cfg.PackfileURIs.Repos,
+		git:      sys,
+	}
+	return nil
+}
+
+// CurrentHistoryPacks 返回全局历史 pack 存储, 未启用时返回 nil
+func CurrentHistoryPacks() *HistoryPackStore {
+	historyPackMu.RLock()
+	defer historyPackMu.RUnlock()
+	return activeHistoryPack
+}
+
+// ScheduleHistoryPack 在需要时于后台为 repo(owner/name)重新生成历史 pack
+func ScheduleHistoryPack(basedir string, userName string, repoName string) {
+	store := CurrentHistoryPacks()
+	if store == nil || !matchRepos(store.patterns, userName, repoName) {
+		return
+	}
+	repo := userName + "/" + repoName
+	if pack, err := store.Manifest(repo); err == nil && time.Since(pack.Created) < store.interval {
+		return
+	}
+	store.tasks.start(JobKindHistoryPack, repo, func(ctx context.Context) error {
+		return generateLocked(ctx, basedir, userName, repoName, store.Generate)
+	})
+}
+
+// PackPath 返回 repo 中指定校验和的历史 pack 路径
+func (s *HistoryPackStore) PackPath(repo string, hash string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(repo), "pack-"+hash+".pack")
+}
+
+// Manifest 读取 repo 当前的历史 pack 描述, 不存在时返回 os.ErrNotExist
+func (s *HistoryPackStore) Manifest(repo string) (*HistoryPack, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(repo), historyManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var pack HistoryPack
+	if err := json.Unmarshal(data, &pack); err != nil {
+		return nil, err
+	}
+	return &pack, nil
+}
+
+// Generate 将当前全部引用可达的对象打包为历史 pack 并更新描述文件.
+// 仅保留当前与上一代 pack, 使已缓存的响应中的 URI 在下一次生成前仍然有效; 调用方需持有仓库锁
+func (s *HistoryPackStore) Generate(ctx context.Context, repo string, localPath string) error {
+	size, err := EstimateRepoSize(localPath)
+	if err != nil {
+		return err
+	}
+	if size < s.minSize {
+		return nil
+	}
+
+	out, err := s.git.Output(ctx, localPath, nil, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return err
+	}
+	// 快照等内部引用不属于普通克隆的历史
+	var objects []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if oid, ref, ok := strings.Cut(line, " "); ok && !strings.HasPrefix(ref, InternalRefPrefix) {
+			objects = append(objects, oid)
+		}
+	}
+	tips := uniqueLines(strings.Join(objects, "\n"))
+	if len(tips) == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(s.dir, filepath.FromSlash(repo))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	out, err = s.git.Output(ctx, localPath, strings.NewReader(strings.Join(tips, "\n")+"\n"),
+		"pack-objects", "--revs", "--quiet", filepath.Join(dir, "pack"))
+	if err != nil {
+		return err
+	}
+	hash := strings.TrimSpace(string(out))
+	_ = os.Remove(filepath.Join(dir, "pack-"+hash+".idx"))
+
+	previous, _ := s.Manifest(repo)
+	data, err := json.Marshal(&HistoryPack{Hash: hash, Tips: tips, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, historyManifestName), data); err != nil {
+		return err
+	}
+
+	keep := map[string]bool{s.PackPath(repo, hash): true}
+	if previous != nil {
+		keep[s.PackPath(repo, previous.Hash)] = true
+	}
+	packs, _ := filepath.Glob(filepath.Join(dir, "pack-*"))
+	for _, pack := range packs {
+		if !keep[pack] {
+			_ = os.Remove(pack)
+		}
+	}
+
+	// 已缓存的完整克隆响应引用的是旧的增量范围
+	InvalidatePackCache(repo)
+	logInfo("history pack %s generated for %s\n", hash, repo)
+	return nil
+}
+
+// uniqueLines 返回去重并排序后的非空行
+func uniqueLines(s string) []string {
+	seen := map[string]bool{}
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || seen[line] {
+			continue
+		}
+		seen[line] = true
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// writeFileAtomic 先写入同目录临时文件再重命名, 读取方不会看到写了一半的内容
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package gitc
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"smart-git/config"
+)
+
+// 上游同步任务的优先级, 交互式请求优先于后台刷新
+const (
+	PriorityBackground  = 0
+	PriorityInteractive = 10
+)
+
+const (
+	JobStateQueued  = "queued"
+	JobStateRunning = "running"
+)
+
+const (
+	JobKindClone = "clone"
+	JobKindFetch = "fetch"
+	// bundle 与历史 pack 的生成不访问上游, 同样经任务队列限制并发
+	JobKindBundle      = "bundle"
+	JobKindHistoryPack = "history-pack"
+	// 仓库与对象池的维护
+	JobKindMaintenance = "maintenance"
+)
+
+var (
+	ErrJobQueueFull = errors.New("upstream job queue is full")
+	ErrJobCanceled  = errors.New("upstream job canceled")
+	ErrJobNotFound  = errors.New("upstream job not found")
+)
+
+type priorityKey struct{}
+
+// WithPriority 为 ctx 设置上游任务优先级, 未设置时视为交互式请求
+func WithPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+func priorityFromContext(ctx context.Context) int {
+	if priority, ok := ctx.Value(priorityKey{}).(int); ok {
+		return priority
+	}
+	return PriorityInteractive
+}
+
+// Job 描述一个排队或运行中的上游 clone/fetch 任务
+type Job struct {
+	ID         string
+	Kind       string
+	Repo       string
+	URL        string
+	Host       string
+	Priority   int
+	State      string
+	EnqueuedAt time.Time
+	StartedAt  time.Time
+
+	seq    uint64
+	index  int
+	ready  chan struct{}
+	err    error
+	cancel context.CancelFunc
+}
+
+// JobQueueStats 汇总上游任务队列的状态
+type JobQueueStats struct {
+	Running int
+	Queued  int
+}
+
+type jobHeap []*Job
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *jobHeap) Push(x any) {
+	job := x.(*Job)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+func (h *jobHeap) Pop() any {
+	old := *h
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	job.index = -1
+	*h = old[:n-1]
+	return job
+}
+
+// JobQueue 限制同时访问上游的 clone/fetch 数量, 支持按 host 限制并发
+type JobQueue struct {
+	mu        sync.Mutex
+	cfg       config.UpstreamConfig
+	queued    jobHeap
+	running   map[string]*Job
+	hostCount map[string]int
+	seq       uint64
+}
+
+var (
+	jobQueueMu      sync.Mutex
+	defaultJobQueue *JobQueue
+)
+
+func NewJobQueue(cfg config.UpstreamConfig) *JobQueue {
+	return &JobQueue{
+		cfg:       cfg,
+		running:   map[string]*Job{},
+		hostCount: map[string]int{},
+	}
+}
+
+// SetupJobQueue 根据配置初始化全局上游任务队列
+func SetupJobQueue(cfg *config.Config) {
+	jobQueueMu.Lock()
+	defer jobQueueMu.Unlock()
+	defaultJobQueue = NewJobQueue(cfg.Upstream)
+}
+
+// Jobs 返回全局上游任务队列, 未初始化时使用默认配置
+func Jobs() *JobQueue {
+	jobQueueMu.Lock()
+	defer jobQueueMu.Unlock()
+	if defaultJobQueue == nil {
+		defaultJobQueue = NewJobQueue(config.DefaultConfig().Upstream)
+	}
+	return defaultJobQueue
+}
+
+// Run 排队等待上游并发名额, 获得名额后在当前 goroutine 中执行 fn
+func (q *JobQueue) Run(ctx context.Context, kind string, repo string, repoURL string, fn func(ctx context.Context) error) error {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	job, err := q.enqueue(kind, repo, repoURL, priorityFromContext(ctx), cancel)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-job.ready:
+	case <-jobCtx.Done():
+		if q.abandon(job) {
+			return ctx.Err()
+		}
+		// 任务已被调度或被 Cancel 移出队列, 以 job.err 为准
+		<-job.ready
+	}
+	if job.err != nil {
+		return job.err
+	}
+	defer q.finish(job)
+
+	return fn(jobCtx)
+}
+
+// Stats 返回当前运行和排队的任务数
+func (q *JobQueue) Stats() JobQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return JobQueueStats{Running: len(q.running), Queued: len(q.queued)}
+}
+
+// List 返回运行中与排队中的任务快照, 运行中的任务在前
+func (q *JobQueue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]Job, 0, len(q.running)+len(q.queued))
+	for _, job := range q.running {
+		jobs = append(jobs, job.snapshot())
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].seq < jobs[j].seq })
+
+	queued := make(jobHeap, len(q.queued))
+	copy(queued, q.queued)
+	sort.Slice(queued, func(i, j int) bool { return queued.Less(i, j) })
+	for _, job := range queued {
+		jobs = append(jobs, job.snapshot())
+	}
+	return jobs
+}
+
+// Cancel 取消指定任务; 排队中的任务直接移出队列, 运行中的任务取消其 context
+func (q *JobQueue) Cancel(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job, ok := q.running[id]; ok {
+		job.cancel()
+		return nil
+	}
+	for _, job := range q.queued {
+		if job.ID != id {
+			continue
+		}
+		heap.Remove(&q.queued, job.index)
+		job.err = ErrJobCanceled
+		close(job.ready)
+		job.cancel()
+		return nil
+	}
+	return ErrJobNotFound
+}
+
+func (q *JobQueue) enqueue(kind string, repo string, repoURL string, priority int, cancel context.CancelFunc) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.cfg.MaxQueued > 0 && len(q.queued) >= q.cfg.MaxQueued {
+		return nil, ErrJobQueueFull
+	}
+
+	q.seq++
+	job := &Job{
+		ID:         strconv.FormatUint(q.seq, 10),
+		Kind:       kind,
+		Repo:       repo,
+		URL:        repoURL,
+		Host:       upstreamHost(repoURL),
+		Priority:   priority,
+		State:      JobStateQueued,
+		EnqueuedAt: time.Now(),
+		seq:        q.seq,
+		ready:      make(chan struct{}),
+		cancel:     cancel,
+	}
+	heap.Push(&q.queued, job)
+	q.dispatchLocked()
+	return job, nil
+}
+
+// abandon 在等待方放弃时将任务移出队列; 若任务已被调度则返回 false
+func (q *JobQueue) abandon(job *Job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job.State != JobStateQueued || job.index < 0 {
+		return false
+	}
+	heap.Remove(&q.queued, job.index)
+	return true
+}
+
+func (q *JobQueue) finish(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.running, job.ID)
+	q.hostCount[job.Host]--
+	if q.hostCount[job.Host] <= 0 {
+		delete(q.hostCount, job.Host)
+	}
+	q.dispatchLocked()
+}
+
+// dispatchLocked 按优先级启动排队任务, 跳过已达到 host 并发上限的任务
+func (q *JobQueue) dispatchLocked() {
+	var skipped []*Job
+	for len(q.queued) > 0 {
+		if q.cfg.MaxConcurrent > 0 && len(q.running) >= q.cfg.MaxConcurrent {
+			break
+		}
+		job := heap.Pop(&q.queued).(*Job)
+		if limit := q.hostLimit(job.Host); limit > 0 && q.hostCount[job.Host] >= limit {
+			skipped = append(skipped, job)
+			continue
+		}
+		job.State = JobStateRunning
+		job.StartedAt = time.Now()
+		q.running[job.ID] = job
+		q.hostCount[job.Host]++
+		close(job.ready)
+	}
+	for _, job := range skipped {
+		heap.Push(&q.queued, job)
+	}
+}
+
+func (q *JobQueue) hostLimit(host string) int {
+	for _, limit := range q.cfg.Hosts {
+		if limit.Host == host {
+			return limit.MaxConcurrent
+		}
+	}
+	return q.cfg.PerHostConcurrent
+}
+
+func (j *Job) snapshot() Job {
+	return Job{
+		ID:         j.ID,
+		Kind:       j.Kind,
+		Repo:       j.Repo,
+		URL:        j.URL,
+		Host:       j.Host,
+		Priority:   j.Priority,
+		State:      j.State,
+		EnqueuedAt: j.EnqueuedAt,
+		StartedAt:  j.StartedAt,
+		seq:        j.seq,
+	}
+}
+
+func upstreamHost(repoURL string) string {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" {
+		return repoURL
+	}
+	return u.Host
+}
@@ -0,0 +1,204 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"smart-git/config"
+)
+
+// waitQueued 等待队列中出现指定数量的排队任务
+func waitQueued(t *testing.T, q *JobQueue, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Stats().Queued != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %d queued jobs, stats: %+v", n, q.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestJobQueuePriority 测试交互式任务优先于先入队的后台任务
+func TestJobQueuePriority(t *testing.T) {
+	q := NewJobQueue(config.UpstreamConfig{MaxConcurrent: 1})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go q.Run(context.Background(), JobKindFetch, "a/a", "https://example.com/a/a", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	order := make(chan string, 2)
+	go q.Run(WithPriority(context.Background(), PriorityBackground), JobKindFetch, "b/b", "https://example.com/b/b", func(ctx context.Context) error {
+		order <- "background"
+		return nil
+	})
+	waitQueued(t, q, 1)
+	go q.Run(context.Background(), JobKindClone, "c/c", "https://example.com/c/c", func(ctx context.Context) error {
+		order <- "interactive"
+		return nil
+	})
+	waitQueued(t, q, 2)
+
+	jobs := q.List()
+	if len(jobs) != 3 || jobs[0].State != JobStateRunning || jobs[1].Repo != "c/c" {
+		t.Fatalf("unexpected job list: %+v", jobs)
+	}
+
+	close(release)
+	if first := <-order; first != "interactive" {
+		t.Fatalf("expected interactive job first, got %s", first)
+	}
+	<-order
+}
+
+// TestJobQueueHostLimitAndCancel 测试 host 并发上限与取消排队任务
+func TestJobQueueHostLimitAndCancel(t *testing.T) {
+	q := NewJobQueue(config.UpstreamConfig{
+		MaxConcurrent: 4,
+		Hosts:         []config.UpstreamHostLimit{{Host: "github.com", MaxConcurrent: 1}},
+	})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go q.Run(context.Background(), JobKindClone, "a/a", "https://github.com/a/a", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	otherHost := q.Run(context.Background(), JobKindClone, "b/b", "https://gitlab.com/b/b", func(ctx context.Context) error {
+		return nil
+	})
+	if otherHost != nil {
+		t.Fatalf("job on another host should not be blocked: %v", otherHost)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- q.Run(context.Background(), JobKindClone, "c/c", "https://github.com/c/c", func(ctx context.Context) error {
+			return nil
+		})
+	}()
+	waitQueued(t, q, 1)
+
+	jobs := q.List()
+	if err := q.Cancel(jobs[len(jobs)-1].ID); err != nil {
+		t.Fatalf("cancel failed: %v", err)
+	}
+	if err := <-result; !errors.Is(err, ErrJobCanceled) {
+		t.Fatalf("expected ErrJobCanceled, got %v", err)
+	}
+	if err := q.Cancel("missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("expected ErrJobNotFound, got %v", err)
+	}
+	close(release)
+}
+
+// TestBackgroundJobPriority 测试重新克隆损坏的镜像、bundle 生成与定时维护以后台优先级排队, 按需获取对象沿用请求的交互式优先级
+func TestBackgroundJobPriority(t *testing.T) {
+	requireGit(t)
+	basedir, src, cfg := newTestMirror(t, BackendSystem)
+	cfg.Upstream.MaxConcurrent = 1
+	cfg.Bundle.Enabled = true
+	cfg.Bundle.Dir = filepath.Join(t.TempDir(), "bundles")
+	cfg.Bundle.Repos = []string{"owner/repo"}
+	cfg.Maintenance.PackThreshold = 1
+	cfg.Maintenance.LooseThreshold = 1
+	if err := SetupMaintenance(cfg); err != nil {
+		t.Fatal(err)
+	}
+	SetupJobQueue(cfg)
+	t.Cleanup(func() {
+		defaults := config.DefaultConfig()
+		_ = SetupBundles(defaults)
+		_ = SetupMaintenance(defaults)
+		SetupJobQueue(defaults)
+		wantFetchesMu.Lock()
+		wantFetches = map[string]*wantFetchState{}
+		wantFetchesMu.Unlock()
+	})
+	src.commit("first")
+
+	ctx := context.Background()
+	for _, name := range []string{"repo", "other"} {
+		if err := EnsureRepoReady(ctx, basedir, "owner", name, src.path, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second := src.commit("second").String()
+	// 克隆完成后才启用 bundle, 只由下面的调用生成
+	if err := SetupBundles(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// 占用唯一的并发名额, 之后的任务全部排队
+	q := Jobs()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go q.Run(ctx, JobKindFetch, "busy/busy", "", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	damageObjectFile(t, filepath.Join(basedir, "owner", "other"))
+	report, err := VerifyMirror(ctx, basedir, "owner", "other", false)
+	if err != nil || !report.Recloning {
+		t.Fatalf("corrupt mirror not recloned: %+v, %v", report, err)
+	}
+	waitQueued(t, q, 1)
+	done := make(chan struct{}, 2)
+	go func() {
+		_ = FetchWants(ctx, basedir, "owner", "repo", src.path, []string{second})
+		done <- struct{}{}
+	}()
+	waitQueued(t, q, 2)
+	ScheduleBundle(basedir, "owner", "repo")
+	waitQueued(t, q, 3)
+	go func() {
+		CurrentMaintainer().scan(ctx)
+		done <- struct{}{}
+	}()
+	waitQueued(t, q, 4)
+
+	var kinds []string
+	for _, job := range q.List() {
+		if job.State != JobStateQueued {
+			continue
+		}
+		priority := PriorityBackground
+		if job.Kind == JobKindFetch {
+			priority = PriorityInteractive
+		}
+		if job.Priority != priority {
+			t.Fatalf("%s job of %s queued with priority %d", job.Kind, job.Repo, job.Priority)
+		}
+		kinds = append(kinds, job.Kind+" "+job.Repo)
+	}
+	slices.Sort(kinds)
+	want := []string{"bundle owner/repo", "clone owner/other", "fetch owner/repo", "maintenance owner/repo"}
+	if !slices.Equal(kinds, want) {
+		t.Fatalf("unexpected queued jobs: %v", kinds)
+	}
+
+	close(release)
+	<-done
+	<-done
+	// 等待后台任务结束并释放仓库锁
+	waitFor(t, func() bool {
+		stats := q.Stats()
+		data, ok, err := GetRepoData("owner", "other")
+		return stats.Running == 0 && stats.Queued == 0 && err == nil && ok && data.Status == RepoStatusSynced && len(GetRepoLockStats().Repos) == 0
+	})
+}
@@ -0,0 +1,358 @@
+package gitc
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"smart-git/config"
+)
+
+// 镜像目录布局
+const (
+	LayoutFlat    = "flat"    // basedir/{owner}/{repo}
+	LayoutSharded = "sharded" // basedir/{h[0:2]}/{h[2:4]}/{owner}/{repo}, h 为 "owner/repo" 的 sha1, 名称中的大写字母转义
+)
+
+var (
+	layoutMu sync.RWMutex
+	layout   = LayoutFlat
+)
+
+// SetupLayout 根据配置设置镜像目录布局, 未设置时为 flat
+func SetupLayout(cfg *config.Config) error {
+	value := cfg.Server.Layout
+	if value == "" {
+		value = LayoutFlat
+	}
+	if value != LayoutFlat && value != LayoutSharded {
+		return fmt.Errorf("invalid server layout %q, expected %s or %s", cfg.Server.Layout, LayoutFlat, LayoutSharded)
+	}
+	layoutMu.Lock()
+	layout = value
+	layoutMu.Unlock()
+	return nil
+}
+
+// CurrentLayout 返回当前的镜像目录布局
+func CurrentLayout() string {
+	layoutMu.RLock()
+	defer layoutMu.RUnlock()
+	return layout
+}
+
+func otherLayout(name string) string {
+	if name == LayoutSharded {
+		return LayoutFlat
+	}
+	return LayoutSharded
+}
+
+// layoutPath 返回仓库在指定布局下的目录
+func layoutPath(name string, basedir string, userName string, repoName string) string {
+	if name != LayoutSharded {
+		return filepath.Join(basedir, userName, repoName)
+	}
+	sum := sha1.Sum([]byte(userName + "/" + repoName))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(basedir, h[0:2], h[2:4], escapePathName(userName), escapePathName(repoName))
+}
+
+// RepoPath 返回仓库镜像的目录. 通常为当前布局下的目录; 迁移完成前镜像仍在另一布局下时返回其所在的目录.
+// 迁移会在仓库的独占锁下移动镜像, 读取镜像前需在持有仓库锁后重新获取
+func RepoPath(basedir string, userName string, repoName string) string {
+	current := CurrentLayout()
+	path := layoutPath(current, basedir, userName, repoName)
+	if dirExists(path) {
+		return path
+	}
+	if legacy := layoutPath(otherLayout(current), basedir, userName, repoName); dirExists(legacy) {
+		return legacy
+	}
+	return path
+}
+
+// escapePathName 将大写字母转义为 "!" 加小写字母, "!" 转义为 "!!", 使仅大小写不同的名称在大小写不敏感的文件系统上不冲突
+func escapePathName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '!':
+			b.WriteString("!!")
+		case 'A' <= r && r <= 'Z':
+			b.WriteByte('!')
+			b.WriteRune(r + 'a' - 'A')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// unescapePathName 为 escapePathName 的逆操作, 不是合法的转义结果时返回 false
+func unescapePathName(name string) (string, bool) {
+	var b strings.Builder
+	escaped := false
+	for _, r := range name {
+		switch {
+		case escaped && r == '!':
+			b.WriteRune('!')
+			escaped = false
+		case escaped && 'a' <= r && r <= 'z':
+			b.WriteRune(r - 'a' + 'A')
+			escaped = false
+		case escaped || 'A' <= r && r <= 'Z':
+			return "", false
+		case r == '!':
+			escaped = true
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if escaped {
+		return "", false
+	}
+	return b.String(), true
+}
+
+func isShardName(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// repoDirs 返回 BaseDir 下两种布局中全部仓库目录的 owner/repo, 跳过 .staging 等以 "." 开头的内部目录.
+// 名称为两位十六进制的两层目录中没有 HEAD 时视为分片目录, 其中名称与分片不符的目录被忽略
+func repoDirs(basedir string) ([]string, error) {
+	owners, err := os.ReadDir(basedir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var dirs []string
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			dirs = append(dirs, key)
+		}
+	}
+	for _, owner := range owners {
+		if !owner.IsDir() || strings.HasPrefix(owner.Name(), ".") {
+			continue
+		}
+		repos, err := os.ReadDir(filepath.Join(basedir, owner.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range repos {
+			if !repo.IsDir() {
+				continue
+			}
+			shard := filepath.Join(basedir, owner.Name(), repo.Name())
+			if !isShardName(owner.Name()) || !isShardName(repo.Name()) || fileExists(filepath.Join(shard, "HEAD")) {
+				add(owner.Name() + "/" + repo.Name())
+				continue
+			}
+			keys, err := shardRepoDirs(basedir, shard)
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range keys {
+				add(key)
+			}
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// shardRepoDirs 返回分片目录中 {owner}/{repo} 两层目录对应的 owner/repo
+func shardRepoDirs(basedir string, shard string) ([]string, error) {
+	owners, err := os.ReadDir(shard)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, owner := range owners {
+		if !owner.IsDir() {
+			continue
+		}
+		userName, ok := unescapePathName(owner.Name())
+		if !ok {
+			continue
+		}
+		repos, err := os.ReadDir(filepath.Join(shard, owner.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range repos {
+			repoName, ok := unescapePathName(repo.Name())
+			if !ok || !repo.IsDir() {
+				continue
+			}
+			if layoutPath(LayoutSharded, basedir, userName, repoName) == filepath.Join(shard, owner.Name(), repo.Name()) {
+				keys = append(keys, userName+"/"+repoName)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// removeEmptyParents 删除 path 在 basedir 下的空的上级目录, 其它仓库正在使用时删除失败即可
+func removeEmptyParents(basedir string, path string) {
+	for dir := filepath.Dir(path); dir != filepath.Clean(basedir) && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// LayoutMove 为迁移中的一个仓库
+type LayoutMove struct {
+	Repo  string
+	From  string
+	To    string
+	Error string
+}
+
+// LayoutMigration 为一次布局迁移的结果, DryRun 时 Moved 为需要移动的仓库
+type LayoutMigration struct {
+	Layout    string
+	DryRun    bool
+	Repos     int
+	Moved     []LayoutMove
+	Conflicts []LayoutMove
+	Failed    []LayoutMove
+}
+
+// MigrateLayout 将另一布局下的镜像移动到当前布局并更新仓库记录的 LocalPath.
+// 每个仓库在仓库的独占锁下移动, 可以在服务运行时执行; 目标目录已存在时记为冲突, 不移动
+func MigrateLayout(ctx context.Context, basedir string, dryRun bool) (*LayoutMigration, error) {
+	current := CurrentLayout()
+	report := &LayoutMigration{Layout: current, DryRun: dryRun}
+
+	records, err := GetAllRepoData()
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := repoDirs(basedir)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for _, record := range records {
+		keys[record.RepoUser+"/"+record.RepoName] = true
+	}
+	for _, dir := range dirs {
+		keys[dir] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	report.Repos = len(sorted)
+
+	for _, key := range sorted {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		userName, repoName, _ := strings.Cut(key, "/")
+		move := LayoutMove{
+			Repo: key,
+			From: layoutPath(otherLayout(current), basedir, userName, repoName),
+			To:   layoutPath(current, basedir, userName, repoName),
+		}
+		moved, err := migrateRepoLayout(ctx, basedir, userName, repoName, move, dryRun)
+		switch {
+		case errors.Is(err, fs.ErrExist):
+			move.Error = "target already exists"
+			report.Conflicts = append(report.Conflicts, move)
+		case err != nil:
+			move.Error = err.Error()
+			report.Failed = append(report.Failed, move)
+		case moved:
+			report.Moved = append(report.Moved, move)
+		}
+	}
+
+	for _, move := range report.Conflicts {
+		logWarning("layout migration conflict: %s, %s and %s both exist\n", move.Repo, move.From, move.To)
+	}
+	for _, move := range report.Failed {
+		logError("layout migration failed: %s, %s\n", move.Repo, move.Error)
+	}
+	if !dryRun {
+		logInfo("镜像目录布局迁移到 %s 完成, 移动 %d 个仓库, %d 个冲突, %d 个失败。\n", current, len(report.Moved), len(report.Conflicts), len(report.Failed))
+	}
+	return report, nil
+}
+
+// migrateRepoLayout 在仓库的独占锁下移动一个镜像, 返回是否(需要)移动
+func migrateRepoLayout(ctx context.Context, basedir string, userName string, repoName string, move LayoutMove, dryRun bool) (bool, error) {
+	unlock, err := lockRepo(ctx, userName, repoName)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	record, exists, err := GetRepoData(userName, repoName)
+	if err != nil {
+		return false, err
+	}
+	if !dirExists(move.From) {
+		// 上次迁移移动镜像后未能更新记录
+		if !exists || record.LocalPath != move.From || !dirExists(move.To) {
+			return false, nil
+		}
+	} else {
+		if dirExists(move.To) {
+			return false, fs.ErrExist
+		}
+		if dryRun {
+			return true, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(move.To), 0755); err != nil {
+			return false, err
+		}
+		if err := os.Rename(move.From, move.To); err != nil {
+			return false, err
+		}
+		removeEmptyParents(basedir, move.From)
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	if exists && record.LocalPath != move.To {
+		record.LocalPath = move.To
+		if err := SaveRepoData(record); err != nil {
+			return true, err
+		}
+	}
+	// 对象池的相对路径随目录层级改变
+	if err := relinkPoolAlternates(basedir, move.To); err != nil {
+		return true, err
+	}
+	InvalidatePackCache(userName + "/" + repoName)
+	logInfo("仓库 '%s/%s' 已移动到 '%s'。\n", userName, repoName, move.To)
+	return true, nil
+}
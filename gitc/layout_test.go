@@ -0,0 +1,103 @@
+package gitc
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"smart-git/config"
+)
+
+func TestEscapePathName(t *testing.T) {
+	for _, name := range []string{"owner", "Owner", "OWNER", "go-git", "a!b", "!!", "Repo.Name_1"} {
+		escaped := escapePathName(name)
+		if strings.ToLower(escaped) != escaped {
+			t.Fatalf("escaped name %q of %q has upper case letters", escaped, name)
+		}
+		got, ok := unescapePathName(escaped)
+		if !ok || got != name {
+			t.Fatalf("unescape %q: got %q, %v, want %q", escaped, got, ok, name)
+		}
+	}
+	for _, name := range []string{"Owner", "a!", "a!1"} {
+		if _, ok := unescapePathName(name); ok {
+			t.Fatalf("invalid escaped name %q accepted", name)
+		}
+	}
+	if escapePathName("Owner") == escapePathName("owner") {
+		t.Fatal("names differing only in case escaped to the same directory")
+	}
+}
+
+// TestMigrateLayout 测试 flat 布局的镜像迁移到 sharded 布局: 镜像移动并更新记录, 迁移前后都可以找到镜像
+func TestMigrateLayout(t *testing.T) {
+	basedir, src, cfg := newTestMirror(t, "")
+	t.Cleanup(func() { _ = SetupLayout(config.DefaultConfig()) })
+	src.commit("first")
+
+	ctx := context.Background()
+	names := []string{"Owner/repo", "owner/repo"}
+	for _, name := range names {
+		userName, repoName, _ := strings.Cut(name, "/")
+		if err := EnsureRepoReady(ctx, basedir, userName, repoName, src.path, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.Server.Layout = LayoutSharded
+	if err := SetupLayout(cfg); err != nil {
+		t.Fatal(err)
+	}
+	// 迁移前仍使用 flat 布局下的镜像
+	if got := RepoPath(basedir, "owner", "repo"); got != filepath.Join(basedir, "owner", "repo") {
+		t.Fatalf("legacy mirror not found: %s", got)
+	}
+
+	report, err := MigrateLayout(ctx, basedir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Moved) != len(names) || dirExists(report.Moved[0].To) {
+		t.Fatalf("unexpected dry run: %+v", report)
+	}
+	report, err = MigrateLayout(ctx, basedir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Moved) != len(names) || len(report.Conflicts)+len(report.Failed) != 0 {
+		t.Fatalf("unexpected migration: %+v", report)
+	}
+	for _, name := range names {
+		userName, repoName, _ := strings.Cut(name, "/")
+		want := layoutPath(LayoutSharded, basedir, userName, repoName)
+		if got := RepoPath(basedir, userName, repoName); got != want || !repoIsUsable(got) {
+			t.Fatalf("mirror of %s not moved: %s", name, got)
+		}
+		data, _, err := GetRepoData(userName, repoName)
+		if err != nil || data.LocalPath != want {
+			t.Fatalf("record of %s not updated: %+v, %v", name, data, err)
+		}
+		if dirExists(filepath.Join(basedir, userName)) {
+			t.Fatalf("empty owner directory %s left", userName)
+		}
+	}
+	dirs, err := repoDirs(basedir)
+	if err != nil || !slices.Equal(dirs, names) {
+		t.Fatalf("unexpected repo dirs: %v, %v", dirs, err)
+	}
+
+	// 迁移后可以继续同步, fsck 只报告大小写不同的别名
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	fsck, err := Fsck(ctx, cfg, false)
+	if err != nil || len(fsck.Issues) != 1 || fsck.Issues[0].Kind != FsckRepoAlias || fsck.Issues[0].Repo != "Owner/repo" {
+		t.Fatalf("fsck after migration: %+v, %v", fsck, err)
+	}
+	report, err = MigrateLayout(ctx, basedir, false)
+	if err != nil || len(report.Moved)+len(report.Conflicts)+len(report.Failed) != 0 {
+		t.Fatalf("second migration not a no-op: %+v, %v", report, err)
+	}
+}
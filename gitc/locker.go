@@ -0,0 +1,256 @@
+package gitc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"smart-git/config"
+)
+
+const (
+	LockProviderNone  = "none"
+	LockProviderFlock = "flock"
+	LockProviderLease = "lease"
+
+	// lockDirName 为 basedir 下存放跨进程锁文件的目录; 镜像目录由 rename 发布, 锁文件不能放在其中
+	lockDirName = ".locks"
+
+	lockPollInterval = 100 * time.Millisecond
+)
+
+// RepoLocker 在共享 BaseDir 的多个进程之间互斥同一仓库的同步、删除与维护
+type RepoLocker interface {
+	Name() string
+	// Lock 获取 key(owner/repo)的跨进程锁直到 ctx 结束, 返回释放函数
+	Lock(ctx context.Context, key string) (func(), error)
+}
+
+var (
+	lockerMu     sync.RWMutex
+	activeLocker RepoLocker = nopLocker{}
+)
+
+// setupLocker 根据 RepoLock.Provider 选择跨进程锁的实现
+func setupLocker(cfg *config.Config) error {
+	var locker RepoLocker
+	dir := filepath.Join(cfg.Server.BaseDir, lockDirName)
+	switch cfg.RepoLock.Provider {
+	case "", LockProviderNone:
+		locker = nopLocker{}
+	case LockProviderFlock:
+		locker = &flockLocker{dir: dir}
+	case LockProviderLease:
+		ttl := cfg.RepoLock.LeaseTTL
+		if ttl <= 0 {
+			return fmt.Errorf("repoLock.leaseTTL must be positive for lease provider")
+		}
+		locker = newLeaseLocker(dir, ttl)
+	default:
+		return fmt.Errorf("unknown repo lock provider: %s", cfg.RepoLock.Provider)
+	}
+
+	lockerMu.Lock()
+	activeLocker = locker
+	lockerMu.Unlock()
+	if locker.Name() != LockProviderNone {
+		logInfo("repo lock provider: %s, dir: %s\n", locker.Name(), dir)
+	}
+	return nil
+}
+
+func currentLocker() RepoLocker {
+	lockerMu.RLock()
+	defer lockerMu.RUnlock()
+	return activeLocker
+}
+
+// SharedStorage 判断是否配置了跨进程锁, 此时 BaseDir 可能被其它进程同时使用
+func SharedStorage() bool {
+	return currentLocker().Name() != LockProviderNone
+}
+
+// lockFilePath 返回 key 对应的锁文件路径
+func lockFilePath(dir string, key string, ext string) string {
+	return filepath.Join(dir, filepath.FromSlash(key)+ext)
+}
+
+// nopLocker 只有单个进程使用 BaseDir 时不需要跨进程锁
+type nopLocker struct{}
+
+func (nopLocker) Name() string { return LockProviderNone }
+
+func (nopLocker) Lock(context.Context, string) (func(), error) { return func() {}, nil }
+
+// leaseRecord 为租约文件的内容, 持有者需要在 Expires 之前续期
+type leaseRecord struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// leaseLocker 以共享目录中的租约文件实现跨进程锁, 不依赖文件系统的锁支持;
+// 持有者崩溃后租约不再续期, 过期后由其它进程接管
+type leaseLocker struct {
+	dir   string
+	ttl   time.Duration
+	owner string
+}
+
+func newLeaseLocker(dir string, ttl time.Duration) *leaseLocker {
+	host, _ := os.Hostname()
+	token := make([]byte, 4)
+	_, _ = rand.Read(token)
+	return &leaseLocker{dir: dir, ttl: ttl, owner: fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(token))}
+}
+
+func (l *leaseLocker) Name() string { return LockProviderLease }
+
+func (l *leaseLocker) Lock(ctx context.Context, key string) (func(), error) {
+	path := lockFilePath(l.dir, key, ".lease")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// 每次获取使用独立的持有者标识, 同一进程内先后的持有者互不混淆
+	token := make([]byte, 4)
+	_, _ = rand.Read(token)
+	owner := l.owner + ":" + hex.EncodeToString(token)
+
+	for {
+		created, err := l.create(path, owner)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			break
+		}
+		if err := l.takeOverStale(path, key); err != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go l.renew(path, key, owner, stop, done)
+	return func() {
+		close(stop)
+		<-done
+		if record, err := readLease(path); err == nil && record.Owner == owner {
+			_ = os.Remove(path)
+		}
+	}, nil
+}
+
+// create 以 O_EXCL 创建租约文件, 文件已存在时返回 false
+func (l *leaseLocker) create(path string, owner string) (bool, error) {
+	data, err := json.Marshal(leaseRecord{Owner: owner, Expires: time.Now().Add(l.ttl)})
+	if err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, errors.Join(err, os.Remove(path))
+	}
+	return true, nil
+}
+
+// takeOverStale 删除已过期(持有者崩溃)的租约. 先 rename 到唯一的文件名再核对内容,
+// 并发接管时只有一个进程能移走同一份过期租约
+func (l *leaseLocker) takeOverStale(path string, key string) error {
+	record, err := readLease(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	// 正在写入的租约文件可能暂时为空, 超过 ttl 仍无法解析才视为过期
+	if err != nil {
+		info, statErr := os.Stat(path)
+		if statErr != nil || time.Since(info.ModTime()) < l.ttl {
+			return nil
+		}
+	} else if time.Now().Before(record.Expires) {
+		return nil
+	}
+
+	stale := fmt.Sprintf("%s.stale-%d", path, time.Now().UnixNano())
+	if err := os.Rename(path, stale); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	moved, movedErr := readLease(stale)
+	if err == nil && (movedErr != nil || moved != record) {
+		// 移走的是其它进程刚创建的租约, 放回原处
+		if linkErr := os.Link(stale, path); linkErr != nil && !errors.Is(linkErr, fs.ErrExist) {
+			return linkErr
+		}
+		return os.Remove(stale)
+	}
+	if err == nil {
+		logWarning("repo lock lease of %s held by %s expired at %s, taking over\n", key, record.Owner, record.Expires.Format(time.RFC3339))
+	} else {
+		logWarning("repo lock lease of %s is unreadable, taking over: %v\n", key, err)
+	}
+	return os.Remove(stale)
+}
+
+// renew 每 ttl/3 延长一次租约, 发现租约已被接管时记录错误
+func (l *leaseLocker) renew(path string, key string, owner string, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		record, err := readLease(path)
+		if err != nil || record.Owner != owner {
+			logError("repo lock lease of %s lost, owner: %s, err: %v\n", key, record.Owner, err)
+			return
+		}
+		data, err := json.Marshal(leaseRecord{Owner: owner, Expires: time.Now().Add(l.ttl)})
+		if err == nil {
+			tmp := path + ".renew-" + owner
+			if err = os.WriteFile(tmp, data, 0644); err == nil {
+				err = os.Rename(tmp, path)
+			}
+		}
+		if err != nil {
+			logWarning("renew repo lock lease of %s failed: %v\n", key, err)
+		}
+	}
+}
+
+func readLease(path string) (leaseRecord, error) {
+	var record leaseRecord
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package gitc
+
+import (
+	"context"
+	"errors"
+)
+
+// flockLocker 在不支持 flock 的平台上不可用
+type flockLocker struct {
+	dir string
+}
+
+func (l *flockLocker) Name() string { return LockProviderFlock }
+
+func (l *flockLocker) Lock(context.Context, string) (func(), error) {
+	return nil, errors.New("flock repo lock provider is not supported on this platform")
+}
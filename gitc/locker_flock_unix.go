@@ -0,0 +1,50 @@
+//go:build unix
+
+package gitc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// flockLocker 以 flock 锁定共享目录中的锁文件; 进程崩溃后锁由内核(NFS 上由服务端)自动释放
+type flockLocker struct {
+	dir string
+}
+
+func (l *flockLocker) Name() string { return LockProviderFlock }
+
+func (l *flockLocker) Lock(ctx context.Context, key string) (func(), error) {
+	path := lockFilePath(l.dir, key, ".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			f.Close()
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
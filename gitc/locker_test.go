@@ -0,0 +1,76 @@
+package gitc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRepoLockers 测试跨进程锁的互斥与释放, 两个 locker 实例模拟两个进程
+func TestRepoLockers(t *testing.T) {
+	dir := t.TempDir()
+	lockers := map[string][2]RepoLocker{
+		LockProviderFlock: {&flockLocker{dir: dir}, &flockLocker{dir: dir}},
+		LockProviderLease: {newLeaseLocker(dir, 60*time.Millisecond), newLeaseLocker(dir, 60*time.Millisecond)},
+	}
+	for name, pair := range lockers {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			release, err := pair[0].Lock(ctx, "owner/repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 持有时间超过租约有效期, 续期使锁保持有效
+			waitCtx, cancel := context.WithTimeout(ctx, 150*time.Millisecond)
+			defer cancel()
+			if _, err := pair[1].Lock(waitCtx, "owner/repo"); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected lock to be held, got %v", err)
+			}
+			other, err := pair[1].Lock(ctx, "owner/other")
+			if err != nil {
+				t.Fatal(err)
+			}
+			other()
+
+			release()
+			release, err = pair[1].Lock(ctx, "owner/repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			release()
+		})
+	}
+}
+
+// TestLeaseLockerStale 测试持有者崩溃后过期的租约被接管
+func TestLeaseLockerStale(t *testing.T) {
+	dir := t.TempDir()
+	path := lockFilePath(dir, "owner/repo", ".lease")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(leaseRecord{Owner: "crashed:1:0", Expires: time.Now().Add(-time.Second)})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	locker := newLeaseLocker(dir, time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	release, err := locker.Lock(ctx, "owner/repo")
+	if err != nil {
+		t.Fatalf("stale lease not taken over: %v", err)
+	}
+	record, err := readLease(path)
+	if err != nil || record.Owner == "crashed:1:0" {
+		t.Fatalf("unexpected lease: %+v, %v", record, err)
+	}
+	release()
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 0 {
+		t.Fatalf("lease files left behind: %v", entries)
+	}
+}
@@ -0,0 +1,424 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"smart-git/config"
+	"smart-git/database"
+	"smart-git/database/schema"
+
+	"github.com/go-git/go-git/v6"
+)
+
+// Maintainer 定期合并镜像中 fetch 产生的小 pack 与松散对象, 清理不可达对象与遗留的临时文件
+type Maintainer struct {
+	basedir        string
+	enabled        bool
+	interval       time.Duration
+	packThreshold  int
+	looseThreshold int
+	grace          time.Duration
+	packGrace      time.Duration
+}
+
+var (
+	maintenanceMu     sync.RWMutex
+	activeMaintenance *Maintainer
+)
+
+// SetupMaintenance 根据配置初始化仓库维护; 未启用定时维护时仍可通过 MaintainRepo 手动执行
+func SetupMaintenance(cfg *config.Config) error {
+	mc := cfg.Maintenance
+	if mc.Enabled && mc.Interval <= 0 {
+		return errors.New("maintenance.interval must be positive when maintenance is enabled")
+	}
+	if mc.PackThreshold < 0 || mc.LooseThreshold < 0 || mc.PruneGrace < 0 || mc.ReplacedPackGrace < 0 {
+		return errors.New("maintenance thresholds must not be negative")
+	}
+
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	activeMaintenance = &Maintainer{
+		basedir:        cfg.Server.BaseDir,
+		enabled:        mc.Enabled,
+		interval:       mc.Interval,
+		packThreshold:  mc.PackThreshold,
+		looseThreshold: mc.LooseThreshold,
+		grace:          mc.PruneGrace,
+		packGrace:      mc.ReplacedPackGrace,
+	}
+	return nil
+}
+
+// CurrentMaintainer 返回全局的仓库维护配置, 未初始化时返回 nil
+func CurrentMaintainer() *Maintainer {
+	maintenanceMu.RLock()
+	defer maintenanceMu.RUnlock()
+	return activeMaintenance
+}
+
+// StartMaintenance 启用定时维护时在后台每隔 interval 检查一次全部仓库, ctx 结束时停止
+func StartMaintenance(ctx context.Context) {
+	m := CurrentMaintainer()
+	if m == nil || !m.enabled {
+		return
+	}
+	logInfo("repo maintenance scheduled every %s, pack threshold: %d, loose threshold: %d\n", m.interval, m.packThreshold, m.looseThreshold)
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.scan(ctx)
+			}
+		}
+	}()
+}
+
+// ObjectStats 为镜像 objects 目录的统计
+type ObjectStats struct {
+	Packs int
+	Loose int
+	Size  int64
+}
+
+// RepoObjectStats 统计镜像的 pack 数量、松散对象数量与 objects 目录的字节数
+func RepoObjectStats(localPath string) (ObjectStats, error) {
+	var stats ObjectStats
+	objectsDir := filepath.Join(localPath, "objects")
+	err := filepath.WalkDir(objectsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		stats.Size += info.Size()
+		dir := filepath.Base(filepath.Dir(path))
+		switch {
+		case dir == "pack" && filepath.Ext(path) == ".pack":
+			stats.Packs++
+		case len(dir) == 2 && filepath.Dir(filepath.Dir(path)) == objectsDir && !strings.HasPrefix(d.Name(), "tmp_"):
+			stats.Loose++
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// Due 判断镜像的 pack 或松散对象数量是否达到维护阈值, 阈值为 0 时不检查该项
+func (m *Maintainer) Due(stats ObjectStats) bool {
+	return (m.packThreshold > 0 && stats.Packs >= m.packThreshold) ||
+		(m.looseThreshold > 0 && stats.Loose >= m.looseThreshold)
+}
+
+// scan 依次维护达到阈值的仓库与对象池, 同一时间只维护一个仓库; 定时维护以后台优先级排队, 让出给交互式请求的同步
+func (m *Maintainer) scan(ctx context.Context) {
+	ctx = WithPriority(ctx, PriorityBackground)
+	records, err := GetAllRepoData()
+	if err != nil {
+		logWarning("list repos for maintenance failed: %v\n", err)
+		return
+	}
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return
+		}
+		if record.Status != RepoStatusSynced && record.Status != RepoStatusOrphaned {
+			continue
+		}
+		localPath := record.LocalPath
+		if localPath == "" {
+			localPath = RepoPath(m.basedir, record.RepoUser, record.RepoName)
+		}
+		stats, err := RepoObjectStats(localPath)
+		if err != nil || !m.Due(stats) {
+			m.expireRetired(localPath)
+			continue
+		}
+		if _, err := m.run(ctx, record.RepoUser, record.RepoName, localPath); err != nil {
+			logWarning("repo maintenance failed: %v, repo: %s/%s\n", err, record.RepoUser, record.RepoName)
+		}
+	}
+	m.scanPools(ctx)
+}
+
+// MaintainRepo 立即维护仓库, 不检查阈值
+func MaintainRepo(ctx context.Context, basedir string, userName string, repoName string) (*schema.MaintenanceRecord, error) {
+	m := CurrentMaintainer()
+	if m == nil {
+		return nil, errors.New("repo maintenance is not set up")
+	}
+	return m.run(ctx, userName, repoName, RepoPath(basedir, userName, repoName))
+}
+
+// run 经任务队列在独占锁下执行 repack、prune 与临时文件清理, 等待正在读取镜像的请求结束后才删除旧 pack;
+// 独占锁只能等待本进程的读取, 共享存储时被替换的旧 pack 保留 replacedPackGrace 后才删除. 结果按仓库记录
+func (m *Maintainer) run(ctx context.Context, userName string, repoName string, localPath string) (*schema.MaintenanceRecord, error) {
+	var record *schema.MaintenanceRecord
+	err := Jobs().Run(ctx, JobKindMaintenance, userName+"/"+repoName, "", func(ctx context.Context) error {
+		unlock, err := lockRepo(ctx, userName, repoName)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		record, err = m.maintainLocked(ctx, userName, repoName, localPath)
+		return err
+	})
+	return record, err
+}
+
+// maintainLocked 维护仓库或对象池, 调用方需持有独占锁
+func (m *Maintainer) maintainLocked(ctx context.Context, userName string, repoName string, localPath string) (*schema.MaintenanceRecord, error) {
+	if !repoIsUsable(localPath) {
+		return nil, ErrRepoNotMirrored
+	}
+	record := &schema.MaintenanceRecord{RepoUser: userName, RepoName: repoName, Time: time.Now()}
+	before, err := RepoObjectStats(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Repacked, err = repackRepo(ctx, localPath, m.grace, SharedStorage())
+	_, expireErr := expireRetiredPacks(localPath, m.packGrace)
+	err = errors.Join(err, expireErr)
+	stale, cleanErr := cleanStaleFiles(localPath, m.grace)
+	if rel, relErr := filepath.Rel(m.basedir, localPath); relErr == nil && !strings.HasPrefix(rel, "..") {
+		// 持有独占锁时该仓库没有进行中的同步, 暂存目录中的内容都是崩溃遗留
+		cleanErr = errors.Join(cleanErr, os.RemoveAll(filepath.Join(stagingDir(m.basedir), rel)))
+	}
+	err = errors.Join(err, cleanErr)
+
+	after, statsErr := RepoObjectStats(localPath)
+	err = errors.Join(err, statsErr)
+	record.Duration = time.Since(record.Time)
+	record.PacksBefore, record.PacksAfter = before.Packs, after.Packs
+	record.LooseBefore, record.LooseAfter = before.Loose, after.Loose
+	record.SizeBefore, record.SizeAfter = before.Size, after.Size
+	record.StaleFiles = stale
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if saveErr := database.DB.SaveMaintenanceRecord(record); saveErr != nil {
+		logWarning("save maintenance record failed: %v, repo: %s/%s\n", saveErr, userName, repoName)
+	}
+	logInfo("仓库 '%s/%s' 维护完成, 耗时 %s, pack %d -> %d, 松散对象 %d -> %d, 大小 %d -> %d, 清理临时文件 %d 个。\n",
+		userName, repoName, record.Duration, before.Packs, after.Packs, before.Loose, after.Loose, before.Size, after.Size, stale)
+	return record, err
+}
+
+// repackRepo 将对象合并为一个 pack 并删除早于 grace 的不可达对象. 系统 git 使用 gc 但不打包引用,
+// go-git 无法改写 packed-refs 中的内部引用; go-git 不能遍历浅镜像与 blobless 镜像, 跳过.
+// retire 为 true 时先将旧 pack 硬链接到 objects/retired, 其它进程正在读取的旧 pack 在 repack 删除后仍然存在
+func repackRepo(ctx context.Context, localPath string, grace time.Duration, retire bool) (bool, error) {
+	cutoff := time.Now().Add(-grace)
+	if sys := SystemGitBackend(); sys != nil {
+		return retireAround(localPath, retire, func() error {
+			return sys.Run(ctx, localPath, "-c", "gc.packRefs=false", "-c", "gc.autoDetach=false",
+				"gc", "--quiet", "--prune="+cutoff.UTC().Format(time.RFC3339))
+		})
+	}
+	if IsPartialRepo(localPath) {
+		return false, nil
+	}
+	// 借用 alternates 对象的镜像(对象池成员)由对象池维护, go-git 的 repack 会把借用的对象复制回镜像
+	if dirs, err := AlternateObjectDirs(localPath); err != nil || len(dirs) > 0 {
+		return false, err
+	}
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return false, err
+	}
+	if _, err := retireAround(localPath, retire, func() error {
+		return repo.RepackObjects(&git.RepackConfig{OnlyDeletePacksOlderThan: cutoff})
+	}); err != nil {
+		return false, err
+	}
+	// 重新打开仓库, 丢弃已删除 pack 的索引缓存
+	if repo, err = openRepo(localPath); err != nil {
+		return false, err
+	}
+	err = repo.Prune(git.PruneOptions{OnlyObjectsOlderThan: cutoff, Handler: repo.DeleteObject})
+	return err == nil, err
+}
+
+// retireAround 在 retire 为 true 时于 repack 前保留旧 pack, repack 后撤回仍在 objects/pack 中的 pack
+func retireAround(localPath string, retire bool, repack func() error) (bool, error) {
+	if !retire {
+		err := repack()
+		return err == nil, err
+	}
+	dir, err := retirePacks(localPath)
+	if err != nil {
+		return false, err
+	}
+	err = repack()
+	return err == nil, errors.Join(err, unretireLivePacks(localPath, dir))
+}
+
+// retiredPacksDir 为 objects 下保留被替换 pack 的目录, 其中每次维护一个以纳秒时间戳命名的子目录
+const retiredPacksDir = "retired"
+
+// retirePacks 将 objects/pack 中的 pack 与辅助文件硬链接到新的保留目录并返回该目录.
+// 共享存储上其它进程可能仍打开着这些文件, 复制得到的新文件无法让它们继续读取, 不能硬链接时返回错误
+func retirePacks(localPath string) (string, error) {
+	packDir := filepath.Join(localPath, "objects", "pack")
+	entries, err := os.ReadDir(packDir)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(localPath, "objects", retiredPacksDir, strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), "pack-") {
+			continue
+		}
+		if err := os.Link(filepath.Join(packDir, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return "", errors.Join(fmt.Errorf("retire %s: %w", entry.Name(), err), os.RemoveAll(dir))
+		}
+	}
+	return dir, nil
+}
+
+// unretireLivePacks 删除保留目录中 repack 后仍在 objects/pack 中的文件, 目录为空时一并删除
+func unretireLivePacks(localPath string, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	live := 0
+	for _, entry := range entries {
+		if !fileExists(filepath.Join(localPath, "objects", "pack", entry.Name())) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+		live++
+	}
+	if live == len(entries) {
+		return os.Remove(dir)
+	}
+	return nil
+}
+
+// expireRetiredPacks 删除保留时间达到 grace 的被替换 pack, 返回删除的目录数. 保留的文件都是硬链接, 删除不影响 objects/pack, 不需要持有仓库锁
+func expireRetiredPacks(localPath string, grace time.Duration) (int, error) {
+	root := filepath.Join(localPath, "objects", retiredPacksDir)
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-grace)
+	removed := 0
+	var errs []error
+	for _, entry := range entries {
+		nanos, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil || time.Unix(0, nanos).After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
+
+// expireRetired 在未达到维护阈值的仓库或对象池中删除到期的被替换 pack
+func (m *Maintainer) expireRetired(localPath string) {
+	if _, err := expireRetiredPacks(localPath, m.packGrace); err != nil {
+		logWarning("expire retired packs failed: %v, path: %s\n", err, localPath)
+	}
+}
+
+// packSidecarExts 为随 pack 生成的辅助文件, 对应的 .pack 不存在时属于遗留文件
+var packSidecarExts = map[string]bool{".idx": true, ".rev": true, ".bitmap": true, ".promisor": true, ".mtimes": true}
+
+// cleanStaleFiles 删除修改时间早于 grace 的临时文件与锁文件, 以及 .pack 已删除的辅助文件
+func cleanStaleFiles(localPath string, grace time.Duration) (int, error) {
+	cutoff := time.Now().Add(-grace)
+	removed := 0
+	remove := func(path string) error {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed++
+		return nil
+	}
+
+	var errs []error
+	// 仓库根目录: HEAD.lock、config.lock、packed-refs.lock、shallow.lock 与 go-git 的临时文件
+	if entries, err := os.ReadDir(localPath); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() && (strings.HasSuffix(entry.Name(), ".lock") || strings.HasPrefix(entry.Name(), "._")) {
+				errs = append(errs, remove(filepath.Join(localPath, entry.Name())))
+			}
+		}
+	}
+	errs = append(errs, filepath.WalkDir(filepath.Join(localPath, "refs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(d.Name(), ".lock") {
+			return nil
+		}
+		return remove(path)
+	}))
+	objectsDir := filepath.Join(localPath, "objects")
+	errs = append(errs, filepath.WalkDir(objectsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		if strings.HasPrefix(name, "tmp_") || strings.HasPrefix(name, ".tmp") {
+			return remove(path)
+		}
+		if filepath.Base(filepath.Dir(path)) == "pack" && packSidecarExts[filepath.Ext(name)] {
+			if _, err := os.Stat(strings.TrimSuffix(path, filepath.Ext(name)) + ".pack"); errors.Is(err, fs.ErrNotExist) {
+				return remove(path)
+			}
+		}
+		return nil
+	}))
+	return removed, errors.Join(errs...)
+}
+
+// MaintenanceRecords 返回全部仓库最近一次维护的结果
+func MaintenanceRecords() ([]schema.MaintenanceRecord, error) {
+	return database.DB.GetAllMaintenanceRecords()
+}
+
+// GetMaintenanceRecord 返回仓库最近一次维护的结果
+func GetMaintenanceRecord(userName string, repoName string) (*schema.MaintenanceRecord, bool, error) {
+	return database.DB.GetMaintenanceRecord(userName, repoName)
+}
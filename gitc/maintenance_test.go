@@ -0,0 +1,263 @@
+package gitc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"smart-git/config"
+
+	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/object"
+)
+
+// TestMaintainRepo 测试维护合并多次刷新产生的 pack, 删除过期的临时文件而保留新的, 引用与快照不受影响
+func TestMaintainRepo(t *testing.T) {
+	forEachBackend(t, testMaintainRepo)
+}
+
+func testMaintainRepo(t *testing.T, backend string) {
+	basedir, src, cfg := newTestMirror(t, backend)
+	// go-git 每次刷新写入一个 pack, 系统 git 从本地仓库获取少量对象时写为松散对象
+	cfg.Maintenance.PackThreshold = 4
+	cfg.Maintenance.LooseThreshold = 4
+	if err := SetupMaintenance(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	localPath := filepath.Join(basedir, "owner", "repo")
+	var head plumbing.Hash
+	for i := 0; i < 4; i++ {
+		head = src.commit("commit")
+		if i > 0 {
+			data, _, err := GetRepoData("owner", "repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data.ExpireTime = time.Now().Add(-time.Second)
+			if err := SaveRepoData(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if _, err := CreateSnapshot(basedir, "owner", "repo", "v1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	stats, err := RepoObjectStats(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CurrentMaintainer().Due(stats) {
+		t.Fatalf("repo with %d packs and %d loose objects should be due", stats.Packs, stats.Loose)
+	}
+
+	// 早于 pruneGrace 的 pack 才会被删除, 将现有文件与遗留的临时文件改为两小时前
+	old := time.Now().Add(-2 * time.Hour)
+	packDir := filepath.Join(localPath, "objects", "pack")
+	stale := []string{
+		filepath.Join(packDir, "tmp_pack_stale"),
+		filepath.Join(packDir, "pack-0000000000000000000000000000000000000000.rev"),
+		filepath.Join(localPath, "packed-refs.lock"),
+	}
+	for _, path := range stale {
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = filepath.Walk(filepath.Join(localPath, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return os.Chtimes(path, old, old)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := filepath.Join(packDir, "tmp_pack_fresh")
+	if err := os.WriteFile(fresh, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(localPath, "packed-refs.lock"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := MaintainRepo(ctx, basedir, "owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.Repacked || record.PacksBefore+record.LooseBefore < 4 || record.PacksAfter != 1 || record.LooseAfter != 0 || record.StaleFiles == 0 {
+		t.Fatalf("unexpected maintenance record: %+v", record)
+	}
+	for _, path := range stale {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("stale file %s not removed: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("fresh temp file removed: %v", err)
+	}
+	entries, err := os.ReadDir(packDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if packSidecarExts[ext] {
+			if _, err := os.Stat(filepath.Join(packDir, strings.TrimSuffix(entry.Name(), ext)+".pack")); err != nil {
+				t.Fatalf("orphaned %s left after repack", entry.Name())
+			}
+		}
+	}
+
+	saved, ok, err := GetMaintenanceRecord("owner", "repo")
+	if err != nil || !ok || saved.PacksAfter != 1 {
+		t.Fatalf("maintenance record not saved: %+v, %v, %v", saved, ok, err)
+	}
+
+	mirror, err := openRepo(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter, err := mirror.Log(&git.LogOptions{From: head})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err := iter.ForEach(func(*object.Commit) error { count++; return nil }); err != nil || count != 4 {
+		t.Fatalf("history damaged after maintenance: %d commits, %v", count, err)
+	}
+	snapshots, err := ListSnapshots(basedir, "owner", "repo")
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("snapshot lost after maintenance: %+v, %v", snapshots, err)
+	}
+	if _, err := mirror.CommitObject(plumbing.NewHash(snapshots[0].Head)); err != nil {
+		t.Fatalf("snapshot objects pruned: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(localPath, "objects", retiredPacksDir)); !os.IsNotExist(err) {
+		t.Fatalf("replaced packs retained without shared storage: %v", err)
+	}
+}
+
+// TestMaintainSharedStorage 测试共享存储时被替换的 pack 以硬链接保留到 replacedPackGrace 之后,
+// 其它进程已打开的旧 pack 仍指向保留的文件
+func TestMaintainSharedStorage(t *testing.T) {
+	forEachBackend(t, testMaintainSharedStorage)
+}
+
+func testMaintainSharedStorage(t *testing.T, backend string) {
+	basedir, src, cfg := newTestMirror(t, backend)
+	cfg.RepoLock.Provider = LockProviderLease
+	cfg.Maintenance.PruneGrace = 0
+	cfg.Maintenance.ReplacedPackGrace = time.Hour
+	if err := setupLocker(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = setupLocker(config.DefaultConfig()) })
+	if err := SetupMaintenance(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	localPath := filepath.Join(basedir, "owner", "repo")
+	src.commitFile("v1")
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	// 系统 git 从本地仓库克隆少量对象时写为松散对象, 先维护一次得到 pack
+	if _, err := MaintainRepo(ctx, basedir, "owner", "repo"); err != nil {
+		t.Fatal(err)
+	}
+	packDir := filepath.Join(localPath, "objects", "pack")
+	oldPacks, err := filepath.Glob(filepath.Join(packDir, "pack-*.pack"))
+	if err != nil || len(oldPacks) != 1 {
+		t.Fatalf("expected one pack after maintenance: %v, %v", oldPacks, err)
+	}
+	// 模拟其它进程正在读取的旧 pack
+	reader, err := os.Open(oldPacks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	src.commitFile("v2")
+	data, _, err := GetRepoData("owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.ExpireTime = time.Now().Add(-time.Second)
+	if err := SaveRepoData(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := MaintainRepo(ctx, basedir, "owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.Repacked || record.PacksAfter != 1 {
+		t.Fatalf("unexpected maintenance record: %+v", record)
+	}
+	if _, err := os.Stat(oldPacks[0]); !os.IsNotExist(err) {
+		t.Fatalf("replaced pack still in objects/pack: %v", err)
+	}
+	retired, err := filepath.Glob(filepath.Join(localPath, "objects", retiredPacksDir, "*", filepath.Base(oldPacks[0])))
+	if err != nil || len(retired) != 1 {
+		t.Fatalf("replaced pack not retained: %v, %v", retired, err)
+	}
+	opened, err := reader.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(retired[0]); err != nil || !os.SameFile(info, opened) {
+		t.Fatalf("retained pack is not the opened file: %v", err)
+	}
+	// 保留的 pack 只有新 pack 之外的文件, 不计入 pack 数量与仓库大小估算
+	live, err := filepath.Glob(filepath.Join(packDir, "pack-*.pack"))
+	if err != nil || len(live) != 1 {
+		t.Fatalf("expected one live pack: %v, %v", live, err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(retired[0]), filepath.Base(live[0]))); !os.IsNotExist(err) {
+		t.Fatalf("live pack retained: %v", err)
+	}
+	if stats, err := RepoObjectStats(localPath); err != nil || stats.Packs != 1 {
+		t.Fatalf("retained packs counted: %+v, %v", stats, err)
+	}
+	size, err := objectsSize(filepath.Join(localPath, "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 未到期的 pack 保留, 到期后删除
+	if n, err := expireRetiredPacks(localPath, time.Hour); err != nil || n != 0 {
+		t.Fatalf("unexpired packs removed: %d, %v", n, err)
+	}
+	if n, err := expireRetiredPacks(localPath, 0); err != nil || n == 0 {
+		t.Fatalf("expired packs not removed: %d, %v", n, err)
+	}
+	if left, err := filepath.Glob(filepath.Join(localPath, "objects", retiredPacksDir, "*")); err != nil || len(left) != 0 {
+		t.Fatalf("expired packs still retained: %v, %v", left, err)
+	}
+	if after, err := objectsSize(filepath.Join(localPath, "objects")); err != nil || after != size {
+		t.Fatalf("retained packs counted in objects size: %d -> %d, %v", size, after, err)
+	}
+	report, err := verifyRepo(ctx, localPath, true)
+	if err == nil {
+		err = report.Err()
+	}
+	if err != nil {
+		t.Fatalf("mirror damaged after expiring replaced packs: %v", err)
+	}
+}
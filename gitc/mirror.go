@@ -0,0 +1,445 @@
+package gitc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"smart-git/config"
+
+	"github.com/go-git/go-billy/v6"
+	"github.com/go-git/go-billy/v6/memfs"
+	"github.com/go-git/go-billy/v6/osfs"
+	"github.com/go-git/go-billy/v6/util"
+	"github.com/go-git/go-git/v6"
+	gconfig "github.com/go-git/go-git/v6/config"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/cache"
+	"github.com/go-git/go-git/v6/storage/filesystem"
+)
+
+const (
+	MirrorFull     = "full"
+	MirrorBranches = "branches"
+	MirrorRefs     = "refs"
+
+	// InfiniteDepth 与 git fetch --unshallow 使用的深度一致, 表示取回全部历史
+	InfiniteDepth = 0x7fffffff
+)
+
+// MirrorSpec 描述仓库在本地的镜像方式
+type MirrorSpec struct {
+	Mode           string
+	Refs           []string
+	Refspecs       []string
+	HideRefs       []string
+	Depth          int
+	Blobless       bool
+	DeepenOnDemand bool
+}
+
+var (
+	mirrorMu    sync.RWMutex
+	mirrorRules []config.MirrorRule
+)
+
+// SetupMirrors 校验并加载按仓库的镜像规则; blobless 镜像依赖系统 git 按需获取缺失对象
+func SetupMirrors(cfg *config.Config) error {
+	for _, rule := range cfg.Mirror.Rules {
+		if rule.Pattern == "" {
+			return errors.New("mirror rule pattern is required")
+		}
+		switch rule.Mode {
+		case "", MirrorFull, MirrorBranches:
+		case MirrorRefs:
+			if len(rule.Refs) == 0 {
+				return fmt.Errorf("mirror rule %s: refs is required when mode = \"refs\"", rule.Pattern)
+			}
+		default:
+			return fmt.Errorf("mirror rule %s: unknown mode: %s", rule.Pattern, rule.Mode)
+		}
+		if len(rule.Refspecs) > 0 && rule.Mode != "" && rule.Mode != MirrorFull {
+			return fmt.Errorf("mirror rule %s: refspecs cannot be used with mode = \"%s\"", rule.Pattern, rule.Mode)
+		}
+		for _, refSpec := range rule.Refspecs {
+			if err := gconfig.RefSpec(refSpec).Validate(); err != nil {
+				return fmt.Errorf("mirror rule %s: invalid refspec %s: %w", rule.Pattern, refSpec, err)
+			}
+		}
+		for _, hideRef := range rule.HideRefs {
+			if strings.Trim(hideRef, "!/") == "" {
+				return fmt.Errorf("mirror rule %s: empty hideRefs pattern", rule.Pattern)
+			}
+		}
+		if rule.Depth < 0 {
+			return fmt.Errorf("mirror rule %s: depth must not be negative", rule.Pattern)
+		}
+		if rule.Blobless && SystemGitBackend() == nil {
+			return fmt.Errorf("mirror rule %s: blobless requires git.backend = \"system\"", rule.Pattern)
+		}
+	}
+
+	mirrorMu.Lock()
+	defer mirrorMu.Unlock()
+	mirrorRules = cfg.Mirror.Rules
+	return nil
+}
+
+// MirrorFor 返回 owner/repo 的镜像方式, 没有匹配的规则时为完整镜像
+func MirrorFor(userName string, repoName string) MirrorSpec {
+	mirrorMu.RLock()
+	defer mirrorMu.RUnlock()
+	for _, rule := range mirrorRules {
+		if !config.MatchRepo(rule.Pattern, userName, repoName) {
+			continue
+		}
+		mode := rule.Mode
+		if mode == "" {
+			mode = MirrorFull
+		}
+		return MirrorSpec{
+			Mode:           mode,
+			Refs:           rule.Refs,
+			Refspecs:       rule.Refspecs,
+			HideRefs:       rule.HideRefs,
+			Depth:          rule.Depth,
+			Blobless:       rule.Blobless,
+			DeepenOnDemand: rule.DeepenOnDemand,
+		}
+	}
+	return MirrorSpec{Mode: MirrorFull}
+}
+
+// IsFull 判断是否为包含全部引用与全部对象的完整镜像
+func (s MirrorSpec) IsFull() bool {
+	return s.AllRefs() && s.Depth == 0 && !s.Blobless
+}
+
+// AllRefs 判断是否镜像上游的全部引用, 否则同步时不额外拉取 tag
+func (s MirrorSpec) AllRefs() bool {
+	return s.Mode == MirrorFull && len(s.Refspecs) == 0
+}
+
+// RefSpecs 返回同步使用的 refspec, 配置了自定义 refspec 时直接使用
+func (s MirrorSpec) RefSpecs() []string {
+	if len(s.Refspecs) > 0 {
+		return s.Refspecs
+	}
+	switch s.Mode {
+	case MirrorBranches:
+		return []string{"+refs/heads/*:refs/heads/*"}
+	case MirrorRefs:
+		specs := make([]string, 0, len(s.Refs))
+		for _, ref := range s.Refs {
+			if !strings.HasPrefix(ref, "refs/") {
+				ref = "refs/heads/" + ref
+			}
+			specs = append(specs, "+"+ref+":"+ref)
+		}
+		return specs
+	default:
+		return []string{"+refs/*:refs/*"}
+	}
+}
+
+// RefHidden 按 git 的 hideRefs 规则判断引用是否从广告中隐藏: 模式为引用名前缀
+// (需在 "/" 处结束), "!" 开头表示取消隐藏, 后面的模式优先
+func RefHidden(hideRefs []string, name string) bool {
+	for i := len(hideRefs) - 1; i >= 0; i-- {
+		pattern, negate := strings.CutPrefix(hideRefs[i], "!")
+		pattern = strings.TrimRight(pattern, "/")
+		if rest, ok := strings.CutPrefix(name, pattern); ok && (rest == "" || rest[0] == '/') {
+			return !negate
+		}
+	}
+	return false
+}
+
+// WithDepth 返回使用指定深度同步的副本
+func (s MirrorSpec) WithDepth(depth int) MirrorSpec {
+	s.Depth = depth
+	return s
+}
+
+// IsShallowRepo 判断本地仓库是否为浅仓库
+func IsShallowRepo(localPath string) bool {
+	info, err := os.Stat(filepath.Join(localPath, "shallow"))
+	return err == nil && info.Size() > 0
+}
+
+// IsPartialRepo 判断本地仓库是否缺少部分历史或对象(浅镜像或 blobless 镜像)
+func IsPartialRepo(localPath string) bool {
+	if IsShallowRepo(localPath) {
+		return true
+	}
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return false
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return false
+	}
+	return cfg.Raw.Section("extensions").Option("partialclone") != "" ||
+		cfg.Raw.Section("remote").Subsection("origin").Option("promisor") == "true"
+}
+
+// MirrorDepth 返回浅镜像当前的深度, 完整历史时返回 0
+func MirrorDepth(localPath string, spec MirrorSpec) int {
+	if !IsShallowRepo(localPath) {
+		return 0
+	}
+	repo, err := openRepo(localPath)
+	if err == nil {
+		if cfg, err := repo.Config(); err == nil {
+			if depth, err := strconv.Atoi(cfg.Raw.Section("smart-git").Option("depth")); err == nil && depth > 0 {
+				return depth
+			}
+		}
+	}
+	// 未记录深度时按配置的深度处理
+	return max(spec.Depth, 1)
+}
+
+// setMirrorDepth 记录浅镜像当前的深度, 后续刷新沿用该深度, 不会把按需加深的历史截断
+func setMirrorDepth(localPath string, depth int) error {
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return err
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Raw.Section("smart-git").SetOption("depth", strconv.Itoa(depth))
+	return repo.SetConfig(cfg)
+}
+
+// syncSpec 返回刷新已有镜像时使用的同步方式: 浅镜像按当前深度刷新, 已加深为完整历史的镜像不再设置深度
+func syncSpec(localPath string, spec MirrorSpec) MirrorSpec {
+	if spec.Depth == 0 {
+		return spec
+	}
+	return spec.WithDepth(MirrorDepth(localPath, spec))
+}
+
+// DeepenRepo 将浅镜像加深到 depth 个提交, depth 为 InfiniteDepth 时取回全部历史
+func DeepenRepo(ctx context.Context, basedir string, userName string, repoName string, repoURL string, depth int, cfg *config.Config) error {
+	lockKey := userName + "/" + repoName
+	unlock, err := lockRepo(ctx, userName, repoName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	localPath := RepoPath(basedir, userName, repoName)
+	spec := MirrorFor(userName, repoName)
+	current := MirrorDepth(localPath, spec)
+	if current == 0 || current >= depth {
+		// 等待锁期间其它请求已经完成加深
+		return nil
+	}
+
+	err = Jobs().Run(ctx, JobKindFetch, lockKey, repoURL, func(ctx context.Context) error {
+		return fetchStaged(ctx, basedir, localPath, spec.WithDepth(depth))
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+	if IsShallowRepo(localPath) {
+		if err := setMirrorDepth(localPath, depth); err != nil {
+			return err
+		}
+	}
+	logInfo("仓库 '%s' 已加深到 %d 个提交。\n", localPath, depth)
+	return finalizeSyncedRepo(basedir, localPath, repoURL, userName, repoName, cfg.Cache.Expire)
+}
+
+// PrefetchMissing 为 blobless 镜像预先从上游批量获取响应请求所需但本地缺失的对象.
+// upload-pack 调用的 pack-objects 不会按需获取缺失对象, 需要在生成 pack 之前补齐;
+// filter 为客户端请求的过滤规则, 被过滤掉的对象不需要获取. 在共享锁下查找缺失的对象,
+// 获取时持有仓库的独占锁, 与同步、维护互斥
+func PrefetchMissing(ctx context.Context, basedir string, userName string, repoName string, wants []string, haves []string, filter string) error {
+	sys := SystemGitBackend()
+	if sys == nil || len(wants) == 0 {
+		return nil
+	}
+
+	unlock, err := RLockRepo(ctx, userName, repoName)
+	if err != nil {
+		return err
+	}
+	missing, err := missingForRequest(ctx, sys, RepoPath(basedir, userName, repoName), wants, haves, filter)
+	unlock()
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+
+	unlock, err = lockRepo(ctx, userName, repoName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	localPath := RepoPath(basedir, userName, repoName)
+	// 等待锁期间其它请求或同步可能已经取回
+	missing, err = sys.missingObjects(ctx, localPath, missing)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+
+	// 与 git 的 promisor 按需获取使用相同的参数
+	_, err = sys.Output(ctx, localPath, strings.NewReader(strings.Join(missing, "\n")+"\n"),
+		"-c", "fetch.negotiationAlgorithm=noop", "fetch", "origin", "--no-tags", "--no-write-fetch-head",
+		"--recurse-submodules=no", "--filter=blob:none", "--stdin")
+	if err != nil {
+		return err
+	}
+	logInfo("prefetched %d missing objects for %s\n", len(missing), localPath)
+	return nil
+}
+
+// missingForRequest 返回生成响应需要但镜像中缺失的对象: 缺失的 want 与 want 可达、haves 不可达的缺失对象
+func missingForRequest(ctx context.Context, sys *SystemGit, localPath string, wants []string, haves []string, filter string) ([]string, error) {
+	missing, err := sys.missingObjects(ctx, localPath, wants)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"rev-list", "--objects", "--missing=print", "--ignore-missing", "--stdin"}
+	if filter != "" {
+		args = append(args, "--filter="+filter)
+	}
+	var input strings.Builder
+	for _, want := range wants {
+		input.WriteString(want + "\n")
+	}
+	for _, have := range haves {
+		input.WriteString("^" + have + "\n")
+	}
+	out, err := sys.Output(ctx, localPath, strings.NewReader(input.String()), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if oid, ok := strings.CutPrefix(line, "?"); ok {
+			missing = append(missing, oid)
+		}
+	}
+	return missing, nil
+}
+
+// pointMirrorHead 让镜像的 HEAD 指向上游默认分支; 该分支未被镜像时改为指向
+// 已镜像的第一个分支, 没有分支时分离到第一个引用
+func pointMirrorHead(localPath string, remoteHead plumbing.ReferenceName) error {
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return err
+	}
+	if remoteHead != "" {
+		if _, err := repo.Storer.Reference(remoteHead); err == nil {
+			return repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, remoteHead))
+		}
+	}
+
+	iter, err := repo.References()
+	if err != nil {
+		return err
+	}
+	var refs []*plumbing.Reference
+	_ = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && !strings.HasPrefix(ref.Name().String(), InternalRefPrefix) {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if len(refs) == 0 {
+		return errors.New("no refs mirrored from upstream")
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		bi, bj := refs[i].Name().IsBranch(), refs[j].Name().IsBranch()
+		if bi != bj {
+			return bi
+		}
+		return refs[i].Name() < refs[j].Name()
+	})
+	if refs[0].Name().IsBranch() {
+		return repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, refs[0].Name()))
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, refs[0].Hash()))
+}
+
+// partialCloneStorage 允许 go-git 打开 blobless 镜像; 缺失的对象只由系统 git 按需获取,
+// go-git 在这类仓库上只读取引用与配置
+type partialCloneStorage struct {
+	*filesystem.Storage
+}
+
+func (s partialCloneStorage) SupportsExtension(name string, value string) bool {
+	return name == "partialclone" || s.Storage.SupportsExtension(name, value)
+}
+
+// AlternatesStorage 返回可以解析 alternates 的存储, 用于借用暂存镜像或对象池对象的仓库;
+// 默认的文件系统无法访问仓库以外的对象目录
+func AlternatesStorage(localPath string) *filesystem.Storage {
+	fs := alternatesFS{Filesystem: osfs.New(localPath, osfs.WithBoundOS()), localPath: localPath}
+	return filesystem.NewStorageWithOptions(fs, cache.NewObjectLRUDefault(),
+		filesystem.Options{AlternatesFS: osfs.New("/", osfs.WithBoundOS())})
+}
+
+// alternatesFS 读取 objects/info/alternates 时返回解析为绝对路径的对象目录.
+// 对象池成员的 alternates 为相对 objects 目录的路径, go-git 按文件系统根目录解析相对路径并忽略其中的 ".."
+type alternatesFS struct {
+	billy.Filesystem
+	localPath string
+}
+
+func (fs alternatesFS) Open(name string) (billy.File, error) {
+	f, err := fs.Filesystem.Open(name)
+	if err != nil || filepath.Clean(name) != filepath.Join("objects", "info", "alternates") {
+		return f, err
+	}
+	_ = f.Close()
+	dirs, err := AlternateObjectDirs(fs.localPath)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(abs + "\n")
+	}
+	mem := memfs.New()
+	if err := util.WriteFile(mem, "alternates", buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	return mem.Open("alternates")
+}
+
+// openRepo 打开本地仓库, 兼容系统 git 创建的 blobless 镜像; 仓库有 alternates 时
+// 以文件系统根目录解析其中的绝对路径, go-git 默认的文件系统不允许访问仓库目录之外
+func openRepo(localPath string) (*git.Repository, error) {
+	if _, err := os.Stat(filepath.Join(localPath, "objects", "info", "alternates")); err == nil {
+		st := AlternatesStorage(localPath)
+		repo, err := git.Open(st, nil)
+		if errors.Is(err, git.ErrUnknownExtension) {
+			return git.Open(partialCloneStorage{st}, nil)
+		}
+		return repo, err
+	}
+	repo, err := git.PlainOpen(localPath)
+	if !errors.Is(err, git.ErrUnknownExtension) {
+		return repo, err
+	}
+	st := filesystem.NewStorage(osfs.New(localPath), cache.NewObjectLRUDefault())
+	return git.Open(partialCloneStorage{st}, nil)
+}
@@ -0,0 +1,96 @@
+package gitc
+
+import (
+	"reflect"
+	"testing"
+
+	"smart-git/config"
+)
+
+// TestMirrorForRules 测试镜像规则的匹配顺序与 refspec 生成
+func TestMirrorForRules(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Mirror.Rules = []config.MirrorRule{
+		{Pattern: "torvalds/linux", Mode: MirrorBranches, Depth: 1},
+		{Pattern: "torvalds/*", Mode: MirrorRefs, Refs: []string{"master", "refs/tags/v*"}},
+		{Pattern: "golang/tools", Refspecs: []string{"+refs/heads/*:refs/heads/*"}, HideRefs: []string{"refs/pull"}},
+	}
+	if err := SetupMirrors(cfg); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+	defer func() {
+		cfg.Mirror.Rules = nil
+		_ = SetupMirrors(cfg)
+	}()
+
+	spec := MirrorFor("torvalds", "linux")
+	if spec.Mode != MirrorBranches || spec.Depth != 1 || spec.IsFull() {
+		t.Fatalf("unexpected spec: %+v", spec)
+	}
+	if got := spec.RefSpecs(); !reflect.DeepEqual(got, []string{"+refs/heads/*:refs/heads/*"}) {
+		t.Fatalf("unexpected refspecs: %v", got)
+	}
+
+	spec = MirrorFor("torvalds", "subsurface")
+	want := []string{"+refs/heads/master:refs/heads/master", "+refs/tags/v*:refs/tags/v*"}
+	if got := spec.RefSpecs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected refspecs: %v", got)
+	}
+
+	spec = MirrorFor("golang", "tools")
+	if spec.IsFull() || spec.AllRefs() || !reflect.DeepEqual(spec.RefSpecs(), []string{"+refs/heads/*:refs/heads/*"}) {
+		t.Fatalf("unexpected refspecs spec: %+v", spec)
+	}
+	if !reflect.DeepEqual(spec.HideRefs, []string{"refs/pull"}) {
+		t.Fatalf("unexpected hideRefs: %v", spec.HideRefs)
+	}
+
+	spec = MirrorFor("golang", "go")
+	if !spec.IsFull() || !reflect.DeepEqual(spec.RefSpecs(), []string{"+refs/*:refs/*"}) {
+		t.Fatalf("expected full mirror, got %+v", spec)
+	}
+}
+
+// TestSetupMirrorsValidate 测试无效镜像规则在启动时报错
+func TestSetupMirrorsValidate(t *testing.T) {
+	for _, rule := range []config.MirrorRule{
+		{Mode: MirrorBranches},
+		{Pattern: "a/*", Mode: "tags"},
+		{Pattern: "a/*", Mode: MirrorRefs},
+		{Pattern: "a/*", Depth: -1},
+		{Pattern: "a/*", Mode: MirrorBranches, Refspecs: []string{"+refs/heads/*:refs/heads/*"}},
+		{Pattern: "a/*", Refspecs: []string{"refs/heads/*:refs/heads/main"}},
+		{Pattern: "a/*", HideRefs: []string{"!"}},
+		// 默认 go-git 后端不支持 blobless
+		{Pattern: "a/*", Blobless: true},
+	} {
+		cfg := config.DefaultConfig()
+		cfg.Mirror.Rules = []config.MirrorRule{rule}
+		if err := SetupMirrors(cfg); err == nil {
+			t.Fatalf("expected error for rule %+v", rule)
+		}
+	}
+}
+
+// TestRefHidden 测试 hideRefs 的前缀匹配与 "!" 取消隐藏
+func TestRefHidden(t *testing.T) {
+	hideRefs := []string{"refs/pull/", "refs/tags", "!refs/tags/v1"}
+	for name, want := range map[string]bool{
+		"refs/pull/1/head": true,
+		"refs/pull":        true,
+		"refs/pullx":       false,
+		"refs/tags/v0":     true,
+		"refs/tags/v1":     false,
+		"refs/tags/v1/rc":  false,
+		"refs/tags/v10":    true,
+		"refs/heads/main":  false,
+		"HEAD":             false,
+	} {
+		if got := RefHidden(hideRefs, name); got != want {
+			t.Fatalf("RefHidden(%s) = %v, want %v", name, got, want)
+		}
+	}
+	if RefHidden(nil, "refs/pull/1/head") {
+		t.Fatal("no patterns should hide nothing")
+	}
+}
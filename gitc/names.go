@@ -0,0 +1,35 @@
+package gitc
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// GitHub 的 owner(用户与组织)与仓库名称规则
+const (
+	MaxOwnerNameLength = 39
+	MaxRepoNameLength  = 100
+)
+
+// ErrInvalidRepoName 为 owner 或仓库名称不符合 GitHub 命名规则
+var ErrInvalidRepoName = errors.New("invalid repository name")
+
+var (
+	// owner 只含字母、数字与连字符, 不以连字符开头; 保留早期账号中连续或结尾的连字符
+	ownerNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+	// 仓库名称只含字母、数字与 . _ -, 不以连字符开头
+	repoNameRe = regexp.MustCompile(`^[A-Za-z0-9._][A-Za-z0-9._-]*$`)
+)
+
+// ValidateRepoName 检查 owner 与仓库名称, 名称会用作 BaseDir 下的目录、数据库的键与上游地址的路径.
+// 合法的名称不含路径分隔符、NUL 与其它控制字符, 不是 "." 或 "..", 也不以 "." 开头的 owner 与 .staging 等内部目录冲突
+func ValidateRepoName(userName string, repoName string) error {
+	if len(userName) > MaxOwnerNameLength || !ownerNameRe.MatchString(userName) {
+		return fmt.Errorf("%w: owner %q", ErrInvalidRepoName, userName)
+	}
+	if len(repoName) > MaxRepoNameLength || !repoNameRe.MatchString(repoName) || repoName == "." || repoName == ".." {
+		return fmt.Errorf("%w: repo %q", ErrInvalidRepoName, repoName)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package gitc
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateRepoName(t *testing.T) {
+	valid := [][2]string{
+		{"octocat", "Hello-World"},
+		{"go-git", "go-git"},
+		{"a", "b"},
+		{"WJQSERVER", ".github"},
+		{"user", "repo.git"},
+		{"legacy--name-", "under_score"},
+		{strings.Repeat("a", MaxOwnerNameLength), strings.Repeat("r", MaxRepoNameLength)},
+	}
+	for _, name := range valid {
+		if err := ValidateRepoName(name[0], name[1]); err != nil {
+			t.Fatalf("valid name %s/%s rejected: %v", name[0], name[1], err)
+		}
+	}
+	invalid := [][2]string{
+		{"", "repo"},
+		{"owner", ""},
+		{"..", "repo"},
+		{"owner", ".."},
+		{"owner", "."},
+		{".pools", "repo"},
+		{".staging", "repo"},
+		{"-owner", "repo"},
+		{"owner", "-repo"},
+		{"own/er", "repo"},
+		{"owner", "re/po"},
+		{"owner", `re\po`},
+		{"owner", "repo\x00"},
+		{"owner", "re po"},
+		{"under_score", "repo"},
+		{"owner", "repo@snapshot"},
+		{"ówner", "repo"},
+		{strings.Repeat("a", MaxOwnerNameLength+1), "repo"},
+		{"owner", strings.Repeat("r", MaxRepoNameLength+1)},
+	}
+	for _, name := range invalid {
+		if err := ValidateRepoName(name[0], name[1]); !errors.Is(err, ErrInvalidRepoName) {
+			t.Fatalf("invalid name %q/%q accepted: %v", name[0], name[1], err)
+		}
+	}
+}
+
+// FuzzValidateRepoName 检查通过校验的名称在两种布局下都只对应 basedir 下 owner/repo 位置的目录
+func FuzzValidateRepoName(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"octocat", "Hello-World"},
+		{"..", "repo"},
+		{"owner", "../../etc"},
+		{"owner", "repo%2F.."},
+		{"owner", "repo\x00"},
+		{"Owner", ".github"},
+		{"a-", "b.c_d"},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+	basedir := filepath.FromSlash("/data/repos")
+	f.Fuzz(func(t *testing.T, userName string, repoName string) {
+		if ValidateRepoName(userName, repoName) != nil {
+			return
+		}
+		if strings.ContainsAny(userName+repoName, "/\\\x00@%") {
+			t.Fatalf("name with separator or escape accepted: %q/%q", userName, repoName)
+		}
+		for name, depth := range map[string]int{LayoutFlat: 2, LayoutSharded: 4} {
+			path := layoutPath(name, basedir, userName, repoName)
+			rel, err := filepath.Rel(basedir, path)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				t.Fatalf("%s path of %q/%q escapes basedir: %s", name, userName, repoName, path)
+			}
+			parts := strings.Split(filepath.ToSlash(rel), "/")
+			if len(parts) != depth || strings.HasPrefix(parts[0], ".") {
+				t.Fatalf("%s path of %q/%q is not a repo directory: %s", name, userName, repoName, path)
+			}
+		}
+		unescaped, ok := unescapePathName(escapePathName(userName))
+		if !ok || unescaped != userName {
+			t.Fatalf("owner %q does not round-trip through escaping", userName)
+		}
+	})
+}
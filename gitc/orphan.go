@@ -0,0 +1,72 @@
+package gitc
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"smart-git/database/schema"
+
+	"github.com/go-git/go-git/v6/plumbing/transport"
+)
+
+// upstreamGoneMessages 为系统 git 在上游仓库被删除、转为私有或被封禁时输出的错误
+var upstreamGoneMessages = []string{
+	"repository not found",
+	"' not found",
+	"does not appear to be a git repository",
+	"could not read username",
+	"authentication failed",
+	"returned error: 401",
+	"returned error: 404",
+	"returned error: 410",
+	"returned error: 451",
+}
+
+// isUpstreamGone 判断同步失败是否因为上游仓库已不可访问, 而不是网络等临时错误
+func isUpstreamGone(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, transport.ErrRepositoryNotFound) ||
+		errors.Is(err, transport.ErrAuthenticationRequired) ||
+		errors.Is(err, transport.ErrAuthorizationFailed) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, gone := range upstreamGoneMessages {
+		if strings.Contains(msg, gone) {
+			return true
+		}
+	}
+	return false
+}
+
+// markRepoOrphaned 将上游已不可用的镜像标记为 orphaned: 镜像保留并继续以只读方式提供,
+// 不会被删除或重建, expire 之后再次尝试同步, 上游恢复时回到 synced
+func markRepoOrphaned(repoData *schema.RepoData, expire time.Duration, cause error) error {
+	now := time.Now()
+	if repoData.Status != RepoStatusOrphaned {
+		logWarning("仓库 '%s/%s' 的上游已不可访问, 保留镜像并标记为 orphaned: %v\n", repoData.RepoUser, repoData.RepoName, cause)
+		repoData.OrphanedTime = now
+	}
+	repoData.Status = RepoStatusOrphaned
+	repoData.UpdatedTime = now
+	repoData.ExpireTime = now.Add(expire)
+	return SaveRepoData(repoData)
+}
+
+// GetOrphanedRepoData 返回全部 orphaned 状态的仓库记录
+func GetOrphanedRepoData() ([]schema.RepoData, error) {
+	records, err := GetAllRepoData()
+	if err != nil {
+		return nil, err
+	}
+	var orphaned []schema.RepoData
+	for _, record := range records {
+		if record.Status == RepoStatusOrphaned {
+			orphaned = append(orphaned, record)
+		}
+	}
+	return orphaned, nil
+}
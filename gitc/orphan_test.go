@@ -0,0 +1,89 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v6/plumbing/transport"
+)
+
+// TestIsUpstreamGone 测试区分上游不可访问与临时错误
+func TestIsUpstreamGone(t *testing.T) {
+	for _, err := range []error{
+		fmt.Errorf("%w: 404", transport.ErrRepositoryNotFound),
+		transport.ErrAuthenticationRequired,
+		errors.New("git fetch: exit status 128: remote: Repository not found.\nfatal: repository 'https://github.com/a/b/' not found"),
+		errors.New("git fetch: exit status 128: fatal: could not read Username for 'https://github.com': terminal prompts disabled"),
+		errors.New("git fetch: exit status 128: fatal: unable to access 'https://github.com/a/b/': The requested URL returned error: 451"),
+	} {
+		if !isUpstreamGone(err) {
+			t.Fatalf("expected upstream gone: %v", err)
+		}
+	}
+	for _, err := range []error{
+		nil,
+		context.DeadlineExceeded,
+		errors.New("git fetch: exit status 128: fatal: unable to access 'https://github.com/a/b/': Could not resolve host: github.com"),
+		errors.New("git fetch: exit status 128: fatal: unable to access 'https://github.com/a/b/': The requested URL returned error: 503"),
+	} {
+		if isUpstreamGone(err) {
+			t.Fatalf("expected transient error: %v", err)
+		}
+	}
+}
+
+// TestOrphanedRepoKept 测试上游被删除后镜像保留为 orphaned, 上游恢复后回到 synced
+func TestOrphanedRepoKept(t *testing.T) {
+	basedir, src, cfg := newTestMirror(t, "")
+	src.commit("init")
+
+	ctx := context.Background()
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	expire := func() {
+		data, _, err := GetRepoData("owner", "repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data.ExpireTime = time.Now().Add(-time.Second)
+		if err := SaveRepoData(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 上游被删除: 同步不报错, 镜像保留
+	backup := src.path + ".bak"
+	if err := os.Rename(src.path, backup); err != nil {
+		t.Fatal(err)
+	}
+	expire()
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatalf("orphaned repo should still be served: %v", err)
+	}
+	orphaned, err := GetOrphanedRepoData()
+	if err != nil || len(orphaned) != 1 || orphaned[0].OrphanedTime.IsZero() {
+		t.Fatalf("unexpected orphaned repos: %+v, %v", orphaned, err)
+	}
+	if !repoIsUsable(filepath.Join(basedir, "owner", "repo")) {
+		t.Fatal("orphaned mirror should be kept")
+	}
+
+	// 上游恢复
+	if err := os.Rename(backup, src.path); err != nil {
+		t.Fatal(err)
+	}
+	expire()
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := GetRepoData("owner", "repo")
+	if err != nil || data.Status != RepoStatusSynced || !data.OrphanedTime.IsZero() {
+		t.Fatalf("repo should be synced again: %+v, %v", data, err)
+	}
+}
@@ -0,0 +1,263 @@
+package gitc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"smart-git/config"
+
+	"github.com/go-git/go-git/v6/plumbing"
+)
+
+const packCacheExt = ".pack"
+
+// PackCache 将完整克隆的 upload-pack 响应保存在磁盘上,
+// 相同请求(相同 want/参数/引用状态)直接复用, 并发的相同请求只生成一次
+type PackCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	inflight map[string]*PackFill
+}
+
+// PackFill 表示一次正在生成的缓存条目, 由生成方写入后 Commit 或 Abort
+type PackFill struct {
+	cache *PackCache
+	path  string
+	tmp   *os.File
+	err   error
+	done  chan struct{}
+	once  sync.Once
+}
+
+var (
+	packCacheMu     sync.RWMutex
+	activePackCache *PackCache
+)
+
+func NewPackCache(dir string, maxBytes int64) *PackCache {
+	return &PackCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		inflight: map[string]*PackFill{},
+	}
+}
+
+// SetupPackCache 根据配置初始化全局 pack 缓存, 未启用时清空
+func SetupPackCache(cfg *config.Config) error {
+	packCacheMu.Lock()
+	defer packCacheMu.Unlock()
+
+	if !cfg.PackCache.Enabled {
+		activePackCache = nil
+		return nil
+	}
+	if cfg.PackCache.Dir == "" {
+		return errors.New("packCache.dir is required when pack cache is enabled")
+	}
+	if err := os.MkdirAll(cfg.PackCache.Dir, 0755); err != nil {
+		return err
+	}
+	activePackCache = NewPackCache(cfg.PackCache.Dir, cfg.PackCache.MaxSize*1024*1024)
+	return nil
+}
+
+// CurrentPackCache 返回全局 pack 缓存, 未启用时返回 nil
+func CurrentPackCache() *PackCache {
+	packCacheMu.RLock()
+	defer packCacheMu.RUnlock()
+	return activePackCache
+}
+
+// InvalidatePackCache 删除 repo(owner/name)的全部缓存条目
+func InvalidatePackCache(repo string) {
+	cache := CurrentPackCache()
+	if cache == nil {
+		return
+	}
+	if err := cache.Invalidate(repo); err != nil {
+		logWarning("invalidate pack cache failed: %v, repo: %s\n", err, repo)
+	}
+}
+
+// Acquire 查找缓存; 命中时返回打开的文件, 未命中时返回 PackFill 由调用方生成,
+// 若相同条目正在生成则等待其完成
+func (c *PackCache) Acquire(ctx context.Context, repo string, key string) (*os.File, *PackFill, error) {
+	path := filepath.Join(c.dir, filepath.FromSlash(repo), key+packCacheExt)
+	for {
+		c.mu.Lock()
+		if f, err := os.Open(path); err == nil {
+			c.mu.Unlock()
+			now := time.Now()
+			_ = os.Chtimes(path, now, now)
+			return f, nil, nil
+		}
+
+		if fill, ok := c.inflight[path]; ok {
+			c.mu.Unlock()
+			select {
+			case <-fill.done:
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			c.mu.Unlock()
+			return nil, nil, err
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+		if err != nil {
+			c.mu.Unlock()
+			return nil, nil, err
+		}
+		fill := &PackFill{cache: c, path: path, tmp: tmp, done: make(chan struct{})}
+		c.inflight[path] = fill
+		c.mu.Unlock()
+		return nil, fill, nil
+	}
+}
+
+// Invalidate 删除 repo 的全部缓存条目, 正在生成的临时文件不受影响
+func (c *PackCache) Invalidate(repo string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := filepath.Glob(filepath.Join(c.dir, filepath.FromSlash(repo), "*"+packCacheExt))
+	if err != nil {
+		return err
+	}
+	var errs error
+	for _, entry := range entries {
+		if err := os.Remove(entry); err != nil && !os.IsNotExist(err) {
+			errs = errors.Join(errs, err)
+		}
+	}
+	return errs
+}
+
+// evict 按最近使用时间淘汰条目, 使缓存总大小不超过 maxBytes
+func (c *PackCache) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	_ = filepath.WalkDir(c.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, packCacheExt) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, entry{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(e.path); err == nil || os.IsNotExist(err) {
+			total -= e.size
+		}
+	}
+}
+
+// Write 写入临时文件; 写入失败只记录错误, 不影响调用方继续向客户端输出
+func (f *PackFill) Write(p []byte) (int, error) {
+	if f.err == nil {
+		if _, err := f.tmp.Write(p); err != nil {
+			f.err = err
+		}
+	}
+	return len(p), nil
+}
+
+// Commit 将生成完成的内容发布为缓存条目
+func (f *PackFill) Commit() error {
+	err := f.err
+	if closeErr := f.tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.tmp.Name(), f.path)
+	}
+	if err != nil {
+		_ = os.Remove(f.tmp.Name())
+	}
+	f.finish()
+	if err == nil {
+		f.cache.evict()
+	}
+	return err
+}
+
+// Abort 放弃本次生成, 等待中的相同请求会重新尝试; Commit 之后调用无副作用
+func (f *PackFill) Abort() {
+	select {
+	case <-f.done:
+		return
+	default:
+	}
+	_ = f.tmp.Close()
+	_ = os.Remove(f.tmp.Name())
+	f.finish()
+}
+
+func (f *PackFill) finish() {
+	f.once.Do(func() {
+		f.cache.mu.Lock()
+		delete(f.cache.inflight, f.path)
+		f.cache.mu.Unlock()
+		close(f.done)
+	})
+}
+
+// RefStateHash 对仓库的全部引用计算摘要, 引用有任何变化摘要都会改变
+func RefStateHash(repoPath string) (string, error) {
+	repo, err := openRepo(repoPath)
+	if err != nil {
+		return "", err
+	}
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.SymbolicReference {
+			lines = append(lines, ref.Name().String()+" -> "+ref.Target().String())
+			return nil
+		}
+		lines = append(lines, ref.Name().String()+" "+ref.Hash().String())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
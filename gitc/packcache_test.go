@@ -0,0 +1,54 @@
+package gitc
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestPackCacheCoalesce 测试相同条目并发请求时等待首个生成者完成后直接命中
+func TestPackCacheCoalesce(t *testing.T) {
+	cache := NewPackCache(t.TempDir(), 0)
+	ctx := context.Background()
+
+	hit, fill, err := cache.Acquire(ctx, "owner/repo", "key")
+	if err != nil || hit != nil || fill == nil {
+		t.Fatalf("expected miss with fill, got hit=%v fill=%v err=%v", hit, fill, err)
+	}
+
+	result := make(chan string, 1)
+	go func() {
+		hit, fill, err := cache.Acquire(ctx, "owner/repo", "key")
+		if err != nil || fill != nil || hit == nil {
+			result <- "unexpected result"
+			return
+		}
+		defer hit.Close()
+		data, _ := io.ReadAll(hit)
+		result <- string(data)
+	}()
+
+	select {
+	case <-result:
+		t.Fatal("follower should wait for in-flight fill")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	fill.Write([]byte("pack"))
+	if err := fill.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	if got := <-result; got != "pack" {
+		t.Fatalf("expected cached content, got %q", got)
+	}
+
+	if err := cache.Invalidate("owner/repo"); err != nil {
+		t.Fatalf("invalidate failed: %v", err)
+	}
+	_, fill, err = cache.Acquire(ctx, "owner/repo", "key")
+	if err != nil || fill == nil {
+		t.Fatalf("expected miss after invalidation, got fill=%v err=%v", fill, err)
+	}
+	fill.Abort()
+}
@@ -0,0 +1,641 @@
+package gitc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"smart-git/config"
+	"smart-git/database/schema"
+
+	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing"
+)
+
+// poolDirName 为 basedir 下存放 fork 网络共享对象池的目录, 每个网络一个裸仓库
+const poolDirName = ".pools"
+
+// poolMemberRefPrefix 为对象池中成员引用的前缀, 成员 owner/repo 的引用保存在 refs/members/owner/repo/ 下,
+// 使成员使用的对象在对象池 repack 与 prune 时可达
+const poolMemberRefPrefix = "refs/members/"
+
+// poolNameRe 限制对象池名称, 名称用作 .pools 下的目录名
+var poolNameRe = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+var (
+	poolMu  sync.RWMutex
+	poolCfg config.ObjectPoolConfig
+)
+
+// SetupObjectPools 根据配置设置 fork 网络的对象池, 检查显式网络的名称与模式
+func SetupObjectPools(cfg *config.Config) error {
+	for _, network := range cfg.ObjectPool.Networks {
+		if !poolNameRe.MatchString(network.Name) {
+			return fmt.Errorf("invalid object pool network name %q", network.Name)
+		}
+		if len(network.Repos) == 0 {
+			return fmt.Errorf("object pool network %q has no repos", network.Name)
+		}
+	}
+	poolMu.Lock()
+	poolCfg = cfg.ObjectPool
+	poolMu.Unlock()
+	return nil
+}
+
+func currentPoolConfig() config.ObjectPoolConfig {
+	poolMu.RLock()
+	defer poolMu.RUnlock()
+	return poolCfg
+}
+
+func poolPath(basedir string, network string) string {
+	return filepath.Join(basedir, poolDirName, network)
+}
+
+// lockPool 获取对象池的独占锁. 持有成员仓库锁时可以再获取对象池锁, 反之不行
+func lockPool(ctx context.Context, network string) (func(), error) {
+	return lockRepo(ctx, poolDirName, network)
+}
+
+// AlternateObjectDirs 返回仓库 objects/info/alternates 中的对象目录, 相对路径按 objects 目录解析
+func AlternateObjectDirs(localPath string) ([]string, error) {
+	objectsDir := filepath.Join(localPath, "objects")
+	data, err := os.ReadFile(filepath.Join(objectsDir, "info", "alternates"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(objectsDir, line)
+		}
+		dirs = append(dirs, filepath.Clean(line))
+	}
+	return dirs, scanner.Err()
+}
+
+// poolObjectsNetwork 返回以 .pools/<network>/objects 结尾的对象目录所属的网络, 不论其所在的根目录; 其他目录返回空字符串
+func poolObjectsNetwork(dir string) string {
+	pool := filepath.Dir(dir)
+	network := filepath.Base(pool)
+	if filepath.Base(dir) == "objects" && filepath.Base(filepath.Dir(pool)) == poolDirName && poolNameRe.MatchString(network) {
+		return network
+	}
+	return ""
+}
+
+// repoPoolDir 返回镜像的 alternates 指向的对象池目录, 镜像不在对象池中时返回空字符串
+func repoPoolDir(localPath string) string {
+	dirs, err := AlternateObjectDirs(localPath)
+	if err != nil {
+		return ""
+	}
+	for _, dir := range dirs {
+		if poolObjectsNetwork(dir) != "" {
+			return filepath.Dir(dir)
+		}
+	}
+	return ""
+}
+
+// repoPoolNetwork 返回镜像的 alternates 指向的对象池网络; BaseDir 移动后残留的旧路径同样按网络名称识别
+func repoPoolNetwork(localPath string) string {
+	if pool := repoPoolDir(localPath); pool != "" {
+		return filepath.Base(pool)
+	}
+	return ""
+}
+
+// poolAlternate 返回写入 localPath 的 alternates 的对象池 objects 目录, 为相对镜像 objects 目录的路径,
+// BaseDir 整体移动或以不同路径挂载时仍然有效
+func poolAlternate(localPath string, pool string) (string, error) {
+	from, err := filepath.Abs(filepath.Join(localPath, "objects"))
+	if err != nil {
+		return "", err
+	}
+	to, err := filepath.Abs(filepath.Join(pool, "objects"))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(from, to)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// stalePoolAlternates 判断镜像的 alternates 是否指向 basedir 下对象池以外的位置, 返回所属网络;
+// 不在对象池中或指向正确时返回空字符串
+func stalePoolAlternates(basedir string, localPath string) string {
+	dir := repoPoolDir(localPath)
+	network := repoPoolNetwork(localPath)
+	if network == "" || sameDir(dir, poolPath(basedir, network)) {
+		return ""
+	}
+	return network
+}
+
+// relinkPoolAlternates 将镜像的 alternates 中指向对象池的路径改写为 basedir 下对象池的相对路径,
+// 镜像在目录层级改变的移动之后调用; 镜像不在对象池中时不做修改. 调用方需持有仓库的独占锁
+func relinkPoolAlternates(basedir string, localPath string) error {
+	network := repoPoolNetwork(localPath)
+	if network == "" {
+		return nil
+	}
+	pool := poolPath(basedir, network)
+	if !repoIsUsable(pool) {
+		return fmt.Errorf("object pool %s is missing", pool)
+	}
+	dirs, err := AlternateObjectDirs(localPath)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, dir := range dirs {
+		if poolObjectsNetwork(dir) == network {
+			if dir, err = poolAlternate(localPath, pool); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(dir + "\n")
+	}
+	return writeAlternates(localPath, buf.Bytes())
+}
+
+// writeAlternates 以 rename 替换镜像的 alternates, 读取方不会看到写入一半的文件
+func writeAlternates(localPath string, data []byte) error {
+	infoDir := filepath.Join(localPath, "objects", "info")
+	if err := os.MkdirAll(infoDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(infoDir, "alternates-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(infoDir, "alternates"))
+}
+
+// poolNetwork 返回镜像所属的 fork 网络: 先按顺序匹配显式网络, 再按 HEAD 沿第一父提交找到的根提交归入 "root-<hash>";
+// 不属于任何网络时返回空字符串
+func poolNetwork(ctx context.Context, userName string, repoName string, localPath string) (string, error) {
+	pc := currentPoolConfig()
+	for _, network := range pc.Networks {
+		for _, pattern := range network.Repos {
+			if config.MatchRepo(pattern, userName, repoName) {
+				return network.Name, nil
+			}
+		}
+	}
+	if !pc.DetectRootCommit {
+		return "", nil
+	}
+	root, err := rootCommit(ctx, localPath)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// 空仓库没有 HEAD
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return "root-" + root, nil
+}
+
+// rootCommit 返回 HEAD 沿第一父提交回溯到的根提交
+func rootCommit(ctx context.Context, localPath string) (string, error) {
+	if sys := SystemGitBackend(); sys != nil {
+		out, err := sys.Output(ctx, localPath, nil, "rev-list", "--first-parent", "--max-parents=0", "HEAD")
+		if err != nil {
+			if _, headErr := LocalHeadHash(localPath); errors.Is(headErr, plumbing.ErrReferenceNotFound) {
+				return "", headErr
+			}
+			return "", err
+		}
+		root, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		if root == "" {
+			return "", errors.New("HEAD has no root commit")
+		}
+		return root, nil
+	}
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return "", err
+	}
+	for commit.NumParents() > 0 {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if commit, err = commit.Parent(0); err != nil {
+			return "", err
+		}
+	}
+	return commit.Hash.String(), nil
+}
+
+// joinObjectPool 将镜像加入所属 fork 网络的对象池, 返回网络名称. 先写入指向对象池的 alternates,
+// 再把镜像的 pack 与松散对象移入对象池, 任一时刻每个对象都能在镜像或对象池中找到; 与池中重复的对象在维护对象池时合并.
+// 浅镜像、blobless 镜像与已有 alternates 的镜像不加入. 调用方需持有仓库的独占锁
+func joinObjectPool(ctx context.Context, basedir string, userName string, repoName string, localPath string) (string, error) {
+	if !currentPoolConfig().Enabled || IsPartialRepo(localPath) {
+		return "", nil
+	}
+	if dirs, err := AlternateObjectDirs(localPath); err != nil || len(dirs) > 0 {
+		return "", err
+	}
+	network, err := poolNetwork(ctx, userName, repoName, localPath)
+	if err != nil || network == "" {
+		return "", err
+	}
+
+	unlock, err := lockPool(ctx, network)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	pool := poolPath(basedir, network)
+	if err := initPool(basedir, pool); err != nil {
+		return "", err
+	}
+	alternate, err := poolAlternate(localPath, pool)
+	if err != nil {
+		return "", err
+	}
+	if err := writeAlternates(localPath, []byte(alternate+"\n")); err != nil {
+		return "", err
+	}
+	if err := publishObjects(localPath, pool); err != nil {
+		return network, err
+	}
+	refs, err := memberRefs(localPath)
+	if err != nil {
+		return network, err
+	}
+	if err := updatePoolRefs(pool, map[string]map[string]plumbing.Hash{userName + "/" + repoName: refs}, false); err != nil {
+		return network, err
+	}
+	logInfo("仓库 '%s/%s' 已加入对象池 '%s'。\n", userName, repoName, network)
+	return network, nil
+}
+
+// joinPoolLogged 尝试将同步完成的镜像加入对象池, 失败时镜像仍可独立使用, 只记录日志
+func joinPoolLogged(ctx context.Context, basedir string, userName string, repoName string, localPath string) {
+	if _, err := joinObjectPool(ctx, basedir, userName, repoName, localPath); err != nil {
+		logWarning("join object pool failed: %v, repo: %s/%s\n", err, userName, repoName)
+	}
+}
+
+// initPool 在暂存目录中初始化对象池的裸仓库后 rename 到位; 对象池已存在但不可用时返回错误
+func initPool(basedir string, pool string) error {
+	if dirExists(pool) {
+		if !repoIsUsable(pool) {
+			return fmt.Errorf("object pool %s is not usable", pool)
+		}
+		return nil
+	}
+	stage, cleanup, err := newStage(basedir, pool, "init-*")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if _, err := git.PlainInit(stage, true); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pool), 0755); err != nil {
+		return err
+	}
+	return os.Rename(stage, pool)
+}
+
+// leaveObjectPool 在镜像被删除或隔离后从对象池中删除该镜像的引用, 对象池没有成员时删除对象池;
+// 只有该镜像使用的对象在下次维护对象池时清理
+func leaveObjectPool(pool string, userName string, repoName string) error {
+	network := filepath.Base(pool)
+	basedir := filepath.Dir(filepath.Dir(pool))
+	unlock, err := lockPool(context.Background(), network)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	members, err := poolMembers(basedir, network)
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		logInfo("对象池 '%s' 已没有成员, 删除。\n", network)
+		return os.RemoveAll(pool)
+	}
+	return updatePoolRefs(pool, map[string]map[string]plumbing.Hash{userName + "/" + repoName: nil}, false)
+}
+
+// removeEmptyPool 在对象池锁下确认对象池没有成员后删除
+func removeEmptyPool(ctx context.Context, basedir string, network string) error {
+	unlock, err := lockPool(ctx, network)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	members, err := poolMembers(basedir, network)
+	if err != nil {
+		return err
+	}
+	if len(members) > 0 {
+		return fmt.Errorf("object pool %s has %d members", network, len(members))
+	}
+	return os.RemoveAll(poolPath(basedir, network))
+}
+
+// renamePoolMember 在镜像以新名称移动到 localPath 后, 将对象池中该成员的引用移到新名称下
+func renamePoolMember(pool string, oldKey string, newKey string, localPath string) error {
+	unlock, err := lockPool(context.Background(), filepath.Base(pool))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	refs, err := memberRefs(localPath)
+	if err != nil {
+		return err
+	}
+	return updatePoolRefs(pool, map[string]map[string]plumbing.Hash{oldKey: nil, newKey: refs}, false)
+}
+
+// removeMirrorDir 删除镜像目录, 镜像在对象池中时同时退出对象池
+func removeMirrorDir(localPath string, userName string, repoName string) error {
+	pool := repoPoolDir(localPath)
+	if err := os.RemoveAll(localPath); err != nil {
+		return err
+	}
+	if pool != "" {
+		if err := leaveObjectPool(pool, userName, repoName); err != nil {
+			logWarning("leave object pool failed: %v, repo: %s/%s\n", err, userName, repoName)
+		}
+	}
+	return nil
+}
+
+// poolMembers 返回 alternates 指向该网络对象池的镜像 owner/repo, 按名称排序. 按 .pools/<network> 后缀匹配,
+// alternates 仍为 BaseDir 移动前的路径的镜像同样是成员, 对象池不会因此被当作没有成员而删除
+func poolMembers(basedir string, network string) ([]string, error) {
+	dirs, err := repoDirs(basedir)
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, dir := range dirs {
+		userName, repoName, _ := strings.Cut(dir, "/")
+		if repoPoolNetwork(RepoPath(basedir, userName, repoName)) == network {
+			members = append(members, dir)
+		}
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// ObjectPoolNetworks 返回 basedir 下全部对象池的名称
+func ObjectPoolNetworks(basedir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(basedir, poolDirName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var networks []string
+	for _, entry := range entries {
+		if entry.IsDir() && poolNameRe.MatchString(entry.Name()) {
+			networks = append(networks, entry.Name())
+		}
+	}
+	return networks, nil
+}
+
+// ObjectPoolInfo 为一个对象池的成员与对象统计
+type ObjectPoolInfo struct {
+	Network string
+	Path    string
+	Members []string
+	Stats   ObjectStats
+}
+
+// ObjectPools 返回 basedir 下全部对象池的成员与对象统计
+func ObjectPools(basedir string) ([]ObjectPoolInfo, error) {
+	networks, err := ObjectPoolNetworks(basedir)
+	if err != nil {
+		return nil, err
+	}
+	pools := make([]ObjectPoolInfo, 0, len(networks))
+	for _, network := range networks {
+		info := ObjectPoolInfo{Network: network, Path: poolPath(basedir, network)}
+		if info.Members, err = poolMembers(basedir, network); err != nil {
+			return nil, err
+		}
+		if info.Stats, err = RepoObjectStats(info.Path); err != nil {
+			return nil, err
+		}
+		pools = append(pools, info)
+	}
+	return pools, nil
+}
+
+// memberRefs 返回镜像的全部哈希引用(含内部引用), 不含 HEAD
+func memberRefs(localPath string) (map[string]plumbing.Hash, error) {
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]plumbing.Hash{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && ref.Name() != plumbing.HEAD {
+			refs[ref.Name().String()] = ref.Hash()
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// updatePoolRefs 以 members 中各成员的引用替换对象池 packed-refs 中该成员的引用, 引用为 nil 的成员被删除;
+// replaceAll 为 true 时删除 members 以外的全部成员引用. 调用方需持有对象池锁
+func updatePoolRefs(pool string, members map[string]map[string]plumbing.Hash, replaceAll bool) error {
+	refs := map[string]string{}
+	if !replaceAll {
+		data, err := os.ReadFile(filepath.Join(pool, "packed-refs"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+				continue
+			}
+			hash, name, _ := strings.Cut(line, " ")
+			if rest, ok := strings.CutPrefix(name, poolMemberRefPrefix); ok {
+				if parts := strings.SplitN(rest, "/", 3); len(parts) == 3 {
+					if _, ok := members[parts[0]+"/"+parts[1]]; ok {
+						continue
+					}
+				}
+			}
+			refs[name] = hash
+		}
+	}
+	for member, memberRefs := range members {
+		for name, hash := range memberRefs {
+			refs[poolMemberRefPrefix+member+"/"+strings.TrimPrefix(name, "refs/")] = hash.String()
+		}
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s %s\n", refs[name], name)
+	}
+	return writePackedRefs(pool, buf.Bytes())
+}
+
+// MaintainPool 立即维护对象池, 不检查阈值
+func MaintainPool(ctx context.Context, basedir string, network string) (*schema.MaintenanceRecord, error) {
+	m := CurrentMaintainer()
+	if m == nil {
+		return nil, errors.New("repo maintenance is not set up")
+	}
+	if !poolNameRe.MatchString(network) || !dirExists(poolPath(basedir, network)) {
+		return nil, ErrRepoNotMirrored
+	}
+	return m.runPool(ctx, basedir, network)
+}
+
+// scanPools 维护达到阈值的对象池, 并删除已没有成员的对象池
+func (m *Maintainer) scanPools(ctx context.Context) {
+	networks, err := ObjectPoolNetworks(m.basedir)
+	if err != nil {
+		logWarning("list object pools for maintenance failed: %v\n", err)
+		return
+	}
+	for _, network := range networks {
+		if ctx.Err() != nil {
+			return
+		}
+		members, err := poolMembers(m.basedir, network)
+		if err != nil {
+			continue
+		}
+		stats, err := RepoObjectStats(poolPath(m.basedir, network))
+		if err != nil || (len(members) > 0 && !m.Due(stats)) {
+			m.expireRetired(poolPath(m.basedir, network))
+			continue
+		}
+		if _, err := m.runPool(ctx, m.basedir, network); err != nil {
+			logWarning("object pool maintenance failed: %v, pool: %s\n", err, network)
+		}
+	}
+}
+
+// runPool 经任务队列维护对象池, 优先级取自 ctx
+func (m *Maintainer) runPool(ctx context.Context, basedir string, network string) (*schema.MaintenanceRecord, error) {
+	var record *schema.MaintenanceRecord
+	err := Jobs().Run(ctx, JobKindMaintenance, poolDirName+"/"+network, "", func(ctx context.Context) error {
+		var err error
+		record, err = m.repackPool(ctx, basedir, network)
+		return err
+	})
+	return record, err
+}
+
+// repackPool 按名称顺序获取全部成员的独占锁后再获取对象池锁, 与同步时先成员后对象池的顺序一致, 等待读取成员的请求结束后才删除旧 pack.
+// 以成员当前的引用重写对象池的引用后 repack 与 prune, 只有已删除成员使用的对象才会被清理; 没有成员时删除对象池
+func (m *Maintainer) repackPool(ctx context.Context, basedir string, network string) (*schema.MaintenanceRecord, error) {
+	members, err := poolMembers(basedir, network)
+	if err != nil {
+		return nil, err
+	}
+	var unlocks []func()
+	defer func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}()
+	for _, member := range members {
+		userName, repoName, _ := strings.Cut(member, "/")
+		unlock, err := lockRepo(ctx, userName, repoName)
+		if err != nil {
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	unlock, err := lockPool(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	unlocks = append(unlocks, unlock)
+
+	// 获取锁期间加入的成员没有被锁定, 留到下次维护
+	current, err := poolMembers(basedir, network)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Equal(current, members) {
+		return nil, errors.New("object pool members changed during maintenance, retry later")
+	}
+	pool := poolPath(basedir, network)
+	if len(members) == 0 {
+		logInfo("对象池 '%s' 已没有成员, 删除。\n", network)
+		return nil, os.RemoveAll(pool)
+	}
+
+	refs := map[string]map[string]plumbing.Hash{}
+	for _, member := range members {
+		userName, repoName, _ := strings.Cut(member, "/")
+		if refs[member], err = memberRefs(RepoPath(basedir, userName, repoName)); err != nil {
+			return nil, fmt.Errorf("read refs of %s: %w", member, err)
+		}
+	}
+	if err := updatePoolRefs(pool, refs, true); err != nil {
+		return nil, err
+	}
+	return m.maintainLocked(ctx, poolDirName, network, pool)
+}
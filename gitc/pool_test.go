@@ -0,0 +1,227 @@
+package gitc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"smart-git/config"
+
+	"github.com/go-git/go-git/v6"
+)
+
+// TestObjectPool 测试同一根提交的 fork 共享对象池: 对象只保存在对象池中, fetch 的新对象发布到对象池,
+// 维护对象池后成员仍然完整, 删除最后一个成员时删除对象池
+func TestObjectPool(t *testing.T) {
+	forEachBackend(t, testObjectPool)
+}
+
+func testObjectPool(t *testing.T, backend string) {
+	basedir, upstream, cfg := newTestMirror(t, backend)
+	cfg.ObjectPool.Enabled = true
+	cfg.Maintenance.PruneGrace = 0
+	if err := SetupObjectPools(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetupObjectPools(config.DefaultConfig()) })
+	if err := SetupMaintenance(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	root := upstream.commitFile("first")
+	upstream.commitFile("second")
+	forkPath := filepath.Join(t.TempDir(), "fork")
+	forkRepo, err := git.PlainClone(forkPath, &git.CloneOptions{URL: upstream.path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork := testUpstreamOf(t, forkPath, forkRepo)
+	fork.commitFile("fork")
+
+	ctx := context.Background()
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", upstream.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureRepoReady(ctx, basedir, "forker", "repo", fork.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	network := "root-" + root.String()
+	pool := poolPath(basedir, network)
+	members, err := poolMembers(basedir, network)
+	if err != nil || !slices.Equal(members, []string{"forker/repo", "owner/repo"}) {
+		t.Fatalf("unexpected pool members: %v, %v", members, err)
+	}
+	healthy := func(member string) {
+		t.Helper()
+		localPath := filepath.Join(basedir, member)
+		stats, err := RepoObjectStats(localPath)
+		if err != nil || stats.Packs+stats.Loose != 0 {
+			t.Fatalf("objects of %s not moved to pool: %+v, %v", member, stats, err)
+		}
+		report, err := verifyRepo(ctx, localPath, true)
+		if err != nil || len(report.Problems) != 0 {
+			t.Fatalf("member %s not healthy: %+v, %v", member, report, err)
+		}
+	}
+	healthy("owner/repo")
+	healthy("forker/repo")
+
+	// 加入对象池后 fetch 的新对象发布到对象池
+	head := fork.commitFile("fork again")
+	data, _, err := GetRepoData("forker", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.ExpireTime = time.Now().Add(-time.Second)
+	if err := SaveRepoData(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureRepoReady(ctx, basedir, "forker", "repo", fork.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := LocalHeadHash(filepath.Join(basedir, "forker", "repo")); err != nil || got != head.String() {
+		t.Fatalf("fork not refreshed: %s, %v", got, err)
+	}
+	healthy("forker/repo")
+
+	// 维护对象池合并两个成员重复的对象, 成员引用的对象不会被清理
+	record, err := MaintainPool(ctx, basedir, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.Repacked || record.PacksAfter != 1 || record.LooseAfter != 0 {
+		t.Fatalf("pool not repacked: %+v", record)
+	}
+	healthy("owner/repo")
+	healthy("forker/repo")
+	packedRefs := func() string {
+		data, err := os.ReadFile(filepath.Join(pool, "packed-refs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if refs := packedRefs(); !strings.Contains(refs, head.String()+" "+poolMemberRefPrefix+"forker/repo/") {
+		t.Fatalf("pool refs do not cover fork head:\n%s", refs)
+	}
+
+	// 删除成员后对象池保留其它成员使用的对象, 删除最后一个成员时删除对象池
+	if err := removeRepoArtifacts(*data); err != nil {
+		t.Fatal(err)
+	}
+	if refs := packedRefs(); strings.Contains(refs, poolMemberRefPrefix+"forker/repo/") {
+		t.Fatalf("removed member still in pool refs:\n%s", refs)
+	}
+	if _, err := MaintainPool(ctx, basedir, network); err != nil {
+		t.Fatal(err)
+	}
+	healthy("owner/repo")
+	data, _, err = GetRepoData("owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := removeRepoArtifacts(*data); err != nil {
+		t.Fatal(err)
+	}
+	if dirExists(pool) {
+		t.Fatal("pool without members not removed")
+	}
+}
+
+// TestObjectPoolBaseDirMove 测试对象池成员的 alternates 为相对路径: BaseDir 整体移动与布局迁移后成员仍然完整,
+// 对象池不会因 alternates 残留的旧绝对路径被当作没有成员而删除
+func TestObjectPoolBaseDirMove(t *testing.T) {
+	forEachBackend(t, testObjectPoolBaseDirMove)
+}
+
+func testObjectPoolBaseDirMove(t *testing.T, backend string) {
+	oldBase, upstream, cfg := newTestMirror(t, backend)
+	cfg.ObjectPool.Enabled = true
+	if err := SetupObjectPools(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetupObjectPools(config.DefaultConfig()) })
+	t.Cleanup(func() { _ = SetupLayout(config.DefaultConfig()) })
+	network := "root-" + upstream.commitFile("first").String()
+
+	ctx := context.Background()
+	if err := EnsureRepoReady(ctx, oldBase, "owner", "repo", upstream.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	alternates := func(localPath string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(localPath, "objects", "info", "alternates"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+	if got := alternates(filepath.Join(oldBase, "owner", "repo")); got != "../../../.pools/"+network+"/objects" {
+		t.Fatalf("unexpected alternates: %q", got)
+	}
+
+	basedir := oldBase + "-moved"
+	if err := os.Rename(oldBase, basedir); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Server.BaseDir = basedir
+	if err := SetupMaintenance(cfg); err != nil {
+		t.Fatal(err)
+	}
+	healthy := func(localPath string) {
+		t.Helper()
+		report, err := verifyRepo(ctx, localPath, true)
+		if err != nil || len(report.Problems) != 0 {
+			t.Fatalf("member %s not healthy: %+v, %v", localPath, report, err)
+		}
+	}
+	localPath := filepath.Join(basedir, "owner", "repo")
+	healthy(localPath)
+
+	// 旧版本写入的绝对路径在 BaseDir 移动后失效, 仍按网络名称识别为成员
+	stale := filepath.Join(oldBase, poolDirName, network, "objects")
+	if err := os.WriteFile(filepath.Join(localPath, "objects", "info", "alternates"), []byte(stale+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	members, err := poolMembers(basedir, network)
+	if err != nil || !slices.Equal(members, []string{"owner/repo"}) {
+		t.Fatalf("member with stale alternates not found: %v, %v", members, err)
+	}
+	if got := stalePoolAlternates(basedir, localPath); got != network {
+		t.Fatalf("stale alternates not detected: %q", got)
+	}
+	CurrentMaintainer().scanPools(ctx)
+	if err := removeEmptyPool(ctx, basedir, network); err == nil || !dirExists(poolPath(basedir, network)) {
+		t.Fatalf("pool with members removed: %v", err)
+	}
+	if err := relinkPoolAlternates(basedir, localPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := stalePoolAlternates(basedir, localPath); got != "" {
+		t.Fatalf("alternates not relinked: %q", got)
+	}
+	healthy(localPath)
+
+	// 布局迁移改变目录层级后改写相对路径
+	cfg.Server.Layout = LayoutSharded
+	if err := SetupLayout(cfg); err != nil {
+		t.Fatal(err)
+	}
+	report, err := MigrateLayout(ctx, basedir, false)
+	if err != nil || len(report.Moved) != 1 {
+		t.Fatalf("unexpected migration: %+v, %v", report, err)
+	}
+	localPath = RepoPath(basedir, "owner", "repo")
+	if got := alternates(localPath); !strings.HasSuffix(got, "/"+poolDirName+"/"+network+"/objects") || filepath.IsAbs(got) {
+		t.Fatalf("unexpected alternates after migration: %q", got)
+	}
+	healthy(localPath)
+	if members, err := poolMembers(basedir, network); err != nil || !slices.Equal(members, []string{"owner/repo"}) {
+		t.Fatalf("unexpected members after migration: %v, %v", members, err)
+	}
+}
@@ -0,0 +1,430 @@
+package gitc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v6/plumbing"
+)
+
+// stagingDirName 为 basedir 下存放未完成的克隆与刷新的目录, 以 "." 开头不会与 owner 重名
+const stagingDirName = ".staging"
+
+// stagingDir 返回 basedir 下的暂存目录, 与镜像位于同一文件系统以便 rename
+func stagingDir(basedir string) string {
+	return filepath.Join(basedir, stagingDirName)
+}
+
+// cleanStagingDir 删除上次运行遗留的暂存目录; BaseDir 由多个进程共享时其中可能有其它进程正在进行的同步,
+// 只在获取仓库独占锁后由 newStage 清理该仓库的遗留
+func cleanStagingDir(basedir string) error {
+	if SharedStorage() {
+		return nil
+	}
+	return os.RemoveAll(stagingDir(basedir))
+}
+
+// newStage 在仓库的暂存目录中创建临时目录, 调用方需持有仓库的独占锁; 同时清理之前崩溃遗留的暂存内容.
+// 返回的 cleanup 删除临时目录
+func newStage(basedir string, localPath string, pattern string) (string, func(), error) {
+	rel, err := filepath.Rel(basedir, localPath)
+	if err != nil {
+		return "", nil, err
+	}
+	root := filepath.Join(stagingDir(basedir), rel)
+	if err := os.RemoveAll(root); err != nil {
+		return "", nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", nil, err
+	}
+	stage, err := os.MkdirTemp(root, pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		_ = os.RemoveAll(root)
+		// 清理空的上级目录, 其它仓库正在使用时删除失败即可
+		for dir := filepath.Dir(root); dir != stagingDir(basedir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	if err := os.Chmod(stage, 0755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return stage, cleanup, nil
+}
+
+// cloneStaged 在暂存目录中完成克隆, 校验并将引用打包后整体 rename 到 localPath,
+// 读取方不会看到只写了一半的仓库
+func cloneStaged(ctx context.Context, basedir string, localPath string, repoURL string, spec MirrorSpec) error {
+	stage, cleanup, err := newStage(basedir, localPath, "clone-*")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := CurrentBackend().Clone(ctx, stage, repoURL, spec); err != nil {
+		return err
+	}
+	if IsShallowRepo(stage) {
+		if err := setMirrorDepth(stage, spec.Depth); err != nil {
+			return err
+		}
+	}
+	if err := verifyStage(ctx, stage); err != nil {
+		return err
+	}
+	if err := publishRefs(stage, stage); err != nil {
+		return err
+	}
+	// 克隆期间布局迁移可能删除了空的上级目录
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(stage, localPath)
+}
+
+// fetchStaged 在借用镜像对象(alternates)的暂存仓库中执行 fetch, 校验后依次发布新对象、
+// shallow 与引用; 引用以 packed-refs 整体替换, 读取方不会看到指向缺失对象的引用
+func fetchStaged(ctx context.Context, basedir string, localPath string, spec MirrorSpec) error {
+	stage, cleanup, err := newStage(basedir, localPath, "fetch-*")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := prepareStage(localPath, stage); err != nil {
+		return err
+	}
+	fetchErr := CurrentBackend().Fetch(ctx, stage, spec)
+	if fetchErr != nil {
+		return fetchErr
+	}
+	// 损坏的 pack 随暂存目录丢弃, 不会进入镜像
+	if err := verifyStage(ctx, stage); err != nil {
+		return err
+	}
+	releasePool, err := publishStagedObjects(ctx, stage, localPath)
+	if err != nil {
+		return err
+	}
+	defer releasePool()
+	if err := publishShallow(stage, localPath); err != nil {
+		return err
+	}
+	return publishRefs(stage, localPath)
+}
+
+// publishStagedObjects 将暂存仓库的新对象发布到镜像. 对象池成员的新对象发布到对象池, 返回的函数释放对象池锁,
+// 调用方在发布引用后调用, 维护对象池时不会看到没有引用的新对象
+func publishStagedObjects(ctx context.Context, stage string, localPath string) (func(), error) {
+	target := localPath
+	unlock := func() {}
+	if pool := repoPoolDir(localPath); pool != "" {
+		var err error
+		unlock, err = lockPool(ctx, filepath.Base(pool))
+		if err != nil {
+			return nil, err
+		}
+		// alternates 仍为 BaseDir 移动前的路径时不向旧位置写入, 由 fsck -fix 改写
+		if !repoIsUsable(pool) {
+			unlock()
+			return nil, fmt.Errorf("object pool %s of %s is missing", pool, localPath)
+		}
+		target = pool
+	}
+	if err := publishObjects(stage, target); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// prepareStage 以镜像的 HEAD、配置、shallow 与引用(内部引用除外)初始化暂存仓库,
+// 对象通过 objects/info/alternates 引用镜像的对象目录
+func prepareStage(localPath string, stage string) error {
+	for _, dir := range []string{"refs/heads", "refs/tags", "objects/pack", "objects/info"} {
+		if err := os.MkdirAll(filepath.Join(stage, dir), 0755); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{"HEAD", "config", "shallow"} {
+		data, err := os.ReadFile(filepath.Join(localPath, name))
+		if errors.Is(err, fs.ErrNotExist) && name == "shallow" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(stage, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	objectsDir, err := filepath.Abs(filepath.Join(localPath, "objects"))
+	if err != nil {
+		return err
+	}
+	// 镜像自身借用的对象目录(对象池)也要列出, 不依赖实现是否递归读取 alternates
+	alternates := []string{objectsDir}
+	borrowed, err := AlternateObjectDirs(localPath)
+	if err != nil {
+		return err
+	}
+	alternates = append(alternates, borrowed...)
+	if err := os.WriteFile(filepath.Join(stage, "objects", "info", "alternates"), []byte(strings.Join(alternates, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+
+	refs, err := publishedRefs(localPath)
+	if err != nil {
+		return err
+	}
+	repo, err := openRepo(stage)
+	if err != nil {
+		return err
+	}
+	// 暂存仓库使用松散引用, go-git 无法改写 packed-refs
+	for name, hash := range refs {
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(name), hash)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishedRefs 返回仓库中由同步维护的引用, 不含 HEAD、符号引用与内部引用
+func publishedRefs(localPath string) (map[string]plumbing.Hash, error) {
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]plumbing.Hash{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if ref.Type() != plumbing.HashReference || ref.Name() == plumbing.HEAD || strings.HasPrefix(name, InternalRefPrefix) {
+			return nil
+		}
+		refs[name] = ref.Hash()
+		return nil
+	})
+	return refs, err
+}
+
+// publishObjects 将暂存仓库新获取的 pack 与松散对象移入镜像或对象池; .idx 最后移动,
+// 读取方只会看到完整的 pack
+func publishObjects(stage string, localPath string) error {
+	packDir := filepath.Join(stage, "objects", "pack")
+	entries, err := os.ReadDir(packDir)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return filepath.Ext(entries[i].Name()) != ".idx" && filepath.Ext(entries[j].Name()) == ".idx"
+	})
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), "tmp_") {
+			continue
+		}
+		if err := os.Rename(filepath.Join(packDir, entry.Name()), filepath.Join(localPath, "objects", "pack", entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	objectsDir := filepath.Join(stage, "objects")
+	entries, err = os.ReadDir(objectsDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || len(entry.Name()) != 2 {
+			continue
+		}
+		objects, err := os.ReadDir(filepath.Join(objectsDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(localPath, "objects", entry.Name())
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		for _, object := range objects {
+			if err := os.Rename(filepath.Join(objectsDir, entry.Name(), object.Name()), filepath.Join(target, object.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// publishShallow 同步暂存仓库的 shallow 文件, 加深为完整历史后删除镜像的 shallow
+func publishShallow(stage string, localPath string) error {
+	err := os.Rename(filepath.Join(stage, "shallow"), filepath.Join(localPath, "shallow"))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = os.Remove(filepath.Join(localPath, "shallow"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+	}
+	return err
+}
+
+// publishRefs 以 stage 的引用整体替换 localPath 的 packed-refs 并删除被取代的松散引用;
+// 镜像中的内部引用保持不变. stage 与 localPath 相同时只打包引用
+func publishRefs(stage string, localPath string) error {
+	refs, err := publishedRefs(stage)
+	if err != nil {
+		return err
+	}
+	if stage != localPath {
+		current, err := publishedRefs(localPath)
+		if err != nil {
+			return err
+		}
+		if sameRefs(refs, current) {
+			return nil
+		}
+	}
+
+	var buf bytes.Buffer
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s %s\n", refs[name], name)
+	}
+	internal, err := packedInternalRefs(localPath)
+	if err != nil {
+		return err
+	}
+	buf.Write(internal)
+
+	loose, err := looseRefFiles(localPath)
+	if err != nil {
+		return err
+	}
+	if err := writePackedRefs(localPath, buf.Bytes()); err != nil {
+		return err
+	}
+	for _, path := range loose {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameRefs(a map[string]plumbing.Hash, b map[string]plumbing.Hash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, hash := range a {
+		if b[name] != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// packedInternalRefs 返回 packed-refs 中内部引用的行(包括随后的 peeled 行)
+func packedInternalRefs(localPath string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(localPath, "packed-refs"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	keep := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "^"):
+			if keep {
+				buf.WriteString(line)
+			}
+			continue
+		}
+		_, name, _ := strings.Cut(strings.TrimSpace(line), " ")
+		keep = strings.HasPrefix(name, InternalRefPrefix)
+		if keep {
+			buf.WriteString(strings.TrimSuffix(line, "\n") + "\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// looseRefFiles 返回 refs 目录下由同步维护的松散引用文件, 不含内部引用与符号引用
+func looseRefFiles(localPath string) ([]string, error) {
+	var files []string
+	refsDir := filepath.Join(localPath, "refs")
+	err := filepath.WalkDir(refsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(localPath, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if strings.HasPrefix(name+"/", InternalRefPrefix) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(name, ".lock") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(data, []byte("ref: ")) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// writePackedRefs 通过 packed-refs.lock 写入新的 packed-refs 并 rename 到位, 与 git 的锁约定一致
+func writePackedRefs(localPath string, data []byte) error {
+	lockPath := filepath.Join(localPath, "packed-refs.lock")
+	f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("lock packed-refs: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Join(err, os.Remove(lockPath))
+	}
+	if err := f.Close(); err != nil {
+		return errors.Join(err, os.Remove(lockPath))
+	}
+	if err := os.Rename(lockPath, filepath.Join(localPath, "packed-refs")); err != nil {
+		return errors.Join(err, os.Remove(lockPath))
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package gitc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v6/plumbing"
+)
+
+// TestStagedSync 测试克隆与刷新经暂存目录发布: 引用整体写入 packed-refs, 新对象移入镜像, 内部引用保持不变
+func TestStagedSync(t *testing.T) {
+	forEachBackend(t, testStagedSync)
+}
+
+func testStagedSync(t *testing.T, backend string) {
+	basedir, src, cfg := newTestMirror(t, backend)
+	first := src.commit("first")
+	if err := src.repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/topic", first)); err != nil {
+		t.Fatal(err)
+	}
+
+	localPath := filepath.Join(basedir, "owner", "repo")
+	ctx := context.Background()
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	assertPublished := func() {
+		t.Helper()
+		if loose, err := looseRefFiles(localPath); err != nil || len(loose) != 0 {
+			t.Fatalf("unexpected loose refs: %v, %v", loose, err)
+		}
+		if entries, _ := os.ReadDir(stagingDir(basedir)); len(entries) != 0 {
+			t.Fatalf("staging dir not cleaned: %v", entries)
+		}
+		if _, err := os.Stat(filepath.Join(localPath, "objects", "info", "alternates")); !os.IsNotExist(err) {
+			t.Fatalf("mirror should not borrow objects: %v", err)
+		}
+	}
+	assertPublished()
+	if _, err := CreateSnapshot(basedir, "owner", "repo", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	second := src.commit("second")
+	if err := src.repo.Storer.RemoveReference("refs/heads/topic"); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := GetRepoData("owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.ExpireTime = time.Now().Add(-time.Second)
+	if err := SaveRepoData(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	assertPublished()
+
+	mirror, err := openRepo(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mirror.CommitObject(second); err != nil {
+		t.Fatalf("new objects not published: %v", err)
+	}
+	refs, err := publishedRefs(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := refs["refs/heads/topic"]; ok || len(refs) != 1 {
+		t.Fatalf("unexpected refs after refresh: %v", refs)
+	}
+	snapshots, err := ListSnapshots(basedir, "owner", "repo")
+	if err != nil || len(snapshots) != 1 || snapshots[0].Head != first.String() {
+		t.Fatalf("snapshot not kept: %+v, %v", snapshots, err)
+	}
+}
@@ -0,0 +1,189 @@
+package gitc
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"smart-git/config"
+	"smart-git/database"
+	"smart-git/database/schema"
+
+	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing"
+)
+
+// 引用日志中的变化类型
+const (
+	RefUpdateCreate      = "create"
+	RefUpdateFastForward = "fast-forward"
+	// RefUpdateForced 为上游 force-push: 新提交不包含旧提交
+	RefUpdateForced = "forced"
+	// RefUpdateTagRewrite 为已有 tag 指向了新的对象
+	RefUpdateTagRewrite = "tag-rewrite"
+	RefUpdateDelete     = "delete"
+	// RefUpdateUpdate 为无法判断是否快进的更新, 例如浅镜像中旧提交已不在历史内
+	RefUpdateUpdate = "update"
+)
+
+var refJournalMaxEntries atomic.Int64
+
+// SetupRefJournal 根据配置设置每个仓库保留的引用日志条目上限
+func SetupRefJournal(cfg *config.Config) {
+	refJournalMaxEntries.Store(int64(cfg.RefJournal.MaxEntries))
+}
+
+// IsRewrite 判断变化是否改写了上游已发布的历史
+func IsRewrite(kind string) bool {
+	return kind == RefUpdateForced || kind == RefUpdateTagRewrite
+}
+
+// recordRefJournal 对比镜像当前引用与上次同步记录的状态, 将变化追加到引用日志;
+// force-push 与 tag 改写以警告级别记录
+func recordRefJournal(localPath string, userName string, repoName string) error {
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return err
+	}
+	refs, err := mirrorRefs(repo)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		current[ref.Name().String()] = ref.Hash().String()
+	}
+	previous, _, err := database.DB.GetRefState(userName, repoName)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	shallow := IsShallowRepo(localPath)
+	var updates []schema.RefUpdate
+	for name, newHash := range current {
+		oldHash, ok := previous[name]
+		if ok && oldHash == newHash {
+			continue
+		}
+		update := schema.RefUpdate{RepoUser: userName, RepoName: repoName, Ref: name, OldHash: oldHash, NewHash: newHash, Time: now}
+		switch {
+		case !ok:
+			update.Kind = RefUpdateCreate
+		case plumbing.ReferenceName(name).IsTag():
+			update.Kind = RefUpdateTagRewrite
+		default:
+			update.Kind = classifyRefUpdate(repo, oldHash, newHash, shallow)
+			update.FastForward = update.Kind == RefUpdateFastForward
+		}
+		updates = append(updates, update)
+	}
+	for name, oldHash := range previous {
+		if _, ok := current[name]; !ok {
+			updates = append(updates, schema.RefUpdate{RepoUser: userName, RepoName: repoName, Ref: name, OldHash: oldHash, Kind: RefUpdateDelete, Time: now})
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Ref < updates[j].Ref })
+
+	if err := database.DB.SaveRefUpdates(userName, repoName, current, updates, int(refJournalMaxEntries.Load())); err != nil {
+		return err
+	}
+	for _, update := range updates {
+		if IsRewrite(update.Kind) || (update.Kind == RefUpdateDelete && plumbing.ReferenceName(update.Ref).IsTag()) {
+			logWarning("仓库 '%s/%s' 的引用 %s 被上游改写(%s): %s -> %s\n", userName, repoName, update.Ref, update.Kind, update.OldHash, update.NewHash)
+		}
+	}
+	return nil
+}
+
+// classifyRefUpdate 判断分支等引用的更新是否为快进; 浅镜像中旧提交不在新提交的历史内时无法区分
+func classifyRefUpdate(repo *git.Repository, oldHash string, newHash string, shallow bool) string {
+	oldCommit, err := repo.CommitObject(plumbing.NewHash(oldHash))
+	if err != nil {
+		return RefUpdateUpdate
+	}
+	newCommit, err := repo.CommitObject(plumbing.NewHash(newHash))
+	if err != nil {
+		return RefUpdateUpdate
+	}
+	isAncestor, err := oldCommit.IsAncestor(newCommit)
+	switch {
+	case err == nil && isAncestor:
+		return RefUpdateFastForward
+	case err != nil || shallow:
+		return RefUpdateUpdate
+	default:
+		return RefUpdateForced
+	}
+}
+
+// RefHistory 返回仓库的引用日志, ref 非空时只返回该引用的记录
+func RefHistory(userName string, repoName string, ref string) ([]schema.RefUpdate, error) {
+	updates, err := database.DB.GetRefUpdates(userName, repoName)
+	if err != nil || ref == "" {
+		return updates, err
+	}
+	var result []schema.RefUpdate
+	for _, update := range updates {
+		if update.Ref == ref {
+			result = append(result, update)
+		}
+	}
+	return result, nil
+}
+
+var (
+	// ErrRefJournalEmpty 表示仓库在指定时间之前没有引用记录
+	ErrRefJournalEmpty = errors.New("no ref history before the requested time")
+	// ErrRefJournalTruncated 表示指定时间的记录已因条目上限被删除
+	ErrRefJournalTruncated = errors.New("ref history before the requested time has been truncated")
+)
+
+// RefsAt 从基线状态开始按引用日志重放仓库在 at 时刻的引用状态
+func RefsAt(userName string, repoName string, at time.Time) (map[string]string, error) {
+	baseline, hasBaseline, err := database.DB.GetRefBaseline(userName, repoName)
+	if err != nil {
+		return nil, err
+	}
+	updates, err := database.DB.GetRefUpdates(userName, repoName)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	switch {
+	case hasBaseline:
+		if at.Before(baseline.Time) {
+			return nil, ErrRefJournalTruncated
+		}
+		for name, hash := range baseline.Refs {
+			refs[name] = hash
+		}
+	case len(updates) == 0 || updates[0].Time.After(at):
+		return nil, ErrRefJournalEmpty
+	}
+	for _, update := range updates {
+		if update.Time.After(at) {
+			break
+		}
+		if update.NewHash == "" {
+			delete(refs, update.Ref)
+			continue
+		}
+		refs[update.Ref] = update.NewHash
+	}
+	return refs, nil
+}
+
+// RefRewrites 返回全部仓库的 force-push 与 tag 改写记录, 最新的在前, limit 大于 0 时限制条数
+func RefRewrites(limit int) ([]schema.RefUpdate, error) {
+	updates, err := database.DB.GetAllRefUpdates(RefUpdateForced, RefUpdateTagRewrite)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(updates, func(i, j int) bool { return updates[i].Time.After(updates[j].Time) })
+	if limit > 0 && len(updates) > limit {
+		updates = updates[:limit]
+	}
+	return updates, nil
+}
@@ -0,0 +1,139 @@
+package gitc
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"smart-git/config"
+	"smart-git/database"
+	"smart-git/database/bolt"
+
+	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/object"
+)
+
+// TestRefJournal 测试快进、force-push、tag 改写与删除的记录, 以及按时间查询与条目上限
+func TestRefJournal(t *testing.T) {
+	tmpDir := t.TempDir()
+	database.DB = bolt.OpenDatabase(filepath.Join(tmpDir, "db"))
+	t.Cleanup(func() { database.DB.Close() })
+	SetupRefJournal(&config.Config{})
+
+	localPath := filepath.Join(tmpDir, "repo")
+	repo, err := git.PlainInit(localPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(msg string, parents ...plumbing.Hash) plumbing.Hash {
+		sig := object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}
+		tree := &object.Tree{}
+		obj := repo.Storer.NewEncodedObject()
+		if err := tree.Encode(obj); err != nil {
+			t.Fatal(err)
+		}
+		treeHash, err := repo.Storer.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &object.Commit{Author: sig, Committer: sig, Message: msg, TreeHash: treeHash, ParentHashes: parents}
+		obj = repo.Storer.NewEncodedObject()
+		if err := c.Encode(obj); err != nil {
+			t.Fatal(err)
+		}
+		h, err := repo.Storer.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	setRef := func(name string, h plumbing.Hash) {
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(name), h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := func() time.Time {
+		if err := recordRefJournal(localPath, "owner", "repo"); err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		return at
+	}
+
+	c1 := commit("c1")
+	setRef("refs/heads/main", c1)
+	setRef("refs/tags/v1", c1)
+	t1 := sync()
+
+	c2 := commit("c2", c1)
+	setRef("refs/heads/main", c2)
+	sync()
+
+	c3 := commit("c3")
+	setRef("refs/heads/main", c3)
+	setRef("refs/tags/v1", c2)
+	setRef("refs/heads/topic", c1)
+	t3 := sync()
+
+	if err := repo.Storer.RemoveReference("refs/heads/topic"); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+
+	history, err := RefHistory("owner", "repo", "refs/heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := []string{RefUpdateCreate, RefUpdateFastForward, RefUpdateForced}
+	if len(history) != len(kinds) {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	for i, kind := range kinds {
+		if history[i].Kind != kind {
+			t.Fatalf("entry %d: expected %s, got %+v", i, kind, history[i])
+		}
+	}
+	if !history[1].FastForward || history[2].FastForward || history[2].OldHash != c2.String() {
+		t.Fatalf("unexpected fast-forward flags: %+v", history)
+	}
+
+	rewrites, err := RefRewrites(0)
+	if err != nil || len(rewrites) != 2 {
+		t.Fatalf("unexpected rewrites: %+v, %v", rewrites, err)
+	}
+	topic, _ := RefHistory("owner", "repo", "refs/heads/topic")
+	if len(topic) != 2 || topic[1].Kind != RefUpdateDelete {
+		t.Fatalf("unexpected topic history: %+v", topic)
+	}
+
+	refs, err := RefsAt("owner", "repo", t1)
+	if err != nil || refs["refs/heads/main"] != c1.String() || refs["refs/tags/v1"] != c1.String() {
+		t.Fatalf("unexpected refs at t1: %v, %v", refs, err)
+	}
+	refs, err = RefsAt("owner", "repo", t3)
+	if err != nil || refs["refs/heads/main"] != c3.String() || refs["refs/heads/topic"] != c1.String() {
+		t.Fatalf("unexpected refs at t3: %v, %v", refs, err)
+	}
+	if _, err := RefsAt("owner", "repo", t1.Add(-time.Hour)); !errors.Is(err, ErrRefJournalEmpty) {
+		t.Fatalf("expected empty journal error, got %v", err)
+	}
+
+	// 条目上限: 删除的记录折叠为基线, 基线之后的查询不受影响
+	SetupRefJournal(&config.Config{RefJournal: config.RefJournalConfig{MaxEntries: 2}})
+	c4 := commit("c4", c3)
+	setRef("refs/heads/main", c4)
+	sync()
+	if history, _ := RefHistory("owner", "repo", ""); len(history) != 2 {
+		t.Fatalf("expected 2 entries after truncation, got %+v", history)
+	}
+	if _, err := RefsAt("owner", "repo", t1); !errors.Is(err, ErrRefJournalTruncated) {
+		t.Fatalf("expected truncated error, got %v", err)
+	}
+	refs, err = RefsAt("owner", "repo", time.Now())
+	if err != nil || refs["refs/heads/main"] != c4.String() || refs["refs/tags/v1"] != c2.String() || len(refs) != 2 {
+		t.Fatalf("unexpected current refs: %v, %v", refs, err)
+	}
+}
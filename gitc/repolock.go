@@ -0,0 +1,247 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"smart-git/config"
+)
+
+// ErrRepoLockTimeout 表示等待仓库锁超过了 RepoLock.Timeout
+var ErrRepoLockTimeout = errors.New("timed out waiting for repo lock")
+
+var (
+	repoLocksMu sync.Mutex
+	repoLocks   = map[string]*repoLockEntry{}
+	// repoLockStats 按 [共享, 独占] 记录锁的获取与等待, 由 repoLocksMu 保护
+	repoLockStats [2]RepoLockModeStats
+
+	repoLockTimeout atomic.Int64
+)
+
+// repoLockEntry 为单个仓库的读写锁: 提供服务时持有共享锁, 同步、删除与维护持有独占锁.
+// 有独占锁在等待时新的共享锁也需要等待, 避免持续的克隆请求使同步无法进行
+type repoLockEntry struct {
+	refs           int
+	readers        int
+	writer         bool
+	waitingReaders int
+	waitingWriters int
+	changed        chan struct{}
+}
+
+func (e *repoLockEntry) available(exclusive bool) bool {
+	if exclusive {
+		return !e.writer && e.readers == 0
+	}
+	return !e.writer && e.waitingWriters == 0
+}
+
+// notify 唤醒全部等待者重新检查锁状态
+func (e *repoLockEntry) notify() {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+func (e *repoLockEntry) take(exclusive bool) {
+	if exclusive {
+		e.writer = true
+	} else {
+		e.readers++
+	}
+}
+
+func (e *repoLockEntry) wait(exclusive bool, delta int) {
+	if exclusive {
+		e.waitingWriters += delta
+	} else {
+		e.waitingReaders += delta
+	}
+}
+
+// RepoLockModeStats 为一种锁模式的累计统计
+type RepoLockModeStats struct {
+	Acquired int64
+	Waited   int64
+	WaitTime time.Duration
+	Timeouts int64
+}
+
+// RepoLockState 为一个仓库当前的锁状态
+type RepoLockState struct {
+	Repo           string
+	Readers        int
+	Writer         bool
+	WaitingReaders int
+	WaitingWriters int
+}
+
+// RepoLockStats 为仓库锁的统计信息
+type RepoLockStats struct {
+	Shared    RepoLockModeStats
+	Exclusive RepoLockModeStats
+	Repos     []RepoLockState
+}
+
+// SetupRepoLocks 根据配置设置等待仓库锁的超时时间与跨进程锁的实现
+func SetupRepoLocks(cfg *config.Config) error {
+	repoLockTimeout.Store(int64(cfg.RepoLock.Timeout))
+	return setupLocker(cfg)
+}
+
+// lockWaitContext 返回按 RepoLock.Timeout 限制等待时间的 context
+func lockWaitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := time.Duration(repoLockTimeout.Load()); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return ctx, func() {}
+}
+
+// RLockRepo 在提供服务期间持有仓库的共享锁, 返回释放函数; 持有期间不能再获取同一仓库的锁
+func RLockRepo(ctx context.Context, userName string, repoName string) (func(), error) {
+	return acquireRepoLock(ctx, userName+"/"+repoName, false)
+}
+
+// lockRepo 获取仓库的独占锁, 等待正在提供服务的请求结束; 配置了跨进程锁时还与共享 BaseDir 的其它进程互斥
+func lockRepo(ctx context.Context, userName string, repoName string) (func(), error) {
+	key := userName + "/" + repoName
+	unlock, err := acquireRepoLock(ctx, key, true)
+	if err != nil {
+		return nil, err
+	}
+
+	waitCtx, cancel := lockWaitContext(ctx)
+	defer cancel()
+	start := time.Now()
+	release, err := currentLocker().Lock(waitCtx, key)
+	if err != nil {
+		unlock()
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			repoLocksMu.Lock()
+			repoLockStats[1].Timeouts++
+			repoLocksMu.Unlock()
+			return nil, ErrRepoLockTimeout
+		}
+		return nil, err
+	}
+	if waited := time.Since(start); waited >= lockPollInterval {
+		repoLocksMu.Lock()
+		repoLockStats[1].Waited++
+		repoLockStats[1].WaitTime += waited
+		repoLocksMu.Unlock()
+		logInfo("repo lock waited %s for %s lock, repo: %s\n", waited, currentLocker().Name(), key)
+	}
+	return func() {
+		release()
+		unlock()
+	}, nil
+}
+
+func acquireRepoLock(ctx context.Context, key string, exclusive bool) (func(), error) {
+	mode := 0
+	if exclusive {
+		mode = 1
+	}
+
+	repoLocksMu.Lock()
+	entry, ok := repoLocks[key]
+	if !ok {
+		entry = &repoLockEntry{changed: make(chan struct{})}
+		repoLocks[key] = entry
+	}
+	entry.refs++
+	if entry.available(exclusive) {
+		entry.take(exclusive)
+		repoLockStats[mode].Acquired++
+		repoLocksMu.Unlock()
+		return func() { releaseRepoLock(key, entry, exclusive) }, nil
+	}
+
+	waitCtx, cancel := lockWaitContext(ctx)
+	defer cancel()
+	entry.wait(exclusive, 1)
+	start := time.Now()
+	for !entry.available(exclusive) {
+		changed := entry.changed
+		repoLocksMu.Unlock()
+		select {
+		case <-changed:
+			repoLocksMu.Lock()
+		case <-waitCtx.Done():
+			repoLocksMu.Lock()
+			entry.wait(exclusive, -1)
+			entry.refs--
+			if entry.refs == 0 {
+				delete(repoLocks, key)
+			}
+			// 放弃等待的独占锁可能正阻塞着共享锁
+			entry.notify()
+			repoLockStats[mode].Waited++
+			repoLockStats[mode].WaitTime += time.Since(start)
+			if ctx.Err() != nil {
+				repoLocksMu.Unlock()
+				return nil, ctx.Err()
+			}
+			repoLockStats[mode].Timeouts++
+			repoLocksMu.Unlock()
+			return nil, ErrRepoLockTimeout
+		}
+	}
+	entry.wait(exclusive, -1)
+	entry.take(exclusive)
+	waited := time.Since(start)
+	repoLockStats[mode].Acquired++
+	repoLockStats[mode].Waited++
+	repoLockStats[mode].WaitTime += waited
+	repoLocksMu.Unlock()
+
+	if exclusive {
+		logInfo("repo lock waited %s for exclusive access, repo: %s\n", waited, key)
+	} else {
+		logInfo("repo lock waited %s for shared access, repo: %s\n", waited, key)
+	}
+	return func() { releaseRepoLock(key, entry, exclusive) }, nil
+}
+
+func releaseRepoLock(key string, entry *repoLockEntry, exclusive bool) {
+	repoLocksMu.Lock()
+	defer repoLocksMu.Unlock()
+
+	if exclusive {
+		entry.writer = false
+	} else {
+		entry.readers--
+	}
+	entry.refs--
+	if entry.refs == 0 {
+		delete(repoLocks, key)
+	}
+	entry.notify()
+}
+
+// GetRepoLockStats 返回仓库锁的累计统计与当前被持有或等待的仓库
+func GetRepoLockStats() RepoLockStats {
+	repoLocksMu.Lock()
+	defer repoLocksMu.Unlock()
+
+	stats := RepoLockStats{
+		Shared:    repoLockStats[0],
+		Exclusive: repoLockStats[1],
+		Repos:     make([]RepoLockState, 0, len(repoLocks)),
+	}
+	for key, entry := range repoLocks {
+		stats.Repos = append(stats.Repos, RepoLockState{
+			Repo:           key,
+			Readers:        entry.readers,
+			Writer:         entry.writer,
+			WaitingReaders: entry.waitingReaders,
+			WaitingWriters: entry.waitingWriters,
+		})
+	}
+	sort.Slice(stats.Repos, func(i, j int) bool { return stats.Repos[i].Repo < stats.Repos[j].Repo })
+	return stats
+}
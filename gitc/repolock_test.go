@@ -0,0 +1,97 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"smart-git/config"
+)
+
+// TestRepoLock 测试共享锁并存、独占锁等待读取结束、等待中的独占锁阻塞新的共享锁以及超时统计
+func TestRepoLock(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.RepoLock.Timeout = 50 * time.Millisecond
+	if err := SetupRepoLocks(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetupRepoLocks(config.DefaultConfig()) })
+	ctx := context.Background()
+	before := GetRepoLockStats()
+
+	r1, err := RLockRepo(ctx, "owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := RLockRepo(ctx, "owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockRepo(ctx, "owner", "repo"); !errors.Is(err, ErrRepoLockTimeout) {
+		t.Fatalf("expected timeout while readers hold the lock, got %v", err)
+	}
+
+	// 独占锁等待期间新的共享锁排在其后
+	if err := SetupRepoLocks(&config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan func())
+	go func() {
+		unlock, err := lockRepo(ctx, "owner", "repo")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- unlock
+	}()
+	waitFor(t, func() bool { return lockState("owner/repo").WaitingWriters == 1 })
+	readerCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := RLockRepo(readerCtx, "owner", "repo"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected reader to queue behind writer, got %v", err)
+	}
+
+	r1()
+	select {
+	case <-acquired:
+		t.Fatal("writer acquired while a reader still holds the lock")
+	case <-time.After(20 * time.Millisecond):
+	}
+	r2()
+	unlock := <-acquired
+	if state := lockState("owner/repo"); !state.Writer || state.Readers != 0 {
+		t.Fatalf("unexpected lock state: %+v", state)
+	}
+	unlock()
+
+	after := GetRepoLockStats()
+	if len(after.Repos) != 0 {
+		t.Fatalf("lock entries not released: %+v", after.Repos)
+	}
+	if after.Exclusive.Timeouts-before.Exclusive.Timeouts != 1 || after.Exclusive.Acquired-before.Exclusive.Acquired != 1 {
+		t.Fatalf("unexpected exclusive stats: %+v", after.Exclusive)
+	}
+	if after.Shared.Acquired-before.Shared.Acquired != 2 || after.Shared.Waited-before.Shared.Waited != 1 {
+		t.Fatalf("unexpected shared stats: %+v", after.Shared)
+	}
+}
+
+func lockState(repo string) RepoLockState {
+	for _, state := range GetRepoLockStats().Repos {
+		if state.Repo == repo {
+			return state
+		}
+	}
+	return RepoLockState{}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,65 @@
+package gitc
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// EstimateRepoSize 统计裸仓库 objects 目录与借用的对象目录(对象池)下 pack 与松散对象的字节数,
+// 作为生成 pack 时内存占用的粗略估计
+func EstimateRepoSize(repoPath string) (int64, error) {
+	objectsDir := filepath.Join(repoPath, "objects")
+	if _, err := os.Stat(objectsDir); err != nil {
+		return 0, err
+	}
+	total, err := objectsSize(objectsDir)
+	if err != nil {
+		return 0, err
+	}
+	alternates, err := AlternateObjectDirs(repoPath)
+	if err != nil {
+		return 0, err
+	}
+	for _, dir := range alternates {
+		size, err := objectsSize(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// objectsSize 统计对象目录下 pack 与松散对象的字节数, 不含 .idx、info 目录与等待删除的被替换 pack
+func objectsSize(objectsDir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(objectsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// 并发 fetch/repack 可能在遍历过程中删除文件, 忽略即可
+			if os.IsNotExist(err) && path != objectsDir {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if (d.Name() == "info" || d.Name() == retiredPacksDir) && filepath.Dir(path) == objectsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == ".idx" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
@@ -0,0 +1,343 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/storer"
+)
+
+const (
+	// InternalNamespace 为 smart-git 在镜像中使用的 git 命名空间, 其中的引用不出现在普通的引用广告中,
+	// 同步上游时保留, 引用指向的对象不会被 gc 清理
+	InternalNamespace = "smart-git"
+	// InternalRefPrefix 为 InternalNamespace 对应的引用前缀
+	InternalRefPrefix = "refs/namespaces/" + InternalNamespace + "/"
+)
+
+var (
+	ErrSnapshotExists      = errors.New("snapshot already exists")
+	ErrSnapshotNotFound    = errors.New("snapshot not found")
+	ErrInvalidSnapshotName = errors.New("invalid snapshot name")
+	ErrRepoNotMirrored     = errors.New("repository is not mirrored")
+)
+
+var snapshotNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+
+// Snapshot 为以名称冻结的镜像引用状态
+type Snapshot struct {
+	Name      string
+	Head      string
+	Refs      int
+	CreatedAt time.Time
+}
+
+// RefView 描述 upload-pack 对客户端可见的引用: Namespace 非空时只提供该 git 命名空间(GIT_NAMESPACE)
+// 内的引用, HideRefs 按 RefHidden 规则从广告中隐藏引用
+type RefView struct {
+	Namespace string
+	HideRefs  []string
+}
+
+// VisibleName 返回引用在该视图中对客户端呈现的名称, 不可见时返回 false.
+// 命名空间内的引用去掉命名空间前缀后再按 HideRefs 判断, 与 git upload-pack 一致
+func (v RefView) VisibleName(name string) (string, bool) {
+	if v.Namespace != "" {
+		rest, ok := strings.CutPrefix(name, NamespaceRefPrefix(v.Namespace))
+		if !ok {
+			return "", false
+		}
+		name = rest
+	} else if strings.HasPrefix(name, InternalRefPrefix) {
+		return "", false
+	}
+	if RefHidden(v.HideRefs, name) {
+		return "", false
+	}
+	return name, true
+}
+
+// NamespaceRefPrefix 返回 git 命名空间对应的引用前缀, "a/b" 对应 refs/namespaces/a/refs/namespaces/b/
+func NamespaceRefPrefix(namespace string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(namespace, "/") {
+		b.WriteString("refs/namespaces/" + part + "/")
+	}
+	return b.String()
+}
+
+// ValidSnapshotName 判断快照名称是否可用作引用路径的一段
+func ValidSnapshotName(name string) bool {
+	return snapshotNameRe.MatchString(name) && !strings.Contains(name, "..") && !strings.HasSuffix(name, ".lock")
+}
+
+// SnapshotNamespace 返回快照所在的 git 命名空间
+func SnapshotNamespace(name string) string {
+	return InternalNamespace + "/" + name
+}
+
+// SnapshotExists 判断仓库中是否存在指定快照
+func SnapshotExists(localPath string, name string) bool {
+	if !ValidSnapshotName(name) {
+		return false
+	}
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return false
+	}
+	_, err = repo.Storer.Reference(plumbing.ReferenceName(NamespaceRefPrefix(SnapshotNamespace(name)) + "HEAD"))
+	return err == nil
+}
+
+// CreateSnapshot 将镜像当前的全部引用(不含内部引用)复制到快照命名空间, 快照创建后不随上游变化
+func CreateSnapshot(basedir string, userName string, repoName string, name string) (*Snapshot, error) {
+	if !ValidSnapshotName(name) {
+		return nil, ErrInvalidSnapshotName
+	}
+	lockKey := userName + "/" + repoName
+	unlock, err := lockRepo(context.Background(), userName, repoName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	localPath := RepoPath(basedir, userName, repoName)
+	if _, err := os.Stat(localPath); err != nil {
+		return nil, ErrRepoNotMirrored
+	}
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return nil, err
+	}
+	prefix := NamespaceRefPrefix(SnapshotNamespace(name))
+	headName := plumbing.ReferenceName(prefix + "HEAD")
+	if _, err := repo.Storer.Reference(headName); err == nil {
+		return nil, ErrSnapshotExists
+	}
+
+	refs, err := mirrorRefs(repo)
+	if err != nil {
+		return nil, err
+	}
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return nil, err
+	}
+
+	// HEAD 最后写入, 作为快照完整的标记
+	snapshot := &Snapshot{Name: name, Refs: len(refs), CreatedAt: time.Now()}
+	for _, ref := range refs {
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(prefix+ref.Name().String()), ref.Hash())); err != nil {
+			_ = removeRefsWithPrefix(repo, prefix)
+			return nil, err
+		}
+	}
+	if head.Type() == plumbing.SymbolicReference {
+		resolved, err := storer.ResolveReference(repo.Storer, plumbing.HEAD)
+		if err == nil {
+			snapshot.Head = resolved.Hash().String()
+		}
+		head = plumbing.NewSymbolicReference(headName, plumbing.ReferenceName(prefix+head.Target().String()))
+	} else {
+		snapshot.Head = head.Hash().String()
+		head = plumbing.NewHashReference(headName, head.Hash())
+	}
+	if err := repo.Storer.SetReference(head); err != nil {
+		_ = removeRefsWithPrefix(repo, prefix)
+		return nil, err
+	}
+
+	cfg, err := repo.Config()
+	if err == nil {
+		cfg.Raw.Section(InternalNamespace).Subsection("snapshot."+name).SetOption("created", snapshot.CreatedAt.UTC().Format(time.RFC3339))
+		err = repo.SetConfig(cfg)
+	}
+	if err != nil {
+		logWarning("save snapshot time failed: %v, repo: %s\n", err, lockKey)
+	}
+	logInfo("仓库 '%s' 已创建快照 '%s', 共 %d 个引用。\n", lockKey, name, len(refs))
+	return snapshot, nil
+}
+
+// ListSnapshots 返回仓库的全部快照, 按名称排序
+func ListSnapshots(basedir string, userName string, repoName string) ([]Snapshot, error) {
+	localPath := RepoPath(basedir, userName, repoName)
+	if _, err := os.Stat(localPath); err != nil {
+		return nil, ErrRepoNotMirrored
+	}
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	root := NamespaceRefPrefix(InternalNamespace) + "refs/namespaces/"
+	snapshots := map[string]*Snapshot{}
+	complete := map[string]bool{}
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		rest, ok := strings.CutPrefix(ref.Name().String(), root)
+		if !ok {
+			return nil
+		}
+		name, refName, ok := strings.Cut(rest, "/")
+		if !ok {
+			return nil
+		}
+		s := snapshots[name]
+		if s == nil {
+			s = &Snapshot{Name: name}
+			snapshots[name] = s
+		}
+		if refName != "HEAD" {
+			s.Refs++
+			return nil
+		}
+		complete[name] = true
+		if resolved, err := storer.ResolveReference(repo.Storer, ref.Name()); err == nil {
+			s.Head = resolved.Hash().String()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Snapshot, 0, len(snapshots))
+	for _, s := range snapshots {
+		// 没有 HEAD 的是未创建完成的快照
+		if !complete[s.Name] {
+			continue
+		}
+		if created, err := time.Parse(time.RFC3339, cfg.Raw.Section(InternalNamespace).Subsection("snapshot."+s.Name).Option("created")); err == nil {
+			s.CreatedAt = created
+		}
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// DeleteSnapshot 删除快照的全部引用, 之后其独有的对象可以被 gc 清理
+func DeleteSnapshot(basedir string, userName string, repoName string, name string) error {
+	if !ValidSnapshotName(name) {
+		return ErrInvalidSnapshotName
+	}
+	lockKey := userName + "/" + repoName
+	unlock, err := lockRepo(context.Background(), userName, repoName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	localPath := RepoPath(basedir, userName, repoName)
+	if !SnapshotExists(localPath, name) {
+		return ErrSnapshotNotFound
+	}
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return err
+	}
+	if err := removeRefsWithPrefix(repo, NamespaceRefPrefix(SnapshotNamespace(name))); err != nil {
+		return err
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Raw.Section(InternalNamespace).RemoveSubsection("snapshot." + name)
+	logInfo("仓库 '%s' 已删除快照 '%s'。\n", lockKey, name)
+	return repo.SetConfig(cfg)
+}
+
+// mirrorRefs 返回镜像自身的引用, 不含 HEAD、符号引用与内部引用
+func mirrorRefs(repo *git.Repository) ([]*plumbing.Reference, error) {
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && !strings.HasPrefix(ref.Name().String(), InternalRefPrefix) {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+func removeRefsWithPrefix(repo *git.Repository, prefix string) error {
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	var names []plumbing.ReferenceName
+	_ = iter.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), prefix) {
+			names = append(names, ref.Name())
+		}
+		return nil
+	})
+	for _, name := range names {
+		if err := repo.Storer.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepInternalRefs 执行 fn 并恢复被删除的内部引用; 镜像以 prune 方式同步 refs/* 时会删除上游不存在的引用
+func keepInternalRefs(localPath string, fn func() error) error {
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return fn()
+	}
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return fn()
+	}
+	var internal []*plumbing.Reference
+	_ = iter.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), InternalRefPrefix) {
+			internal = append(internal, ref)
+		}
+		return nil
+	})
+
+	fnErr := fn()
+	if len(internal) == 0 {
+		return fnErr
+	}
+	// 同步过程中引用可能由系统 git 改写, 重新打开仓库读取最新状态
+	repo, err = openRepo(localPath)
+	if err != nil {
+		return errors.Join(fnErr, err)
+	}
+	restored := 0
+	for _, ref := range internal {
+		if _, err := repo.Storer.Reference(ref.Name()); err == nil {
+			continue
+		}
+		if err := repo.Storer.SetReference(ref); err != nil {
+			return errors.Join(fnErr, err)
+		}
+		restored++
+	}
+	if restored > 0 {
+		logInfo("restored %d internal refs pruned by fetch: %s\n", restored, localPath)
+	}
+	return fnErr
+}
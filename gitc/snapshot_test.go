@@ -0,0 +1,94 @@
+package gitc
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/object"
+)
+
+// TestSnapshotLifecycle 测试快照的创建、在引用变化与 prune 后保持不变以及删除
+func TestSnapshotLifecycle(t *testing.T) {
+	basedir := t.TempDir()
+	localPath := filepath.Join(basedir, "owner", "repo")
+	repo, err := git.PlainInit(localPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(msg string) plumbing.Hash {
+		h, err := wt.Commit(msg, &git.CommitOptions{
+			AllowEmptyCommits: true,
+			Author:            &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	first := commit("first")
+
+	if _, err := CreateSnapshot(basedir, "owner", "repo", "../x"); !errors.Is(err, ErrInvalidSnapshotName) {
+		t.Fatalf("expected invalid name error, got %v", err)
+	}
+	if _, err := CreateSnapshot(basedir, "owner", "missing", "v1"); !errors.Is(err, ErrRepoNotMirrored) {
+		t.Fatalf("expected not mirrored error, got %v", err)
+	}
+	snapshot, err := CreateSnapshot(basedir, "owner", "repo", "release-2026-10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Head != first.String() || snapshot.Refs != 1 {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+	if _, err := CreateSnapshot(basedir, "owner", "repo", "release-2026-10"); !errors.Is(err, ErrSnapshotExists) {
+		t.Fatalf("expected exists error, got %v", err)
+	}
+
+	// 上游推进后快照仍指向原提交; 模拟 prune 删除内部引用
+	commit("second")
+	prefix := NamespaceRefPrefix(SnapshotNamespace("release-2026-10"))
+	err = keepInternalRefs(localPath, func() error {
+		return removeRefsWithPrefix(repo, InternalRefPrefix)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Reference(plumbing.ReferenceName(prefix+"refs/heads/master"), true)
+	if err != nil || ref.Hash() != first {
+		t.Fatalf("snapshot ref not kept: %v, %v", ref, err)
+	}
+
+	view := RefView{Namespace: SnapshotNamespace("release-2026-10")}
+	if name, ok := view.VisibleName(prefix + "HEAD"); !ok || name != "HEAD" {
+		t.Fatalf("unexpected visible name: %q %v", name, ok)
+	}
+	if _, ok := view.VisibleName("refs/heads/master"); ok {
+		t.Fatal("mirror refs should not be visible in snapshot view")
+	}
+	if _, ok := (RefView{}).VisibleName(prefix + "refs/heads/master"); ok {
+		t.Fatal("internal refs should not be visible in default view")
+	}
+
+	snapshots, err := ListSnapshots(basedir, "owner", "repo")
+	if err != nil || len(snapshots) != 1 || snapshots[0].Head != first.String() || snapshots[0].CreatedAt.IsZero() {
+		t.Fatalf("unexpected snapshots: %+v, %v", snapshots, err)
+	}
+
+	if err := DeleteSnapshot(basedir, "owner", "repo", "release-2026-10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteSnapshot(basedir, "owner", "repo", "release-2026-10"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if snapshots, err := ListSnapshots(basedir, "owner", "repo"); err != nil || len(snapshots) != 0 {
+		t.Fatalf("snapshot not deleted: %+v, %v", snapshots, err)
+	}
+}
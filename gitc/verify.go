@@ -0,0 +1,452 @@
+package gitc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"smart-git/config"
+	"smart-git/database/schema"
+
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/object"
+	"github.com/go-git/go-git/v6/plumbing/revlist"
+)
+
+// ErrRepoCorrupt 表示镜像的 pack、松散对象或引用损坏
+var ErrRepoCorrupt = errors.New("repository is corrupt")
+
+// quarantineDirName 为 basedir 下存放损坏镜像的目录, 保留现场以便排查
+const quarantineDirName = ".quarantine"
+
+var (
+	verifyMu  sync.RWMutex
+	verifyCfg = config.DefaultConfig()
+)
+
+// SetupVerify 根据配置设置同步后的校验, 并保存重新克隆损坏镜像时使用的配置
+func SetupVerify(cfg *config.Config) {
+	verifyMu.Lock()
+	verifyCfg = cfg
+	verifyMu.Unlock()
+}
+
+func currentVerifyConfig() *config.Config {
+	verifyMu.RLock()
+	defer verifyMu.RUnlock()
+	return verifyCfg
+}
+
+// VerifyReport 为一次校验的结果, Problems 为空表示未发现损坏
+type VerifyReport struct {
+	Packs        int
+	Loose        int
+	Refs         int
+	Connectivity bool // 是否完成了连通性检查
+	Problems     []string
+	Duration     time.Duration
+	Quarantine   string // 镜像损坏后移入的隔离目录
+	Recloning    bool   // 是否已开始重新克隆
+}
+
+// Err 在发现损坏时返回包装 ErrRepoCorrupt 的错误
+func (r *VerifyReport) Err() error {
+	if len(r.Problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrRepoCorrupt, strings.Join(r.Problems, "; "))
+}
+
+func (r *VerifyReport) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// verifyRepo 校验 pack 与 idx 的校验和及对象数、松散对象的哈希与引用指向的对象;
+// connectivity 为 true 时还检查从全部引用可达的对象是否都存在. 返回的 error 只表示校验本身失败
+func verifyRepo(ctx context.Context, localPath string, connectivity bool) (*VerifyReport, error) {
+	start := time.Now()
+	report := &VerifyReport{}
+	if err := verifyPacks(localPath, report); err != nil {
+		return nil, err
+	}
+	if err := verifyLooseObjects(localPath, report); err != nil {
+		return nil, err
+	}
+	if err := verifyRefs(localPath, report); err != nil {
+		return nil, err
+	}
+	if connectivity && len(report.Problems) == 0 {
+		if err := verifyConnectivity(ctx, localPath, report); err != nil {
+			return nil, err
+		}
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// verifyStage 在发布前校验暂存仓库; 拉取的暂存仓库通过 alternates 借用镜像的对象, 只校验新获取的对象
+func verifyStage(ctx context.Context, stage string) error {
+	cfg := currentVerifyConfig()
+	if !cfg.Verify.AfterSync {
+		return nil
+	}
+	report, err := verifyRepo(ctx, stage, cfg.Verify.Connectivity)
+	if err != nil {
+		return err
+	}
+	return report.Err()
+}
+
+// verifyPacks 检查每个 pack 的文件头与 SHA-1 校验和, 以及 idx 的校验和、对象数与 pack 是否一致
+func verifyPacks(localPath string, report *VerifyReport) error {
+	packDir := filepath.Join(localPath, "objects", "pack")
+	entries, err := os.ReadDir(packDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, "tmp_") {
+			continue
+		}
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		switch filepath.Ext(name) {
+		case ".pack":
+			report.Packs++
+			if err := verifyPack(filepath.Join(packDir, base)); err != nil {
+				report.problem("%s: %v", name, err)
+			}
+		case ".idx":
+			if _, err := os.Stat(filepath.Join(packDir, base+".pack")); errors.Is(err, fs.ErrNotExist) {
+				report.problem("%s: pack file is missing", name)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyPack 校验 base.pack 与 base.idx
+func verifyPack(base string) error {
+	f, err := os.Open(base + ".pack")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < 12+sha1.Size {
+		return fmt.Errorf("truncated pack (%d bytes)", info.Size())
+	}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) {
+		return errors.New("bad pack signature")
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != 2 && version != 3 {
+		return fmt.Errorf("unsupported pack version %d", version)
+	}
+	count := binary.BigEndian.Uint32(header[8:12])
+
+	h := sha1.New()
+	h.Write(header)
+	if _, err := io.CopyN(h, f, info.Size()-12-sha1.Size); err != nil {
+		return err
+	}
+	trailer := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(f, trailer); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), trailer) {
+		return errors.New("pack checksum mismatch, the pack is truncated or damaged")
+	}
+
+	idx, err := os.ReadFile(base + ".idx")
+	if errors.Is(err, fs.ErrNotExist) {
+		return errors.New("index file is missing")
+	}
+	if err != nil {
+		return err
+	}
+	// idx v2: 魔数、版本、256 项 fanout, 末尾为 pack 与 idx 自身的校验和
+	const fanoutEnd = 8 + 256*4
+	if len(idx) < fanoutEnd+2*sha1.Size || !bytes.Equal(idx[:8], []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}) {
+		return errors.New("index file is truncated or not version 2")
+	}
+	sum := sha1.Sum(idx[:len(idx)-sha1.Size])
+	if !bytes.Equal(sum[:], idx[len(idx)-sha1.Size:]) {
+		return errors.New("index checksum mismatch")
+	}
+	if !bytes.Equal(idx[len(idx)-2*sha1.Size:len(idx)-sha1.Size], trailer) {
+		return errors.New("index does not belong to the pack")
+	}
+	if indexed := binary.BigEndian.Uint32(idx[fanoutEnd-4 : fanoutEnd]); indexed != count {
+		return fmt.Errorf("index has %d objects, pack has %d", indexed, count)
+	}
+	return nil
+}
+
+// verifyLooseObjects 解压每个松散对象并核对内容的 SHA-1 与文件名一致
+func verifyLooseObjects(localPath string, report *VerifyReport) error {
+	objectsDir := filepath.Join(localPath, "objects")
+	dirs, err := os.ReadDir(objectsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(objectsDir, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), "tmp_") {
+				continue
+			}
+			report.Loose++
+			hash := dir.Name() + entry.Name()
+			if err := verifyLooseObject(filepath.Join(objectsDir, dir.Name(), entry.Name()), hash); err != nil {
+				report.problem("loose object %s: %v", hash, err)
+			}
+		}
+	}
+	return nil
+}
+
+func verifyLooseObject(path string, hash string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, zr); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != hash {
+		return fmt.Errorf("content hashes to %s", got)
+	}
+	return nil
+}
+
+// verifyRefs 检查每个引用(包括快照等内部引用)指向的对象存在, 附注标签逐层解引用;
+// 标签以外的引用必须指向提交
+func verifyRefs(localPath string, report *VerifyReport) error {
+	repo, err := openRepo(localPath)
+	if err != nil {
+		report.problem("open repository: %v", err)
+		return nil
+	}
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	return iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		report.Refs++
+		name := ref.Name().String()
+		hash := ref.Hash()
+		for {
+			obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, hash)
+			if err != nil {
+				report.problem("ref %s: object %s: %v", name, hash, err)
+				return nil
+			}
+			if obj.Type() != plumbing.TagObject {
+				if obj.Type() != plumbing.CommitObject && !strings.HasPrefix(name, "refs/tags/") && !strings.Contains(name, "/refs/tags/") {
+					report.problem("ref %s points to a %s, not a commit", name, obj.Type())
+				}
+				return nil
+			}
+			tag, err := object.DecodeTag(repo.Storer, obj)
+			if err != nil {
+				report.problem("ref %s: tag %s: %v", name, hash, err)
+				return nil
+			}
+			hash = tag.Target
+		}
+	})
+}
+
+// verifyConnectivity 检查从全部引用可达的对象都存在. 系统 git 使用 fsck --connectivity-only;
+// go-git 无法遍历浅镜像与 blobless 镜像, 跳过
+func verifyConnectivity(ctx context.Context, localPath string, report *VerifyReport) error {
+	if sys := SystemGitBackend(); sys != nil {
+		if err := sys.Run(ctx, localPath, "fsck", "--connectivity-only", "--no-dangling", "--no-progress"); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			report.problem("connectivity: %v", err)
+			return nil
+		}
+		report.Connectivity = true
+		return nil
+	}
+	if IsShallowRepo(localPath) || IsPartialRepo(localPath) {
+		return nil
+	}
+
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return err
+	}
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	var tips []plumbing.Hash
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			tips = append(tips, ref.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// revlist 会读取提交、树与标签, 树中的 blob 只列出哈希, 需要逐个确认存在
+	hashes, err := revlist.Objects(repo.Storer, tips, nil)
+	if err != nil {
+		report.problem("connectivity: %v", err)
+		return nil
+	}
+	for i, hash := range hashes {
+		if i%1024 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := repo.Storer.HasEncodedObject(hash); err != nil {
+			report.problem("connectivity: object %s: %v", hash, err)
+		}
+	}
+	report.Connectivity = true
+	return nil
+}
+
+// quarantineRepoLocked 将损坏的镜像移入 basedir/.quarantine/{owner}/{repo}-{时间} 并删除仓库记录,
+// 之后的请求按新仓库重新克隆; 调用方需持有仓库的独占锁
+func quarantineRepoLocked(basedir string, userName string, repoName string, localPath string, cause error) (string, error) {
+	target := filepath.Join(basedir, quarantineDirName, userName, fmt.Sprintf("%s-%d", repoName, time.Now().UnixNano()))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	pool := repoPoolDir(localPath)
+	if err := os.Rename(localPath, target); err != nil {
+		return "", err
+	}
+	// 隔离的镜像不再是对象池成员, 其中借用的对象可能在维护对象池时被清理
+	if pool != "" {
+		if err := leaveObjectPool(pool, userName, repoName); err != nil {
+			logWarning("leave object pool failed: %v, repo: %s/%s\n", err, userName, repoName)
+		}
+	}
+	InvalidatePackCache(userName + "/" + repoName)
+	if err := DeleteRepoData(userName, repoName); err != nil {
+		return target, err
+	}
+	logError("仓库 '%s/%s' 已损坏, 移入隔离目录 '%s': %v\n", userName, repoName, target, cause)
+	return target, nil
+}
+
+// verifyInterruptedRepo 校验同步中断后留下的镜像(不含连通性检查), 损坏时隔离并返回 false,
+// 之后按新仓库重新克隆; 调用方需持有仓库的独占锁或处于启动阶段
+func verifyInterruptedRepo(basedir string, repoData schema.RepoData) (bool, error) {
+	if !currentVerifyConfig().Verify.AfterSync {
+		return true, nil
+	}
+	report, err := verifyRepo(context.Background(), repoData.LocalPath, false)
+	if err != nil {
+		return false, err
+	}
+	corrupt := report.Err()
+	if corrupt == nil {
+		return true, nil
+	}
+	_, err = quarantineRepoLocked(basedir, repoData.RepoUser, repoData.RepoName, repoData.LocalPath, corrupt)
+	return false, err
+}
+
+// VerifyMirror 按需校验镜像, full 为 true 时进行连通性检查. 校验期间持有共享锁, 不阻塞克隆;
+// 发现损坏时隔离镜像并在后台重新克隆. orphaned 镜像无法重新克隆, 只报告损坏
+func VerifyMirror(ctx context.Context, basedir string, userName string, repoName string, full bool) (*VerifyReport, error) {
+	localPath := RepoPath(basedir, userName, repoName)
+	runlock, err := RLockRepo(ctx, userName, repoName)
+	if err != nil {
+		return nil, err
+	}
+	if !repoIsUsable(localPath) {
+		runlock()
+		return nil, ErrRepoNotMirrored
+	}
+	report, err := verifyRepo(ctx, localPath, full)
+	runlock()
+	if err != nil {
+		return nil, err
+	}
+	corrupt := report.Err()
+	if corrupt == nil {
+		logInfo("仓库 '%s/%s' 校验通过, %d 个 pack, %d 个松散对象, %d 个引用, 耗时 %s。\n",
+			userName, repoName, report.Packs, report.Loose, report.Refs, report.Duration)
+		return report, nil
+	}
+
+	repoData, exists, err := GetRepoData(userName, repoName)
+	if err != nil {
+		return report, err
+	}
+	if exists && repoData.Status == RepoStatusOrphaned {
+		logError("orphaned mirror %s/%s is corrupt and cannot be recloned: %v\n", userName, repoName, corrupt)
+		return report, nil
+	}
+
+	unlock, err := lockRepo(ctx, userName, repoName)
+	if err != nil {
+		return report, err
+	}
+	report.Quarantine, err = quarantineRepoLocked(basedir, userName, repoName, localPath, corrupt)
+	unlock()
+	if err != nil {
+		return report, err
+	}
+	if exists && repoData.RepoURL != "" {
+		report.Recloning = true
+		repoURL := repoData.RepoURL
+		go func() {
+			// 后台重新克隆, 不与交互式请求争抢任务队列
+			ctx := WithPriority(context.Background(), PriorityBackground)
+			if err := EnsureRepoReady(ctx, basedir, userName, repoName, repoURL, currentVerifyConfig()); err != nil {
+				logError("reclone corrupt mirror failed: %v, repo: %s/%s\n", err, userName, repoName)
+			}
+		}()
+	}
+	return report, nil
+}
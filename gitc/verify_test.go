@@ -0,0 +1,141 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"smart-git/config"
+)
+
+// TestVerifyRepo 测试校验发现截断的对象文件与指向缺失对象的引用, 损坏的镜像被隔离并重新克隆
+func TestVerifyRepo(t *testing.T) {
+	forEachBackend(t, testVerifyRepo)
+}
+
+func testVerifyRepo(t *testing.T, backend string) {
+	basedir, src, cfg := newTestMirror(t, backend)
+	SetupVerify(cfg)
+	t.Cleanup(func() { SetupVerify(config.DefaultConfig()) })
+	src.commitFile("first")
+	src.commitFile("second")
+
+	ctx := context.Background()
+	localPath := filepath.Join(basedir, "owner", "repo")
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	report, err := verifyRepo(ctx, localPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || !report.Connectivity || report.Refs == 0 || report.Packs+report.Loose == 0 {
+		t.Fatalf("unexpected report for healthy mirror: %+v", report)
+	}
+
+	// 拉取的暂存仓库中引用指向的对象只存在于镜像, 需要经 alternates 找到
+	stage := filepath.Join(t.TempDir(), "stage")
+	if err := prepareStage(localPath, stage); err != nil {
+		t.Fatal(err)
+	}
+	report, err = verifyRepo(ctx, stage, false)
+	if err != nil || len(report.Problems) != 0 || report.Refs == 0 {
+		t.Fatalf("stage borrowing mirror objects not verified: %+v, %v", report, err)
+	}
+
+	// 指向缺失对象的引用
+	missing := filepath.Join(localPath, "refs", "heads", "missing")
+	if err := os.WriteFile(missing, []byte(strings.Repeat("1", 40)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = verifyRepo(ctx, localPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(report.Err(), ErrRepoCorrupt) || !strings.Contains(report.Err().Error(), "refs/heads/missing") {
+		t.Fatalf("missing ref target not reported: %+v", report)
+	}
+	if err := os.Remove(missing); err != nil {
+		t.Fatal(err)
+	}
+
+	// 截断对象文件; 以新文件替换, 不影响系统 git 本地克隆时硬链接的源仓库
+	damaged := damageObjectFile(t, localPath)
+	report, err = VerifyMirror(ctx, basedir, "owner", "repo", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) == 0 || !strings.Contains(strings.Join(report.Problems, "\n"), filepath.Base(damaged)) {
+		t.Fatalf("damaged object not reported: %+v", report)
+	}
+	if !report.Recloning || report.Quarantine == "" {
+		t.Fatalf("corrupt mirror not quarantined: %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(report.Quarantine, "HEAD")); err != nil {
+		t.Fatalf("quarantined mirror missing: %v", err)
+	}
+
+	recloned := func() bool {
+		data, ok, err := GetRepoData("owner", "repo")
+		return err == nil && ok && data.Status == RepoStatusSynced && repoIsUsable(localPath)
+	}
+	waitFor(t, recloned)
+	report, err = verifyRepo(ctx, localPath, true)
+	if err != nil || len(report.Problems) != 0 {
+		t.Fatalf("recloned mirror not healthy: %+v, %v", report, err)
+	}
+
+	// 同步中断后留下的损坏镜像在下次请求时隔离并重新克隆
+	damageObjectFile(t, localPath)
+	if err := SavePendingRepoData(src.path, "owner", "repo", localPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	report, err = verifyRepo(ctx, localPath, true)
+	if err != nil || len(report.Problems) != 0 {
+		t.Fatalf("interrupted mirror not recloned: %+v, %v", report, err)
+	}
+	quarantined, err := os.ReadDir(filepath.Join(basedir, quarantineDirName, "owner"))
+	if err != nil || len(quarantined) != 2 {
+		t.Fatalf("expected two quarantined mirrors: %v, %v", quarantined, err)
+	}
+	if !repoIsUsable(localPath) {
+		t.Fatal("mirror not usable after reclone")
+	}
+	if _, err := LocalHeadHash(localPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// damageObjectFile 截断镜像中的第一个 pack, 没有 pack 时截断一个松散对象, 返回被截断的文件
+func damageObjectFile(t *testing.T, localPath string) string {
+	t.Helper()
+	var target string
+	packs, _ := filepath.Glob(filepath.Join(localPath, "objects", "pack", "*.pack"))
+	if len(packs) > 0 {
+		target = packs[0]
+	} else {
+		loose, _ := filepath.Glob(filepath.Join(localPath, "objects", "??", "*"))
+		if len(loose) == 0 {
+			t.Fatal("mirror has no objects")
+		}
+		target = loose[0]
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := target + ".damaged"
+	if err := os.WriteFile(tmp, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
@@ -0,0 +1,339 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing"
+)
+
+const (
+	// unknownWantTTL 为上游同样无法提供的对象的负缓存时间, 避免无效 SHA 反复触发上游 fetch
+	unknownWantTTL = time.Minute
+	// maxFetchWants 为单个请求最多按需获取的对象数
+	maxFetchWants = 32
+	// fetchWantsBurst 与 fetchWantsInterval 限制每个仓库按需获取的频率: 最多连续获取 fetchWantsBurst 次,
+	// 之后每 fetchWantsInterval 恢复一次
+	fetchWantsBurst    = 4
+	fetchWantsInterval = 15 * time.Second
+	// wantsStageDirName 为暂存目录下按需获取使用的目录, 以 "." 开头不会与 owner 重名
+	wantsStageDirName = ".wants"
+
+	// WantRefPrefix 为按需获取的对象的内部引用前缀, 引用名称为对象 ID
+	WantRefPrefix = InternalRefPrefix + "refs/wants/"
+)
+
+// ErrFetchWantsLimited 表示仓库的按需获取超过了频率限制
+var ErrFetchWantsLimited = errors.New("too many on-demand fetches for repository")
+
+// unknownWantErrors 为上游明确不提供对象时错误信息中的片段
+var unknownWantErrors = []string{"not our ref", "not found", "no such remote ref", "couldn't find remote ref", "unadvertised object"}
+
+var (
+	unknownWantsMu sync.Mutex
+	unknownWants   = map[string]time.Time{}
+
+	wantFetchesMu sync.Mutex
+	wantFetches   = map[string]*wantFetchState{}
+)
+
+// MissingWants 返回 wants 中本地仓库不存在的对象, 无法解析的 ID 交给 upload-pack 报错
+func MissingWants(ctx context.Context, localPath string, wants []string) ([]string, error) {
+	valid := make([]string, 0, len(wants))
+	for _, want := range wants {
+		if _, ok := plumbing.FromHex(want); ok {
+			valid = append(valid, want)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, nil
+	}
+	// 系统 git 不需要为每次请求加载全部 pack 索引
+	if sys := SystemGitBackend(); sys != nil {
+		return sys.missingObjects(ctx, localPath, valid)
+	}
+
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, want := range valid {
+		if err := repo.Storer.HasEncodedObject(plumbing.NewHash(want)); errors.Is(err, plumbing.ErrObjectNotFound) {
+			missing = append(missing, want)
+		}
+	}
+	return missing, nil
+}
+
+// FetchWants 在 wants 中有本地缺失的对象时按对象 ID 从上游获取, 用于锁文件与子模块固定的、
+// 已不在任何分支上或尚未同步到镜像的提交. 每个请求最多获取 maxFetchWants 个对象, 每个仓库按
+// fetchWantsBurst 与 fetchWantsInterval 限制获取的频率. 获取在借用镜像对象的暂存仓库中进行, 不持有仓库锁,
+// 只在发布对象时短暂持有独占锁; 获取的对象以 WantRefPrefix 下的内部引用保存, 不会被 gc 清理.
+// 上游明确不提供的对象在 unknownWantTTL 内不再重试
+func FetchWants(ctx context.Context, basedir string, userName string, repoName string, repoURL string, wants []string) error {
+	localPath := RepoPath(basedir, userName, repoName)
+	lockKey := userName + "/" + repoName
+	missing, err := MissingWants(ctx, localPath, wants)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+	missing = filterUnknownWants(lockKey, missing)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	release, err := acquireWantFetch(ctx, lockKey)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// 等待期间其它请求可能已经取回
+	missing, err = MissingWants(ctx, localPath, missing)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+	if len(missing) > maxFetchWants {
+		logWarning("too many unadvertised wants, fetching %d of %d, repo: %s\n", maxFetchWants, len(missing), lockKey)
+		missing = missing[:maxFetchWants]
+	}
+	if !takeWantFetchToken(lockKey) {
+		return ErrFetchWantsLimited
+	}
+
+	stage, cleanup, err := newWantsStage(basedir, localPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := prepareStage(localPath, stage); err != nil {
+		return err
+	}
+	spec := syncSpec(localPath, MirrorFor(userName, repoName))
+	// 按需获取由客户端请求触发, 沿用调用方的优先级排队
+	err = Jobs().Run(ctx, JobKindFetch, lockKey, repoURL, func(ctx context.Context) error {
+		return CurrentBackend().FetchObjects(ctx, stage, missing, spec)
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		// 只有上游明确拒绝时才负缓存, 取消、超时与网络错误之后仍可重试
+		if unknown := unknownWantsIn(err, missing); len(unknown) > 0 {
+			markUnknownWants(lockKey, unknown)
+		}
+		return err
+	}
+	still, err := MissingWants(ctx, stage, missing)
+	if err != nil {
+		return err
+	}
+	if len(still) > 0 {
+		markUnknownWants(lockKey, still)
+	}
+	if len(still) == len(missing) {
+		return nil
+	}
+	if err := verifyStage(ctx, stage); err != nil {
+		return err
+	}
+	if err := publishWants(ctx, basedir, userName, repoName, stage, missing, still); err != nil {
+		return err
+	}
+	logInfo("fetched %d of %d unadvertised objects for %s\n", len(missing)-len(still), len(missing), lockKey)
+	return nil
+}
+
+// publishWants 在仓库独占锁下将暂存仓库获取的对象发布到镜像(对象池成员发布到对象池), 并为取回的对象创建内部引用
+func publishWants(ctx context.Context, basedir string, userName string, repoName string, stage string, fetched []string, still []string) error {
+	unlock, err := lockRepo(ctx, userName, repoName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// 获取期间镜像可能被删除或迁移, 按当前的路径发布
+	localPath := RepoPath(basedir, userName, repoName)
+	if !repoIsUsable(localPath) {
+		return ErrRepoNotMirrored
+	}
+	releasePool, err := publishStagedObjects(ctx, stage, localPath)
+	if err != nil {
+		return err
+	}
+	defer releasePool()
+	repo, err := openRepo(localPath)
+	if err != nil {
+		return err
+	}
+	for _, want := range fetched {
+		if slices.Contains(still, want) {
+			continue
+		}
+		ref := plumbing.NewHashReference(plumbing.ReferenceName(WantRefPrefix+want), plumbing.NewHash(want))
+		if err := repo.Storer.SetReference(ref); err != nil {
+			return err
+		}
+	}
+	InvalidatePackCache(userName + "/" + repoName)
+	return nil
+}
+
+// newWantsStage 为按需获取创建暂存仓库; 与同步的暂存目录分开, 不需要持有仓库锁, 多个获取互不影响.
+// 返回的 cleanup 删除暂存仓库与空的上级目录
+func newWantsStage(basedir string, localPath string) (string, func(), error) {
+	rel, err := filepath.Rel(basedir, localPath)
+	if err != nil {
+		return "", nil, err
+	}
+	root := filepath.Join(stagingDir(basedir), wantsStageDirName, rel)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", nil, err
+	}
+	stage, err := os.MkdirTemp(root, "wants-*")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		_ = os.RemoveAll(stage)
+		for dir := root; dir != stagingDir(basedir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	if err := os.Chmod(stage, 0755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return stage, cleanup, nil
+}
+
+// unknownWantsIn 在上游明确拒绝提供对象时返回被拒绝的对象: 错误中列出了对象 ID 时只返回这些对象, 否则返回全部;
+// 取消、超时与其它错误返回 nil
+func unknownWantsIn(err error, wants []string) []string {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	msg := strings.ToLower(err.Error())
+	definitive := false
+	for _, pattern := range unknownWantErrors {
+		if strings.Contains(msg, pattern) {
+			definitive = true
+			break
+		}
+	}
+	if !definitive {
+		return nil
+	}
+	var named []string
+	for _, want := range wants {
+		if strings.Contains(msg, strings.ToLower(want)) {
+			named = append(named, want)
+		}
+	}
+	if len(named) > 0 {
+		return named
+	}
+	return wants
+}
+
+// wantFetchState 为一个仓库按需获取的令牌桶与正在进行的获取
+type wantFetchState struct {
+	tokens   float64
+	last     time.Time
+	fetching chan struct{}
+}
+
+// acquireWantFetch 等待同一仓库正在进行的按需获取结束后开始新的获取, 返回结束获取的函数
+func acquireWantFetch(ctx context.Context, repo string) (func(), error) {
+	for {
+		wantFetchesMu.Lock()
+		state := wantFetches[repo]
+		if state == nil {
+			state = &wantFetchState{tokens: fetchWantsBurst, last: time.Now()}
+			wantFetches[repo] = state
+		}
+		if state.fetching == nil {
+			done := make(chan struct{})
+			state.fetching = done
+			wantFetchesMu.Unlock()
+			return func() {
+				wantFetchesMu.Lock()
+				defer wantFetchesMu.Unlock()
+				close(done)
+				state.fetching = nil
+				sweepWantFetches(time.Now())
+			}, nil
+		}
+		fetching := state.fetching
+		wantFetchesMu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// takeWantFetchToken 消耗仓库的一个按需获取令牌, 令牌耗尽时返回 false. 调用方需已通过 acquireWantFetch 开始获取
+func takeWantFetchToken(repo string) bool {
+	wantFetchesMu.Lock()
+	defer wantFetchesMu.Unlock()
+	state := wantFetches[repo]
+	now := time.Now()
+	state.tokens = min(fetchWantsBurst, state.tokens+float64(now.Sub(state.last))/float64(fetchWantsInterval))
+	state.last = now
+	if state.tokens < 1 {
+		return false
+	}
+	state.tokens--
+	return true
+}
+
+// sweepWantFetches 删除令牌已补满且没有获取在进行的仓库, 避免状态无限增长. 调用方需持有 wantFetchesMu
+func sweepWantFetches(now time.Time) {
+	for repo, state := range wantFetches {
+		if state.fetching == nil && now.Sub(state.last) > fetchWantsBurst*fetchWantsInterval {
+			delete(wantFetches, repo)
+		}
+	}
+}
+
+// filterUnknownWants 去掉负缓存仍有效的对象
+func filterUnknownWants(repo string, wants []string) []string {
+	unknownWantsMu.Lock()
+	defer unknownWantsMu.Unlock()
+	now := time.Now()
+	var result []string
+	for _, want := range wants {
+		key := repo + "@" + want
+		if expire, ok := unknownWants[key]; ok {
+			if now.Before(expire) {
+				continue
+			}
+			delete(unknownWants, key)
+		}
+		result = append(result, want)
+	}
+	return result
+}
+
+func markUnknownWants(repo string, wants []string) {
+	unknownWantsMu.Lock()
+	defer unknownWantsMu.Unlock()
+	now := time.Now()
+	// 顺带清理过期条目, 避免负缓存无限增长
+	for key, expire := range unknownWants {
+		if now.After(expire) {
+			delete(unknownWants, key)
+		}
+	}
+	for _, want := range wants {
+		unknownWants[repo+"@"+want] = now.Add(unknownWantTTL)
+	}
+}
@@ -0,0 +1,143 @@
+package gitc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v6/plumbing"
+)
+
+// TestUnknownWantsCache 测试上游不提供的对象在有效期内不再重试, 且按仓库区分
+func TestUnknownWantsCache(t *testing.T) {
+	wants := []string{"17b24e835317f14df978a91d3e8fa0c4cddfdddc", "8403599758df58ab87f79d58b911b08d57fb9734"}
+	markUnknownWants("owner/repo", wants[:1])
+	defer func() {
+		unknownWantsMu.Lock()
+		unknownWants = map[string]time.Time{}
+		unknownWantsMu.Unlock()
+	}()
+
+	if got := filterUnknownWants("owner/repo", wants); !reflect.DeepEqual(got, wants[1:]) {
+		t.Fatalf("unexpected wants: %v", got)
+	}
+	if got := filterUnknownWants("owner/other", wants); !reflect.DeepEqual(got, wants) {
+		t.Fatalf("cache should be per repo: %v", got)
+	}
+
+	unknownWantsMu.Lock()
+	unknownWants["owner/repo@"+wants[0]] = time.Now().Add(-time.Second)
+	unknownWantsMu.Unlock()
+	if got := filterUnknownWants("owner/repo", wants); !reflect.DeepEqual(got, wants) {
+		t.Fatalf("expired entry should be retried: %v", got)
+	}
+}
+
+// TestUnknownWantsIn 测试只有上游明确拒绝时才负缓存, 错误中列出对象 ID 时只缓存这些对象
+func TestUnknownWantsIn(t *testing.T) {
+	wants := []string{"17b24e835317f14df978a91d3e8fa0c4cddfdddc", "8403599758df58ab87f79d58b911b08d57fb9734"}
+	for _, tt := range []struct {
+		err      error
+		expected []string
+	}{
+		{errors.New("fatal: remote error: upload-pack: not our ref " + wants[1]), wants[1:]},
+		{errors.New("object not found"), wants},
+		{context.Canceled, nil},
+		{errors.Join(context.DeadlineExceeded, errors.New("not found")), nil},
+		{errors.New("connection reset by peer"), nil},
+	} {
+		if got := unknownWantsIn(tt.err, wants); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%v: expected %v, got %v", tt.err, tt.expected, got)
+		}
+	}
+}
+
+// TestWantFetchLimit 测试同一仓库的按需获取依次进行, 令牌耗尽后拒绝
+func TestWantFetchLimit(t *testing.T) {
+	t.Cleanup(func() {
+		wantFetchesMu.Lock()
+		wantFetches = map[string]*wantFetchState{}
+		wantFetchesMu.Unlock()
+	})
+	ctx := context.Background()
+	release, err := acquireWantFetch(ctx, "owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := acquireWantFetch(waitCtx, "owner/repo"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("concurrent fetch of the same repo not serialized: %v", err)
+	}
+	for i := 0; i < fetchWantsBurst; i++ {
+		if !takeWantFetchToken("owner/repo") {
+			t.Fatalf("fetch %d limited", i)
+		}
+	}
+	if takeWantFetchToken("owner/repo") {
+		t.Fatal("fetch after burst not limited")
+	}
+	release()
+
+	otherRelease, err := acquireWantFetch(ctx, "owner/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherRelease()
+	if !takeWantFetchToken("owner/other") {
+		t.Fatal("limit should be per repo")
+	}
+}
+
+// TestFetchWants 测试按需获取的对象发布到镜像并以内部引用保存, 上游拒绝的对象进入负缓存.
+// go-git 的本地传输不支持按对象 ID 获取, 只使用系统 git 后端
+func TestFetchWants(t *testing.T) {
+	requireGit(t)
+	basedir, src, cfg := newTestMirror(t, BackendSystem)
+	t.Cleanup(func() {
+		unknownWantsMu.Lock()
+		unknownWants = map[string]time.Time{}
+		unknownWantsMu.Unlock()
+		wantFetchesMu.Lock()
+		wantFetches = map[string]*wantFetchState{}
+		wantFetchesMu.Unlock()
+	})
+
+	src.commit("first")
+
+	localPath := filepath.Join(basedir, "owner", "repo")
+	ctx := context.Background()
+	if err := EnsureRepoReady(ctx, basedir, "owner", "repo", src.path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	// 尚未同步到镜像的提交
+	second := src.commit("second").String()
+	if err := FetchWants(ctx, basedir, "owner", "repo", src.path, []string{second}); err != nil {
+		t.Fatal(err)
+	}
+	mirror, err := openRepo(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mirror.CommitObject(plumbing.NewHash(second)); err != nil {
+		t.Fatalf("fetched object not published: %v", err)
+	}
+	if ref, err := mirror.Storer.Reference(plumbing.ReferenceName(WantRefPrefix + second)); err != nil || ref.Hash().String() != second {
+		t.Fatalf("fetched object not kept by an internal ref: %v, %v", ref, err)
+	}
+	if entries, _ := os.ReadDir(stagingDir(basedir)); len(entries) != 0 {
+		t.Fatalf("staging dir not cleaned: %v", entries)
+	}
+
+	unknown := "17b24e835317f14df978a91d3e8fa0c4cddfdddc"
+	if err := FetchWants(ctx, basedir, "owner", "repo", src.path, []string{unknown}); err == nil {
+		t.Fatal("fetching an unknown object succeeded")
+	}
+	if got := filterUnknownWants("owner/repo", []string{unknown}); len(got) != 0 {
+		t.Fatalf("unknown object not cached: %v", got)
+	}
+}
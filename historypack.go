@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"regexp"
+	"smart-git/gitc"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v6/plumbing/format/pktline"
+	"github.com/go-git/go-git/v6/plumbing/protocol"
+	"github.com/infinite-iroha/touka"
+)
+
+var historyPackNameRe = regexp.MustCompile(`^pack-[0-9a-f]{40}([0-9a-f]{24})?\.pack$`)
+
+// handleHistoryPack 在未配置外部 baseURL 时由 smart-git 自身提供历史 pack 下载
+func handleHistoryPack() touka.HandlerFunc {
+	return func(c *touka.Context) {
+		store := gitc.CurrentHistoryPacks()
+		name := c.Param("name")
+		if store == nil || !historyPackNameRe.MatchString(name) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		hash := strings.TrimSuffix(strings.TrimPrefix(name, "pack-"), ".pack")
+		serveArtifact(c, store.PackPath(c.Param("user")+"/"+c.Param("repo"), hash), "application/x-git-packfile")
+	}
+}
+
+// historyPackAvailable 判断仓库是否有可通过 packfile-uris 下发的历史 pack
+func historyPackAvailable(userName string, repoName string) bool {
+	store := gitc.CurrentHistoryPacks()
+	if store == nil {
+		return false
+	}
+	_, err := store.Manifest(userName + "/" + repoName)
+	return err == nil
+}
+
+// historyPackURL 返回历史 pack 的下载地址; 配置了 baseURL 时按 dir 的目录结构拼接
+func historyPackURL(r *http.Request, userName string, repoName string, hash string) string {
+	if base := strings.TrimSuffix(cfg.PackfileURIs.BaseURL, "/"); base != "" {
+		return base + "/" + userName + "/" + repoName + "/pack-" + hash + ".pack"
+	}
+	return requestOrigin(r) + "/" + userName + "/" + repoName + "/packfiles/pack-" + hash + ".pack"
+}
+
+// historyPackFor 判断请求能否由历史 pack 加增量 pack 满足, 可以时返回
+// 改写后的请求体与需要注入响应的 packfile-uris 段
+func historyPackFor(r *http.Request, userName string, repoName string, req *uploadPackRequest) ([]byte, []byte) {
+	store := gitc.CurrentHistoryPacks()
+	if store == nil || req == nil || req.Version != protocol.V2 || !req.isFullClone() {
+		return nil, nil
+	}
+	// shallow 与 filter 请求需要的对象集合与历史 pack 不一致
+	for _, arg := range req.Args {
+		if strings.HasPrefix(arg, "deepen") || strings.HasPrefix(arg, "shallow ") || strings.HasPrefix(arg, "filter ") {
+			return nil, nil
+		}
+	}
+	protocols, ok := req.Arg("packfile-uris ")
+	if !ok {
+		return nil, nil
+	}
+
+	repo := userName + "/" + repoName
+	pack, err := store.Manifest(repo)
+	if err != nil {
+		return nil, nil
+	}
+	uri := historyPackURL(r, userName, repoName, pack.Hash)
+	u, err := url.Parse(uri)
+	if err != nil || !containsField(protocols, ",", u.Scheme) {
+		return nil, nil
+	}
+
+	// 客户端将在下载历史 pack 之前索引增量 pack, 增量 pack 不能是 thin pack;
+	// 历史 pack 的 tips 作为 have, upload-pack 只发送其后的对象
+	body, err := req.encodeV2Fetch(pack.Tips, "thin-pack", "packfile-uris ")
+	if err != nil {
+		logWarning("encode fetch request failed: %v, repo: %s\n", err, repo)
+		return nil, nil
+	}
+
+	var section bytes.Buffer
+	_, _ = pktline.Writeln(&section, "packfile-uris")
+	_, _ = pktline.Writeln(&section, pack.Hash+" "+uri)
+	_ = pktline.WriteDelim(&section)
+	return body, section.Bytes()
+}
+
+func containsField(s string, sep string, value string) bool {
+	for _, field := range strings.Split(s, sep) {
+		if strings.TrimSpace(field) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// packfileURIResponseWriter 在 upload-pack 响应的 packfile 段之前插入 packfile-uris 段
+type packfileURIResponseWriter struct {
+	http.ResponseWriter
+	section []byte
+	buf     []byte
+	done    bool
+}
+
+func (w *packfileURIResponseWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	for !w.done && len(w.buf) >= pktline.LenSize {
+		size, err := strconv.ParseUint(string(w.buf[:pktline.LenSize]), 16, 16)
+		if err != nil {
+			// 不是 pkt-line(例如错误输出), 停止改写
+			w.done = true
+			break
+		}
+		n := max(int(size), pktline.LenSize)
+		if len(w.buf) < n {
+			break
+		}
+		if string(w.buf[pktline.LenSize:n]) == "packfile\n" {
+			if _, err := w.ResponseWriter.Write(w.section); err != nil {
+				return 0, err
+			}
+			w.done = true
+			break
+		}
+		if _, err := w.ResponseWriter.Write(w.buf[:n]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[n:]
+	}
+
+	if w.done && len(w.buf) > 0 {
+		buf := w.buf
+		w.buf = nil
+		if _, err := w.ResponseWriter.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *packfileURIResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
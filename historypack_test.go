@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// TestPackfileURIResponseWriter 测试逐字节写入时 packfile-uris 段插入在 packfile 段之前
+func TestPackfileURIResponseWriter(t *testing.T) {
+	section := buildPktLines(t, "packfile-uris", testOID1+" https://example.com/pack-"+testOID1+".pack", "0001")
+	resp := buildPktLines(t, "shallow-info", "shallow "+testOID2, "0001", "packfile")
+	resp = append(resp, "0009\x01PACK0000"...)
+
+	rec := httptest.NewRecorder()
+	w := &packfileURIResponseWriter{ResponseWriter: rec, section: section}
+	for i := range resp {
+		if _, err := w.Write(resp[i : i+1]); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	want := buildPktLines(t, "shallow-info", "shallow "+testOID2, "0001")
+	want = append(want, section...)
+	want = append(want, buildPktLines(t, "packfile")...)
+	want = append(want, "0009\x01PACK0000"...)
+	if got := rec.Body.String(); got != string(want) {
+		t.Fatalf("unexpected response:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+// TestRequestOrigin 测试仅信任受信代理传递的 X-Forwarded-Proto
+func TestRequestOrigin(t *testing.T) {
+	old := forwardedProxies
+	forwardedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	t.Cleanup(func() { forwardedProxies = old })
+
+	for _, tt := range []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{"192.0.2.1:1234", "http://example.com"},
+		{"10.0.0.1:1234", "https://example.com"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("X-Forwarded-Proto", "https")
+		if got := requestOrigin(req); got != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.remoteAddr, tt.expected, got)
+		}
+	}
+}
@@ -3,9 +3,11 @@ package main
 // MIT https://github.com/erred/gitreposerver
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"smart-git/database"
+	"smart-git/gitc"
 
 	"github.com/fenthope/compress"
 	"github.com/fenthope/record"
@@ -34,8 +36,17 @@ func RunHTTP(addr string, baseRepoDir string) error {
 
 	r.Use(compress.Compression(compress.DefaultCompressionConfig()))
 
-	r.GET("/:user/:repo/info/refs", handleInfoRefs(baseRepoDir))    // 处理仓库引用信息请求
-	r.POST("/:user/:repo/git-upload-pack", serviceRPC(baseRepoDir)) // 处理 git-upload-pack 请求
+	// owner 与仓库名称在进入限流与处理函数之前校验
+	validRepo := validateRepoParams(false)
+	validAPIRepo := validateRepoParams(true)
+	limiter := newRateLimiter(cfg.RateLimit)
+	forwardedProxies = parseTrustedProxies(cfg.RateLimit.TrustedProxies)
+	packLimiter = newPackGuard(cfg)
+
+	r.GET("/:user/:repo/info/refs", validRepo, limiter.Middleware(false), handleInfoRefs(baseRepoDir))   // 处理仓库引用信息请求
+	r.POST("/:user/:repo/git-upload-pack", validRepo, limiter.Middleware(true), serviceRPC(baseRepoDir)) // 处理 git-upload-pack 请求
+	r.GET("/:user/:repo/clone.bundle", validRepo, limiter.Middleware(false), handleCloneBundle())        // 预生成的 bundle 文件
+	r.GET("/:user/:repo/packfiles/:name", validRepo, limiter.Middleware(false), handleHistoryPack())     // packfile-uris 指向的历史 pack
 
 	r.GET("/healthz", func(c *touka.Context) {
 		RenderWANF(c, http.StatusOK, &APIHealthResponse{
@@ -74,6 +85,81 @@ func RunHTTP(addr string, baseRepoDir string) error {
 		RenderWANF(c, http.StatusOK, &APIRepoStatsList{Items: resp})
 	})
 
+	// 上游已被删除或转为私有、保留为只读的镜像
+	r.GET("/api/repos/orphaned", func(c *touka.Context) {
+		records, err := gitc.GetOrphanedRepoData()
+		if err != nil {
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		resp := make([]APIRepoRecord, 0, len(records))
+		for _, record := range records {
+			resp = append(resp, NewAPIRepoRecord(record))
+		}
+		RenderWANF(c, http.StatusOK, &APIRepoRecordList{Items: resp})
+	})
+
+	// 上游同步任务
+	r.GET("/api/jobs", func(c *touka.Context) {
+		queue := gitc.Jobs()
+		stats := queue.Stats()
+		jobs := queue.List()
+
+		resp := make([]APIJob, 0, len(jobs))
+		for _, job := range jobs {
+			resp = append(resp, NewAPIJob(job))
+		}
+		RenderWANF(c, http.StatusOK, &APIJobList{Running: stats.Running, Queued: stats.Queued, Items: resp})
+	})
+	r.DELETE("/api/jobs/:id", func(c *touka.Context) {
+		if err := gitc.Jobs().Cancel(c.Param("id")); err != nil {
+			if errors.Is(err, gitc.ErrJobNotFound) {
+				RenderWANFError(c, http.StatusNotFound, err.Error())
+				return
+			}
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// 仓库读写锁的等待统计
+	r.GET("/api/locks", func(c *touka.Context) {
+		resp := NewAPIRepoLockStats(gitc.GetRepoLockStats())
+		RenderWANF(c, http.StatusOK, &resp)
+	})
+
+	// 仓库维护: repack、prune 与临时文件清理
+	r.GET("/api/maintenance", handleListMaintenance())
+	r.GET("/api/repos/:owner/:repo/maintenance", validAPIRepo, handleGetMaintenance())
+	r.POST("/api/repos/:owner/:repo/maintenance", validAPIRepo, handleRunMaintenance(baseRepoDir))
+
+	// 核对 BaseDir 与数据库, POST 时修复
+	r.GET("/api/fsck", handleFsck(false))
+	r.POST("/api/fsck", handleFsck(true))
+
+	// 校验镜像完整性, 损坏时隔离并重新克隆
+	r.POST("/api/repos/:owner/:repo/verify", validAPIRepo, handleVerifyRepo(baseRepoDir))
+
+	// fork 网络的共享对象池
+	r.GET("/api/pools", handleListPools(baseRepoDir))
+	r.POST("/api/pools/:network/maintenance", handleRunPoolMaintenance(baseRepoDir))
+
+	// 将镜像迁移到当前的目录布局, GET 时只列出需要移动的仓库
+	r.GET("/api/layout/migrate", handleMigrateLayout(baseRepoDir, true))
+	r.POST("/api/layout/migrate", handleMigrateLayout(baseRepoDir, false))
+
+	// 引用快照, 以 /:user/:repo@name 克隆
+	r.GET("/api/repos/:owner/:repo/snapshots", validAPIRepo, handleListSnapshots(baseRepoDir))
+	r.POST("/api/repos/:owner/:repo/snapshots", validAPIRepo, handleCreateSnapshot(baseRepoDir))
+	r.DELETE("/api/repos/:owner/:repo/snapshots/:name", validAPIRepo, handleDeleteSnapshot(baseRepoDir))
+
+	// 引用日志, force-push 与 tag 改写记录
+	r.GET("/api/repos/:owner/:repo/refs/history", validAPIRepo, handleRefHistory())
+	r.GET("/api/repos/:owner/:repo/refs/at", validAPIRepo, handleRefsAt())
+	r.GET("/api/ref-rewrites", handleRefRewrites())
+
 	// 404 路由处理
 	r.NoRoute(func(c *touka.Context) {
 		logInfo("404 Not Found, Path: %s", string(c.GetRequestURIPath())) // 使用 rc.Path() 获取路径
@@ -1,16 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"smart-git/gitc"
 
-	"github.com/go-git/go-billy/v6/osfs"
 	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/protocol"
 	"github.com/go-git/go-git/v6/plumbing/transport"
-	gitserver "github.com/go-git/go-git/v6/plumbing/transport"
-	"github.com/go-git/go-git/v6/utils/ioutil"
 	"github.com/infinite-iroha/touka"
 )
 
@@ -20,7 +21,7 @@ func handleInfoRefs(baseRepoDir string) touka.HandlerFunc {
 		r := c.Request
 		ctx := c.Context()
 
-		repoName := c.Param("repo")
+		repoName, snapshot := splitRepoSnapshot(c.Param("repo"))
 		userName := c.Param("user")
 		serviceName := c.Query("service")
 		if serviceName != "git-upload-pack" {
@@ -30,64 +31,102 @@ func handleInfoRefs(baseRepoDir string) touka.HandlerFunc {
 			return
 		}
 
-		if err := ensureRepoReady(ctx, baseRepoDir, userName, repoName); err != nil {
-			if err == plumbing.ErrReferenceNotFound {
-				c.ErrorUseHandle(http.StatusNotFound, err)
-				return
-			}
+		service := transport.Service(serviceName)
+		version := r.Header.Get("Git-Protocol")
+		repoPath := gitc.RepoPath(baseRepoDir, userName, repoName)
+		mirror := gitc.MirrorFor(userName, repoName)
 
-			logError("ensure repo failed: %v\n", err)
-			c.ErrorUseHandle(http.StatusInternalServerError, err)
+		view, err := snapshotView(repoPath, snapshot, mirror)
+		if err != nil {
+			c.ErrorUseHandle(http.StatusNotFound, err)
 			return
 		}
+		// 快照不随上游变化, 不触发同步
+		if snapshot == "" {
+			if err := ensureRepoReady(ctx, baseRepoDir, userName, repoName); err != nil {
+				if err == plumbing.ErrReferenceNotFound {
+					c.ErrorUseHandle(http.StatusNotFound, err)
+					return
+				}
+				if errors.Is(err, gitc.ErrJobQueueFull) || errors.Is(err, gitc.ErrRepoLockTimeout) {
+					c.SetHeader("Retry-After", "5")
+					c.ErrorUseHandle(http.StatusServiceUnavailable, err)
+					return
+				}
 
-		c.SetHeader("Content-Type", "application/x-git-upload-pack-advertisement")
+				logError("ensure repo failed: %v\n", err)
+				c.ErrorUseHandle(http.StatusInternalServerError, err)
+				return
+			}
+		}
 
-		bfs := osfs.New(baseRepoDir)
-		ld := gitserver.NewFilesystemLoader(bfs, true)
-		epStr := "/" + userName + "/" + repoName
-		c.Infof("epStr: %s\n", epStr)
-		ep, err := transport.NewEndpoint(epStr)
+		// 广告期间持有共享锁, 同步与维护等待其结束
+		unlock, err := gitc.RLockRepo(ctx, userName, repoName)
 		if err != nil {
-			logError("Error creating endpoint: %v, repo: %s\n", err, repoName)
-			c.ErrorUseHandle(http.StatusInternalServerError, err)
+			if errors.Is(err, gitc.ErrRepoLockTimeout) {
+				c.SetHeader("Retry-After", "10")
+				c.ErrorUseHandle(http.StatusServiceUnavailable, err)
+			}
 			return
 		}
+		defer unlock()
+		// 等待锁期间镜像可能已被布局迁移移动
+		repoPath = gitc.RepoPath(baseRepoDir, userName, repoName)
 
-		st, err := ld.Load(ep)
-		if err != nil {
-			logError("Error loading repository: %v, repo: %s\n", err, repoName)
-			c.Status(http.StatusNotFound)
-			return
+		hdrNocache(w)
+		w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-advertisement", service.Name()))
+
+		// protocol v2 广告较小, 需要追加能力时先缓冲再改写; bundle 与历史 pack 只对应镜像的当前引用
+		isV2 := transport.ProtocolVersion(version) == protocol.V2
+		withBundle := isV2 && snapshot == "" && bundleAvailable(userName, repoName)
+		withPackfileURIs := isV2 && snapshot == "" && historyPackAvailable(userName, repoName)
+		// v0/v1 广告中的 shallow 行会让客户端沿用镜像的浅边界, 即使之后按需加深或拒绝了请求;
+		// 浅镜像不广告 shallow 行, 由 git-upload-pack 阶段按请求的深度处理
+		stripShallow := !isV2 && mirror.Depth > 0
+		var out io.Writer = w
+		var adv bytes.Buffer
+		if withBundle || withPackfileURIs || stripShallow {
+			out = &adv
 		}
 
-		c.Header("Cache-Control", "no-cache, max-age=0, must-revalidate")
-		service := transport.Service(serviceName)
-		version := r.Header.Get("Git-Protocol")
+		if err := currentUploadPackBackend().AdvertiseRefs(ctx, repoPath, version, view, out); err != nil {
+			if errors.Is(err, transport.ErrRepositoryNotFound) {
+				logError("Error loading repository: %v, repo: %s\n", err, repoName)
+				c.Status(http.StatusNotFound)
+				return
+			}
+			logError("Error advertising refs: %v, repo: %s\n", err, repoName)
+			return
+		}
 
-		if service != "" {
-			hdrNocache(w)
-			w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-advertisement", service.Name()))
-
-			switch service {
-			case transport.UploadPackService:
-				err = writeAdvertisedRefs(ctx, st, service, version, w)
-			case transport.ReceivePackService:
-				err = transport.ReceivePack(ctx, st, nil, ioutil.WriteNopCloser(w),
-					&transport.ReceivePackOptions{
-						GitProtocol:   version,
-						AdvertiseRefs: true,
-						StatelessRPC:  true,
-					},
-				)
+		if stripShallow {
+			body, err := dropPktLines(adv.Bytes(), "shallow ")
+			if err != nil {
+				logWarning("strip shallow lines failed: %v, repo: %s/%s\n", err, userName, repoName)
+				body = adv.Bytes()
+			}
+			if _, err := w.Write(body); err != nil {
+				logError("Error writing advertisement: %v, repo: %s\n", err, repoName)
 			}
+		}
+
+		if withBundle || withPackfileURIs {
+			body, err := editV2Capabilities(adv.Bytes(), func(caps []string) []string {
+				if withBundle {
+					caps = append(caps, "bundle-uri")
+				}
+				if withPackfileURIs {
+					caps = addFetchFeature(caps, "packfile-uris")
+				}
+				return caps
+			})
 			if err != nil {
-				logError("Error advertising refs: %v, repo: %s\n", err, repoName)
-				return
+				logWarning("edit v2 capabilities failed: %v, repo: %s/%s\n", err, userName, repoName)
+				body = adv.Bytes()
+			}
+			if _, err := w.Write(body); err != nil {
+				logError("Error writing advertisement: %v, repo: %s\n", err, repoName)
 			}
-		} else {
-			hdrNocache(w)
-			sendFile(w, r, "text/plain; charset=utf-8")
 		}
 	}
 }
@@ -97,6 +136,10 @@ func ensureRepoReady(ctx context.Context, baseRepoDir, userName, repoName string
 		return err
 	}
 
-	gitURL := "https://github.com/" + userName + "/" + repoName
-	return gitc.EnsureRepoReady(ctx, baseRepoDir, userName, repoName, gitURL, cfg)
+	return gitc.EnsureRepoReady(ctx, baseRepoDir, userName, repoName, upstreamURL(userName, repoName), cfg)
+}
+
+// upstreamURL 返回 owner/repo 对应的上游仓库地址
+func upstreamURL(userName string, repoName string) string {
+	return "https://github.com/" + userName + "/" + repoName
 }
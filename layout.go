@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"smart-git/config"
+	"smart-git/database"
+	"smart-git/gitc"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// runMigrateLayout 执行 `smart-git migrate-layout [-c config] [-dry-run]`, 将镜像移动到配置的目录布局,
+// 全部移动成功时返回 0, 有冲突或失败时返回 1
+func runMigrateLayout(args []string) int {
+	flags := flag.NewFlagSet("migrate-layout", flag.ContinueOnError)
+	cfgPath := flags.String("c", "./config/config", "config file path")
+	cfgCompat := flags.String("cfg", "", "config file path (compat alias)")
+	dryRun := flags.Bool("dry-run", false, "only list the mirrors to move")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *cfgCompat != "" {
+		*cfgPath = *cfgCompat
+	}
+
+	var err error
+	cfg, err = config.LoadConfig(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to load config: %v\n", err)
+		return 2
+	}
+	if err := database.OpenDB(cfg, fsckDBTimeout); err != nil {
+		fmt.Fprintf(os.Stderr, "fail to open database %s: %v\n", cfg.Database.Path, err)
+		fmt.Fprintln(os.Stderr, "the database is locked while smart-git is running, use GET/POST /api/layout/migrate instead")
+		return 2
+	}
+	defer database.DB.Close()
+	if err := gitc.SetupRepoLocks(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "fail to setup repo locks: %v\n", err)
+		return 2
+	}
+	if err := gitc.SetupLayout(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "fail to setup repo layout: %v\n", err)
+		return 2
+	}
+
+	report, err := gitc.MigrateLayout(context.Background(), cfg.Server.BaseDir, *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate layout failed: %v\n", err)
+		return 2
+	}
+	action := "moved"
+	if report.DryRun {
+		action = "to move"
+	}
+	for _, move := range report.Moved {
+		fmt.Printf("%-10s %s: %s -> %s\n", action, move.Repo, move.From, move.To)
+	}
+	for _, move := range report.Conflicts {
+		fmt.Printf("%-10s %s: %s -> %s, %s\n", "conflict", move.Repo, move.From, move.To, move.Error)
+	}
+	for _, move := range report.Failed {
+		fmt.Printf("%-10s %s: %s -> %s, %s\n", "failed", move.Repo, move.From, move.To, move.Error)
+	}
+	fmt.Printf("checked %d repos for %s layout: %d %s, %d conflicts, %d failed\n",
+		report.Repos, report.Layout, len(report.Moved), action, len(report.Conflicts), len(report.Failed))
+	if len(report.Conflicts)+len(report.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// handleMigrateLayout 将镜像移动到当前的目录布局, dryRun 为 true 时只列出需要移动的仓库
+func handleMigrateLayout(baseRepoDir string, dryRun bool) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		report, err := gitc.MigrateLayout(c.Request.Context(), baseRepoDir, dryRun)
+		if err != nil {
+			logError("migrate layout request failed: %v\n", err)
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp := NewAPILayoutMigration(*report)
+		RenderWANF(c, http.StatusOK, &resp)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -97,14 +98,55 @@ func bootstrap() error {
 	}
 
 	database.SetDBInfo(cfg)
+	if err := gitc.SetupLayout(cfg); err != nil {
+		return fmt.Errorf("fail to setup repo layout: %w", err)
+	}
+	gitc.SetupJobQueue(cfg)
+	if err := gitc.SetupBackend(cfg); err != nil {
+		return fmt.Errorf("fail to setup git backend: %w", err)
+	}
+	if err := gitc.SetupMirrors(cfg); err != nil {
+		return fmt.Errorf("fail to setup mirror rules: %w", err)
+	}
+	gitc.SetupRefJournal(cfg)
+	gitc.SetupVerify(cfg)
+	if err := gitc.SetupRepoLocks(cfg); err != nil {
+		return fmt.Errorf("fail to setup repo locks: %w", err)
+	}
+	if err := gitc.SetupObjectPools(cfg); err != nil {
+		return fmt.Errorf("fail to setup object pools: %w", err)
+	}
+	if err := gitc.SetupPackCache(cfg); err != nil {
+		return fmt.Errorf("fail to setup pack cache: %w", err)
+	}
+	if err := gitc.SetupBundles(cfg); err != nil {
+		return fmt.Errorf("fail to setup bundle: %w", err)
+	}
+	if err := gitc.SetupHistoryPacks(cfg); err != nil {
+		return fmt.Errorf("fail to setup packfile-uris: %w", err)
+	}
 	if err := gitc.RecoverPendingRepos(cfg); err != nil {
 		return fmt.Errorf("fail to recover pending repos: %w", err)
 	}
+	if _, err := gitc.MergeRepoAliases(context.Background(), cfg); err != nil {
+		return fmt.Errorf("fail to merge repo aliases: %w", err)
+	}
+	if err := gitc.SetupMaintenance(cfg); err != nil {
+		return fmt.Errorf("fail to setup maintenance: %w", err)
+	}
+	gitc.StartMaintenance(context.Background())
 
 	return nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(runFsck(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-layout" {
+		os.Exit(runMigrateLayout(os.Args[2:]))
+	}
+
 	if err := bootstrap(); err != nil {
 		log.Fatalf("startup failed: %v", err)
 	}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"smart-git/gitc"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// handleListMaintenance 返回全部仓库最近一次维护的结果
+func handleListMaintenance() touka.HandlerFunc {
+	return func(c *touka.Context) {
+		records, err := gitc.MaintenanceRecords()
+		if err != nil {
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp := make([]APIMaintenance, 0, len(records))
+		for _, record := range records {
+			resp = append(resp, NewAPIMaintenance(record))
+		}
+		RenderWANF(c, http.StatusOK, &APIMaintenanceList{Items: resp})
+	}
+}
+
+func handleGetMaintenance() touka.HandlerFunc {
+	return func(c *touka.Context) {
+		record, ok, err := gitc.GetMaintenanceRecord(c.Param("owner"), c.Param("repo"))
+		if err != nil {
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			RenderWANFError(c, http.StatusNotFound, "repository has not been maintained")
+			return
+		}
+		resp := NewAPIMaintenance(*record)
+		RenderWANF(c, http.StatusOK, &resp)
+	}
+}
+
+// handleRunMaintenance 立即维护仓库, 不检查阈值; 维护出错时仍返回记录, 错误写在 error 字段中
+func handleRunMaintenance(baseRepoDir string) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		record, err := gitc.MaintainRepo(c.Request.Context(), baseRepoDir, c.Param("owner"), c.Param("repo"))
+		if record != nil {
+			resp := NewAPIMaintenance(*record)
+			RenderWANF(c, http.StatusOK, &resp)
+			return
+		}
+		switch {
+		case errors.Is(err, gitc.ErrRepoNotMirrored):
+			RenderWANFError(c, http.StatusNotFound, err.Error())
+		case errors.Is(err, gitc.ErrRepoLockTimeout):
+			c.SetHeader("Retry-After", "10")
+			RenderWANFError(c, http.StatusServiceUnavailable, err.Error())
+		default:
+			logError("maintenance request failed: %v, repo: %s\n", err, filepath.Join(c.Param("owner"), c.Param("repo")))
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+		}
+	}
+}
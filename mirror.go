@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"smart-git/gitc"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v6/plumbing/protocol"
+)
+
+// errShallowMirror 表示请求需要的历史超出浅镜像现有深度且未启用按需加深
+var errShallowMirror = errors.New("shallow mirror")
+
+// requiredMirrorDepth 返回请求需要浅镜像具备的历史深度, 0 表示镜像现有历史即可响应.
+// 已是浅仓库的客户端、带 have 的增量 fetch 以及 deepen-since/deepen-not 都在现有历史内处理
+func requiredMirrorDepth(req *uploadPackRequest) int {
+	if len(req.Wants) == 0 || len(req.Haves) > 0 {
+		return 0
+	}
+	if req.Version == protocol.V2 && req.Command != "fetch" {
+		return 0
+	}
+	for _, arg := range req.Args {
+		if strings.HasPrefix(arg, "shallow ") || strings.HasPrefix(arg, "deepen-since ") || strings.HasPrefix(arg, "deepen-not ") {
+			return 0
+		}
+	}
+	if value, ok := req.Arg("deepen "); ok {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth <= 0 {
+			return 0
+		}
+		return depth
+	}
+	return gitc.InfiniteDepth
+}
+
+// ensureMirrorDepth 在浅镜像的历史不足以响应请求时按配置加深镜像或返回 errShallowMirror
+func ensureMirrorDepth(ctx context.Context, baseRepoDir string, userName string, repoName string, req *uploadPackRequest) error {
+	spec := gitc.MirrorFor(userName, repoName)
+	if spec.Depth == 0 || req == nil {
+		return nil
+	}
+	need := requiredMirrorDepth(req)
+	current := gitc.MirrorDepth(gitc.RepoPath(baseRepoDir, userName, repoName), spec)
+	if need == 0 || current == 0 || need <= current {
+		return nil
+	}
+	if !spec.DeepenOnDemand {
+		if need == gitc.InfiniteDepth {
+			return fmt.Errorf("%w: %s/%s is mirrored with depth %d, use --depth=%d or less", errShallowMirror, userName, repoName, current, current)
+		}
+		return fmt.Errorf("%w: %s/%s is mirrored with depth %d, requested depth %d", errShallowMirror, userName, repoName, current, need)
+	}
+	return gitc.DeepenRepo(ctx, baseRepoDir, userName, repoName, upstreamURL(userName, repoName), need, cfg)
+}
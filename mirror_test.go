@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"smart-git/gitc"
+	"testing"
+)
+
+// TestRequiredMirrorDepth 测试浅镜像按请求判断所需的历史深度
+func TestRequiredMirrorDepth(t *testing.T) {
+	cases := []struct {
+		name  string
+		lines []string
+		want  int
+	}{
+		{"full clone", []string{"want " + testOID1, "0000", "done"}, gitc.InfiniteDepth},
+		{"depth", []string{"want " + testOID1, "deepen 3", "0000", "done"}, 3},
+		{"shallow client", []string{"want " + testOID1, "shallow " + testOID2, "deepen 1", "0000", "done"}, 0},
+		{"since", []string{"want " + testOID1, "deepen-since 1700000000", "0000", "done"}, 0},
+		{"incremental", []string{"want " + testOID1, "0000", "have " + testOID2, "done"}, 0},
+	}
+	for _, tc := range cases {
+		req, err := parseUploadPackRequest(buildPktLines(t, tc.lines...), "")
+		if err != nil {
+			t.Fatalf("%s: parse failed: %v", tc.name, err)
+		}
+		if got := requiredMirrorDepth(req); got != tc.want {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.want, got)
+		}
+	}
+}
+
+// TestDropPktLines 测试去掉 v0 广告中的 shallow 行且保留 flush
+func TestDropPktLines(t *testing.T) {
+	adv := buildPktLines(t, "# service=git-upload-pack", "0000", testOID1+" HEAD", "shallow "+testOID2, "0000")
+	got, err := dropPktLines(adv, "shallow ")
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	want := buildPktLines(t, "# service=git-upload-pack", "0000", testOID1+" HEAD", "0000")
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected output: %q", got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"smart-git/gitc"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// validateRepoParams 返回校验路由中 owner 与仓库名称的中间件, 名称不合法时返回 400, 不进入后续的处理函数;
+// 合法的名称改写为规范名称(小写, 不带 .git 后缀), 同一仓库的各种写法使用同一个镜像.
+// git 路由的参数为 :user/:repo, 仓库名称可带 @快照; 管理接口的参数为 :owner/:repo, api 为 true 时以 WANF 返回错误
+func validateRepoParams(api bool) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		userKey := "user"
+		userName := c.Param(userKey)
+		if userName == "" {
+			userKey = "owner"
+			userName = c.Param(userKey)
+		}
+		repoName, snapshot := splitRepoSnapshot(c.Param("repo"))
+		err := gitc.ValidateRepoName(userName, repoName)
+		if err == nil {
+			userName, repoName = gitc.CanonicalRepoName(userName, repoName)
+			err = gitc.ValidateRepoName(userName, repoName)
+		}
+		if err == nil && snapshot != "" && !gitc.ValidSnapshotName(snapshot) {
+			err = gitc.ErrInvalidSnapshotName
+		}
+		if err == nil {
+			if snapshot != "" {
+				repoName += "@" + snapshot
+			}
+			for i := range c.Params {
+				switch c.Params[i].Key {
+				case userKey:
+					c.Params[i].Value = userName
+				case "repo":
+					c.Params[i].Value = repoName
+				}
+			}
+			c.Next()
+			return
+		}
+		logWarning("rejected request: %v, path: %q\n", err, c.Request.URL.Path)
+		if api {
+			RenderWANFError(c, http.StatusBadRequest, err.Error())
+		} else {
+			renderStatusError(c.Writer, http.StatusBadRequest)
+		}
+		c.Abort()
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"smart-git/gitc"
+	"strings"
+	"testing"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// newValidateRouter 返回带名称校验的 git 路由与管理接口路由, 处理函数记录收到的参数
+func newValidateRouter(seen *[]string) *touka.Engine {
+	r := touka.Default()
+	handler := func(c *touka.Context) {
+		owner := c.Param("user") + c.Param("owner")
+		*seen = append(*seen, owner+"/"+c.Param("repo"))
+		c.Status(http.StatusOK)
+	}
+	r.GET("/:user/:repo/info/refs", validateRepoParams(false), handler)
+	r.GET("/api/repos/:owner/:repo/snapshots", validateRepoParams(true), handler)
+	return r
+}
+
+// TestValidateRepoParams 测试路径穿越、编码的斜杠、NUL 与过长的名称在进入处理函数前被拒绝, 合法的名称改写为规范名称
+func TestValidateRepoParams(t *testing.T) {
+	var seen []string
+	r := newValidateRouter(&seen)
+	do := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.URL.RawPath = path
+		req.URL.Path = strings.ReplaceAll(strings.ReplaceAll(path, "%2F", "/"), "%00", "\x00")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, path := range []string{
+		"/octocat/Hello-World/info/refs",
+		"/octocat/Hello-World@v1/info/refs",
+		"/api/repos/octocat/.github/snapshots",
+		"/OctoCat/Hello-World.git/info/refs",
+	} {
+		if code := do(path); code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, code)
+		}
+	}
+	for _, path := range []string{
+		"/../repo/info/refs",
+		"/owner/../info/refs",
+		"/.pools/network/info/refs",
+		"/owner/repo%2F..%2F..%2Fetc/info/refs",
+		"/owner/repo%00/info/refs",
+		"/owner/repo@../info/refs",
+		"/" + strings.Repeat("a", gitc.MaxOwnerNameLength+1) + "/repo/info/refs",
+		"/api/repos/owner/" + strings.Repeat("r", gitc.MaxRepoNameLength+1) + "/snapshots",
+		"/api/repos/-owner/repo/snapshots",
+		"/owner/.git/info/refs",
+	} {
+		if code := do(path); code == http.StatusOK {
+			t.Fatalf("%s: invalid name accepted", path)
+		}
+	}
+	want := []string{"octocat/hello-world", "octocat/hello-world@v1", "octocat/.github", "octocat/hello-world"}
+	if strings.Join(seen, " ") != strings.Join(want, " ") {
+		t.Fatalf("handler reached with unexpected names: %q", seen)
+	}
+}
+
+// FuzzValidateRepoParams 检查处理函数收到的参数总是合法的规范名称
+func FuzzValidateRepoParams(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"octocat", "Hello-World"},
+		{"..", "repo"},
+		{"owner", "repo%2F.."},
+		{"owner", "repo@snap"},
+		{"owner", "%00"},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+	var seen []string
+	r := newValidateRouter(&seen)
+	f.Fuzz(func(t *testing.T, owner string, repo string) {
+		seen = seen[:0]
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/"+owner+"/"+repo+"/info/refs", nil)
+		if err != nil {
+			return
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		for _, key := range seen {
+			userName, repoName, _ := strings.Cut(key, "/")
+			repoName, _ = splitRepoSnapshot(repoName)
+			if err := gitc.ValidateRepoName(userName, repoName); err != nil || !gitc.IsCanonicalRepoName(userName, repoName) {
+				t.Fatalf("handler reached with %q: %v", key, err)
+			}
+		}
+	})
+}
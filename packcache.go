@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"smart-git/gitc"
+)
+
+// 超过该大小的请求体必然包含大量 have 行, 不做预读解析
+const maxCacheableRequestSize = 1 << 20
+
+// 命中缓存时向客户端输出的块大小
+const packCacheChunkSize = 64 * 1024
+
+// readUploadPackRequest 预读并解析请求体; 请求体过大或无法解析时 req 为 nil.
+// 返回的 reader 仍可读取完整请求体
+func readUploadPackRequest(reader io.ReadCloser, version string) (io.ReadCloser, *uploadPackRequest, error) {
+	body, err := io.ReadAll(io.LimitReader(reader, maxCacheableRequestSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	rest := io.NopCloser(io.MultiReader(bytes.NewReader(body), reader))
+	if len(body) > maxCacheableRequestSize {
+		return rest, nil, nil
+	}
+
+	req, err := parseUploadPackRequest(body, version)
+	if err != nil {
+		return rest, nil, nil
+	}
+	return rest, req, nil
+}
+
+// packCacheKey 计算 pack 缓存键; 请求不可缓存时返回空
+func packCacheKey(repoPath string, req *uploadPackRequest) string {
+	if req == nil || !req.isFullClone() {
+		return ""
+	}
+
+	refState, err := gitc.RefStateHash(repoPath)
+	if err != nil {
+		logWarning("compute ref state failed: %v, repo: %s\n", err, repoPath)
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(refState + ":" + req.cacheKey()))
+	return hex.EncodeToString(sum[:])
+}
+
+// packCacheResponseWriter 将响应同时写入客户端与正在生成的缓存条目
+type packCacheResponseWriter struct {
+	http.ResponseWriter
+	fill *gitc.PackFill
+}
+
+func (w *packCacheResponseWriter) Write(p []byte) (int, error) {
+	_, _ = w.fill.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *packCacheResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
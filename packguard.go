@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"smart-git/config"
+	"smart-git/gitc"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+var errPackQueueTimeout = errors.New("timed out waiting for pack generation budget")
+
+const (
+	// repoSizeTTL 为仓库体积估算的缓存时间, 避免每个请求都遍历 objects 目录
+	repoSizeTTL = 5 * time.Minute
+	// incrementalWeightDivisor 为带 have 的增量 fetch 相对完整克隆的权重比例的倒数
+	incrementalWeightDivisor = 8
+)
+
+// packGuard 以仓库体积估算(MB)为权重, 限制同时进行的 pack 生成所占用的内存预算
+type packGuard struct {
+	sem     *semaphore.Weighted
+	budget  int64
+	timeout time.Duration
+
+	mu    sync.Mutex
+	sizes map[string]repoSizeEntry
+	now   func() time.Time
+}
+
+type repoSizeEntry struct {
+	size int64
+	at   time.Time
+}
+
+// newPackGuard 根据配置创建 packGuard, 预算为 0 时返回 nil 表示不限制
+func newPackGuard(cfg *config.Config) *packGuard {
+	budget := cfg.Pack.MemBudget
+	if budget <= 0 {
+		return nil
+	}
+	return &packGuard{
+		sem:     semaphore.NewWeighted(budget),
+		budget:  budget,
+		timeout: cfg.Pack.QueueTimeout,
+		sizes:   map[string]repoSizeEntry{},
+		now:     time.Now,
+	}
+}
+
+// Acquire 为 repoPath 上 req 的 pack 生成占用预算, 超时返回 errPackQueueTimeout; 不生成 pack 的请求不占用预算
+func (g *packGuard) Acquire(ctx context.Context, repoPath string, req *uploadPackRequest) (func(), error) {
+	if g == nil {
+		return func() {}, nil
+	}
+
+	weight := g.weight(repoPath, req)
+	if weight == 0 {
+		return func() {}, nil
+	}
+	if g.sem.TryAcquire(weight) {
+		return func() { g.sem.Release(weight) }, nil
+	}
+
+	waitCtx := ctx
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	if err := g.sem.Acquire(waitCtx, weight); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errPackQueueTimeout
+	}
+	logInfo("pack generation waited %s for %d MB budget, repo: %s\n", time.Since(start), weight, repoPath)
+	return func() { g.sem.Release(weight) }, nil
+}
+
+// weight 将仓库体积换算为 MB 权重, 至少为 1 且不超过总预算; 带 have 的增量 fetch 按 incrementalWeightDivisor 缩小,
+// ls-refs 等不生成 pack 的请求返回 0. req 为 nil 时按完整克隆计算
+func (g *packGuard) weight(repoPath string, req *uploadPackRequest) int64 {
+	if req != nil && !req.producesPack() {
+		return 0
+	}
+	weight := (g.repoSize(repoPath) + 1<<20 - 1) >> 20
+	if req != nil && len(req.Haves) > 0 {
+		weight /= incrementalWeightDivisor
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	if weight > g.budget {
+		weight = g.budget
+	}
+	return weight
+}
+
+// repoSize 返回仓库(含对象池)体积的估算, 结果缓存 repoSizeTTL
+func (g *packGuard) repoSize(repoPath string) int64 {
+	now := g.now()
+	g.mu.Lock()
+	entry, ok := g.sizes[repoPath]
+	g.mu.Unlock()
+	if ok && now.Sub(entry.at) < repoSizeTTL {
+		return entry.size
+	}
+
+	size, err := gitc.EstimateRepoSize(repoPath)
+	if err != nil {
+		logWarning("estimate repo size failed: %v, repo: %s\n", err, repoPath)
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// 顺带清理过期条目, 避免缓存无限增长
+	for path, entry := range g.sizes {
+		if now.Sub(entry.at) >= repoSizeTTL {
+			delete(g.sizes, path)
+		}
+	}
+	g.sizes[repoPath] = repoSizeEntry{size: size, at: now}
+	return size
+}
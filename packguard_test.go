@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"smart-git/config"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v6/plumbing/protocol"
+)
+
+// TestPackGuardQueueTimeout 测试预算耗尽时等待超时, 释放后可再次获取
+func TestPackGuardQueueTimeout(t *testing.T) {
+	repoPath := t.TempDir()
+	packDir := filepath.Join(repoPath, "objects", "pack")
+	if err := os.MkdirAll(packDir, 0755); err != nil {
+		t.Fatalf("failed to create pack dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(packDir, "pack-test.pack"), make([]byte, 3<<20), 0644); err != nil {
+		t.Fatalf("failed to write pack: %v", err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Pack.MemBudget = 4
+	cfg.Pack.QueueTimeout = 20 * time.Millisecond
+	guard := newPackGuard(cfg)
+
+	if weight := guard.weight(repoPath, nil); weight != 3 {
+		t.Fatalf("expected weight 3, got %d", weight)
+	}
+
+	release, err := guard.Acquire(context.Background(), repoPath, nil)
+	if err != nil {
+		t.Fatalf("first acquire failed: %v", err)
+	}
+
+	if _, err := guard.Acquire(context.Background(), repoPath, nil); !errors.Is(err, errPackQueueTimeout) {
+		t.Fatalf("expected errPackQueueTimeout, got %v", err)
+	}
+
+	release()
+	release, err = guard.Acquire(context.Background(), repoPath, nil)
+	if err != nil {
+		t.Fatalf("acquire after release failed: %v", err)
+	}
+	release()
+}
+
+// TestPackGuardDisabled 测试未配置预算时不限制
+func TestPackGuardDisabled(t *testing.T) {
+	if guard := newPackGuard(config.DefaultConfig()); guard != nil {
+		t.Fatal("expected nil guard without budget")
+	}
+
+	var guard *packGuard
+	release, err := guard.Acquire(context.Background(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("nil guard should not fail: %v", err)
+	}
+	release()
+}
+
+// TestPackGuardWeight 测试只有生成 pack 的请求占用预算, 增量 fetch 按比例缩小, 对象池计入体积, 体积估算按仓库缓存
+func TestPackGuardWeight(t *testing.T) {
+	tmpDir := t.TempDir()
+	repoPath := filepath.Join(tmpDir, "repo")
+	poolObjects := filepath.Join(tmpDir, "pool", "objects")
+	for _, dir := range []string{filepath.Join(repoPath, "objects", "pack"), filepath.Join(repoPath, "objects", "info"), filepath.Join(poolObjects, "pack")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(repoPath, "objects", "pack", "pack-test.pack"), make([]byte, 8<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(poolObjects, "pack", "pack-pool.pack"), make([]byte, 24<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repoPath, "objects", "info", "alternates"), []byte(poolObjects+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Pack.MemBudget = 1024
+	guard := newPackGuard(cfg)
+	now := time.Unix(1000, 0)
+	guard.now = func() time.Time { return now }
+
+	want := "17b24e835317f14df978a91d3e8fa0c4cddfdddc"
+	for _, tt := range []struct {
+		name     string
+		req      *uploadPackRequest
+		expected int64
+	}{
+		{"ls-refs", &uploadPackRequest{Version: protocol.V2, Command: "ls-refs"}, 0},
+		{"v2 clone", &uploadPackRequest{Version: protocol.V2, Command: "fetch", Wants: []string{want}, Done: true}, 32},
+		{"v0 clone", &uploadPackRequest{Version: protocol.V0, Wants: []string{want}, Done: true}, 32},
+		{"incremental", &uploadPackRequest{Version: protocol.V2, Command: "fetch", Wants: []string{want}, Haves: []string{want}}, 4},
+	} {
+		if got := guard.weight(repoPath, tt.req); got != tt.expected {
+			t.Errorf("%s: expected weight %d, got %d", tt.name, tt.expected, got)
+		}
+	}
+
+	// 缓存有效期内不重新统计
+	if err := os.WriteFile(filepath.Join(repoPath, "objects", "pack", "pack-new.pack"), make([]byte, 32<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := guard.weight(repoPath, nil); got != 32 {
+		t.Fatalf("expected cached weight 32, got %d", got)
+	}
+	now = now.Add(repoSizeTTL)
+	if got := guard.weight(repoPath, nil); got != 64 {
+		t.Fatalf("expected weight 64 after ttl, got %d", got)
+	}
+}
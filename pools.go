@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"smart-git/gitc"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// handleListPools 返回全部对象池的成员与对象统计
+func handleListPools(baseRepoDir string) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		pools, err := gitc.ObjectPools(baseRepoDir)
+		if err != nil {
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp := make([]APIObjectPool, 0, len(pools))
+		for _, pool := range pools {
+			resp = append(resp, NewAPIObjectPool(pool))
+		}
+		RenderWANF(c, http.StatusOK, &APIObjectPoolList{Items: resp})
+	}
+}
+
+// handleRunPoolMaintenance 立即维护对象池, 不检查阈值; 对象池已没有成员时删除对象池并返回 204
+func handleRunPoolMaintenance(baseRepoDir string) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		record, err := gitc.MaintainPool(c.Request.Context(), baseRepoDir, c.Param("network"))
+		if record != nil {
+			resp := NewAPIMaintenance(*record)
+			RenderWANF(c, http.StatusOK, &resp)
+			return
+		}
+		switch {
+		case err == nil:
+			c.Status(http.StatusNoContent)
+		case errors.Is(err, gitc.ErrRepoNotMirrored):
+			RenderWANFError(c, http.StatusNotFound, "object pool not found")
+		case errors.Is(err, gitc.ErrRepoLockTimeout):
+			c.SetHeader("Retry-After", "10")
+			RenderWANFError(c, http.StatusServiceUnavailable, err.Error())
+		default:
+			logError("pool maintenance request failed: %v, pool: %s\n", err, c.Param("network"))
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"smart-git/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// 超过该时长未被使用的令牌桶会在清理时移除
+const rateLimitIdleTTL = 10 * time.Minute
+
+// tokenBucket 是一个简单的令牌桶, 配合 inflight 计数限制并发 upload-pack
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	inflight int
+}
+
+type rateLimitParams struct {
+	key           string
+	ratePerSecond float64
+	burst         int
+	maxInflight   int
+}
+
+// rateLimiter 按客户端(IP 或认证身份)与仓库规则对请求进行限流
+type rateLimiter struct {
+	cfg     config.RateLimitConfig
+	proxies []netip.Prefix
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(cfg config.RateLimitConfig) *rateLimiter {
+	rl := &rateLimiter{
+		cfg:     cfg,
+		proxies: parseTrustedProxies(cfg.TrustedProxies),
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+	rl.lastSweep = rl.now()
+	return rl
+}
+
+// Middleware 返回限流中间件; uploadPack 为 true 时额外占用一个 inflight 名额直到请求结束
+func (rl *rateLimiter) Middleware(uploadPack bool) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		if rl == nil || !rl.cfg.Enabled {
+			c.Next()
+			return
+		}
+
+		params := rl.paramsFor(c.Param("user"), c.Param("repo"))
+		key := params.key + "|" + rl.clientKey(c.Request)
+
+		retryAfter, ok := rl.allow(key, params, uploadPack)
+		if !ok {
+			logWarning("rate limited: client %s, repo %s/%s\n", key, c.Param("user"), c.Param("repo"))
+			c.Writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			renderStatusError(c.Writer, http.StatusTooManyRequests)
+			c.Abort()
+			return
+		}
+		if uploadPack {
+			defer rl.release(key)
+		}
+		c.Next()
+	}
+}
+
+func (rl *rateLimiter) paramsFor(owner string, repo string) rateLimitParams {
+	for _, rule := range rl.cfg.Rules {
+		if !config.MatchRepo(rule.Pattern, owner, repo) {
+			continue
+		}
+		return rateLimitParams{
+			key:           rule.Pattern,
+			ratePerSecond: rule.RatePerSecond,
+			burst:         rule.Burst,
+			maxInflight:   rule.MaxInflight,
+		}
+	}
+	return rateLimitParams{
+		key:           "*",
+		ratePerSecond: rl.cfg.RatePerSecond,
+		burst:         rl.cfg.Burst,
+		maxInflight:   rl.cfg.MaxInflight,
+	}
+}
+
+// allow 消耗一个令牌并在需要时占用 inflight 名额, 失败时返回建议的重试秒数
+func (rl *rateLimiter) allow(key string, params rateLimitParams, uploadPack bool) (int, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweepLocked(now)
+
+	burst := float64(params.burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[key] = bucket
+	}
+
+	if params.ratePerSecond > 0 {
+		elapsed := now.Sub(bucket.last).Seconds()
+		bucket.tokens = math.Min(burst, bucket.tokens+elapsed*params.ratePerSecond)
+	}
+	bucket.last = now
+
+	if uploadPack && params.maxInflight > 0 && bucket.inflight >= params.maxInflight {
+		return 1, false
+	}
+
+	if params.ratePerSecond > 0 {
+		if bucket.tokens < 1 {
+			wait := math.Ceil((1 - bucket.tokens) / params.ratePerSecond)
+			return int(math.Max(wait, 1)), false
+		}
+		bucket.tokens--
+	}
+
+	if uploadPack {
+		bucket.inflight++
+	}
+	return 0, true
+}
+
+func (rl *rateLimiter) release(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if bucket, ok := rl.buckets[key]; ok && bucket.inflight > 0 {
+		bucket.inflight--
+	}
+}
+
+func (rl *rateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitIdleTTL {
+		return
+	}
+	rl.lastSweep = now
+	for key, bucket := range rl.buckets {
+		if bucket.inflight == 0 && now.Sub(bucket.last) > rateLimitIdleTTL {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// clientKey 返回区分客户端的键: 请求中的认证信息未经校验, 不能用于区分客户端;
+// 仅在直连地址属于受信代理且配置了 identityHeader 时使用代理校验后传递的身份, 否则使用客户端 IP
+func (rl *rateLimiter) clientKey(r *http.Request) string {
+	if rl.cfg.IdentityHeader != "" {
+		if identity := strings.TrimSpace(r.Header.Get(rl.cfg.IdentityHeader)); identity != "" {
+			if remote, ok := parseRemoteAddr(r.RemoteAddr); ok && rl.isTrustedProxy(remote) {
+				return "user:" + identity
+			}
+		}
+	}
+	return "ip:" + rl.clientIP(r)
+}
+
+// clientIP 仅在直连地址属于受信代理时才解析 X-Forwarded-For,
+// 从右向左跳过受信代理, 返回第一个不受信的地址
+func (rl *rateLimiter) clientIP(r *http.Request) string {
+	remote, ok := parseRemoteAddr(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !rl.isTrustedProxy(remote) {
+		return remote.String()
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = addr.Unmap()
+		if !rl.isTrustedProxy(addr) {
+			return addr.String()
+		}
+		remote = addr
+	}
+	return remote.String()
+}
+
+func (rl *rateLimiter) isTrustedProxy(addr netip.Addr) bool {
+	return containsAddr(rl.proxies, addr)
+}
+
+// parseTrustedProxies 解析受信代理的 IP 或 CIDR 列表, 忽略不合法的条目
+func parseTrustedProxies(list []string) []netip.Prefix {
+	var proxies []netip.Prefix
+	for _, proxy := range list {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(proxy); err == nil {
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		logWarning("ignore invalid trusted proxy: %s\n", proxy)
+	}
+	return proxies
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRemoteAddr(remoteAddr string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if addr, err := netip.ParseAddr(remoteAddr); err == nil {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
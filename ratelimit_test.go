@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"smart-git/config"
+	"testing"
+	"time"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// TestRateLimiterTokenBucket 测试令牌耗尽后返回 429 与 Retry-After
+func TestRateLimiterTokenBucket(t *testing.T) {
+	rl := newRateLimiter(config.RateLimitConfig{Enabled: true, RatePerSecond: 1, Burst: 2})
+	now := time.Unix(1000, 0)
+	rl.now = func() time.Time { return now }
+
+	r := touka.Default()
+	r.GET("/:user/:repo/info/refs", rl.Middleware(false), func(c *touka.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/octocat/hello/info/refs", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := do(); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rec.Code)
+		}
+	}
+
+	rec := do()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected Retry-After 1, got %q", rec.Header().Get("Retry-After"))
+	}
+
+	now = now.Add(time.Second)
+	if rec := do(); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 after refill, got %d", rec.Code)
+	}
+}
+
+// TestRateLimiterInflight 测试 upload-pack 并发上限与规则覆盖
+func TestRateLimiterInflight(t *testing.T) {
+	rl := newRateLimiter(config.RateLimitConfig{
+		Enabled:     true,
+		MaxInflight: 2,
+		Rules: []config.RateLimitRule{
+			{Pattern: "big/*", MaxInflight: 1},
+		},
+	})
+
+	params := rl.paramsFor("big", "mono")
+	if _, ok := rl.allow("k", params, true); !ok {
+		t.Fatal("first upload-pack should be allowed")
+	}
+	if _, ok := rl.allow("k", params, true); ok {
+		t.Fatal("second upload-pack should exceed rule inflight limit")
+	}
+	rl.release("k")
+	if _, ok := rl.allow("k", params, true); !ok {
+		t.Fatal("upload-pack should be allowed after release")
+	}
+
+	if got := rl.paramsFor("octocat", "hello").maxInflight; got != 2 {
+		t.Fatalf("expected global inflight 2, got %d", got)
+	}
+}
+
+// TestRateLimiterClientIP 测试仅信任配置的代理转发的 X-Forwarded-For
+func TestRateLimiterClientIP(t *testing.T) {
+	rl := newRateLimiter(config.RateLimitConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"direct", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"untrusted proxy", "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"proxy chain", "10.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"only proxies", "10.0.0.1:1234", "10.0.0.2", "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := rl.clientIP(req); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestRateLimiterClientKey 测试未经校验的认证信息不区分客户端, 身份请求头仅在受信代理转发时使用
+func TestRateLimiterClientKey(t *testing.T) {
+	rl := newRateLimiter(config.RateLimitConfig{TrustedProxies: []string{"10.0.0.0/8"}, IdentityHeader: "X-Auth-User"})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		basicUser  string
+		identity   string
+		expected   string
+	}{
+		{"basic auth", "192.0.2.1:1234", "alice", "", "ip:192.0.2.1"},
+		{"other basic auth", "192.0.2.1:1234", "bob", "", "ip:192.0.2.1"},
+		{"identity from client", "192.0.2.1:1234", "", "alice", "ip:192.0.2.1"},
+		{"identity from trusted proxy", "10.0.0.1:1234", "", "alice", "user:alice"},
+		{"trusted proxy without identity", "10.0.0.1:1234", "alice", "", "ip:10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.basicUser != "" {
+				req.SetBasicAuth(tt.basicUser, "x")
+			}
+			if tt.identity != "" {
+				req.Header.Set("X-Auth-User", tt.identity)
+			}
+			if got := rl.clientKey(req); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+
+	rl = newRateLimiter(config.RateLimitConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Auth-User", "alice")
+	if got := rl.clientKey(req); got != "ip:10.0.0.1" {
+		t.Errorf("identity header used without identityHeader: %s", got)
+	}
+}
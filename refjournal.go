@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"smart-git/database/schema"
+	"smart-git/gitc"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// handleRefHistory 返回仓库的引用日志, ref 参数非空时只返回该引用的记录
+func handleRefHistory() touka.HandlerFunc {
+	return func(c *touka.Context) {
+		updates, err := gitc.RefHistory(c.Param("owner"), c.Param("repo"), c.Query("ref"))
+		if err != nil {
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		renderRefUpdates(c, updates)
+	}
+}
+
+// handleRefsAt 返回仓库在 time 参数(RFC3339, 默认当前时间)时刻的引用, ref 参数非空时只返回该引用
+func handleRefsAt() touka.HandlerFunc {
+	return func(c *touka.Context) {
+		at := time.Now()
+		if value := c.Query("time"); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				RenderWANFError(c, http.StatusBadRequest, "invalid time, expected RFC3339: "+err.Error())
+				return
+			}
+			at = parsed
+		}
+
+		refs, err := gitc.RefsAt(c.Param("owner"), c.Param("repo"), at)
+		if err != nil {
+			if errors.Is(err, gitc.ErrRefJournalEmpty) || errors.Is(err, gitc.ErrRefJournalTruncated) {
+				RenderWANFError(c, http.StatusNotFound, err.Error())
+				return
+			}
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		resp := &APIRefState{Owner: c.Param("owner"), Repo: c.Param("repo"), Time: formatTime(at), Refs: []APIRef{}}
+		if ref := c.Query("ref"); ref != "" {
+			oid, ok := refs[ref]
+			if !ok {
+				RenderWANFError(c, http.StatusNotFound, "ref did not exist at the requested time")
+				return
+			}
+			resp.Refs = append(resp.Refs, APIRef{Name: ref, OID: oid})
+		} else {
+			for name, oid := range refs {
+				resp.Refs = append(resp.Refs, APIRef{Name: name, OID: oid})
+			}
+			sort.Slice(resp.Refs, func(i, j int) bool { return resp.Refs[i].Name < resp.Refs[j].Name })
+		}
+		RenderWANF(c, http.StatusOK, resp)
+	}
+}
+
+// handleRefRewrites 返回全部仓库最近的 force-push 与 tag 改写, limit 参数默认 100
+func handleRefRewrites() touka.HandlerFunc {
+	return func(c *touka.Context) {
+		limit := 100
+		if value := c.Query("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				RenderWANFError(c, http.StatusBadRequest, "invalid limit")
+				return
+			}
+			limit = parsed
+		}
+		updates, err := gitc.RefRewrites(limit)
+		if err != nil {
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		renderRefUpdates(c, updates)
+	}
+}
+
+func renderRefUpdates(c *touka.Context, updates []schema.RefUpdate) {
+	resp := make([]APIRefUpdate, 0, len(updates))
+	for _, update := range updates {
+		resp = append(resp, NewAPIRefUpdate(update))
+	}
+	RenderWANF(c, http.StatusOK, &APIRefUpdateList{Items: resp})
+}
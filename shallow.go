@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/object"
+	"github.com/go-git/go-git/v6/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v6/storage"
+)
+
+// infiniteDepth 是 git fetch --unshallow 发送的深度
+const infiniteDepth = 0x7fffffff
+
+// shallowRequest 为 v0/v1 请求中的 shallow 与 deepen 参数
+type shallowRequest struct {
+	// clientShallows 为客户端当前的浅边界提交
+	clientShallows []plumbing.Hash
+	depth          int
+	relative       bool
+	// since 为 deepen-since 的 unix 时间, 0 表示未设置
+	since int64
+	not   []string
+}
+
+// parseShallowRequest 从请求参数中解析 shallow/deepen 行
+func parseShallowRequest(req *uploadPackRequest) (*shallowRequest, error) {
+	s := &shallowRequest{}
+	for _, c := range req.Caps {
+		if c == capability.DeepenRelative.String() {
+			s.relative = true
+		}
+	}
+	for _, arg := range req.Args {
+		switch {
+		case strings.HasPrefix(arg, "shallow "):
+			h, ok := plumbing.FromHex(strings.TrimPrefix(arg, "shallow "))
+			if !ok {
+				return nil, fmt.Errorf("invalid shallow line: %s", arg)
+			}
+			s.clientShallows = append(s.clientShallows, h)
+		case strings.HasPrefix(arg, "deepen-since "):
+			since, err := strconv.ParseInt(strings.TrimPrefix(arg, "deepen-since "), 10, 64)
+			if err != nil || since <= 0 {
+				return nil, fmt.Errorf("invalid deepen-since: %s", arg)
+			}
+			s.since = since
+		case strings.HasPrefix(arg, "deepen-not "):
+			s.not = append(s.not, strings.TrimPrefix(arg, "deepen-not "))
+		case strings.HasPrefix(arg, "deepen "):
+			depth, err := strconv.Atoi(strings.TrimPrefix(arg, "deepen "))
+			if err != nil || depth <= 0 {
+				return nil, fmt.Errorf("invalid deepen: %s", arg)
+			}
+			s.depth = depth
+		}
+	}
+	if s.depth > 0 && (s.since > 0 || len(s.not) > 0) {
+		return nil, errors.New("deepen and deepen-since (or deepen-not) cannot be used together")
+	}
+	return s, nil
+}
+
+// deepen 判断请求是否要求重新计算浅边界
+func (s *shallowRequest) deepen() bool {
+	return s.depth > 0 || s.since > 0 || len(s.not) > 0
+}
+
+// shallowUpdate 为按请求计算出的浅边界变化
+type shallowUpdate struct {
+	// shallow 与 unshallow 为需要告知客户端的浅边界变化
+	shallow   []plumbing.Hash
+	unshallow []plumbing.Hash
+	// boundary 为生成 pack 时不再遍历父提交的提交
+	boundary map[plumbing.Hash]bool
+}
+
+// computeShallow 按 deepen 参数计算新的浅边界; 仓库自身为浅仓库时其浅边界同样作为边界
+func computeShallow(st storage.Storer, wants []plumbing.Hash, s *shallowRequest) (*shallowUpdate, error) {
+	repoShallow := map[plumbing.Hash]bool{}
+	if hashes, err := st.Shallow(); err == nil {
+		for _, h := range hashes {
+			repoShallow[h] = true
+		}
+	}
+	client := map[plumbing.Hash]bool{}
+	for _, h := range s.clientShallows {
+		client[h] = true
+	}
+
+	update := &shallowUpdate{boundary: map[plumbing.Hash]bool{}}
+	for h := range repoShallow {
+		update.boundary[h] = true
+	}
+	if !s.deepen() {
+		for h := range client {
+			update.boundary[h] = true
+		}
+		return update, nil
+	}
+
+	var shallow, notShallow map[plumbing.Hash]bool
+	var err error
+	if s.depth > 0 {
+		starts := wants
+		depth := s.depth
+		if s.relative {
+			// deepen-relative 从客户端当前的浅边界起算
+			starts = s.clientShallows
+			depth = min(s.depth, infiniteDepth-1) + 1
+		}
+		shallow, notShallow, err = shallowByDepth(st, starts, depth, repoShallow)
+	} else {
+		shallow, notShallow, err = shallowByRevList(st, wants, s, repoShallow)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for h := range shallow {
+		update.boundary[h] = true
+		if !client[h] {
+			update.shallow = append(update.shallow, h)
+		}
+	}
+	for _, h := range s.clientShallows {
+		switch {
+		case notShallow[h]:
+			update.unshallow = append(update.unshallow, h)
+		case !shallow[h]:
+			update.boundary[h] = true
+		}
+	}
+	return update, nil
+}
+
+// shallowByDepth 从 starts 起按广度优先计算深度, 深度达到 depth 且有父提交的提交成为浅边界
+func shallowByDepth(st storage.Storer, starts []plumbing.Hash, depth int, repoShallow map[plumbing.Hash]bool) (shallow, notShallow map[plumbing.Hash]bool, err error) {
+	shallow = map[plumbing.Hash]bool{}
+	notShallow = map[plumbing.Hash]bool{}
+	visited := map[plumbing.Hash]bool{}
+
+	level := peelCommits(st, starts)
+	for d := 1; len(level) > 0; d++ {
+		var next []plumbing.Hash
+		for _, h := range level {
+			if visited[h] {
+				continue
+			}
+			visited[h] = true
+			commit, err := object.GetCommit(st, h)
+			if err != nil {
+				return nil, nil, err
+			}
+			if d >= depth || repoShallow[h] {
+				if len(commit.ParentHashes) > 0 {
+					shallow[h] = true
+				}
+				continue
+			}
+			notShallow[h] = true
+			next = append(next, commit.ParentHashes...)
+		}
+		level = next
+	}
+	return shallow, notShallow, nil
+}
+
+// shallowByRevList 按 deepen-since/deepen-not 选取提交, 与 rev-list --max-age 加排除引用一致;
+// 选中提交中有父提交未被选中的成为浅边界
+func shallowByRevList(st storage.Storer, wants []plumbing.Hash, s *shallowRequest, repoShallow map[plumbing.Hash]bool) (shallow, notShallow map[plumbing.Hash]bool, err error) {
+	var notTips []plumbing.Hash
+	for _, name := range s.not {
+		ref, err := resolveDeepenNot(st, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		notTips = append(notTips, ref)
+	}
+	excluded := map[plumbing.Hash]bool{}
+	stack := peelCommits(st, notTips)
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if excluded[h] {
+			continue
+		}
+		excluded[h] = true
+		if repoShallow[h] {
+			continue
+		}
+		commit, err := object.GetCommit(st, h)
+		if err != nil {
+			return nil, nil, err
+		}
+		stack = append(stack, commit.ParentHashes...)
+	}
+
+	selected := map[plumbing.Hash]*object.Commit{}
+	stack = peelCommits(st, wants)
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if selected[h] != nil || excluded[h] {
+			continue
+		}
+		commit, err := object.GetCommit(st, h)
+		if err != nil {
+			return nil, nil, err
+		}
+		if s.since > 0 && commit.Committer.When.Unix() < s.since {
+			continue
+		}
+		selected[h] = commit
+		if !repoShallow[h] {
+			stack = append(stack, commit.ParentHashes...)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, nil, errors.New("no commits selected for shallow requests")
+	}
+
+	shallow = map[plumbing.Hash]bool{}
+	notShallow = map[plumbing.Hash]bool{}
+	for h, commit := range selected {
+		boundary := false
+		for _, parent := range commit.ParentHashes {
+			if selected[parent] == nil || repoShallow[h] {
+				boundary = true
+				break
+			}
+		}
+		if boundary {
+			shallow[h] = true
+		} else {
+			notShallow[h] = true
+		}
+	}
+	return shallow, notShallow, nil
+}
+
+// resolveDeepenNot 按 git 的 dwim 规则解析 deepen-not 引用
+func resolveDeepenNot(st storage.Storer, name string) (plumbing.Hash, error) {
+	for _, candidate := range []string{name, "refs/" + name, "refs/tags/" + name, "refs/heads/" + name, "refs/remotes/" + name, "refs/remotes/" + name + "/HEAD"} {
+		ref, err := st.Reference(plumbing.ReferenceName(candidate))
+		if err == nil && ref.Type() == plumbing.HashReference {
+			return ref.Hash(), nil
+		}
+	}
+	return plumbing.ZeroHash, fmt.Errorf("git upload-pack: not our ref %s", name)
+}
+
+// peelCommits 将 hashes 中的 tag 剥离到提交, 忽略不存在或不指向提交的对象
+func peelCommits(st storage.Storer, hashes []plumbing.Hash) []plumbing.Hash {
+	commits := make([]plumbing.Hash, 0, len(hashes))
+	for _, h := range hashes {
+		for {
+			obj, err := st.EncodedObject(plumbing.AnyObject, h)
+			if err != nil {
+				break
+			}
+			if obj.Type() == plumbing.CommitObject {
+				commits = append(commits, h)
+				break
+			}
+			if obj.Type() != plumbing.TagObject {
+				break
+			}
+			tag, err := object.DecodeTag(st, obj)
+			if err != nil {
+				break
+			}
+			h = tag.Target
+		}
+	}
+	return commits
+}
@@ -0,0 +1,148 @@
+//go:build behavior
+// +build behavior
+
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"smart-git/config"
+	"smart-git/database"
+	"smart-git/database/bolt"
+	"smart-git/gitc"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// gitOutput 执行 git 命令并返回输出
+func gitOutput(t *testing.T, gitPath string, dir string, env []string, args ...string) string {
+	cmd := exec.Command(gitPath, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed: %s", args, output)
+	}
+	return string(output)
+}
+
+// countCommits 返回 dir 中全部引用可达的提交数
+func countCommits(t *testing.T, gitPath string, dir string) int {
+	return strings.Count(gitOutput(t, gitPath, dir, nil, "rev-list", "--all"), "\n")
+}
+
+// startMirrorServer 以 populate 填充 main 分支的上游仓库, 预先镜像到 smart-git 并启动服务, 返回服务地址与临时目录
+func startMirrorServer(t *testing.T, gitPath string, backend string, populate func(src string)) (string, string) {
+	tmpDir := t.TempDir()
+	cfg = config.DefaultConfig()
+	cfg.Server.BaseDir = filepath.Join(tmpDir, "repos")
+	cfg.Git.Backend = backend
+	if err := gitc.SetupBackend(cfg); err != nil {
+		t.Fatal(err)
+	}
+	database.DB = bolt.OpenDatabase(filepath.Join(tmpDir, "db"))
+	t.Cleanup(func() { database.DB.Close() })
+
+	src := filepath.Join(tmpDir, "src")
+	runGit(t, gitPath, tmpDir, "init", "-b", "main", src)
+	populate(src)
+
+	mirror := filepath.Join(cfg.Server.BaseDir, "owner", "repo")
+	runGit(t, gitPath, tmpDir, "clone", "--mirror", src, mirror)
+	head, err := gitc.LocalHeadHash(mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gitc.SaveSyncedRepoData("https://github.com/owner/repo", "owner", "repo", mirror, head, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	r := touka.Default()
+	r.GET("/:user/:repo/info/refs", handleInfoRefs(cfg.Server.BaseDir))
+	r.POST("/:user/:repo/git-upload-pack", serviceRPC(cfg.Server.BaseDir))
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server.URL + "/owner/repo", tmpDir
+}
+
+// startShallowServer 创建 5 个提交(2024-01-01 至 2024-01-05, 依次打 v0..v4 标签)的上游仓库并启动服务
+func startShallowServer(t *testing.T, gitPath string, backend string) (string, string) {
+	return startMirrorServer(t, gitPath, backend, func(src string) {
+		for i := 0; i < 5; i++ {
+			if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte(fmt.Sprintf("content %d\n", i)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			date := fmt.Sprintf("2024-01-0%dT00:00:00Z", i+1)
+			runGit(t, gitPath, src, "add", ".")
+			gitOutput(t, gitPath, src, []string{"GIT_AUTHOR_DATE=" + date, "GIT_COMMITTER_DATE=" + date},
+				"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", fmt.Sprintf("commit %d", i))
+			runGit(t, gitPath, src, "tag", fmt.Sprintf("v%d", i))
+		}
+	})
+}
+
+// TestGitBehaviorShallow 测试 --depth、--shallow-since、--shallow-exclude、--deepen 与 --unshallow
+func TestGitBehaviorShallow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping behavior test in short mode")
+	}
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found, skipping behavior test")
+	}
+
+	for _, backend := range []string{gitc.BackendGoGit, gitc.BackendSystem} {
+		for _, proto := range []string{"0", "2"} {
+			t.Run(backend+"/v"+proto, func(t *testing.T) {
+				url, tmpDir := startShallowServer(t, gitPath, backend)
+				protoArgs := []string{"-c", "protocol.version=" + proto}
+
+				// deepen: 只取回最近 1 个提交
+				depthPath := filepath.Join(tmpDir, "depth")
+				runGit(t, gitPath, tmpDir, append(protoArgs, "clone", "--depth=1", url, depthPath)...)
+				if n := countCommits(t, gitPath, depthPath); n != 1 {
+					t.Fatalf("--depth=1: expected 1 commit, got %d", n)
+				}
+
+				// deepen-relative: 从当前浅边界再加深 2 个提交
+				runGit(t, gitPath, depthPath, append(protoArgs, "fetch", "--deepen=2")...)
+				if n := countCommits(t, gitPath, depthPath); n != 3 {
+					t.Fatalf("--deepen=2: expected 3 commits, got %d", n)
+				}
+
+				runGit(t, gitPath, depthPath, append(protoArgs, "fetch", "--unshallow")...)
+				if n := countCommits(t, gitPath, depthPath); n != 5 {
+					t.Fatalf("--unshallow: expected 5 commits, got %d", n)
+				}
+				if _, err := os.Stat(filepath.Join(depthPath, ".git", "shallow")); !os.IsNotExist(err) {
+					t.Fatalf("--unshallow: shallow file should be removed, err: %v", err)
+				}
+				runGit(t, gitPath, depthPath, "fsck")
+
+				// deepen-since: 只取回 2024-01-04 及之后的提交
+				sincePath := filepath.Join(tmpDir, "since")
+				runGit(t, gitPath, tmpDir, append(protoArgs, "clone", "--shallow-since=2024-01-03T12:00:00Z", url, sincePath)...)
+				if n := countCommits(t, gitPath, sincePath); n != 2 {
+					t.Fatalf("--shallow-since: expected 2 commits, got %d", n)
+				}
+				runGit(t, gitPath, sincePath, "fsck")
+
+				// deepen-not: 排除 v1 及其祖先
+				excludePath := filepath.Join(tmpDir, "exclude")
+				runGit(t, gitPath, tmpDir, append(protoArgs, "clone", "--shallow-exclude=v1", url, excludePath)...)
+				if n := countCommits(t, gitPath, excludePath); n != 3 {
+					t.Fatalf("--shallow-exclude: expected 3 commits, got %d", n)
+				}
+				runGit(t, gitPath, excludePath, "fsck")
+			})
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+// TestParseShallowRequest 测试 shallow 与 deepen 参数解析
+func TestParseShallowRequest(t *testing.T) {
+	oid := "17b24e835317f14df978a91d3e8fa0c4cddfdddc"
+	s, err := parseShallowRequest(&uploadPackRequest{
+		Caps: []string{"deepen-relative"},
+		Args: []string{"shallow " + oid, "deepen 2"},
+	})
+	if err != nil || len(s.clientShallows) != 1 || s.depth != 2 || !s.relative || !s.deepen() {
+		t.Fatalf("unexpected deepen request: %+v, %v", s, err)
+	}
+
+	s, err = parseShallowRequest(&uploadPackRequest{Args: []string{"deepen-since 1704153600", "deepen-not v1", "deepen-not v2"}})
+	if err != nil || s.since != 1704153600 || len(s.not) != 2 || s.depth != 0 {
+		t.Fatalf("unexpected deepen-since/deepen-not request: %+v, %v", s, err)
+	}
+
+	s, err = parseShallowRequest(&uploadPackRequest{Args: []string{"shallow " + oid}})
+	if err != nil || s.deepen() {
+		t.Fatalf("shallow lines alone should not deepen: %+v, %v", s, err)
+	}
+
+	for _, args := range [][]string{
+		{"deepen 0"},
+		{"deepen abc"},
+		{"deepen-since -1"},
+		{"shallow xyz"},
+		{"deepen 1", "deepen-not v1"},
+	} {
+		if _, err := parseShallowRequest(&uploadPackRequest{Args: args}); err == nil {
+			t.Fatalf("expected error for %q", args)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"smart-git/gitc"
+	"strings"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// splitRepoSnapshot 拆分 "repo@snapshot" 形式的仓库参数, 没有快照时 snapshot 为空
+func splitRepoSnapshot(repo string) (string, string) {
+	name, snapshot, _ := strings.Cut(repo, "@")
+	return name, snapshot
+}
+
+// snapshotView 返回请求可见的引用视图, 快照不存在时返回 gitc.ErrSnapshotNotFound
+func snapshotView(repoPath string, snapshot string, mirror gitc.MirrorSpec) (gitc.RefView, error) {
+	view := gitc.RefView{HideRefs: mirror.HideRefs}
+	if snapshot == "" {
+		return view, nil
+	}
+	if !gitc.SnapshotExists(repoPath, snapshot) {
+		return view, gitc.ErrSnapshotNotFound
+	}
+	view.Namespace = gitc.SnapshotNamespace(snapshot)
+	return view, nil
+}
+
+// handleCreateSnapshot 以 name 参数(查询参数或表单)为名冻结镜像当前的引用
+func handleCreateSnapshot(baseRepoDir string) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		snapshot, err := gitc.CreateSnapshot(baseRepoDir, c.Param("owner"), c.Param("repo"), c.Request.FormValue("name"))
+		if err != nil {
+			renderSnapshotError(c, err)
+			return
+		}
+		resp := NewAPISnapshot(c.Param("owner"), c.Param("repo"), *snapshot)
+		RenderWANF(c, http.StatusCreated, &resp)
+	}
+}
+
+func handleListSnapshots(baseRepoDir string) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		snapshots, err := gitc.ListSnapshots(baseRepoDir, c.Param("owner"), c.Param("repo"))
+		if err != nil {
+			renderSnapshotError(c, err)
+			return
+		}
+		resp := make([]APISnapshot, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			resp = append(resp, NewAPISnapshot(c.Param("owner"), c.Param("repo"), snapshot))
+		}
+		RenderWANF(c, http.StatusOK, &APISnapshotList{Items: resp})
+	}
+}
+
+func handleDeleteSnapshot(baseRepoDir string) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		if err := gitc.DeleteSnapshot(baseRepoDir, c.Param("owner"), c.Param("repo"), c.Param("name")); err != nil {
+			renderSnapshotError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func renderSnapshotError(c *touka.Context, err error) {
+	switch {
+	case errors.Is(err, gitc.ErrInvalidSnapshotName):
+		RenderWANFError(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, gitc.ErrRepoNotMirrored), errors.Is(err, gitc.ErrSnapshotNotFound):
+		RenderWANFError(c, http.StatusNotFound, err.Error())
+	case errors.Is(err, gitc.ErrSnapshotExists):
+		RenderWANFError(c, http.StatusConflict, err.Error())
+	default:
+		logError("snapshot request failed: %v, repo: %s\n", err, filepath.Join(c.Param("owner"), c.Param("repo")))
+		RenderWANFError(c, http.StatusInternalServerError, err.Error())
+	}
+}
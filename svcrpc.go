@@ -1,19 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"smart-git/gitc"
 	"strings"
 
-	"github.com/go-git/go-billy/v6/osfs"
 	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/format/pktline"
 	"github.com/go-git/go-git/v6/plumbing/transport"
-	gitserver "github.com/go-git/go-git/v6/plumbing/transport"
 	"github.com/infinite-iroha/touka"
 )
 
+// packLimiter 限制并发 pack 生成占用的内存预算, 为 nil 时不限制
+var packLimiter *packGuard
+
 func serviceRPC(baseRepoDir string) touka.HandlerFunc {
 	return func(c *touka.Context) {
 		ctx := c.Request.Context()
@@ -21,14 +27,14 @@ func serviceRPC(baseRepoDir string) touka.HandlerFunc {
 		w := c.Writer
 		svc := transport.UploadPackService
 
-		repoName := c.Param("repo")
+		repoName, snapshot := splitRepoSnapshot(c.Param("repo"))
 		if repoName == "" {
 			renderStatusError(w, http.StatusBadRequest)
 			return
 		}
 		userName := c.Param("user")
 
-		endpoint := "/" + userName + "/" + repoName
+		repoPath := gitc.RepoPath(baseRepoDir, userName, repoName)
 
 		version := r.Header.Get("Git-Protocol")
 		contentType := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Type")))
@@ -40,24 +46,32 @@ func serviceRPC(baseRepoDir string) touka.HandlerFunc {
 			return
 		}
 
-		if err := ensureRepoReady(ctx, baseRepoDir, userName, repoName); err != nil {
-			if err == plumbing.ErrReferenceNotFound {
-				renderStatusError(w, http.StatusNotFound)
-				return
-			}
-
-			logError("ensure repo failed: %v, repo: %s\n", err, repoName)
-			renderStatusError(w, http.StatusInternalServerError)
+		mirror := gitc.MirrorFor(userName, repoName)
+		view, err := snapshotView(repoPath, snapshot, mirror)
+		if err != nil {
+			renderStatusError(w, http.StatusNotFound)
 			return
 		}
+		// 快照只由本地已有的对象提供, 不同步、不加深也不向上游获取对象
+		if snapshot == "" {
+			if err := ensureRepoReady(ctx, baseRepoDir, userName, repoName); err != nil {
+				if err == plumbing.ErrReferenceNotFound {
+					renderStatusError(w, http.StatusNotFound)
+					return
+				}
+				if errors.Is(err, gitc.ErrJobQueueFull) || errors.Is(err, gitc.ErrRepoLockTimeout) {
+					w.Header().Set("Retry-After", "5")
+					renderStatusError(w, http.StatusServiceUnavailable)
+					return
+				}
 
-		w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-result", svc.Name()))
-		w.Header().Set("Connection", "Keep-Alive")
-		w.Header().Set("Transfer-Encoding", "chunked")
-		w.Header().Set("X-Content-Type-Options", "nosniff")
+				logError("ensure repo failed: %v, repo: %s\n", err, repoName)
+				renderStatusError(w, http.StatusInternalServerError)
+				return
+			}
+		}
 
 		var reader io.ReadCloser
-		var err error
 		switch r.Header.Get("Content-Encoding") {
 		case "gzip":
 			reader, err = gzip.NewReader(r.Body)
@@ -71,46 +85,137 @@ func serviceRPC(baseRepoDir string) touka.HandlerFunc {
 			reader = r.Body
 		}
 
-		frw := &flushResponseWriter{ResponseWriter: w, log: nil, chunkSize: defaultChunkSize}
-
-		ep, err := transport.NewEndpoint(endpoint)
+		reader, req, err := readUploadPackRequest(reader, version)
 		if err != nil {
-			logError("Error creating endpoint: %v, repo: %s\n", err, repoName)
+			logError("Error reading request body: %v, repo: %s\n", err, repoName)
 			renderStatusError(w, http.StatusBadRequest)
 			return
 		}
 
-		bfs := osfs.New(baseRepoDir)
-		ld := gitserver.NewFilesystemLoader(bfs, true)
-		st, err := ld.Load(ep)
+		// bundle-uri 命令只返回 bundle 列表, 不经过 upload-pack
+		if req.Command == "bundle-uri" && snapshot == "" {
+			setUploadPackResultHeaders(w, svc)
+			if err := writeBundleURIList(w, r, userName, repoName); err != nil {
+				logError("Error writing bundle list: %v, repo: %s\n", err, repoName)
+			}
+			return
+		}
+
+		// 浅镜像的历史不足时按需加深, 未启用加深时以 ERR 包告知客户端
+		if mirror.Depth > 0 && snapshot == "" {
+			if err := ensureMirrorDepth(ctx, baseRepoDir, userName, repoName, req); err != nil {
+				if errors.Is(err, errShallowMirror) {
+					setUploadPackResultHeaders(w, svc)
+					_, _ = pktline.WriteError(w, err)
+					return
+				}
+				logError("deepen mirror failed: %v, repo: %s/%s\n", err, userName, repoName)
+				renderStatusError(w, http.StatusInternalServerError)
+				return
+			}
+		}
+		// 本地缺失的 want(未广告或尚未同步的提交)先尝试从上游按对象 ID 获取, 失败时由 upload-pack 报错
+		if snapshot == "" {
+			if err := gitc.FetchWants(ctx, baseRepoDir, userName, repoName, upstreamURL(userName, repoName), req.Wants); err != nil {
+				logWarning("fetch missing wants failed: %v, repo: %s/%s\n", err, userName, repoName)
+			}
+		}
+		// blobless 镜像先补齐本次响应需要的对象
+		if mirror.Blobless {
+			filter, _ := req.Arg("filter ")
+			if err := gitc.PrefetchMissing(ctx, baseRepoDir, userName, repoName, req.Wants, req.Haves, filter); err != nil {
+				logError("prefetch missing objects failed: %v, repo: %s/%s\n", err, userName, repoName)
+				renderStatusError(w, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// 读取镜像期间持有共享锁, 同步与维护等待其结束; 之前的加深与按需获取会获取独占锁
+		unlock, err := gitc.RLockRepo(ctx, userName, repoName)
 		if err != nil {
-			logError("Error loading filesystem: %v, repo: %s\n", err, repoName)
-			renderStatusError(w, http.StatusInternalServerError)
+			logWarning("waiting for repo lock failed: %v, repo: %s/%s\n", err, userName, repoName)
+			if errors.Is(err, gitc.ErrRepoLockTimeout) {
+				w.Header().Set("Retry-After", "10")
+			}
+			renderStatusError(w, http.StatusServiceUnavailable)
 			return
 		}
+		defer unlock()
+		// 等待锁期间镜像可能已被布局迁移移动
+		repoPath = gitc.RepoPath(baseRepoDir, userName, repoName)
 
-		switch svc {
-		case transport.UploadPackService:
-			err = transport.UploadPack(ctx, st, reader, frw,
-				&transport.UploadPackOptions{
-					GitProtocol:   version,
-					AdvertiseRefs: false,
-					StatelessRPC:  true,
-				})
-		case transport.ReceivePackService:
-			err = transport.ReceivePack(ctx, st, reader, frw,
-				&transport.ReceivePackOptions{
-					GitProtocol:   version,
-					AdvertiseRefs: false,
-					StatelessRPC:  true,
-				})
-		default:
-			renderStatusError(w, http.StatusBadRequest)
+		// 可由历史 pack 满足的完整克隆只生成增量 pack, 其余部分由客户端通过 packfile-uris 下载
+		var uriSection []byte
+		if snapshot == "" {
+			if body, section := historyPackFor(r, userName, repoName, req); body != nil {
+				reader = io.NopCloser(bytes.NewReader(body))
+				uriSection = section
+			}
+		}
+
+		// 带 packfile-uris 段的响应含有按请求推断的地址, 不能缓存给其他客户端
+		var fill *gitc.PackFill
+		if cache := gitc.CurrentPackCache(); cache != nil && uriSection == nil {
+			if key := packCacheKey(repoPath, req); key != "" {
+				var hit *os.File
+				hit, fill, err = cache.Acquire(ctx, userName+"/"+repoName, key)
+				if err != nil {
+					logWarning("pack cache unavailable: %v, repo: %s/%s\n", err, userName, repoName)
+				}
+				if hit != nil {
+					defer hit.Close() //nolint:errcheck
+					setUploadPackResultHeaders(w, svc)
+					frw := &flushResponseWriter{ResponseWriter: w, log: nil, chunkSize: packCacheChunkSize}
+					if _, err := frw.ReadFrom(hit); err != nil {
+						logError("Error serving cached pack: %v, repo: %s\n", err, repoName)
+					}
+					return
+				}
+				if fill != nil {
+					defer fill.Abort()
+				}
+			}
+		}
+
+		release, err := packLimiter.Acquire(ctx, repoPath, req)
+		if err != nil {
+			logWarning("waiting for pack generation budget failed: %v, repo: %s/%s\n", err, userName, repoName)
+			if errors.Is(err, errPackQueueTimeout) {
+				w.Header().Set("Retry-After", "10")
+			}
+			renderStatusError(w, http.StatusServiceUnavailable)
 			return
 		}
+		defer release()
+
+		setUploadPackResultHeaders(w, svc)
+
+		var out http.ResponseWriter = w
+		if fill != nil {
+			out = &packCacheResponseWriter{ResponseWriter: w, fill: fill}
+		}
+		if uriSection != nil {
+			out = &packfileURIResponseWriter{ResponseWriter: out, section: uriSection}
+		}
+		frw := &flushResponseWriter{ResponseWriter: out, log: nil, chunkSize: defaultChunkSize}
+
+		err = currentUploadPackBackend().UploadPack(ctx, repoPath, version, view, reader, frw)
 		if err != nil {
+			logError("Error processing upload-pack: %v, repo: %s\n", err, repoName)
 			renderStatusError(w, http.StatusInternalServerError)
 			return
 		}
+		if fill != nil {
+			if err := fill.Commit(); err != nil {
+				logWarning("pack cache commit failed: %v, repo: %s/%s\n", err, userName, repoName)
+			}
+		}
 	}
 }
+
+func setUploadPackResultHeaders(w http.ResponseWriter, svc transport.Service) {
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-result", svc.Name()))
+	w.Header().Set("Connection", "Keep-Alive")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	gconfig "github.com/go-git/go-git/v6/config"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/filemode"
+	"github.com/go-git/go-git/v6/plumbing/format/packfile"
+	"github.com/go-git/go-git/v6/plumbing/format/pktline"
+	"github.com/go-git/go-git/v6/plumbing/object"
+	"github.com/go-git/go-git/v6/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v6/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v6/storage"
+)
+
+// needsCustomUploadPack 判断请求是否需要 serveUploadPack 处理:
+// go-git 的 UploadPack 无法解析 filter, 也不能正确处理 shallow/deepen
+func needsCustomUploadPack(req *uploadPackRequest) bool {
+	for _, arg := range req.Args {
+		if strings.HasPrefix(arg, "filter ") || strings.HasPrefix(arg, "shallow ") || strings.HasPrefix(arg, "deepen") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveUploadPack 处理 v0/v1 stateless 请求: 先按 deepen 参数回复浅边界变化,
+// 再完成协商应答, 收到 done 后按浅边界与 filter 生成 pack
+func serveUploadPack(st storage.Storer, req *uploadPackRequest, w io.Writer) error {
+	filter := &packFilter{blobLimit: -1, treeDepth: -1}
+	if spec, ok := req.Arg("filter "); ok {
+		f, err := parsePackFilter(st, spec)
+		if err != nil {
+			_, werr := pktline.WriteError(w, err)
+			return werr
+		}
+		filter = f
+	}
+	shallowReq, err := parseShallowRequest(req)
+	if err != nil {
+		_, werr := pktline.WriteError(w, err)
+		return werr
+	}
+
+	wants := make([]plumbing.Hash, 0, len(req.Wants))
+	for _, want := range req.Wants {
+		h, ok := plumbing.FromHex(want)
+		if !ok {
+			return fmt.Errorf("invalid want: %s", want)
+		}
+		wants = append(wants, h)
+	}
+
+	update, err := computeShallow(st, wants, shallowReq)
+	if err != nil {
+		_, werr := pktline.WriteError(w, err)
+		return werr
+	}
+	if shallowReq.deepen() {
+		for _, h := range update.shallow {
+			if _, err := pktline.Writef(w, "shallow %s\n", h); err != nil {
+				return err
+			}
+		}
+		for _, h := range update.unshallow {
+			if _, err := pktline.Writef(w, "unshallow %s\n", h); err != nil {
+				return err
+			}
+		}
+		if err := pktline.WriteFlush(w); err != nil {
+			return err
+		}
+	}
+
+	var common []plumbing.Hash
+	for _, have := range req.Haves {
+		if h, ok := plumbing.FromHex(have); ok && st.HasEncodedObject(h) == nil {
+			common = append(common, h)
+		}
+	}
+
+	caps := map[string]bool{}
+	for _, c := range req.Caps {
+		caps[c] = true
+	}
+
+	// stateless-rpc 下未收到 done 时只回复协商结果, 客户端会带上更多 have 再次请求;
+	// 没有 have 的请求(如浅克隆的首轮)与 git upload-pack 一致不回复 NAK
+	if !req.Done {
+		if len(req.Haves) == 0 {
+			return nil
+		}
+		for _, h := range common {
+			switch {
+			case caps[capability.MultiACKDetailed.String()]:
+				_, err = pktline.Writef(w, "ACK %s common\n", h)
+			case caps[capability.MultiACK.String()]:
+				_, err = pktline.Writef(w, "ACK %s continue\n", h)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err := pktline.Writeln(w, "NAK")
+		return err
+	}
+	if len(common) > 0 {
+		_, err = pktline.Writef(w, "ACK %s\n", common[len(common)-1])
+	} else {
+		_, err = pktline.Writeln(w, "NAK")
+	}
+	if err != nil {
+		return err
+	}
+
+	// 客户端没有浅边界提交的父提交, 计算已有对象时在原浅边界处停止
+	clientStop := map[plumbing.Hash]bool{}
+	for _, h := range shallowReq.clientShallows {
+		clientStop[h] = true
+	}
+	for h := range update.boundary {
+		clientStop[h] = true
+	}
+	ignore, err := reachableObjects(st, common, clientStop)
+	if err != nil {
+		return err
+	}
+
+	// 取消浅边界的提交本身客户端已有, 需要从其父提交继续发送
+	starts := append([]plumbing.Hash(nil), wants...)
+	for _, h := range update.unshallow {
+		commit, err := object.GetCommit(st, h)
+		if err != nil {
+			return err
+		}
+		starts = append(starts, commit.ParentHashes...)
+	}
+	objs, err := filteredObjects(st, starts, ignore, update.boundary, filter)
+	if err != nil {
+		return err
+	}
+	if caps[capability.IncludeTag.String()] {
+		objs, err = includeTags(st, objs, ignore)
+		if err != nil {
+			return err
+		}
+	}
+
+	var writer io.Writer = w
+	useSideband := true
+	switch {
+	case caps[capability.Sideband64k.String()]:
+		writer = sideband.NewMuxer(sideband.Sideband64k, w)
+	case caps[capability.Sideband.String()]:
+		writer = sideband.NewMuxer(sideband.Sideband, w)
+	default:
+		useSideband = false
+	}
+
+	packWindow := gconfig.DefaultPackWindow
+	if cfg, err := st.Config(); err == nil && cfg != nil {
+		packWindow = cfg.Pack.Window
+	}
+	if _, err := packfile.NewEncoder(writer, st, false).Encode(objs, packWindow); err != nil {
+		return fmt.Errorf("encoding packfile: %w", err)
+	}
+	if useSideband {
+		return pktline.WriteFlush(w)
+	}
+	return nil
+}
+
+// reachableObjects 返回从 commits 可达的全部对象, 遍历在 stop 提交处停止
+func reachableObjects(st storage.Storer, commits []plumbing.Hash, stop map[plumbing.Hash]bool) (map[plumbing.Hash]bool, error) {
+	seen := map[plumbing.Hash]bool{}
+	var walkTree func(h plumbing.Hash) error
+	walkTree = func(h plumbing.Hash) error {
+		if seen[h] {
+			return nil
+		}
+		seen[h] = true
+		tree, err := object.GetTree(st, h)
+		if err != nil {
+			return err
+		}
+		for _, entry := range tree.Entries {
+			switch entry.Mode {
+			case filemode.Submodule:
+			case filemode.Dir:
+				if err := walkTree(entry.Hash); err != nil {
+					return err
+				}
+			default:
+				seen[entry.Hash] = true
+			}
+		}
+		return nil
+	}
+
+	stack := append([]plumbing.Hash(nil), commits...)
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		commit, err := object.GetCommit(st, h)
+		if err != nil {
+			return nil, err
+		}
+		if err := walkTree(commit.TreeHash); err != nil {
+			return nil, err
+		}
+		if !stop[h] {
+			stack = append(stack, commit.ParentHashes...)
+		}
+	}
+	return seen, nil
+}
+
+// includeTags 实现 include-tag: 追加指向已发送对象的附注 tag
+func includeTags(st storage.Storer, objs []plumbing.Hash, ignore map[plumbing.Hash]bool) ([]plumbing.Hash, error) {
+	sent := make(map[plumbing.Hash]bool, len(objs))
+	for _, h := range objs {
+		sent[h] = true
+	}
+	iter, err := st.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || !ref.Name().IsTag() {
+			return nil
+		}
+		// 沿 tag 链找到最终对象, 最终对象已发送时补上链上所有 tag
+		var chain []plumbing.Hash
+		h := ref.Hash()
+		for {
+			tag, err := object.GetTag(st, h)
+			if err != nil {
+				break
+			}
+			chain = append(chain, h)
+			h = tag.Target
+		}
+		if len(chain) == 0 || !sent[h] {
+			return nil
+		}
+		for _, t := range chain {
+			if !sent[t] && !ignore[t] {
+				sent[t] = true
+				objs = append(objs, t)
+			}
+		}
+		return nil
+	})
+	return objs, err
+}
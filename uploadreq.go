@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v6/plumbing/format/pktline"
+	"github.com/go-git/go-git/v6/plumbing/protocol"
+	"github.com/go-git/go-git/v6/plumbing/transport"
+)
+
+// uploadPackRequest 是对 upload-pack 请求体的轻量解析, 用于缓存键与服务策略判断;
+// 实际协议处理仍交给 uploadPackBackend
+type uploadPackRequest struct {
+	Version protocol.Version
+	// Command 为 protocol v2 的命令(如 fetch、ls-refs), v0/v1 时为空
+	Command string
+	Wants   []string
+	Haves   []string
+	Done    bool
+	// Caps 为 v0 首个 want 行携带的能力或 v2 的能力行
+	Caps []string
+	// Args 为 shallow/deepen/filter 以及 v2 的其他参数行
+	Args []string
+}
+
+// parseUploadPackRequest 解析 stateless-rpc 的 upload-pack 请求体
+func parseUploadPackRequest(body []byte, gitProtocol string) (*uploadPackRequest, error) {
+	req := &uploadPackRequest{Version: transport.ProtocolVersion(gitProtocol)}
+	r := bytes.NewReader(body)
+	inArgs := false
+	for r.Len() > 0 {
+		l, p, err := pktline.ReadLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if l < pktline.LenSize {
+			// v2 中 delim 之后为命令参数
+			if l == pktline.Delim {
+				inArgs = true
+			}
+			continue
+		}
+
+		line := strings.TrimSuffix(string(p), "\n")
+		switch {
+		case req.Version == protocol.V2 && !inArgs:
+			if cmd, ok := strings.CutPrefix(line, "command="); ok {
+				req.Command = cmd
+				continue
+			}
+			req.Caps = append(req.Caps, line)
+		case strings.HasPrefix(line, "want "):
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return nil, errors.New("malformed want line")
+			}
+			req.Wants = append(req.Wants, fields[1])
+			if len(req.Wants) == 1 && req.Version != protocol.V2 {
+				req.Caps = append(req.Caps, fields[2:]...)
+			}
+		case strings.HasPrefix(line, "have "):
+			req.Haves = append(req.Haves, strings.TrimPrefix(line, "have "))
+		case line == "done":
+			req.Done = true
+		default:
+			req.Args = append(req.Args, line)
+		}
+	}
+	return req, nil
+}
+
+// Arg 返回第一个以 prefix 开头的参数行去掉前缀后的值
+func (req *uploadPackRequest) Arg(prefix string) (string, bool) {
+	for _, arg := range req.Args {
+		if value, ok := strings.CutPrefix(arg, prefix); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// isFullClone 判断请求是否为不带 have 的完整 fetch, 其响应只取决于请求参数与引用状态
+func (req *uploadPackRequest) isFullClone() bool {
+	if len(req.Wants) == 0 || len(req.Haves) > 0 || !req.Done {
+		return false
+	}
+	return req.Version != protocol.V2 || req.Command == "fetch"
+}
+
+// producesPack 判断请求是否可能生成 pack: v0/v1 的 want 请求与 v2 的 fetch 命令, ls-refs 等只返回引用或能力
+func (req *uploadPackRequest) producesPack() bool {
+	if len(req.Wants) == 0 {
+		return false
+	}
+	return req.Version != protocol.V2 || req.Command == "fetch"
+}
+
+// cacheKey 生成与客户端 agent/session 无关的请求指纹
+func (req *uploadPackRequest) cacheKey() string {
+	caps := make([]string, 0, len(req.Caps))
+	for _, c := range req.Caps {
+		if strings.HasPrefix(c, "agent=") || strings.HasPrefix(c, "session-id=") {
+			continue
+		}
+		caps = append(caps, c)
+	}
+	wants := append([]string(nil), req.Wants...)
+	args := append([]string(nil), req.Args...)
+	sort.Strings(caps)
+	sort.Strings(wants)
+	sort.Strings(args)
+
+	h := sha256.New()
+	h.Write([]byte(req.Version.String() + "\n" + req.Command + "\n"))
+	for _, part := range [][]string{caps, wants, args} {
+		h.Write([]byte(strings.Join(part, "\n")))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// editV2Capabilities 解析 protocol v2 能力广告, 交给 edit 修改能力行后重新编码
+func editV2Capabilities(adv []byte, edit func(caps []string) []string) ([]byte, error) {
+	r := bytes.NewReader(adv)
+	var caps []string
+	for {
+		l, p, err := pktline.ReadLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if l == pktline.Flush {
+			break
+		}
+		if l < pktline.LenSize {
+			return nil, errors.New("unexpected special packet in v2 capability advertisement")
+		}
+		caps = append(caps, strings.TrimSuffix(string(p), "\n"))
+	}
+
+	var buf bytes.Buffer
+	for _, c := range edit(caps) {
+		if _, err := pktline.Writeln(&buf, c); err != nil {
+			return nil, err
+		}
+	}
+	if err := pktline.WriteFlush(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// addFetchFeature 在 v2 的 fetch 能力值中追加 feature
+func addFetchFeature(caps []string, feature string) []string {
+	for i, c := range caps {
+		switch {
+		case c == "fetch":
+			caps[i] = "fetch=" + feature
+		case strings.HasPrefix(c, "fetch="):
+			caps[i] = c + " " + feature
+		}
+	}
+	return caps
+}
+
+// dropPktLines 去掉内容以 prefix 开头的 pkt-line, 其余数据包(包括 flush 等特殊包)原样保留
+func dropPktLines(data []byte, prefix string) ([]byte, error) {
+	r := bytes.NewReader(data)
+	out := make([]byte, 0, len(data))
+	for r.Len() > 0 {
+		start := len(data) - r.Len()
+		_, p, err := pktline.ReadLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(string(p), prefix) {
+			continue
+		}
+		out = append(out, data[start:len(data)-r.Len()]...)
+	}
+	return out, nil
+}
+
+// encodeV2Fetch 将解析后的 v2 fetch 请求重新编码, 追加 haves 并去掉 dropArgs 前缀的参数
+func (req *uploadPackRequest) encodeV2Fetch(haves []string, dropArgs ...string) ([]byte, error) {
+	var lines []string
+	lines = append(lines, "command="+req.Command)
+	lines = append(lines, req.Caps...)
+
+	var args []string
+	for _, arg := range req.Args {
+		drop := false
+		for _, prefix := range dropArgs {
+			if strings.HasPrefix(arg, prefix) {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			args = append(args, arg)
+		}
+	}
+	for _, want := range req.Wants {
+		args = append(args, "want "+want)
+	}
+	for _, have := range haves {
+		args = append(args, "have "+have)
+	}
+	if req.Done {
+		args = append(args, "done")
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if _, err := pktline.Writeln(&buf, line); err != nil {
+			return nil, err
+		}
+	}
+	if err := pktline.WriteDelim(&buf); err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		if _, err := pktline.Writeln(&buf, arg); err != nil {
+			return nil, err
+		}
+	}
+	if err := pktline.WriteFlush(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-git/go-git/v6/plumbing/format/pktline"
+)
+
+// buildPktLines 按顺序编码 pkt-line, "0000"/"0001" 分别表示 flush/delim
+func buildPktLines(t *testing.T, lines ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, line := range lines {
+		switch line {
+		case "0000":
+			pktline.WriteFlush(&buf)
+		case "0001":
+			pktline.WriteDelim(&buf)
+		default:
+			if _, err := pktline.Writeln(&buf, line); err != nil {
+				t.Fatalf("failed to write pkt-line: %v", err)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+const (
+	testOID1 = "1111111111111111111111111111111111111111"
+	testOID2 = "2222222222222222222222222222222222222222"
+)
+
+// TestParseUploadPackRequestV0 测试 v0 请求解析与缓存键忽略 agent
+func TestParseUploadPackRequestV0(t *testing.T) {
+	body := buildPktLines(t,
+		"want "+testOID1+" multi_ack_detailed side-band-64k ofs-delta agent=git/2.39.5",
+		"want "+testOID2,
+		"deepen 1",
+		"0000",
+		"done",
+	)
+	req, err := parseUploadPackRequest(body, "")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if len(req.Wants) != 2 || !req.Done || len(req.Haves) != 0 {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+	if depth, ok := req.Arg("deepen "); !ok || depth != "1" {
+		t.Fatalf("expected deepen arg, got %q", depth)
+	}
+	if !req.isFullClone() {
+		t.Fatal("expected full clone")
+	}
+
+	other := buildPktLines(t,
+		"want "+testOID2+" multi_ack_detailed side-band-64k ofs-delta agent=git/2.45.0",
+		"want "+testOID1,
+		"deepen 1",
+		"0000",
+		"done",
+	)
+	otherReq, err := parseUploadPackRequest(other, "")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	// want 顺序与 agent 不同不影响指纹
+	if req.cacheKey() != otherReq.cacheKey() {
+		t.Fatal("expected equal cache keys regardless of agent and want order")
+	}
+
+	withHave := buildPktLines(t, "want "+testOID1+" ofs-delta", "0000", "have "+testOID2, "done")
+	haveReq, err := parseUploadPackRequest(withHave, "")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if haveReq.isFullClone() {
+		t.Fatal("request with haves should not be treated as full clone")
+	}
+}
+
+// TestParseUploadPackRequestV2 测试 v2 fetch 与 ls-refs 请求解析
+func TestParseUploadPackRequestV2(t *testing.T) {
+	body := buildPktLines(t,
+		"command=fetch",
+		"agent=git/2.39.5",
+		"object-format=sha1",
+		"0001",
+		"thin-pack",
+		"ofs-delta",
+		"want "+testOID1,
+		"filter blob:none",
+		"done",
+		"0000",
+	)
+	req, err := parseUploadPackRequest(body, "version=2")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if req.Command != "fetch" || len(req.Wants) != 1 || !req.isFullClone() {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+	if filter, ok := req.Arg("filter "); !ok || filter != "blob:none" {
+		t.Fatalf("expected filter arg, got %q", filter)
+	}
+
+	lsRefs := buildPktLines(t, "command=ls-refs", "agent=git/2.39.5", "0001", "peel", "symrefs", "0000")
+	lsReq, err := parseUploadPackRequest(lsRefs, "version=2")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if lsReq.isFullClone() {
+		t.Fatal("ls-refs should not be treated as full clone")
+	}
+}
+
+// TestEditV2Capabilities 测试改写 v2 能力广告
+func TestEditV2Capabilities(t *testing.T) {
+	adv := buildPktLines(t, "version 2", "ls-refs=unborn", "fetch=shallow wait-for-done", "0000")
+	got, err := editV2Capabilities(adv, func(caps []string) []string {
+		return append(addFetchFeature(caps, "packfile-uris"), "bundle-uri")
+	})
+	if err != nil {
+		t.Fatalf("edit failed: %v", err)
+	}
+	want := buildPktLines(t, "version 2", "ls-refs=unborn", "fetch=shallow wait-for-done packfile-uris", "bundle-uri", "0000")
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected advertisement:\n%q\nwant:\n%q", got, want)
+	}
+
+	if _, err := editV2Capabilities([]byte("000eversion 2\n"), func(caps []string) []string { return caps }); err == nil {
+		t.Fatal("expected error for advertisement without flush")
+	}
+}
+
+// TestEncodeV2Fetch 测试追加 have 并去掉指定参数后重新编码 fetch 请求
+func TestEncodeV2Fetch(t *testing.T) {
+	body := buildPktLines(t,
+		"command=fetch",
+		"agent=git/2.39.5",
+		"0001",
+		"thin-pack",
+		"ofs-delta",
+		"packfile-uris https",
+		"want "+testOID1,
+		"done",
+		"0000",
+	)
+	req, err := parseUploadPackRequest(body, "version=2")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	got, err := req.encodeV2Fetch([]string{testOID2}, "thin-pack", "packfile-uris ")
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	want := buildPktLines(t,
+		"command=fetch",
+		"agent=git/2.39.5",
+		"0001",
+		"ofs-delta",
+		"want "+testOID1,
+		"have "+testOID2,
+		"done",
+		"0000",
+	)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected request:\n%q\nwant:\n%q", got, want)
+	}
+}
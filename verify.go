@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"smart-git/gitc"
+	"strconv"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// handleVerifyRepo 校验镜像的 pack、松散对象与引用, full=true 时还检查对象连通性;
+// 发现损坏时返回 409 及损坏详情, 镜像已被隔离并在后台重新克隆
+func handleVerifyRepo(baseRepoDir string) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		full, _ := strconv.ParseBool(c.Request.FormValue("full"))
+		report, err := gitc.VerifyMirror(c.Request.Context(), baseRepoDir, c.Param("owner"), c.Param("repo"), full)
+		if report != nil {
+			code := http.StatusOK
+			if len(report.Problems) > 0 {
+				code = http.StatusConflict
+			}
+			if err != nil {
+				logError("quarantine corrupt mirror failed: %v, repo: %s\n", err, filepath.Join(c.Param("owner"), c.Param("repo")))
+			}
+			resp := NewAPIVerifyReport(c.Param("owner"), c.Param("repo"), *report)
+			RenderWANF(c, code, &resp)
+			return
+		}
+		switch {
+		case errors.Is(err, gitc.ErrRepoNotMirrored):
+			RenderWANFError(c, http.StatusNotFound, err.Error())
+		case errors.Is(err, gitc.ErrRepoLockTimeout):
+			c.SetHeader("Retry-After", "10")
+			RenderWANFError(c, http.StatusServiceUnavailable, err.Error())
+		default:
+			logError("verify request failed: %v, repo: %s\n", err, filepath.Join(c.Param("owner"), c.Param("repo")))
+			RenderWANFError(c, http.StatusInternalServerError, err.Error())
+		}
+	}
+}